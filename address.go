@@ -0,0 +1,141 @@
+// address.go
+package main
+
+import (
+	"mime"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-message/charset"
+	"golang.org/x/net/idna"
+)
+
+// addressParser understands RFC 6532 UTF-8 addresses and RFC 2047 encoded
+// display names in any charset
+var addressParser = mail.AddressParser{
+	WordDecoder: &mime.WordDecoder{CharsetReader: charset.Reader},
+}
+
+// angleAddrPattern finds addresses in headers net/mail can't parse
+var angleAddrPattern = regexp.MustCompile(`<([^<>\s]+@[^<>\s]+)>|([^\s<>,;"]+@[^\s<>,;"]+)`)
+
+// graphAddress converts the domain of an internationalized address to its
+// ASCII (punycode) form, which Graph and Exchange require. The local part
+// is kept as it is, UTF-8 local parts are valid under RFC 6531.
+func graphAddress(addr string) string {
+	i := strings.LastIndex(addr, "@")
+	if i < 0 {
+		return addr
+	}
+	return addr[:i+1] + asciiDomain(addr[i+1:])
+}
+
+// asciiDomain returns the ASCII (punycode) form of a domain, or the domain
+// itself when it can't be converted
+func asciiDomain(domain string) string {
+	if ascii, err := idna.Lookup.ToASCII(domain); err == nil {
+		return ascii
+	}
+	return domain
+}
+
+// isASCII reports whether s has only 7-bit characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// sameAddress compares addresses case-insensitively, with the domain in
+// either its Unicode or ASCII form
+func sameAddress(a, b string) bool {
+	return strings.EqualFold(graphAddress(a), graphAddress(b))
+}
+
+// parseAddressList reads the addresses of a To, Cc, Bcc or From header.
+// Raw 8-bit Latin-1 is tolerated, and lists net/mail rejects still yield
+// their bare addresses.
+func parseAddressList(value string) []*mail.Address {
+	value = textContent(value)
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	if list, err := addressParser.ParseList(value); err == nil {
+		return list
+	}
+
+	// Parse the entries one by one so a single broken entry doesn't cost
+	// the others their display names
+	var list []*mail.Address
+	for _, entry := range strings.Split(value, ",") {
+		if addr, err := addressParser.Parse(entry); err == nil {
+			list = append(list, addr)
+			continue
+		}
+		for _, m := range angleAddrPattern.FindAllStringSubmatch(entry, -1) {
+			addr := m[1]
+			if addr == "" {
+				addr = m[2]
+			}
+			list = append(list, &mail.Address{Address: addr})
+		}
+	}
+	return list
+}
+
+// displayNames maps the addresses in the To and Cc headers to their display
+// names, keyed by the lower-cased Graph form of the address
+func displayNames(headers map[string]string) map[string]string {
+	names := make(map[string]string)
+	for _, field := range []string{"To", "Cc"} {
+		for _, addr := range parseAddressList(headerValue(headers, field)) {
+			if addr.Name != "" {
+				names[strings.ToLower(graphAddress(addr.Address))] = addr.Name
+			}
+		}
+	}
+	return names
+}
+
+// headerAddresses returns the addresses of an address header with their
+// display names, keyed like displayNames
+func headerAddresses(headers map[string]string, field string) ([]string, map[string]string) {
+	var addrs []string
+	names := make(map[string]string)
+	for _, addr := range parseAddressList(headerValue(headers, field)) {
+		addrs = append(addrs, addr.Address)
+		if addr.Name != "" {
+			names[strings.ToLower(graphAddress(addr.Address))] = addr.Name
+		}
+	}
+	return addrs, names
+}
+
+// splitRecipients sorts envelope recipients by the header that names them:
+// To, else Cc, else Bcc. Bcc thus also gets recipients the headers leave
+// out, e.g. of a mailing list expansion.
+func splitRecipients(headers map[string]string, rcpts []string) (to, cc, bcc []string) {
+	listed := func(field, rcpt string) bool {
+		for _, addr := range parseAddressList(headerValue(headers, field)) {
+			if sameAddress(addr.Address, rcpt) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, rcpt := range rcpts {
+		switch {
+		case listed("To", rcpt):
+			to = append(to, rcpt)
+		case listed("Cc", rcpt):
+			cc = append(cc, rcpt)
+		default:
+			bcc = append(bcc, rcpt)
+		}
+	}
+	return to, cc, bcc
+}
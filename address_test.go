@@ -0,0 +1,115 @@
+// address_test.go
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGraphAddress(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"user@example.com", "user@example.com"},
+		{"jörg@bücher.example", "jörg@xn--bcher-kva.example"},
+		{"info@münchen.de", "info@xn--mnchen-3ya.de"},
+		{"user@xn--bcher-kva.example", "user@xn--bcher-kva.example"},
+		{"no-domain", "no-domain"},
+	}
+	for _, tt := range tests {
+		if got := graphAddress(tt.in); got != tt.want {
+			t.Errorf("graphAddress(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSameAddress(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"User@Example.com", "user@example.com", true},
+		{"jörg@bücher.example", "jörg@xn--bcher-kva.example", true},
+		{"jörg@BÜCHER.example", "jörg@bücher.example", true},
+		{"jörg@bücher.example", "joerg@bücher.example", false},
+	}
+	for _, tt := range tests {
+		if got := sameAddress(tt.a, tt.b); got != tt.want {
+			t.Errorf("sameAddress(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestParseAddressList(t *testing.T) {
+	type addr struct{ Name, Address string }
+	tests := []struct {
+		name  string
+		value string
+		want  []addr
+	}{
+		{"empty", " ", nil},
+		{
+			"mixed ascii and utf-8",
+			`Jane Doe <jane@example.com>, "Jörg Müller" <jörg@bücher.example>, plain@example.org`,
+			[]addr{{"Jane Doe", "jane@example.com"}, {"Jörg Müller", "jörg@bücher.example"}, {"", "plain@example.org"}},
+		},
+		{
+			"encoded display names",
+			"=?ISO-8859-1?Q?J=F6rg?= <joerg@example.com>, =?UTF-8?B?5bGx55Sw?= <yamada@例え.jp>",
+			[]addr{{"Jörg", "joerg@example.com"}, {"山田", "yamada@例え.jp"}},
+		},
+		{
+			"raw latin-1 display name",
+			"J\xf6rg <joerg@example.com>",
+			[]addr{{"Jörg", "joerg@example.com"}},
+		},
+		{
+			"broken entry keeps the others",
+			`Jane <jane@example.com>, broken <<x@example.com>, "Jörg" <jörg@bücher.example>`,
+			[]addr{{"Jane", "jane@example.com"}, {"", "x@example.com"}, {"Jörg", "jörg@bücher.example"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []addr
+			for _, a := range parseAddressList(tt.value) {
+				got = append(got, addr{a.Name, a.Address})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseAddressList(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDisplayNames(t *testing.T) {
+	headers := map[string]string{
+		"To": `"Jörg Müller" <jörg@bücher.example>, jane@example.com`,
+		"cc": `Ops <OPS@Example.com>`,
+	}
+	want := map[string]string{
+		"jörg@xn--bcher-kva.example": "Jörg Müller",
+		"ops@example.com":            "Ops",
+	}
+	if got := displayNames(headers); !reflect.DeepEqual(got, want) {
+		t.Errorf("displayNames = %q, want %q", got, want)
+	}
+}
+
+func TestSplitRecipients(t *testing.T) {
+	headers := map[string]string{
+		"To": `"Jörg" <jörg@bücher.example>, jane@example.com`,
+		"Cc": `ops@xn--mnchen-3ya.de`,
+	}
+	rcpts := []string{"jörg@xn--bcher-kva.example", "JANE@example.com", "ops@münchen.de", "hidden@example.com"}
+	to, cc, bcc := splitRecipients(headers, rcpts)
+	if want := []string{"jörg@xn--bcher-kva.example", "JANE@example.com"}; !reflect.DeepEqual(to, want) {
+		t.Errorf("to = %q, want %q", to, want)
+	}
+	if want := []string{"ops@münchen.de"}; !reflect.DeepEqual(cc, want) {
+		t.Errorf("cc = %q, want %q", cc, want)
+	}
+	if want := []string{"hidden@example.com"}; !reflect.DeepEqual(bcc, want) {
+		t.Errorf("bcc = %q, want %q", bcc, want)
+	}
+}
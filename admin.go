@@ -0,0 +1,191 @@
+// admin.go
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// sessionInfo describes an open SMTP connection for GET /sessions
+type sessionInfo struct {
+	Client        string    `json:"client"`
+	Listener      string    `json:"listener,omitempty"`
+	Connected     time.Time `json:"connected"`
+	TLS           bool      `json:"tls"`
+	Authenticated bool      `json:"authenticated"`
+	// State is greeting, command, transaction (after MAIL) or data
+	State string `json:"state"`
+}
+
+// info returns what the connection is doing
+func (c *sessionConn) info(ip string) sessionInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	si := sessionInfo{Client: ip, Listener: c.listener, Connected: c.started.UTC(), TLS: c.tlsOn, Authenticated: c.authed, State: "greeting"}
+	switch {
+	case c.state == inputData || c.state == inputChunk:
+		si.State = "data"
+	case c.inTx:
+		si.State = "transaction"
+	case c.helloed:
+		si.State = "command"
+	}
+	return si
+}
+
+// list returns the open connections, oldest first
+func (t *sessionTracker) list() []sessionInfo {
+	t.mu.Lock()
+	conns := make(map[*sessionConn]string, len(t.conns))
+	for c, ip := range t.conns {
+		conns[c] = ip
+	}
+	t.mu.Unlock()
+
+	sessions := make([]sessionInfo, 0, len(conns))
+	for c, ip := range conns {
+		sessions = append(sessions, c.info(ip))
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Connected.Before(sessions[j].Connected) })
+	return sessions
+}
+
+// limitUsage is a limit and how much of it is used in the current window
+type limitUsage struct {
+	Limit int   `json:"limit"`
+	Used  int64 `json:"used"`
+}
+
+// senderLimits is the rate limit and quota state of a sender, for
+// GET /limits/{sender}
+type senderLimits struct {
+	Sender        string      `json:"sender"`
+	PerMinute     *limitUsage `json:"per_minute,omitempty"`
+	HourlyQuota   *limitUsage `json:"hourly_quota,omitempty"`
+	DailyQuota    *limitUsage `json:"daily_quota,omitempty"`
+	StoreError    string      `json:"store_error,omitempty"`
+	ThrottledFor  string      `json:"throttled_for,omitempty"`     // Graph throttling pause of the sender's tenant
+	GraphDisabled bool        `json:"graph_unavailable,omitempty"` // circuit breaker of the tenant is open
+}
+
+// tenantLimits is the Graph state of a tenant, for GET /limits
+type tenantLimits struct {
+	Tenant           string `json:"tenant"`
+	ThrottledFor     string `json:"throttled_for,omitempty"`
+	GraphUnavailable bool   `json:"graph_unavailable"`
+}
+
+// handleSessions lists the open SMTP connections
+func (bkd *Backend) handleSessions(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, bkd.sessions.list())
+}
+
+// handleLimits reports the throttling pause and circuit breaker of each
+// tenant
+func (bkd *Backend) handleLimits(w http.ResponseWriter, r *http.Request) {
+	tenants := make([]tenantLimits, 0, len(bkd.tenants))
+	for _, t := range bkd.tenants {
+		tl := tenantLimits{Tenant: t.name, GraphUnavailable: t.breaker.unavailable()}
+		if d := t.throttle.remaining(); d > 0 {
+			tl.ThrottledFor = d.Round(time.Second).String()
+		}
+		tenants = append(tenants, tl)
+	}
+	writeJSON(w, tenants)
+}
+
+// handleSenderLimits reports how much of its rate limit and quotas a
+// sender, or authenticated user, used in the current minute, hour and day
+func (bkd *Backend) handleSenderLimits(w http.ResponseWriter, r *http.Request) {
+	sender := r.PathValue("sender")
+	config := bkd.policy().config
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	result := senderLimits{Sender: sender}
+	now := time.Now()
+	usage := func(limit int, key string) *limitUsage {
+		if limit <= 0 {
+			return nil
+		}
+		used, err := bkd.store.Get(ctx, key)
+		if err != nil {
+			result.StoreError = err.Error()
+		}
+		return &limitUsage{Limit: limit, Used: used}
+	}
+	result.PerMinute = usage(config.rateLimit(config.domain(sender)), rateKey(sender, now))
+	periods := config.quota(sender).periods(sender, now)
+	result.HourlyQuota = usage(periods[0].limit, periods[0].key)
+	result.DailyQuota = usage(periods[1].limit, periods[1].key)
+
+	t := bkd.tenant(sender)
+	if d := t.throttle.remaining(); d > 0 {
+		result.ThrottledFor = d.Round(time.Second).String()
+	}
+	result.GraphDisabled = t.breaker.unavailable()
+	writeJSON(w, result)
+}
+
+func (bkd *Backend) handleQueueList(w http.ResponseWriter, r *http.Request) {
+	entries, err := bkd.retry.list()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, entries)
+}
+
+// handleQueueShow returns the queued message as received
+func (bkd *Backend) handleQueueShow(w http.ResponseWriter, r *http.Request) {
+	_, data, err := bkd.retry.get(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Write(data)
+}
+
+// handleQueueRetry makes the next attempt for a queued message now
+func (bkd *Backend) handleQueueRetry(w http.ResponseWriter, r *http.Request) {
+	entry, err := bkd.retry.entry(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err := bkd.sendRetry(entry); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, entry)
+}
+
+// handleQueueFlush starts an attempt for every queued message, due or
+// not, and answers with their number
+func (bkd *Backend) handleQueueFlush(w http.ResponseWriter, r *http.Request) {
+	entries, err := bkd.retry.list()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	bkd.logger.Info("queue flush started", "status", "flush", "messages", len(entries))
+	go func() {
+		for _, entry := range entries {
+			bkd.sendRetry(entry)
+		}
+	}()
+	writeJSON(w, map[string]int{"messages": len(entries)})
+}
+
+func (bkd *Backend) handleQueueDelete(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := bkd.retry.remove(id); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	bkd.logger.Info("queued message deleted", "retry", id, "status", "deleted")
+	w.WriteHeader(http.StatusNoContent)
+}
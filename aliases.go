@@ -0,0 +1,118 @@
+// aliases.go
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// alias returns the members of an alias in recipients.aliases, matched
+// case-insensitively
+func (c Config) alias(addr string) ([]string, bool) {
+	for name, members := range c.Recipients.Aliases {
+		if strings.EqualFold(name, addr) {
+			return members, true
+		}
+	}
+	return nil, false
+}
+
+// expandAlias returns the mailboxes an alias stands for, following
+// aliases that are members of it, each mailbox once. It returns nil when
+// addr is no alias. A loop, which loadConfig refuses, ends the expansion.
+func (c Config) expandAlias(addr string) []string {
+	if _, ok := c.alias(addr); !ok {
+		return nil
+	}
+	var mailboxes []string
+	seen := make(map[string]bool)
+	var expand func(addr string)
+	expand = func(addr string) {
+		key := strings.ToLower(addr)
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		members, ok := c.alias(addr)
+		if !ok {
+			mailboxes = append(mailboxes, addr)
+			return
+		}
+		for _, member := range members {
+			expand(member)
+		}
+	}
+	expand(addr)
+	return mailboxes
+}
+
+// checkAliases refuses empty aliases and aliases that contain themselves,
+// naming the loop
+func checkAliases(aliases map[string][]string) error {
+	for name, members := range aliases {
+		if len(members) == 0 {
+			return fmt.Errorf("recipients.aliases: %s has no members", name)
+		}
+	}
+	c := Config{}
+	c.Recipients.Aliases = aliases
+	var path []string
+	var visit func(addr string) error
+	visit = func(addr string) error {
+		for i, p := range path {
+			if strings.EqualFold(p, addr) {
+				return fmt.Errorf("recipients.aliases: %s loops", strings.Join(append(path[i:], addr), " -> "))
+			}
+		}
+		members, ok := c.alias(addr)
+		if !ok {
+			return nil
+		}
+		path = append(path, addr)
+		defer func() { path = path[:len(path)-1] }()
+		for _, member := range members {
+			if err := visit(member); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for name := range aliases {
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rcptAlias accepts an alias at RCPT TO by adding its members as
+// recipients. Members the recipient policy refuses are left out; the alias
+// is refused when all of them are.
+func (s *Session) rcptAlias(alias string, members []string) ([]string, error) {
+	var accepted []string
+	var lastErr error
+	for _, member := range members {
+		if err := s.backend.checkRecipient(member); err != nil {
+			s.log().Warn("alias member rejected", "client", s.clientIP, "from", s.from, "to", alias, "member", member, "errormsg", err)
+			lastErr = err
+			continue
+		}
+		accepted = append(accepted, member)
+	}
+	if len(accepted) == 0 {
+		return nil, lastErr
+	}
+	s.log().Info("alias expanded", "client", s.clientIP, "from", s.from, "to", alias, "status", "alias", "members", strings.Join(accepted, ","))
+	return accepted, nil
+}
+
+// mimeRecipients makes sure a MIME message reaches the envelope
+// recipients, which Graph takes from its headers. With recipients
+// rewritten or aliases expanded the headers are rewritten to the
+// recipients, so Graph doesn't send to the addresses the client gave.
+func (s *Session) mimeRecipients(data []byte, headers map[string]string) []byte {
+	if len(s.givenAs) > 0 {
+		return batchMessage(data, headers, s.envelopeRecipients())
+	}
+	return withEnvelopeRecipients(data, headers, s.envelopeRecipients())
+}
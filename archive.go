@@ -0,0 +1,129 @@
+// archive.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// archiveDayLayout names the directory of a day's messages below
+// archive.directory
+const archiveDayLayout = "2006/01/02"
+
+var archivedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "gographsmtp_archived_messages_total",
+	Help: "Sent messages copied to the local archive, per result (ok, failed).",
+}, []string{"result"})
+
+// archiveRecord is written next to an archived message as <id>.json
+type archiveRecord struct {
+	QueueID    string    `json:"queue_id"`
+	Received   time.Time `json:"received"`
+	Sent       time.Time `json:"sent"`
+	Client     string    `json:"client"`
+	From       string    `json:"from"`
+	Recipients []string  `json:"recipients"`
+	Subject    string    `json:"subject"`
+	// MessageID is the Internet Message-ID Graph reported, if any
+	MessageID string `json:"message_id,omitempty"`
+	// Host is the Graph endpoint, the smarthost or direct_mx
+	Host     string `json:"host"`
+	Attempts int    `json:"attempts"`
+}
+
+// archive copies a sent message to archive.directory, as received in
+// <yyyy>/<mm>/<dd>/<queue id>.eml with the delivery in <queue id>.json.
+// The message was sent, so a failed copy is only logged.
+func (bkd *Backend) archive(entry spoolEntry, data []byte, messageID, host string) {
+	dir := bkd.policy().config.Archive.Directory
+	if dir == "" {
+		return
+	}
+	now := time.Now().UTC()
+	record := archiveRecord{
+		QueueID:    entry.ID,
+		Received:   entry.Received,
+		Sent:       now,
+		Client:     entry.Client,
+		From:       entry.From,
+		Recipients: entry.To,
+		Subject:    entry.Subject,
+		MessageID:  messageID,
+		Host:       host,
+		Attempts:   entry.Attempts + 1,
+	}
+	// Messages sent right away were received just now
+	if record.Received.IsZero() {
+		record.Received = now
+	}
+	base, err := writeArchive(filepath.Join(dir, now.Format(archiveDayLayout)), record, data)
+	if err != nil {
+		archivedMessages.WithLabelValues("failed").Inc()
+		bkd.logger.Error("archiving failed", "queueid", entry.ID, "from", entry.From, "errormsg", err)
+		return
+	}
+	archivedMessages.WithLabelValues("ok").Inc()
+	bkd.history.add(entry.ID, historyEvent{Event: "archived", Detail: base + ".eml"})
+}
+
+func writeArchive(dir string, record archiveRecord, data []byte) (string, error) {
+	meta, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to archive message: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to archive message: %v", err)
+	}
+	base := filepath.Join(dir, record.QueueID)
+	if err := os.WriteFile(base+".eml", data, 0600); err != nil {
+		return "", fmt.Errorf("failed to archive message: %v", err)
+	}
+	if err := os.WriteFile(base+".json", meta, 0600); err != nil {
+		return "", fmt.Errorf("failed to archive message: %v", err)
+	}
+	return base, nil
+}
+
+// pruneArchive removes the archive's day directories older than
+// archive.retention, and the month and year directories it empties
+func (bkd *Backend) pruneArchive(ctx context.Context) error {
+	config := bkd.policy().config
+	if config.Archive.Directory == "" || config.Archive.Retention <= 0 {
+		return nil
+	}
+	cutoff := time.Now().UTC().Add(-config.Archive.Retention)
+	days, err := filepath.Glob(filepath.Join(config.Archive.Directory, "[0-9][0-9][0-9][0-9]", "[0-9][0-9]", "[0-9][0-9]"))
+	if err != nil {
+		return err
+	}
+	removed := 0
+	for _, day := range days {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rel, _ := filepath.Rel(config.Archive.Directory, day)
+		date, err := time.Parse(archiveDayLayout, filepath.ToSlash(rel))
+		// A day is kept until all of it is past the retention
+		if err != nil || !date.AddDate(0, 0, 1).Before(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(day); err != nil {
+			return fmt.Errorf("failed to prune archive: %v", err)
+		}
+		removed++
+		// Fails while the directory still holds other days
+		os.Remove(filepath.Dir(day))
+		os.Remove(filepath.Dir(filepath.Dir(day)))
+	}
+	if removed > 0 {
+		bkd.logger.Info("archive pruned", "task", "archive_prune", "days", removed)
+	}
+	return nil
+}
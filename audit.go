@@ -0,0 +1,147 @@
+// audit.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	khttp "github.com/microsoft/kiota-http-go"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// auditRecord is a line of the audit log, written for every DATA
+type auditRecord struct {
+	Time    time.Time `json:"time"`
+	QueueID string    `json:"queue_id,omitempty"`
+	Client  string    `json:"client"`
+	User    string    `json:"user,omitempty"`
+	From    string    `json:"from"`
+	To      []string  `json:"to"`
+	Size    int64     `json:"size"`
+	// Outcome is the message's status when the client got its reply:
+	// sent, queued, failed, rejected, or accepted for a delivery worker
+	Outcome   string `json:"outcome"`
+	Reply     string `json:"reply"`
+	LatencyMS int64  `json:"latency_ms"`
+	// Virus is the name the virus scan gave what it found
+	Virus string `json:"virus,omitempty"`
+}
+
+// auditLog writes the audit records as JSON lines to audit.file, rotated
+// like the log file
+type auditLog struct {
+	file *logFile
+}
+
+func newAuditLog(config Config) (*auditLog, error) {
+	if config.Audit.File == "" {
+		return nil, nil
+	}
+	lf, err := newLogFile(config.Audit.File, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit file: %v", err)
+	}
+	return &auditLog{file: lf}, nil
+}
+
+// write appends a record; the log file serializes the writes
+func (a *auditLog) write(rec auditRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = a.file.Write(append(line, '\n'))
+	return err
+}
+
+// audit records the outcome of a DATA command that started at start, with
+// the reply the client gets
+func (s *Session) audit(start time.Time, size int64, reply error) {
+	if s.backend.audit == nil {
+		return
+	}
+	rec := auditRecord{
+		Time:      start.UTC(),
+		QueueID:   s.queueID,
+		Client:    s.clientIP,
+		User:      s.authUser,
+		From:      s.from,
+		To:        s.envelopeRecipients(),
+		Size:      size,
+		Outcome:   "rejected",
+		LatencyMS: time.Since(start).Milliseconds(),
+		Virus:     s.virus,
+	}
+	var smtpErr *smtp.SMTPError
+	switch {
+	case errors.As(reply, &smtpErr):
+		rec.Reply = fmt.Sprintf("%d %d.%d.%d %s", smtpErr.Code, smtpErr.EnhancedCode[0], smtpErr.EnhancedCode[1], smtpErr.EnhancedCode[2], smtpErr.Message)
+	case reply != nil:
+		rec.Reply = reply.Error()
+	}
+	if records := s.backend.history.lookup(s.queueID); s.queueID != "" && len(records) > 0 {
+		rec.Outcome = records[0].Status
+	}
+	if smtpErr == nil || smtpErr.Code >= 400 {
+		if rec.Outcome == "accepted" {
+			rec.Outcome = "rejected"
+		}
+	}
+	if err := s.backend.audit.write(rec); err != nil {
+		s.log().Error("writing audit record failed", "errormsg", err)
+	}
+}
+
+// log returns the session's logger, which names the message by its queue
+// ID once DATA assigned one
+func (s *Session) log() *slog.Logger {
+	logger := s.backend.logger
+	// Traced sessions name their trace, to find it from the log
+	if sc := trace.SpanContextFromContext(s.traceCtx); sc.IsSampled() {
+		logger = logger.With("traceid", sc.TraceID().String())
+	}
+	if s.queueID == "" {
+		return logger
+	}
+	return logger.With("queueid", s.queueID)
+}
+
+// countingReader counts the bytes of a message as it is read
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// requestCorrelator sends the queue ID of the message a Graph request is
+// made for as its client-request-id, which Microsoft support and the
+// Azure AD sign-in logs can search by. The header must be a GUID, so the
+// queue ID makes up its first 16 digits.
+type requestCorrelator struct{}
+
+func (requestCorrelator) Intercept(pipeline khttp.Pipeline, middlewareIndex int, req *http.Request) (*http.Response, error) {
+	if id := correlationGUID(queueIDFrom(req.Context())); id != "" {
+		req.Header.Set("client-request-id", id)
+	}
+	return pipeline.Next(req, middlewareIndex)
+}
+
+// correlationGUID formats a queue ID as a GUID, or returns "" for anything
+// but a queue ID
+func correlationGUID(queueID string) string {
+	if len(queueID) != 16 || !validSpoolID(queueID) {
+		return ""
+	}
+	return queueID[:8] + "-" + queueID[8:12] + "-" + queueID[12:] + "-0000-000000000000"
+}
@@ -0,0 +1,135 @@
+// auth.go
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// credentialStore checks SMTP AUTH passwords against the bcrypt hashes of
+// auth.users and auth.htpasswd_file, and else the directory of auth.ldap
+type credentialStore struct {
+	users    map[string][]byte
+	htpasswd string
+	ldap     *ldapAuthenticator
+
+	mu        sync.Mutex
+	fileUsers map[string][]byte
+	modTime   time.Time
+	checked   time.Time
+	// dummy is compared for unknown users, so they take as long to refuse
+	// as wrong passwords and can't be told apart
+	dummy []byte
+}
+
+// htpasswdCheckInterval is how often the htpasswd file is checked for
+// changes
+const htpasswdCheckInterval = 10 * time.Second
+
+// newCredentialStore returns nil when no accounts are configured
+func newCredentialStore(config Config) (*credentialStore, error) {
+	if len(config.Auth.Users) == 0 && config.Auth.HtpasswdFile == "" && config.Auth.LDAP.URL == "" {
+		return nil, nil
+	}
+	cs := &credentialStore{users: make(map[string][]byte), htpasswd: config.Auth.HtpasswdFile}
+	var err error
+	if cs.ldap, err = newLDAPAuthenticator(config.Auth.LDAP); err != nil {
+		return nil, err
+	}
+	for _, u := range config.Auth.Users {
+		if u.Username == "" {
+			return nil, fmt.Errorf("auth user without a username")
+		}
+		if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+			return nil, fmt.Errorf("auth user %s: password_hash is not a bcrypt hash", u.Username)
+		}
+		cs.users[u.Username] = []byte(u.PasswordHash)
+	}
+	if cs.htpasswd != "" {
+		if err := cs.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	dummy, err := bcrypt.GenerateFromPassword([]byte("no such user"), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	cs.dummy = dummy
+	return cs, nil
+}
+
+// load reads the htpasswd file, which has to use bcrypt (htpasswd -B)
+func (cs *credentialStore) load() error {
+	info, err := os.Stat(cs.htpasswd)
+	if err != nil {
+		return fmt.Errorf("failed to read htpasswd file: %v", err)
+	}
+	f, err := os.Open(cs.htpasswd)
+	if err != nil {
+		return fmt.Errorf("failed to read htpasswd file: %v", err)
+	}
+	defer f.Close()
+
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok || username == "" {
+			return fmt.Errorf("htpasswd file %s, line %d: expected user:hash", cs.htpasswd, n)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("htpasswd file %s, line %d: %s is not a bcrypt hash", cs.htpasswd, n, username)
+		}
+		users[username] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read htpasswd file: %v", err)
+	}
+	cs.fileUsers, cs.modTime = users, info.ModTime()
+	return nil
+}
+
+// verify reports whether the password is right for the user. Accounts in
+// the config win over the htpasswd file, which is reread when it changes,
+// and both over the LDAP directory. A file that no longer parses keeps the
+// previous accounts and is returned as an error next to the result, as is
+// a directory that couldn't be reached.
+func (cs *credentialStore) verify(username, password string) (bool, error) {
+	var reloadErr error
+	cs.mu.Lock()
+	if cs.htpasswd != "" && time.Since(cs.checked) > htpasswdCheckInterval {
+		cs.checked = time.Now()
+		if info, err := os.Stat(cs.htpasswd); err == nil && !info.ModTime().Equal(cs.modTime) {
+			reloadErr = cs.load()
+		}
+	}
+	hash, ok := cs.users[username]
+	if !ok {
+		hash, ok = cs.fileUsers[username]
+	}
+	cs.mu.Unlock()
+
+	if !ok && cs.ldap != nil {
+		ok, err := cs.ldap.verify(username, password)
+		if err == nil {
+			err = reloadErr
+		}
+		return ok, err
+	}
+	if !ok {
+		bcrypt.CompareHashAndPassword(cs.dummy, []byte(password))
+		return false, reloadErr
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil, reloadErr
+}
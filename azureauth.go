@@ -0,0 +1,115 @@
+// azureauth.go
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+// newCredential returns the Azure AD credential of an app registration or
+// managed identity, by azure.auth_method
+func newCredential(azure AzureConfig, transport *http.Transport) (azcore.TokenCredential, error) {
+	clientOptions := azcore.ClientOptions{Cloud: azure.cloud().configuration(), Transport: &http.Client{Transport: transport}}
+	switch azure.AuthMethod {
+	case "", "secret":
+		return azidentity.NewClientSecretCredential(azure.TenantID, azure.ClientID, azure.ClientSecret,
+			&azidentity.ClientSecretCredentialOptions{ClientOptions: clientOptions})
+	case "certificate":
+		certs, key, err := readCertificate(azure)
+		if err != nil {
+			return nil, err
+		}
+		return azidentity.NewClientCertificateCredential(azure.TenantID, azure.ClientID, certs, key,
+			&azidentity.ClientCertificateCredentialOptions{ClientOptions: clientOptions})
+	case "managed_identity":
+		// client_id selects a user-assigned identity, else the
+		// system-assigned one is used
+		opts := &azidentity.ManagedIdentityCredentialOptions{ClientOptions: clientOptions}
+		if azure.ClientID != "" {
+			opts.ID = azidentity.ClientID(azure.ClientID)
+		}
+		return azidentity.NewManagedIdentityCredential(opts)
+	case "workload_identity":
+		// Settings left empty come from the AZURE_CLIENT_ID,
+		// AZURE_TENANT_ID and AZURE_FEDERATED_TOKEN_FILE variables the
+		// AKS webhook sets
+		return azidentity.NewWorkloadIdentityCredential(&azidentity.WorkloadIdentityCredentialOptions{
+			ClientOptions: clientOptions,
+			ClientID:      azure.ClientID,
+			TenantID:      azure.TenantID,
+			TokenFilePath: azure.TokenFile,
+		})
+	case "delegated":
+		return newDelegatedCredential(azure, &http.Client{Transport: transport})
+	case "default":
+		return azidentity.NewDefaultAzureCredential(&azidentity.DefaultAzureCredentialOptions{
+			ClientOptions: clientOptions,
+			TenantID:      azure.TenantID,
+		})
+	}
+	return nil, fmt.Errorf("invalid auth_method %q", azure.AuthMethod)
+}
+
+// newOnBehalfOfCredential exchanges a user's token for the relay's app,
+// the assertion, for Graph tokens of that user (the OAuth 2.0 on-behalf-of
+// flow). The app proves itself with its secret or certificate; other auth
+// methods can't.
+func newOnBehalfOfCredential(azure AzureConfig, transport *http.Transport, assertion string) (azcore.TokenCredential, error) {
+	options := &azidentity.OnBehalfOfCredentialOptions{ClientOptions: azcore.ClientOptions{Cloud: azure.cloud().configuration(), Transport: &http.Client{Transport: transport}}}
+	switch azure.AuthMethod {
+	case "", "secret":
+		return azidentity.NewOnBehalfOfCredentialWithSecret(azure.TenantID, azure.ClientID, assertion, azure.ClientSecret, options)
+	case "certificate":
+		certs, key, err := readCertificate(azure)
+		if err != nil {
+			return nil, err
+		}
+		return azidentity.NewOnBehalfOfCredentialWithCertificate(azure.TenantID, azure.ClientID, assertion, certs, key, options)
+	}
+	return nil, fmt.Errorf("auth_method %s of tenant %s can't act on behalf of users", azure.AuthMethod, azure.tenantName())
+}
+
+// readCertificate reads the app's certificate_file, PEM or PFX with the
+// private key
+func readCertificate(azure AzureConfig) ([]*x509.Certificate, crypto.PrivateKey, error) {
+	data, err := os.ReadFile(azure.CertificateFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read certificate: %v", err)
+	}
+	var password []byte
+	if azure.CertificatePassword != "" {
+		password = []byte(azure.CertificatePassword)
+	}
+	certs, key, err := azidentity.ParseCertificates(data, password)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse certificate %s: %v", azure.CertificateFile, err)
+	}
+	return certs, key, nil
+}
+
+// validate checks the settings the auth method needs
+func (a AzureConfig) validate() error {
+	if err := a.checkCloud(); err != nil {
+		return err
+	}
+	switch a.AuthMethod {
+	case "", "secret", "managed_identity", "workload_identity", "default":
+	case "certificate":
+		if a.CertificateFile == "" {
+			return fmt.Errorf("auth_method certificate needs a certificate_file")
+		}
+	case "delegated":
+		if a.TenantID == "" || a.ClientID == "" || a.TokenCache == "" {
+			return fmt.Errorf("auth_method delegated needs a tenant_id, client_id and token_cache")
+		}
+	default:
+		return fmt.Errorf("invalid auth_method %q", a.AuthMethod)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// backoff.go
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"time"
+
+	abstractions "github.com/microsoft/kiota-abstractions-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var graphRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "gographsmtp_graph_retries_total",
+	Help: "Graph sends repeated after a transient error, per tenant.",
+}, []string{"tenant"})
+
+// Defaults of graph.retry
+const (
+	defaultGraphAttempts    = 3
+	defaultGraphRetryFirst  = time.Second
+	defaultGraphRetryMaxGap = 30 * time.Second
+)
+
+// transientError reports whether a failed Graph request is worth repeating
+// right away: a timeout, a dropped connection or a 5xx answer. Throttling
+// is waited out by the throttle gate, and permanent errors won't change.
+func transientError(err error) bool {
+	var open breakerOpenError
+	if err == nil || permanentError(err) || throttled(err) || errors.Is(err, context.Canceled) || errors.As(err, &open) {
+		return false
+	}
+	var apiErr abstractions.ApiErrorable
+	if errors.As(err, &apiErr) {
+		code := apiErr.GetStatusCode()
+		return code == 408 || code >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// graphRetryDelay is the wait before attempt n+1 after n failed ones:
+// graph.retry.initial_interval doubling up to max_interval, with jitter so
+// messages that failed together don't retry together
+func (c Config) graphRetryDelay(n int) time.Duration {
+	first, limit := c.Graph.Retry.InitialInterval, c.Graph.Retry.MaxInterval
+	if first <= 0 {
+		first = defaultGraphRetryFirst
+	}
+	if limit <= 0 {
+		limit = defaultGraphRetryMaxGap
+	}
+	delay := first
+	for i := 1; i < n && delay < limit; i++ {
+		delay *= 2
+	}
+	delay = min(delay, limit)
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// graphAttempts returns how often a Graph send is tried
+func (c Config) graphAttempts() int {
+	if c.Graph.Retry.Attempts > 0 {
+		return c.Graph.Retry.Attempts
+	}
+	return defaultGraphAttempts
+}
+
+// withRetries calls send until it succeeds, fails for good or the attempts
+// of graph.retry are used up. A retry that wouldn't start before ctx
+// expires isn't made.
+func (bkd *Backend) withRetries(ctx context.Context, logger *slog.Logger, from, queueID string, send func() error) error {
+	config := bkd.policy().config
+	attempts := config.graphAttempts()
+	for n := 1; ; n++ {
+		err := send()
+		if n >= attempts || !transientError(err) || ctx.Err() != nil {
+			return err
+		}
+		delay := config.graphRetryDelay(n)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return err
+		}
+		logger.Warn("Graph request failed, retrying", "from", from, "attempt", n, "delay", delay.Round(time.Millisecond).String(),
+			"errormsg", err, "status", "graph_retry")
+		graphRetries.WithLabelValues(bkd.tenant(from).name).Inc()
+		bkd.notifyWebhooks(queueID, "retried", err.Error())
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
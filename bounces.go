@@ -0,0 +1,174 @@
+// bounces.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+	"github.com/microsoftgraph/msgraph-sdk-go/users"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// bouncePageSize is the most Inbox messages read per mailbox and run; the
+// next run goes on where this one stopped
+const bouncePageSize = 50
+
+var bouncesSeen = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "gographsmtp_bounces_total",
+	Help: "Non-delivery reports found in the watched mailboxes, per result (matched, unmatched).",
+}, []string{"result"})
+
+// bounceCursor is where the watch of a mailbox stands: the receive time of
+// the newest message read and the messages received at that very time
+type bounceCursor struct {
+	since time.Time
+	seen  map[string]bool
+}
+
+// watchBounces returns the bounce_watch task. Once Graph accepted a
+// message, a recipient server may still refuse it; the non-delivery
+// report then lands in the Inbox of the sending mailbox. The task reads
+// the messages that arrived in the bounces.mailboxes since its previous
+// run, matches reports to relayed messages by the Message-ID they refer
+// to, and records, logs and posts the bounce to bounces.webhook.
+func (bkd *Backend) watchBounces() func(ctx context.Context) error {
+	cursors := make(map[string]*bounceCursor)
+	start := time.Now().UTC()
+	return func(ctx context.Context) error {
+		var failed []string
+		for _, mailbox := range bkd.policy().config.Bounces.Mailboxes {
+			cursor, ok := cursors[mailbox]
+			if !ok {
+				cursor = &bounceCursor{since: start, seen: map[string]bool{}}
+				cursors[mailbox] = cursor
+			}
+			if err := bkd.readBounces(ctx, mailbox, cursor); err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %v", mailbox, err))
+			}
+		}
+		if len(failed) > 0 {
+			return fmt.Errorf("failed to read bounces: %s", strings.Join(failed, "; "))
+		}
+		return nil
+	}
+}
+
+// readBounces reads the mailbox's Inbox messages from the cursor on, oldest
+// first, and moves the cursor past them
+func (bkd *Backend) readBounces(ctx context.Context, mailbox string, cursor *bounceCursor) error {
+	filter := "receivedDateTime ge " + cursor.since.Format(time.RFC3339)
+	top := int32(bouncePageSize)
+	page, err := bkd.tenant(mailbox).user(mailbox).MailFolders().ByMailFolderId("inbox").Messages().Get(ctx,
+		&users.ItemMailFoldersItemMessagesRequestBuilderGetRequestConfiguration{
+			QueryParameters: &users.ItemMailFoldersItemMessagesRequestBuilderGetQueryParameters{
+				Filter:  &filter,
+				Orderby: []string{"receivedDateTime"},
+				Select:  []string{"id", "subject", "receivedDateTime", "internetMessageHeaders"},
+				Top:     &top,
+			},
+		})
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range page.GetValue() {
+		id, subject := "", ""
+		if v := msg.GetId(); v != nil {
+			id = *v
+		}
+		if v := msg.GetSubject(); v != nil {
+			subject = *v
+		}
+		received := msg.GetReceivedDateTime()
+		if received == nil || cursor.seen[id] {
+			continue
+		}
+		if received.After(cursor.since) {
+			cursor.since, cursor.seen = *received, map[string]bool{}
+		}
+		cursor.seen[id] = true
+
+		headers := messageHeaders(msg)
+		if nonDeliveryReport(headers, subject) {
+			bkd.recordBounce(mailbox, subject, headers)
+		}
+	}
+	return nil
+}
+
+// recordBounce matches a non-delivery report to the messages it refers to
+// by In-Reply-To and References
+func (bkd *Backend) recordBounce(mailbox, subject string, headers map[string]string) {
+	failed := headerValue(headers, "X-Failed-Recipients")
+	var records []deliveryRecord
+	for _, field := range []string{"In-Reply-To", "References"} {
+		for _, id := range strings.Fields(headerValue(headers, field)) {
+			if records = bkd.history.lookup(id); len(records) > 0 {
+				break
+			}
+		}
+		if len(records) > 0 {
+			break
+		}
+	}
+	if len(records) == 0 {
+		bouncesSeen.WithLabelValues("unmatched").Inc()
+		bkd.logger.Info("bounce not matched", "mailbox", mailbox, "subject", subject, "status", "bounce_unmatched",
+			"reason", "the report refers to no message in the history")
+		return
+	}
+
+	bouncesSeen.WithLabelValues("matched").Inc()
+	for _, rec := range records {
+		bkd.history.add(rec.QueueID, historyEvent{Event: "bounced", Detail: subject})
+		bkd.notifyWebhooks(rec.QueueID, "bounced", subject)
+		bkd.logger.Warn("message bounced", "queueid", rec.QueueID, "msgid", rec.MessageID, "from", rec.From, "mailbox", mailbox,
+			"recipients", failed, "subject", subject, "status", "bounced")
+		if webhook := bkd.policy().config.Bounces.Webhook; webhook != "" {
+			notice := callbackNotice{QueueID: rec.QueueID, MessageID: rec.MessageID, From: rec.From, To: rec.To,
+				Status: "bounced", Detail: subject, Time: time.Now().UTC()}
+			body, err := json.Marshal(notice)
+			if err == nil {
+				err = postCallback(webhook, nil, body)
+			}
+			if err != nil {
+				bkd.logger.Warn("bounce webhook failed", "queueid", rec.QueueID, "callback", webhook, "errormsg", err)
+			}
+		}
+	}
+}
+
+// nonDeliveryReport reports whether an Inbox message is a non-delivery
+// report: Exchange marks its own, other servers send a delivery status
+// report (RFC 3464)
+func nonDeliveryReport(headers map[string]string, subject string) bool {
+	// Exchange sends the marker header without a value
+	for name := range headers {
+		if strings.EqualFold(name, "X-MS-Exchange-Message-Is-Ndr") {
+			return true
+		}
+	}
+	mediaType, params, err := mime.ParseMediaType(headerValue(headers, "Content-Type"))
+	if err == nil && mediaType == "multipart/report" && strings.EqualFold(params["report-type"], "delivery-status") {
+		return true
+	}
+	return strings.HasPrefix(strings.ToLower(subject), "undeliverable:")
+}
+
+// messageHeaders returns the internet message headers Graph read from a
+// received message
+func messageHeaders(msg models.Messageable) map[string]string {
+	headers := make(map[string]string)
+	for _, h := range msg.GetInternetMessageHeaders() {
+		if h.GetName() != nil && h.GetValue() != nil {
+			headers[*h.GetName()] = *h.GetValue()
+		}
+	}
+	return headers
+}
@@ -0,0 +1,168 @@
+// breaker.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	khttp "github.com/microsoft/kiota-http-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Defaults of graph.circuit_breaker
+const (
+	defaultBreakerFailures = 5
+	defaultBreakerOpen     = 30 * time.Second
+)
+
+// Circuit breaker states, as exported in the state metric
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var breakerTrips = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "gographsmtp_graph_breaker_trips_total",
+	Help: "Times the circuit breaker opened after consecutive Graph failures, per tenant.",
+}, []string{"tenant"})
+
+// circuitBreaker stops sending to a tenant's Graph endpoint during an
+// outage. After graph.circuit_breaker.failures requests in a row failed
+// with a network error, a timeout or a 5xx answer, requests fail at once
+// for open_duration instead of each waiting for its timeout. Then one
+// request is let through as a probe: its success closes the breaker, its
+// failure opens it again. 503 answers are left to the throttle gate.
+type circuitBreaker struct {
+	tenant   string
+	host     string
+	logger   *slog.Logger
+	failures int
+	open     time.Duration
+
+	mu        sync.Mutex
+	state     int
+	failed    int
+	openUntil time.Time
+}
+
+// breakerOpenError is returned for requests refused while the breaker is
+// open
+type breakerOpenError struct {
+	until time.Time
+}
+
+func (e breakerOpenError) Error() string {
+	return fmt.Sprintf("Graph is unavailable, requests are suspended until %s", e.until.Format(time.RFC3339))
+}
+
+func newCircuitBreaker(tenant, host string, config Config, logger *slog.Logger) *circuitBreaker {
+	b := &circuitBreaker{
+		tenant:   tenant,
+		host:     host,
+		logger:   logger,
+		failures: config.Graph.CircuitBreaker.Failures,
+		open:     config.Graph.CircuitBreaker.OpenDuration,
+	}
+	if b.failures <= 0 {
+		b.failures = defaultBreakerFailures
+	}
+	if b.open <= 0 {
+		b.open = defaultBreakerOpen
+	}
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "gographsmtp_graph_breaker_state",
+		Help:        "State of the tenant's circuit breaker: 0 closed, 1 open, 2 half-open while probing.",
+		ConstLabels: prometheus.Labels{"tenant": tenant},
+	}, func() float64 {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return float64(b.state)
+	})
+	return b
+}
+
+func (b *circuitBreaker) Intercept(pipeline khttp.Pipeline, middlewareIndex int, req *http.Request) (*http.Response, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	resp, err := pipeline.Next(req, middlewareIndex)
+	switch {
+	case err != nil && errors.Is(err, context.Canceled):
+		// The caller gave up, which says nothing about Graph
+		b.release()
+	case err != nil || resp.StatusCode >= 500 && resp.StatusCode != http.StatusServiceUnavailable:
+		b.failure()
+	default:
+		b.success()
+	}
+	return resp, err
+}
+
+// allow lets a request through, or refuses it while the breaker is open.
+// Once open_duration is over the first request becomes the probe.
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Now().Before(b.openUntil) {
+			return breakerOpenError{until: b.openUntil}
+		}
+		b.state = breakerHalfOpen
+		return nil
+	case breakerHalfOpen:
+		// The probe is still running
+		return breakerOpenError{until: time.Now().Add(b.open)}
+	}
+	return nil
+}
+
+// unavailable reports whether requests are currently refused
+func (b *circuitBreaker) unavailable() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == breakerHalfOpen || b.state == breakerOpen && time.Now().Before(b.openUntil)
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	closed := b.state == breakerHalfOpen
+	b.state, b.failed = breakerClosed, 0
+	b.mu.Unlock()
+	if closed {
+		b.logger.Info("Graph is available again", "host", b.host, "tenant", b.tenant, "status", "breaker_closed")
+	}
+}
+
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	b.failed++
+	opened := b.state == breakerHalfOpen || b.state == breakerClosed && b.failed >= b.failures
+	if opened {
+		b.state, b.openUntil = breakerOpen, time.Now().Add(b.open)
+	}
+	failed := b.failed
+	b.mu.Unlock()
+	if opened {
+		breakerTrips.WithLabelValues(b.tenant).Inc()
+		b.logger.Warn("Graph is failing, suspending requests", "host", b.host, "tenant", b.tenant,
+			"status", "breaker_open", "failures", failed, "pause", b.open)
+	}
+}
+
+// release ends a request without a verdict; a probe that was canceled
+// leaves the next request to probe
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		b.state = breakerOpen
+	}
+}
@@ -0,0 +1,77 @@
+// capture.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	kjson "github.com/microsoft/kiota-serialization-json-go"
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+)
+
+// captureRecord is written next to a captured message as <id>.json
+type captureRecord struct {
+	QueueID    string    `json:"queue_id"`
+	Received   time.Time `json:"received"`
+	Client     string    `json:"client"`
+	From       string    `json:"from"`
+	Recipients []string  `json:"recipients"`
+	// Message is the Graph message the relay would have sent, missing for
+	// messages sent to Graph as MIME
+	Message json.RawMessage `json:"message,omitempty"`
+}
+
+// capture writes the message to capture.directory instead of sending it:
+// the message as received in <queue id>.eml and the envelope with the
+// Graph message in <queue id>.json. The client is told it was sent.
+func (s *Session) capture(dir string, data []byte) error {
+	record := captureRecord{
+		QueueID:    s.queueID,
+		Received:   time.Now().UTC(),
+		Client:     s.clientIP,
+		From:       s.from,
+		Recipients: s.envelopeRecipients(),
+	}
+	if s.message != nil {
+		msg, err := graphJSON(s.message)
+		if err != nil {
+			return fmt.Errorf("failed to capture message: %v", err)
+		}
+		record.Message = msg
+	}
+	meta, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to capture message: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to capture message: %v", err)
+	}
+	base := filepath.Join(dir, s.queueID)
+	if err := os.WriteFile(base+".eml", data, 0600); err != nil {
+		return fmt.Errorf("failed to capture message: %v", err)
+	}
+	if err := os.WriteFile(base+".json", meta, 0600); err != nil {
+		return fmt.Errorf("failed to capture message: %v", err)
+	}
+
+	s.backend.recordMessage(s.from, "captured")
+	s.backend.history.add(s.queueID, historyEvent{Event: "captured", Detail: base + ".eml"})
+	s.backend.notifyCallback(s.control.callback, s.queueID, "captured", "")
+	s.log().Info("message captured", "client", s.clientIP, "from", s.from,
+		"recipients", strings.Join(s.to, ","), "status", "captured", "file", base+".eml")
+	return nil
+}
+
+// graphJSON serializes a Graph message the way the SDK sends it
+func graphJSON(msg models.Messageable) ([]byte, error) {
+	w := kjson.NewJsonSerializationWriter()
+	defer w.Close()
+	if err := w.WriteObjectValue("", msg); err != nil {
+		return nil, err
+	}
+	return w.GetSerializedContent()
+}
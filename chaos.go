@@ -0,0 +1,78 @@
+// chaos.go
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	khttp "github.com/microsoft/kiota-http-go"
+)
+
+// chaosEnv must be set to 1 in addition to chaos.enabled, so a staging
+// config copied to production can't inject failures there
+const chaosEnv = "GOGRAPHSMTP_CHAOS"
+
+// chaosServerErrors are the 5xx answers a simulated outage picks from
+var chaosServerErrors = []int{
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// chaosInjector is the innermost Graph middleware in chaos mode. It fails
+// a share of the requests before they reach Graph, so everything above it
+// (retries, pacing metrics, callers) sees the failures as real ones.
+type chaosInjector struct {
+	config ChaosConfig
+}
+
+func (c chaosInjector) Intercept(pipeline khttp.Pipeline, middlewareIndex int, req *http.Request) (*http.Response, error) {
+	r := rand.Float64()
+	switch {
+	case r < c.config.ThrottleRate:
+		retryAfter := c.config.RetryAfter
+		if retryAfter <= 0 {
+			retryAfter = 2 * time.Second
+		}
+		resp := chaosResponse(req, http.StatusTooManyRequests, "TooManyRequests")
+		resp.Header.Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+		return resp, nil
+	case r < c.config.ThrottleRate+c.config.ServerErrorRate:
+		status := chaosServerErrors[rand.Intn(len(chaosServerErrors))]
+		return chaosResponse(req, status, "ServiceUnavailable"), nil
+	case r < c.config.ThrottleRate+c.config.ServerErrorRate+c.config.TimeoutRate:
+		timeout := c.config.Timeout
+		if timeout <= 0 {
+			timeout = time.Minute
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(timeout):
+			return nil, fmt.Errorf("chaos: simulated timeout after %s", timeout)
+		}
+	}
+	return pipeline.Next(req, middlewareIndex)
+}
+
+// chaosResponse builds a Graph error answer
+func chaosResponse(req *http.Request, status int, code string) *http.Response {
+	body := fmt.Sprintf(`{"error":{"code":%q,"message":"Simulated by chaos mode"}}`, code)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(bytes.NewBufferString(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,59 @@
+// classification.go
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+)
+
+// messageSensitivity is PR_SENSITIVITY, which Graph's message has no
+// property for: 0 normal, 1 personal, 2 private, 3 confidential
+const messageSensitivity = "Integer 0x0036"
+
+// headerSensitivity reads the Sensitivity header (RFC 2156) and returns
+// its PR_SENSITIVITY value, or -1 when it's missing or unknown
+func headerSensitivity(headers map[string]string) int {
+	switch strings.ToLower(strings.TrimSpace(headerValue(headers, "Sensitivity"))) {
+	case "normal":
+		return 0
+	case "personal":
+		return 1
+	case "private":
+		return 2
+	case "company-confidential", "confidential":
+		return 3
+	}
+	return -1
+}
+
+// headerCategories returns the Outlook categories named in the header
+// graph.categories_header, separated by commas or semicolons
+func headerCategories(headers map[string]string, name string) []string {
+	if name == "" {
+		return nil
+	}
+	var categories []string
+	for _, c := range strings.FieldsFunc(decodeWords(headerValue(headers, name)), func(r rune) bool { return r == ',' || r == ';' }) {
+		if c = strings.TrimSpace(c); c != "" {
+			categories = append(categories, c)
+		}
+	}
+	return categories
+}
+
+// setClassification carries the message's sensitivity and categories over
+// to msg, so Outlook shows their markings
+func setClassification(msg models.Messageable, headers map[string]string, categoriesHeader string) {
+	if sensitivity := headerSensitivity(headers); sensitivity >= 0 {
+		prop := models.NewSingleValueLegacyExtendedProperty()
+		id, value := messageSensitivity, strconv.Itoa(sensitivity)
+		prop.SetId(&id)
+		prop.SetValue(&value)
+		msg.SetSingleValueExtendedProperties(append(msg.GetSingleValueExtendedProperties(), prop))
+	}
+	if categories := headerCategories(headers, categoriesHeader); len(categories) > 0 {
+		msg.SetCategories(categories)
+	}
+}
@@ -0,0 +1,279 @@
+// cli.go
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `usage: gographsmtp [-config file] [-log-level level] [-listen address] [-debug-graph] [command] [args]
+
+commands:
+  serve              run the relay (default)
+  validate           check the config file, -graph also gets a Graph token
+  send-test          send a test message through Graph
+  queue              list, show, retry, delete or flush messages in the retry spool
+  quarantine         list, show, release or delete quarantined messages
+  replay             submit archived .eml files to the running relay
+  status             print the send pacing report of the running relay
+  lookup             look up a message in the delivery history
+  login              sign in the user of auth_method: delegated
+  service            install, uninstall, start or stop the Windows service
+`
+
+// cliOptions are the global flags, given before the command
+type cliOptions struct {
+	config     string
+	logLevel   string
+	listen     string
+	debugGraph bool
+}
+
+// parseCLI returns the global flags, the command and its arguments
+func parseCLI(args []string) (cliOptions, string, []string, error) {
+	var opts cliOptions
+	fs := flag.NewFlagSet("gographsmtp", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(fs.Output(), usage) }
+	fs.StringVar(&opts.config, "config", "config.yaml", "config file")
+	fs.StringVar(&opts.logLevel, "log-level", "", "replaces log.level")
+	fs.StringVar(&opts.listen, "listen", "", "replaces the address of smtp.address or the first listener")
+	fs.BoolVar(&opts.debugGraph, "debug-graph", false, "logs Graph requests and responses, redacted")
+	if err := fs.Parse(args); err != nil {
+		return opts, "", nil, err
+	}
+	command := fs.Arg(0)
+	if command == "" {
+		command = "serve"
+	}
+	var rest []string
+	if fs.NArg() > 1 {
+		rest = fs.Args()[1:]
+	}
+	return opts, command, rest, nil
+}
+
+// loadConfig reads the config file and applies the flags that replace its
+// settings, again on every reload
+func (o cliOptions) loadConfig() (Config, error) {
+	config, err := loadConfig(o.config)
+	if err != nil {
+		return config, err
+	}
+	if o.logLevel != "" {
+		switch o.logLevel {
+		case "debug", "info", "warn", "error":
+		default:
+			return config, fmt.Errorf("invalid -log-level %q", o.logLevel)
+		}
+		config.Log.Level = o.logLevel
+	}
+	if o.listen != "" {
+		if len(config.SMTP.Listeners) > 0 {
+			// The slice is the config's own, copy it before changing it
+			config.SMTP.Listeners = append([]ListenerConfig(nil), config.SMTP.Listeners...)
+			config.SMTP.Listeners[0].Address = o.listen
+		} else {
+			config.SMTP.Address = o.listen
+		}
+	}
+	if o.debugGraph {
+		config.Graph.Debug = true
+	}
+	return config, nil
+}
+
+// runSendTestCommand sends a short test message through Graph, bypassing
+// the SMTP listeners and policies, to check the app registration and the
+// sender's mailbox
+func runSendTestCommand(bkd *Backend, args []string) error {
+	fs := flag.NewFlagSet("send-test", flag.ContinueOnError)
+	from := fs.String("from", "", "sender mailbox")
+	to := fs.String("to", "", "comma-separated recipients")
+	subject := fs.String("subject", "GoGraphSmtp test message", "subject")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" || *to == "" || fs.NArg() > 0 {
+		return fmt.Errorf("usage: send-test -from addr -to addrs [-subject text]")
+	}
+	rcpts, err := mail.ParseAddressList(*to)
+	if err != nil {
+		return fmt.Errorf("invalid -to: %v", err)
+	}
+	var list []string
+	for _, addr := range rcpts {
+		list = append(list, addr.String())
+	}
+	hostname, _ := os.Hostname()
+
+	var b strings.Builder
+	b.WriteString("From: " + *from + "\r\n")
+	b.WriteString("To: " + strings.Join(list, ", ") + "\r\n")
+	b.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", *subject) + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&b, "Test message sent by gographsmtp send-test on %s.\r\n", hostname)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := bkd.sendMIME(ctx, *from, []byte(b.String())); err != nil {
+		return fmt.Errorf("test message failed: %v", err)
+	}
+	fmt.Printf("Test message sent from %s to %s\n", *from, strings.Join(list, ", "))
+	return nil
+}
+
+// runQueueCommand manages the retry spool from the command line, like
+// postqueue and postsuper; requeue moves a message from the quarantine
+// back into it. With http.admin_token set the commands go to the running
+// relay, and to the spool directory only when it doesn't answer.
+func runQueueCommand(bkd *Backend, args []string) error {
+	if bkd.retry == nil {
+		return fmt.Errorf("spool.directory is not configured")
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("usage: queue list | show <id> | retry <id> | delete <id> | flush | requeue <id>")
+	}
+	if args[0] != "list" && args[0] != "flush" && len(args) != 2 {
+		return fmt.Errorf("usage: queue %s <id>", args[0])
+	}
+
+	config := bkd.policy().config
+	if config.HTTP.Address != "" && config.HTTP.AdminToken != "" {
+		err := runQueueViaRelay(config, args)
+		if !errors.Is(err, errRelayUnreachable) {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "The relay doesn't answer, working on the spool directory")
+	}
+
+	switch args[0] {
+	case "list":
+		entries, err := bkd.retry.list()
+		if err != nil {
+			return err
+		}
+		return printQueue(entries)
+	case "show":
+		_, data, err := bkd.retry.get(args[1])
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	case "retry":
+		entry, err := bkd.retry.entry(args[1])
+		if err != nil {
+			return err
+		}
+		if err := bkd.sendRetry(entry); err != nil {
+			return fmt.Errorf("retry of %s failed: %v", args[1], err)
+		}
+		fmt.Printf("Sent %s\n", args[1])
+		return nil
+	case "delete":
+		if err := bkd.retry.remove(args[1]); err != nil {
+			return err
+		}
+		bkd.logger.Info("queued message deleted", "retry", args[1], "status", "deleted")
+		fmt.Printf("Deleted %s\n", args[1])
+		return nil
+	case "flush":
+		entries, err := bkd.retry.list()
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := bkd.sendRetry(entry); err != nil {
+				fmt.Printf("%s failed: %v\n", entry.ID, err)
+				continue
+			}
+			fmt.Printf("Sent %s\n", entry.ID)
+		}
+		return nil
+	case "requeue":
+		if bkd.quarantine == nil {
+			return fmt.Errorf("quarantine.directory is not configured")
+		}
+		if _, err := bkd.requeue(args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("Requeued %s\n", args[1])
+		return nil
+	}
+	return fmt.Errorf("unknown queue command %q", args[0])
+}
+
+// runQueueViaRelay runs a queue command through the admin API of the
+// running relay
+func runQueueViaRelay(config Config, args []string) error {
+	var id string
+	if len(args) == 2 {
+		id = url.PathEscape(args[1])
+	}
+	switch args[0] {
+	case "list":
+		var entries []spoolEntry
+		if err := adminGet(config, "/queue", nil, &entries); err != nil {
+			return err
+		}
+		return printQueue(entries)
+	case "show":
+		var data []byte
+		if err := adminGet(config, "/queue/"+id, nil, &data); err != nil {
+			return err
+		}
+		_, err := os.Stdout.Write(data)
+		return err
+	case "retry":
+		if err := adminRequest(config, "POST", "/queue/"+id+"/retry", nil, nil); err != nil {
+			return fmt.Errorf("retry of %s failed: %v", args[1], err)
+		}
+		fmt.Printf("Sent %s\n", args[1])
+		return nil
+	case "delete":
+		if err := adminRequest(config, "DELETE", "/queue/"+id, nil, nil); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted %s\n", args[1])
+		return nil
+	case "flush":
+		var result struct {
+			Messages int `json:"messages"`
+		}
+		if err := adminRequest(config, "POST", "/queue/flush", nil, &result); err != nil {
+			return err
+		}
+		fmt.Printf("Flushing %d messages, see the relay's log for the results\n", result.Messages)
+		return nil
+	case "requeue":
+		if err := adminRequest(config, "POST", "/quarantine/"+id+"/requeue", nil, nil); err != nil {
+			return err
+		}
+		fmt.Printf("Requeued %s\n", args[1])
+		return nil
+	}
+	return fmt.Errorf("unknown queue command %q", args[0])
+}
+
+// printQueue lists queued messages with their attempts, next attempt and
+// last error
+func printQueue(entries []spoolEntry) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tRECEIVED\tFROM\tTO\tATTEMPTS\tNEXT\tREASON")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", e.ID, e.Received.Format(time.RFC3339), e.From, strings.Join(e.To, ","), e.Attempts,
+			e.NotBefore.Local().Format(time.RFC3339), e.Reason)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,78 @@
+// clients.go
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// clientOverride is a clients config section with its networks parsed
+type clientOverride struct {
+	ClientConfig
+	nets  []*net.IPNet
+	names []string
+}
+
+// newClientOverrides parses the match lists of the clients config section.
+// Entries that look like an IP address or CIDR are networks, everything
+// else is an EHLO name.
+func newClientOverrides(list []ClientConfig) ([]clientOverride, error) {
+	overrides := make([]clientOverride, 0, len(list))
+	for _, cc := range list {
+		o := clientOverride{ClientConfig: cc}
+		var networks []string
+		for _, m := range cc.Match {
+			m = strings.TrimSpace(m)
+			if strings.Contains(m, "/") || net.ParseIP(m) != nil {
+				networks = append(networks, m)
+			} else if m != "" {
+				o.names = append(o.names, strings.ToLower(strings.TrimSuffix(m, ".")))
+			}
+		}
+		nets, err := parseCIDRs(networks)
+		if err != nil {
+			return nil, err
+		}
+		o.nets = nets
+		overrides = append(overrides, o)
+	}
+	return overrides, nil
+}
+
+// matches reports whether the client address or its EHLO name is listed.
+// "*.example.com" matches every name below example.com.
+func (o clientOverride) matches(ip net.IP, helo string) bool {
+	if ip != nil && containsIP(o.nets, ip) {
+		return true
+	}
+	helo = strings.ToLower(strings.TrimSuffix(helo, "."))
+	for _, name := range o.names {
+		if name == helo || strings.HasPrefix(name, "*.") && strings.HasSuffix(helo, name[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientConfig returns the overrides of the first matching clients section
+func (bkd *Backend) clientConfig(ip net.IP, helo string) (ClientConfig, bool) {
+	for _, o := range bkd.policy().clients {
+		if o.matches(ip, helo) {
+			return o.ClientConfig, true
+		}
+	}
+	return ClientConfig{}, false
+}
+
+// maxMessageBytes is the largest message any client of the listener may
+// send. go-smtp enforces it while reading; smaller per-session limits are
+// checked after.
+func (c Config) maxMessageBytes(lc ListenerConfig) int64 {
+	limit := lc.MaxMessageBytes
+	for _, cc := range c.Clients {
+		if cc.MaxMessageBytes > limit {
+			limit = cc.MaxMessageBytes
+		}
+	}
+	return limit
+}
@@ -0,0 +1,80 @@
+// cloud.go
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+)
+
+// graphCloud is a Microsoft cloud: the Graph endpoint mail is sent
+// through and the Azure AD authority that issues its tokens
+type graphCloud struct {
+	graph     string
+	authority string
+}
+
+// graphClouds are the clouds azure.cloud names
+var graphClouds = map[string]graphCloud{
+	"global":    {graph: "https://graph.microsoft.com", authority: "https://login.microsoftonline.com"},
+	"usgov":     {graph: "https://graph.microsoft.us", authority: "https://login.microsoftonline.us"},
+	"usgov_dod": {graph: "https://dod-graph.microsoft.us", authority: "https://login.microsoftonline.us"},
+	"china":     {graph: "https://microsoftgraph.chinacloudapi.cn", authority: "https://login.chinacloudapi.cn"},
+}
+
+// cloud returns the tenant's cloud, with graph_endpoint and authority_host
+// replacing its endpoints
+func (a AzureConfig) cloud() graphCloud {
+	c := graphClouds["global"]
+	if a.Cloud != "" {
+		c = graphClouds[a.Cloud]
+	}
+	if a.GraphEndpoint != "" {
+		c.graph = strings.TrimRight(a.GraphEndpoint, "/")
+	}
+	if a.AuthorityHost != "" {
+		c.authority = strings.TrimRight(a.AuthorityHost, "/")
+	}
+	return c
+}
+
+// checkCloud refuses unknown clouds and endpoints that aren't https URLs
+func (a AzureConfig) checkCloud() error {
+	if _, ok := graphClouds[a.Cloud]; a.Cloud != "" && !ok {
+		return fmt.Errorf("invalid cloud %q, must be global, usgov, usgov_dod or china", a.Cloud)
+	}
+	for name, endpoint := range map[string]string{"graph_endpoint": a.GraphEndpoint, "authority_host": a.AuthorityHost} {
+		if endpoint == "" {
+			continue
+		}
+		if u, err := url.Parse(endpoint); err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("invalid %s %q, must be an https URL", name, endpoint)
+		}
+	}
+	return nil
+}
+
+// scope is the token scope of Graph requests
+func (c graphCloud) scope() string {
+	return c.graph + "/.default"
+}
+
+// baseURL is the Graph API root requests are sent to
+func (c graphCloud) baseURL() string {
+	return c.graph + "/v1.0"
+}
+
+// host names the Graph endpoint in logs
+func (c graphCloud) host() string {
+	if u, err := url.Parse(c.graph); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return c.graph
+}
+
+// configuration is the cloud for the azidentity credentials
+func (c graphCloud) configuration() cloud.Configuration {
+	return cloud.Configuration{ActiveDirectoryAuthorityHost: c.authority + "/"}
+}
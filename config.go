@@ -0,0 +1,1137 @@
+// config.go
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config represents the structure of the configuration file
+type Config struct {
+	// Azure is the app registration of the default tenant
+	Azure AzureConfig `yaml:"azure"`
+	// Tenants are further Microsoft 365 tenants, used for the senders
+	// they list
+	Tenants []TenantConfig `yaml:"tenants"`
+	Secrets struct {
+		// AgeKeyFile holds the age identity that decrypts encrypted
+		// config values
+		AgeKeyFile string `yaml:"age_key_file"`
+	} `yaml:"secrets"`
+	Graph struct {
+		// SourceAddress is the local address Graph and token requests are
+		// sent from; Interface picks the first address of an interface
+		SourceAddress string `yaml:"source_address"`
+		Interface     string `yaml:"interface"`
+		// Proxy sends Graph and token requests through an HTTP proxy,
+		// instead of the one HTTPS_PROXY names; Username and Password
+		// authenticate to it
+		Proxy struct {
+			URL      string `yaml:"url"`
+			Username string `yaml:"username"`
+			Password string `yaml:"password"`
+		} `yaml:"proxy"`
+		// SendMode is "sendmail" (default) to send with a single request,
+		// "draft" to create a draft and send it, which tells the relay
+		// the message's Internet message ID, or "mime" to post messages as
+		// received
+		SendMode string `yaml:"send_mode"`
+		// SaveToSent keeps a copy of sent mail in the mailbox's Sent
+		// Items, true unless set; sender_map entries override it
+		SaveToSent *bool `yaml:"save_to_sent"`
+		// ThreadReplies sends messages whose In-Reply-To or References
+		// name a message in the sender's mailbox as a reply to it, so
+		// they join its conversation
+		ThreadReplies bool `yaml:"thread_replies"`
+		// CategoriesHeader names a header, such as X-Categories, whose
+		// comma-separated values become the message's Outlook categories
+		CategoriesHeader string `yaml:"categories_header"`
+		// Debug logs every Graph request and response, redacted, with the
+		// details of OData errors
+		Debug bool `yaml:"debug"`
+		// SplitRecipients sends messages with more envelope recipients in
+		// batches of this many, so one recipient Graph rejects doesn't
+		// fail the others; 0 sends every message once
+		SplitRecipients int `yaml:"split_recipients"`
+		// Retry repeats sends that failed with a timeout, a dropped
+		// connection or a 5xx answer, waiting InitialInterval, doubling up
+		// to MaxInterval with jitter, for up to Attempts tries in all
+		Retry struct {
+			Attempts        int           `yaml:"attempts"`
+			InitialInterval time.Duration `yaml:"initial_interval"`
+			MaxInterval     time.Duration `yaml:"max_interval"`
+		} `yaml:"retry"`
+		// Timeout bounds the delivery of a message to Graph, 30s unless
+		// set; UploadTimeout that of one with attachments uploaded in
+		// chunks, 5m unless set
+		Timeout       time.Duration `yaml:"timeout"`
+		UploadTimeout time.Duration `yaml:"upload_timeout"`
+		// CircuitBreaker fails Graph requests at once for OpenDuration
+		// after Failures requests in a row failed
+		CircuitBreaker struct {
+			Failures     int           `yaml:"failures"`
+			OpenDuration time.Duration `yaml:"open_duration"`
+		} `yaml:"circuit_breaker"`
+		// Preflight checks every tenant at startup, before the listeners
+		// are bound, and stops the relay when one fails: it gets a token,
+		// checks that it grants Mail.Send, and looks up the signed-in user
+		// of delegated auth or Mailbox in its tenant
+		Preflight struct {
+			Enabled bool          `yaml:"enabled"`
+			Mailbox string        `yaml:"mailbox"`
+			Timeout time.Duration `yaml:"timeout"`
+		} `yaml:"preflight"`
+	} `yaml:"graph"`
+	SMTP struct {
+		Address        string   `yaml:"address"`
+		Domain         string   `yaml:"domain"`
+		TrustedProxies []string `yaml:"trusted_proxies"`
+
+		// Hostname is the name presented in the greeting and EHLO reply,
+		// e.g. the public name of a relay behind NAT. Defaults to Domain.
+		Hostname string `yaml:"hostname"`
+		// HeloValidationDomain rejects clients that introduce themselves
+		// with a name inside our own domain
+		HeloValidationDomain string `yaml:"helo_validation_domain"`
+
+		// MaxMessageBytes is the largest message accepted, advertised with
+		// SIZE; 1 MiB unless configured, at most the 150 MiB Exchange
+		// Online takes
+		MaxMessageBytes int64 `yaml:"max_message_bytes"`
+		// MaxRecipients is the most RCPT TO per message, 50 unless
+		// configured
+		MaxRecipients int `yaml:"max_recipients"`
+		// DataSpoolBytes is the size from which a message is written to a
+		// temp file in DataSpoolDirectory (the system's temp directory by
+		// default) while it's received, 1 MiB unless configured
+		DataSpoolBytes     int64  `yaml:"data_spool_bytes"`
+		DataSpoolDirectory string `yaml:"data_spool_directory"`
+		// MaxMemoryBytes bounds the total size of the messages processed
+		// at once; others wait for their turn. 0 is unlimited.
+		MaxMemoryBytes int64 `yaml:"max_memory_bytes"`
+		// WriteTimeout bounds sending a reply to the client, 10s unless
+		// configured
+		WriteTimeout time.Duration `yaml:"write_timeout"`
+		// IdleTimeout and DataTimeout are the listeners' timeouts for the
+		// next command and a whole DATA transfer, 10s and 10m unless
+		// configured
+		IdleTimeout time.Duration `yaml:"idle_timeout"`
+		DataTimeout time.Duration `yaml:"data_timeout"`
+
+		// MaxLineLength is the longest command or content line accepted,
+		// 1000 per RFC 5321 unless configured
+		MaxLineLength int `yaml:"max_line_length"`
+		// LineEndings is "normalize" (default) to rewrite bare CR/LF line
+		// endings to CRLF, or "reject" to refuse such messages with 554
+		LineEndings string `yaml:"line_endings"`
+		// ReceivedHeader adds a Received trace field to every message,
+		// unless set to false
+		ReceivedHeader *bool `yaml:"received_header"`
+
+		// DSN offers delivery status notifications (RFC 3461); the sender
+		// is notified as the recipients asked with NOTIFY
+		DSN bool `yaml:"dsn"`
+
+		// MaxConnections caps the simultaneous connections of all
+		// listeners, MaxConnectionsPerIP those of one client; 0 is
+		// unlimited
+		MaxConnections      int `yaml:"max_connections"`
+		MaxConnectionsPerIP int `yaml:"max_connections_per_ip"`
+
+		MaxErrors    int     `yaml:"max_errors"`
+		CommandRate  float64 `yaml:"command_rate"`
+		CommandBurst int     `yaml:"command_burst"`
+
+		// TLS holds the certificate for STARTTLS and implicit TLS
+		// listeners, from files or obtained with ACME
+		TLS struct {
+			CertFile string `yaml:"cert_file"`
+			KeyFile  string `yaml:"key_file"`
+			ACME     struct {
+				Domains  []string `yaml:"domains"`
+				Email    string   `yaml:"email"`
+				CacheDir string   `yaml:"cache_dir"`
+				// HTTPAddress serves the HTTP-01 challenge, e.g. ":80"
+				HTTPAddress string `yaml:"http_address"`
+			} `yaml:"acme"`
+		} `yaml:"tls"`
+
+		Listeners []ListenerConfig `yaml:"listeners"`
+
+		// ShutdownTimeout is how long SIGTERM waits for open transactions
+		// and queued deliveries, 30s unless configured
+		ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	} `yaml:"smtp"`
+	// Auth holds the accounts for SMTP AUTH; without any, AUTH is not
+	// offered
+	Auth struct {
+		Users []AuthUser `yaml:"users"`
+		// HtpasswdFile holds further accounts with bcrypt hashes
+		// (htpasswd -B); it is reread when it changes
+		HtpasswdFile string `yaml:"htpasswd_file"`
+		// LDAP checks the passwords of users in neither against a
+		// directory such as Active Directory
+		LDAP LDAPConfig `yaml:"ldap"`
+		// Senders binds users to the envelope senders they may use,
+		// addresses or *@domain; {user} stands for the user name. The "*"
+		// entry applies to users without one. Users without an entry may
+		// use any sender.
+		Senders map[string][]string `yaml:"senders"`
+		// XOAuth2 offers AUTH XOAUTH2: the client's Azure AD token for the
+		// relay's app is exchanged for a Graph token of the user, which
+		// sends the user's messages
+		XOAuth2 bool `yaml:"xoauth2"`
+	} `yaml:"auth"`
+	LogFile string `yaml:"log_file"`
+	Log     struct {
+		// Level is debug, info (default), warn or error
+		Level string `yaml:"level"`
+		// Format is text (default), key=value pairs, or json
+		Format string `yaml:"format"`
+		// log_file is rotated when it grows past MaxSizeMB or is older
+		// than RotateEvery; 0 turns either off
+		MaxSizeMB   int           `yaml:"max_size_mb"`
+		RotateEvery time.Duration `yaml:"rotate_every"`
+		// Rotated files beyond MaxBackups or older than MaxAge are removed
+		MaxBackups int           `yaml:"max_backups"`
+		MaxAge     time.Duration `yaml:"max_age"`
+	} `yaml:"log"`
+	// Audit writes a JSON line per DATA command to File, rotated with the
+	// log settings
+	Audit struct {
+		File string `yaml:"file"`
+	} `yaml:"audit"`
+	HTTP struct {
+		Address string `yaml:"address"`
+		// AdminToken enables the admin API; requests must send it as a
+		// bearer token
+		AdminToken string `yaml:"admin_token"`
+	} `yaml:"http"`
+	Debug struct {
+		// Address is a loopback host:port serving net/http/pprof and
+		// expvar; empty disables it
+		Address string `yaml:"address"`
+	} `yaml:"debug"`
+	Redis struct {
+		Address   string `yaml:"address"`
+		Username  string `yaml:"username"`
+		Password  string `yaml:"password"`
+		DB        int    `yaml:"db"`
+		KeyPrefix string `yaml:"key_prefix"`
+	} `yaml:"redis"`
+	RateLimit struct {
+		MessagesPerMinute int `yaml:"messages_per_minute"`
+		// Global limits the submissions of all clients together, PerClient
+		// those of each client IP and PerUser those of each
+		// authenticated user
+		Global    SubmissionLimit `yaml:"global"`
+		PerClient SubmissionLimit `yaml:"per_client"`
+		PerUser   SubmissionLimit `yaml:"per_user"`
+	} `yaml:"rate_limit"`
+	// Quotas cap the messages of each authenticated user, or else
+	// envelope sender; Overrides replace them for users, addresses or
+	// *@domain
+	Quotas struct {
+		QuotaConfig `yaml:",inline"`
+		Overrides   map[string]QuotaConfig `yaml:"overrides"`
+	} `yaml:"quotas"`
+	Recipients struct {
+		// Suppressed recipients are refused with 550, e.g. addresses that
+		// bounced permanently. Entries are addresses or *@domain.
+		Suppressed []string `yaml:"suppressed"`
+		// Moved maps old addresses to their new one; clients get 551 with
+		// the new address so they can resubmit there
+		Moved map[string]string `yaml:"moved"`
+		// Aliases expand an address at RCPT TO into the mailboxes, or
+		// other aliases, it stands for
+		Aliases map[string][]string `yaml:"aliases"`
+		// Rewrite replaces recipients at RCPT TO, before the aliases and
+		// the checks
+		Rewrite []RewriteRule `yaml:"rewrite"`
+		// AllowedDomains are the only recipient domains mail is relayed
+		// to, "*.example.com" including subdomains; empty allows all.
+		// DeniedDomains are refused in any case.
+		AllowedDomains []string `yaml:"allowed_domains"`
+		DeniedDomains  []string `yaml:"denied_domains"`
+		// VerifyDomains are the tenant's own domains whose recipients must
+		// exist as a user or group in the directory. Answers are cached
+		// for VerifyCacheTTL, 10m unless set.
+		VerifyDomains  []string      `yaml:"verify_domains"`
+		VerifyCacheTTL time.Duration `yaml:"verify_cache_ttl"`
+	} `yaml:"recipients"`
+	// Senders restricts the envelope senders of all domains, addresses or
+	// *@domain; the allowed_senders of a domain apply on top
+	Senders struct {
+		Allowed []string `yaml:"allowed"`
+		Denied  []string `yaml:"denied"`
+	} `yaml:"senders"`
+	Dedup struct {
+		Enabled bool          `yaml:"enabled"`
+		TTL     time.Duration `yaml:"ttl"`
+	} `yaml:"dedup"`
+	Content struct {
+		// SanitizeHTML strips scripts, forms and dangerous attributes from
+		// HTML bodies before they are sent
+		SanitizeHTML bool `yaml:"sanitize_html"`
+		// TextToHTML lists senders (addresses or *@domain) whose plain
+		// text bodies are converted to simple HTML
+		TextToHTML []string `yaml:"text_to_html"`
+		// TextAlternative adds a plain text version generated from the
+		// HTML to HTML-only mail
+		TextAlternative bool `yaml:"text_alternative"`
+		// KeepTextPart keeps the plain text part of mail that has both,
+		// which Graph's single body would drop
+		KeepTextPart bool `yaml:"keep_text_part"`
+		// UnpackTNEF replaces winmail.dat parts with the body and the
+		// attachments they contain
+		UnpackTNEF bool `yaml:"unpack_tnef"`
+		// MessageItems attaches forwarded messages (message/rfc822 parts)
+		// as Outlook items instead of .eml files
+		MessageItems bool `yaml:"message_items"`
+		// RejectEncrypted refuses encrypted S/MIME and PGP messages instead
+		// of passing them through
+		RejectEncrypted bool `yaml:"reject_encrypted"`
+		// BlockedAttachments refuses messages with an attachment of a
+		// listed extension (".exe") or content type; AllowedAttachments,
+		// when set, refuses those with any other attachment
+		BlockedAttachments []string `yaml:"blocked_attachments"`
+		AllowedAttachments []string `yaml:"allowed_attachments"`
+	} `yaml:"content"`
+	// Scan has messages scanned for viruses by clamd and an ICAP service
+	Scan struct {
+		// Clamd is host:port or unix:/path of clamd
+		Clamd string `yaml:"clamd"`
+		// ICAP is the URL of the service, icap://host[:port]/service
+		ICAP string `yaml:"icap"`
+		// Action is "reject" (default) or "quarantine" for infected
+		// messages
+		Action string `yaml:"action"`
+		// OnError is "tempfail" (default) to refuse messages that couldn't
+		// be scanned with 451, or "accept" to send them unscanned
+		OnError string        `yaml:"on_error"`
+		Timeout time.Duration `yaml:"timeout"`
+	} `yaml:"scan"`
+	Milter struct {
+		// Addresses are host:port or unix:/path of the milters a message
+		// passes through, in order
+		Addresses []string `yaml:"addresses"`
+		// OnError is "tempfail" (default) to refuse messages a milter
+		// couldn't check with 451, or "accept" to go on without it
+		OnError string        `yaml:"on_error"`
+		Timeout time.Duration `yaml:"timeout"`
+	} `yaml:"milter"`
+	Script struct {
+		// File is an expr expression whose result decides about every
+		// message: reject, defer or route it
+		File string `yaml:"file"`
+	} `yaml:"script"`
+	Templates struct {
+		// Directory holds the message templates clients can select with
+		// the X-GoGraph-Template header
+		Directory string `yaml:"directory"`
+	} `yaml:"templates"`
+	Pacing struct {
+		// MailboxMessagesPerMinute is the sending budget of a mailbox the
+		// status report compares against, 30 for Exchange Online
+		MailboxMessagesPerMinute int `yaml:"mailbox_messages_per_minute"`
+	} `yaml:"pacing"`
+	Metrics struct {
+		// SenderLabel is "mailbox" (default), "domain" or "none" and sets
+		// how senders are labeled in metrics
+		SenderLabel string `yaml:"sender_label"`
+		// MaxSenderLabels caps the distinct sender labels, 1000 unless set
+		MaxSenderLabels int `yaml:"max_sender_labels"`
+	} `yaml:"metrics"`
+	// Tracing exports OpenTelemetry spans of SMTP sessions and Graph
+	// requests to Endpoint, an OTLP/HTTP collector such as
+	// http://localhost:4318; it is off without one
+	Tracing struct {
+		Endpoint string            `yaml:"endpoint"`
+		Headers  map[string]string `yaml:"headers"`
+		// SampleRatio is the share of sessions traced, 1 unless set
+		SampleRatio float64 `yaml:"sample_ratio"`
+		ServiceName string  `yaml:"service_name"`
+	} `yaml:"tracing"`
+	History struct {
+		// MaxMessages and Retention bound the delivery history kept in
+		// memory for lookups, 10000 messages and 7 days unless set
+		MaxMessages int           `yaml:"max_messages"`
+		Retention   time.Duration `yaml:"retention"`
+	} `yaml:"history"`
+	SendWindows struct {
+		// Directory holds messages submitted outside their send window
+		// until it opens
+		Directory string             `yaml:"directory"`
+		Windows   []SendWindowConfig `yaml:"windows"`
+		// DefaultDelay holds every message that doesn't name its own send
+		// time for this long; MaxDelay bounds the times messages may ask
+		// for, 7 days unless set
+		DefaultDelay time.Duration `yaml:"default_delay"`
+		MaxDelay     time.Duration `yaml:"max_delay"`
+	} `yaml:"send_windows"`
+	// Workers deliver accepted messages in the background instead of
+	// during DATA; failed sends go to the retry spool, which is required
+	Workers struct {
+		Count int `yaml:"count"`
+		// QueueSize bounds the messages waiting for a worker; beyond it
+		// clients get 451. 100 unless set.
+		QueueSize int `yaml:"queue_size"`
+		// Weights shares the workers among the priorities high, normal
+		// and low while messages wait, 4, 2 and 1 unless set
+		Weights map[string]int `yaml:"weights"`
+	} `yaml:"workers"`
+	Spool struct {
+		// Directory holds messages whose send failed temporarily, e.g.
+		// while Graph is down or throttling, until a retry succeeds;
+		// without it the client gets the error
+		Directory string `yaml:"directory"`
+		// Expiry is how long a message is retried, 48 hours unless set
+		Expiry time.Duration `yaml:"expiry"`
+		// OnExpiry is "bounce" (default) to notify the sender or
+		// "quarantine" to keep the message in the quarantine
+		OnExpiry string `yaml:"on_expiry"`
+	} `yaml:"spool"`
+	Quarantine struct {
+		// Directory holds messages that matched a rule until they are
+		// released or deleted
+		Directory string           `yaml:"directory"`
+		Rules     []QuarantineRule `yaml:"rules"`
+	} `yaml:"quarantine"`
+	Capture struct {
+		// Directory receives accepted messages as .eml files with their
+		// Graph JSON instead of sending them, e.g. for staging
+		Directory string `yaml:"directory"`
+	} `yaml:"capture"`
+	Archive struct {
+		// Directory receives a copy of every sent message, in a directory
+		// per day, with its delivery details
+		Directory string `yaml:"directory"`
+		// Retention is how long copies are kept; 0 keeps them forever
+		Retention time.Duration `yaml:"retention"`
+	} `yaml:"archive"`
+	// ArchiveBcc receives a Bcc copy of every message of the domains
+	// without an archive of their own
+	ArchiveBcc string `yaml:"archive_bcc"`
+	Journal    struct {
+		// Address receives a copy of every relayed message
+		Address string `yaml:"address"`
+		// Mode is "bcc" (default) to add Address as a Bcc recipient, or
+		// "separate" to send it a journal report with the message attached
+		Mode string `yaml:"mode"`
+		// OnFailure is "continue" (default) to only log failed journal
+		// reports, or "block" to refuse messages that can't be journaled
+		OnFailure string `yaml:"on_failure"`
+		// Sender is the mailbox that sends journal reports; defaults to
+		// the message's sender
+		Sender string `yaml:"sender"`
+	} `yaml:"journal"`
+	DirectMX struct {
+		// RequireTLS only delivers over STARTTLS with a verified
+		// certificate; otherwise STARTTLS is used when offered
+		RequireTLS bool          `yaml:"require_tls"`
+		Timeout    time.Duration `yaml:"timeout"`
+	} `yaml:"direct_mx"`
+	Smarthost struct {
+		// Address is the host:port of an SMTP server that takes the mail
+		// Graph refused for good or couldn't take while the circuit
+		// breaker is open
+		Address  string `yaml:"address"`
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+		// TLS is "starttls" (default, required), "implicit" or "none"
+		TLS     string        `yaml:"tls"`
+		Timeout time.Duration `yaml:"timeout"`
+	} `yaml:"smarthost"`
+	DNSBL struct {
+		// Zones are the DNS blocklists queried for clients on listeners
+		// with dnsbl set, e.g. "zen.spamhaus.org"
+		Zones []string `yaml:"zones"`
+		// Action is "reject" (default, 554) or "greylist" (451 until the
+		// client retries after GreylistDelay)
+		Action        string        `yaml:"action"`
+		GreylistDelay time.Duration `yaml:"greylist_delay"`
+		// CacheTTL is how long an answer is reused, 10 minutes unless set
+		CacheTTL time.Duration `yaml:"cache_ttl"`
+	} `yaml:"dnsbl"`
+	ETRN struct {
+		// Clients are the IPs or CIDRs allowed to use ETRN, e.g. the
+		// upstream MTA; nobody else is offered the command
+		Clients []string `yaml:"clients"`
+	} `yaml:"etrn"`
+	VRFY struct {
+		// Clients are the IPs or CIDRs whose VRFY commands are answered
+		// from the Graph directory, e.g. an upstream MTA making callouts
+		Clients []string `yaml:"clients"`
+		// Domains are those whose addresses are looked up
+		Domains []string `yaml:"domains"`
+		// Rate is how many addresses a client may verify per minute, 10
+		// unless set; negative for no limit
+		Rate int `yaml:"rate"`
+	} `yaml:"vrfy"`
+	// Routes choose the transport of recipients by their domain, see
+	// TransportRoute. The first matching route wins; recipients of no
+	// route go through Graph.
+	Routes []TransportRoute `yaml:"routes"`
+	// Chaos injects Graph failures for testing, see ChaosConfig
+	Chaos ChaosConfig `yaml:"chaos"`
+	// Domains holds per-domain settings, e.g. for business units sharing
+	// the relay. The domain of the authenticated user, or else of the
+	// envelope sender, selects the section.
+	Domains map[string]DomainConfig `yaml:"domains"`
+	// Networks lists the client IPs and CIDRs allowed to connect; others
+	// are refused before the greeting. Empty allows every client.
+	Networks []string `yaml:"networks"`
+	// Clients overrides settings for single clients, e.g. a copier that
+	// sends large scans. The first section matching the client wins.
+	Clients []ClientConfig `yaml:"clients"`
+	// ControlHeaders grant identities the X-GoGraph-* control headers;
+	// without a matching rule a control header is refused
+	ControlHeaders []ControlHeaderRule `yaml:"control_headers"`
+	// CustomHeaders lists the X- headers, names or prefixes ending in *,
+	// that are passed to Graph as internet message headers
+	CustomHeaders []string `yaml:"custom_headers"`
+	// SenderMap maps envelope senders, addresses or *@domain, to the
+	// Graph mailbox that sends their mail, e.g. for applications that
+	// submit with local addresses. Addresses win over domains.
+	SenderMap map[string]SenderMapping `yaml:"sender_map"`
+	// Webhooks get delivery events pushed as JSON, see webhookEvents
+	Webhooks []WebhookConfig `yaml:"webhooks"`
+	// Bounces watches the Inbox of sending mailboxes for non-delivery
+	// reports of relayed messages, see watchBounces
+	Bounces struct {
+		Mailboxes []string `yaml:"mailboxes"`
+		// Webhook gets a POST with the message and its bounce
+		Webhook string `yaml:"webhook"`
+	} `yaml:"bounces"`
+	// Schedule overrides the schedules of the maintenance tasks by name,
+	// see defaultSchedules
+	Schedule map[string]string `yaml:"schedule"`
+	// Replies overrides the text of replies by name, see defaultReplies
+	Replies map[string]string `yaml:"replies"`
+}
+
+// AzureConfig is the app registration the relay sends through
+type AzureConfig struct {
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	TenantID     string `yaml:"tenant_id"`
+	// AuthMethod is "secret" (default), "certificate",
+	// "managed_identity", "workload_identity", "default" for
+	// DefaultAzureCredential or "delegated" to send as a signed-in user
+	AuthMethod string `yaml:"auth_method"`
+	// CertificateFile is a PEM or PFX file with the certificate and its
+	// private key, CertificatePassword decrypts it
+	CertificateFile     string `yaml:"certificate_file"`
+	CertificatePassword string `yaml:"certificate_password"`
+	// TokenFile is the federated token of workload_identity, by default
+	// from AZURE_FEDERATED_TOKEN_FILE
+	TokenFile string `yaml:"token_file"`
+	// TokenCache keeps the refresh token of the delegated user
+	TokenCache string `yaml:"token_cache"`
+	// Name labels the tenant in metrics and logs; defaults to TenantID
+	Name string `yaml:"name"`
+	// Cloud is the Microsoft cloud of the tenant: "global" (default),
+	// "usgov" for GCC High, "usgov_dod" for DoD or "china" for the cloud
+	// operated by 21Vianet. GraphEndpoint and AuthorityHost replace its
+	// Graph endpoint and Azure AD authority.
+	Cloud         string `yaml:"cloud"`
+	GraphEndpoint string `yaml:"graph_endpoint"`
+	AuthorityHost string `yaml:"authority_host"`
+	// MaxMessageBytes is the tenant's message size limit, 35 MiB unless
+	// set; larger messages are refused before they are sent
+	MaxMessageBytes int64 `yaml:"max_message_bytes"`
+}
+
+// TenantConfig routes the listed senders to another tenant, or to another
+// app registration of the same tenant under its own name
+type TenantConfig struct {
+	AzureConfig `yaml:",inline"`
+	// Domains are sender domains, *.domain includes subdomains
+	Domains []string `yaml:"domains"`
+	// Senders are addresses, for mailboxes outside the tenant's domains
+	Senders []string `yaml:"senders"`
+}
+
+// AuthUser is an SMTP AUTH account
+type AuthUser struct {
+	Username string `yaml:"username"`
+	// PasswordHash is a bcrypt hash, e.g. from htpasswd -nbB user password
+	PasswordHash string `yaml:"password_hash"`
+}
+
+// ListenerConfig describes one SMTP listener. Every listener is served by
+// the same backend but has its own timeouts and auth policy.
+type ListenerConfig struct {
+	Name string `yaml:"name"`
+	// Address is host:port, or unix:/path for a Unix socket
+	Address            string        `yaml:"address"`
+	Hostname           string        `yaml:"hostname"`
+	IdleTimeout        time.Duration `yaml:"idle_timeout"`
+	DataTimeout        time.Duration `yaml:"data_timeout"`
+	MaxSessionDuration time.Duration `yaml:"max_session_duration"`
+	// MaxMessageBytes and MaxRecipients replace the smtp section's limits
+	// on this listener
+	MaxMessageBytes int64 `yaml:"max_message_bytes"`
+	MaxRecipients   int   `yaml:"max_recipients"`
+
+	// RequireAuth rejects MAIL FROM until the client has authenticated,
+	// e.g. on the public submission port
+	RequireAuth bool `yaml:"require_auth"`
+	// PlaintextAuth controls AUTH on connections without TLS: "allow"
+	// (default), "hidden" to accept it without advertising it, or "deny"
+	PlaintextAuth string `yaml:"plaintext_auth"`
+	// EHLOAfterSTARTTLS is "require" (default) to refuse MAIL, RCPT and
+	// AUTH after STARTTLS until the client sends EHLO again, as RFC 3207
+	// says, or "optional" to keep the EHLO from before for legacy clients
+	EHLOAfterSTARTTLS string `yaml:"ehlo_after_starttls"`
+	// ProxyProtocol requires a PROXY protocol v1 or v2 header on every
+	// connection, from the smtp.trusted_proxies if any are listed
+	ProxyProtocol bool `yaml:"proxy_protocol"`
+	// SocketMode and SocketGroup set the permissions of a Unix socket
+	// address, 0660 and the relay's group by default
+	SocketMode  string `yaml:"socket_mode"`
+	SocketGroup string `yaml:"socket_group"`
+	// LMTP serves LMTP (RFC 2033) instead of SMTP, for use as the
+	// transport of an MTA, with a reply for every recipient
+	LMTP bool `yaml:"lmtp"`
+	// Networks limits the clients of this listener, on top of the
+	// top-level networks
+	Networks []string `yaml:"networks"`
+	// DNSBL checks unauthenticated clients against dnsbl.zones at MAIL
+	DNSBL bool `yaml:"dnsbl"`
+	// TLS is "starttls" (default with a certificate), "implicit" for TLS
+	// from the first byte (port 465) or "none"
+	TLS string `yaml:"tls"`
+	// ClientCerts asks TLS clients for a certificate: "off" (default),
+	// "optional" to verify one if given, or "require". A verified
+	// certificate authenticates the client like AUTH.
+	ClientCerts string `yaml:"client_certs"`
+	// ClientCAFile holds the PEM certificates of the CAs that issue client
+	// certificates
+	ClientCAFile string `yaml:"client_ca_file"`
+	// Footer is appended to the body of messages received on the listener
+	// whose sender domain has no footer
+	Footer FooterConfig `yaml:"footer"`
+}
+
+// ClientConfig overrides listener defaults for the clients it matches
+type ClientConfig struct {
+	// Match lists client IPs or CIDRs and EHLO names ("*.example.com"
+	// matches subdomains)
+	Match []string `yaml:"match"`
+	// MaxMessageBytes replaces the default message size limit
+	MaxMessageBytes int64         `yaml:"max_message_bytes"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout"`
+	DataTimeout     time.Duration `yaml:"data_timeout"`
+	// Sender replaces the envelope sender of every message, for devices
+	// that can't be configured with a valid mailbox
+	Sender string `yaml:"sender"`
+}
+
+// QuarantineRule holds back messages instead of sending them. Every
+// condition that is set must match; any entry of a list does.
+type QuarantineRule struct {
+	// Senders are envelope senders (addresses or *@domain)
+	Senders []string `yaml:"senders"`
+	// Keywords are looked for in the subject and body, ignoring case
+	Keywords []string `yaml:"keywords"`
+	// AttachmentTypes are file extensions (".exe") or content types
+	AttachmentTypes []string `yaml:"attachment_types"`
+}
+
+// ControlHeaderRule allows identities to use control headers
+type ControlHeaderRule struct {
+	// Identities are authenticated users or else envelope senders
+	// (addresses or *@domain)
+	Identities []string `yaml:"identities"`
+	// Allow names the headers: route, save_to_sent, importance, dry_run,
+	// callback_url, send_at and delay
+	Allow []string `yaml:"allow"`
+}
+
+// SendWindowConfig limits when mail from its senders is sent
+type SendWindowConfig struct {
+	// Senders are envelope senders (addresses or *@domain)
+	Senders []string `yaml:"senders"`
+	// Days are "mon" to "sun"; empty means every day
+	Days []string `yaml:"days"`
+	// Start and End are "HH:MM" in Timezone (IANA name, default local
+	// time). An End before Start makes the window run overnight.
+	Start    string `yaml:"start"`
+	End      string `yaml:"end"`
+	Timezone string `yaml:"timezone"`
+}
+
+// ChaosConfig makes a share of the Graph requests fail without reaching
+// Graph, to exercise retries and queues in staging. It only takes effect
+// when the GOGRAPHSMTP_CHAOS environment variable is 1 as well.
+type ChaosConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// ThrottleRate is the share (0 to 1) of requests answered with 429
+	ThrottleRate float64       `yaml:"throttle_rate"`
+	RetryAfter   time.Duration `yaml:"retry_after"`
+	// ServerErrorRate is the share of requests answered with a 5xx
+	ServerErrorRate float64 `yaml:"server_error_rate"`
+	// TimeoutRate is the share of requests that hang for Timeout
+	TimeoutRate float64       `yaml:"timeout_rate"`
+	Timeout     time.Duration `yaml:"timeout"`
+}
+
+// SubmissionLimit caps the messages (MAIL) and recipients (RCPT) submitted
+// per minute; 0 means no limit
+type SubmissionLimit struct {
+	MessagesPerMinute   int `yaml:"messages_per_minute"`
+	RecipientsPerMinute int `yaml:"recipients_per_minute"`
+}
+
+// QuotaConfig is a sender's quota per hour and per day, 0 for none
+type QuotaConfig struct {
+	MessagesPerHour int `yaml:"messages_per_hour"`
+	MessagesPerDay  int `yaml:"messages_per_day"`
+}
+
+// SenderMapping is a sender_map entry: the mailbox alone, or a mapping
+// with the mailbox and settings for the sender
+type SenderMapping struct {
+	// Mailbox sends the sender's mail; empty keeps the sender
+	Mailbox string `yaml:"mailbox"`
+	// SaveToSent overrides graph.save_to_sent for the sender
+	SaveToSent *bool `yaml:"save_to_sent"`
+}
+
+// UnmarshalYAML also takes the mailbox alone
+func (m *SenderMapping) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&m.Mailbox)
+	}
+	type plain SenderMapping
+	return value.Decode((*plain)(m))
+}
+
+// DomainConfig overrides settings for the senders of one domain
+type DomainConfig struct {
+	// AllowedSenders restricts the envelope senders (addresses or
+	// *@domain) accepted for the domain
+	AllowedSenders []string `yaml:"allowed_senders"`
+	// FallbackSender is the mailbox that sends mail submitted with an
+	// empty envelope sender, e.g. bounces from applications
+	FallbackSender string `yaml:"fallback_sender"`
+	// Archive receives a Bcc copy of every message sent for the domain
+	Archive   string `yaml:"archive"`
+	RateLimit struct {
+		MessagesPerMinute int `yaml:"messages_per_minute"`
+	} `yaml:"rate_limit"`
+	// DirectMX delivers by SMTP to the recipients' MX hosts when Graph
+	// fails. Mail then comes from the relay's address instead of
+	// Microsoft 365, which the domain's SPF and DKIM must allow for.
+	DirectMX bool `yaml:"direct_mx"`
+	// Footer is appended to the body of the domain's messages
+	Footer FooterConfig `yaml:"footer"`
+	// TLS is the certificate served to clients asking for the domain, or
+	// a host in it, by SNI; others get the one of smtp.tls
+	TLS struct {
+		CertFile string `yaml:"cert_file"`
+		KeyFile  string `yaml:"key_file"`
+	} `yaml:"tls"`
+}
+
+// domain returns the settings for the domain of addr, or the zero value
+// when the domain has no section
+func (c Config) domain(addr string) DomainConfig {
+	i := strings.LastIndex(addr, "@")
+	if i < 0 {
+		return DomainConfig{}
+	}
+	name := addr[i+1:]
+	for domain, dc := range c.Domains {
+		if strings.EqualFold(domain, name) {
+			return dc
+		}
+	}
+	return DomainConfig{}
+}
+
+// tenantName returns the name of the tenant in metrics and logs
+func (a AzureConfig) tenantName() string {
+	if a.Name != "" {
+		return a.Name
+	}
+	return a.TenantID
+}
+
+// hostname returns the name the relay advertises to clients
+func (c Config) hostname() string {
+	if c.SMTP.Hostname != "" {
+		return c.SMTP.Hostname
+	}
+	return c.SMTP.Domain
+}
+
+// listeners returns the configured listeners with defaults applied. A
+// config without a listeners section gets a single listener on smtp.address.
+func (c Config) listeners() []ListenerConfig {
+	listeners := c.SMTP.Listeners
+	if len(listeners) == 0 {
+		listeners = []ListenerConfig{{Address: c.SMTP.Address}}
+	}
+
+	result := make([]ListenerConfig, 0, len(listeners))
+	for i, lc := range listeners {
+		if lc.Name == "" {
+			lc.Name = fmt.Sprintf("smtp%d", i)
+		}
+		if lc.Hostname == "" {
+			lc.Hostname = c.hostname()
+		}
+		if lc.IdleTimeout <= 0 {
+			lc.IdleTimeout = c.SMTP.IdleTimeout
+		}
+		if lc.IdleTimeout <= 0 {
+			lc.IdleTimeout = defaultIdleTimeout
+		}
+		if lc.DataTimeout <= 0 {
+			lc.DataTimeout = c.SMTP.DataTimeout
+		}
+		if lc.DataTimeout <= 0 {
+			lc.DataTimeout = defaultDataTimeout
+		}
+		if lc.MaxMessageBytes <= 0 {
+			lc.MaxMessageBytes = c.SMTP.MaxMessageBytes
+		}
+		if lc.MaxMessageBytes <= 0 {
+			lc.MaxMessageBytes = defaultMaxMessageBytes
+		}
+		if lc.MaxRecipients <= 0 {
+			lc.MaxRecipients = c.SMTP.MaxRecipients
+		}
+		if lc.MaxRecipients <= 0 {
+			lc.MaxRecipients = defaultMaxRecipients
+		}
+		result = append(result, lc)
+	}
+	return result
+}
+
+// readConfigTree reads the config file with the environment overrides
+// applied and secrets resolved, and returns the plaintext of the file
+func readConfigTree(filename string) (yaml.Node, []byte, error) {
+	var root yaml.Node
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return root, nil, fmt.Errorf("error reading config file: %v", err)
+	}
+
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return root, nil, fmt.Errorf("error parsing config file: %v", err)
+	}
+	if isSOPSFile(&root) {
+		if data, err = decryptSOPS(filename); err != nil {
+			return root, nil, err
+		}
+		root = yaml.Node{}
+		if err := yaml.Unmarshal(data, &root); err != nil {
+			return root, nil, fmt.Errorf("error parsing decrypted config file: %v", err)
+		}
+	}
+
+	if err := applyOverrides(&root); err != nil {
+		return root, nil, err
+	}
+
+	// The first pass only finds secrets.age_key_file for decrypting
+	// values; the caller decodes the plaintext and resolved references
+	if root.Kind != 0 {
+		var config Config
+		if err := root.Decode(&config); err != nil {
+			return root, nil, fmt.Errorf("error parsing config file: %v", err)
+		}
+		if err := resolveSecrets(&root, config.Secrets.AgeKeyFile); err != nil {
+			return root, nil, err
+		}
+	}
+	return root, data, nil
+}
+
+func loadConfig(filename string) (Config, error) {
+	var config Config
+	root, _, err := readConfigTree(filename)
+	if err != nil {
+		return config, err
+	}
+	if root.Kind != 0 {
+		if err := root.Decode(&config); err != nil {
+			return config, fmt.Errorf("error parsing config file: %v", err)
+		}
+	}
+
+	for _, lc := range config.SMTP.Listeners {
+		switch lc.PlaintextAuth {
+		case "", "allow", "hidden", "deny":
+		default:
+			return config, fmt.Errorf("invalid plaintext_auth %q on listener %s", lc.PlaintextAuth, lc.Name)
+		}
+		switch lc.EHLOAfterSTARTTLS {
+		case "", "require", "optional":
+		default:
+			return config, fmt.Errorf("invalid ehlo_after_starttls %q on listener %s", lc.EHLOAfterSTARTTLS, lc.Name)
+		}
+		switch lc.ClientCerts {
+		case "", "off", "optional", "require":
+		default:
+			return config, fmt.Errorf("invalid client_certs %q on listener %s", lc.ClientCerts, lc.Name)
+		}
+		certAuth := lc.ClientCerts == "optional" || lc.ClientCerts == "require"
+		if certAuth && lc.ClientCAFile == "" {
+			return config, fmt.Errorf("listener %s has client_certs %s, but no client_ca_file", lc.Name, lc.ClientCerts)
+		}
+		if lc.RequireAuth && !certAuth && !config.Auth.XOAuth2 && len(config.Auth.Users) == 0 && config.Auth.HtpasswdFile == "" && config.Auth.LDAP.URL == "" {
+			return config, fmt.Errorf("listener %s requires auth, but auth has no users", lc.Name)
+		}
+		switch lc.TLS {
+		case "", "none", "starttls", "implicit":
+		default:
+			return config, fmt.Errorf("invalid tls %q on listener %s", lc.TLS, lc.Name)
+		}
+		if certAuth && lc.TLS == "none" {
+			return config, fmt.Errorf("listener %s has client_certs %s, but no tls", lc.Name, lc.ClientCerts)
+		}
+		if _, err := lc.socketMode(); err != nil {
+			return config, err
+		}
+		if _, err := parseCIDRs(lc.Networks); err != nil {
+			return config, fmt.Errorf("invalid networks on listener %s: %v", lc.Name, err)
+		}
+	}
+	switch config.SMTP.LineEndings {
+	case "", "normalize", "reject":
+	default:
+		return config, fmt.Errorf("invalid smtp.line_endings %q", config.SMTP.LineEndings)
+	}
+	switch config.Journal.Mode {
+	case "", "bcc", "separate":
+	default:
+		return config, fmt.Errorf("invalid journal.mode %q", config.Journal.Mode)
+	}
+	switch config.Journal.OnFailure {
+	case "", "continue", "block":
+	default:
+		return config, fmt.Errorf("invalid journal.on_failure %q", config.Journal.OnFailure)
+	}
+	scheduled := config.SendWindows.DefaultDelay > 0
+	for _, rule := range config.ControlHeaders {
+		for _, name := range rule.Allow {
+			if !validControlHeader(name) {
+				return config, fmt.Errorf("invalid control header %q in control_headers", name)
+			}
+			scheduled = scheduled || name == "send_at" || name == "delay"
+		}
+	}
+	if config.SendWindows.DefaultDelay < 0 || config.SendWindows.MaxDelay < 0 {
+		return config, fmt.Errorf("send_windows.default_delay and max_delay can't be negative")
+	}
+	if scheduled && config.SendWindows.Directory == "" {
+		return config, fmt.Errorf("scheduled delivery needs a send_windows.directory")
+	}
+	for name, spec := range config.Schedule {
+		if _, ok := defaultSchedules[name]; !ok {
+			return config, fmt.Errorf("unknown task %q in schedule", name)
+		}
+		if _, err := parseSchedule(spec); err != nil {
+			return config, fmt.Errorf("invalid schedule %q for %s: %v", spec, name, err)
+		}
+	}
+	switch config.Smarthost.TLS {
+	case "", "starttls", "implicit", "none":
+	default:
+		return config, fmt.Errorf("invalid smarthost.tls %q", config.Smarthost.TLS)
+	}
+	if config.Smarthost.Address != "" {
+		if _, _, err := net.SplitHostPort(config.Smarthost.Address); err != nil {
+			return config, fmt.Errorf("invalid smarthost.address: %v", err)
+		}
+	}
+	if err := validateRoutes(config); err != nil {
+		return config, err
+	}
+	if config.Debug.Address != "" {
+		if err := checkDebugAddress(config.Debug.Address); err != nil {
+			return config, err
+		}
+	}
+	for _, w := range config.Webhooks {
+		if err := w.validate(); err != nil {
+			return config, err
+		}
+	}
+	if webhook := config.Bounces.Webhook; webhook != "" {
+		if u, err := url.Parse(webhook); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return config, fmt.Errorf("invalid bounces.webhook %q, must be an http(s) URL", webhook)
+		}
+	}
+	if cb := config.Graph.CircuitBreaker; cb.Failures < 0 || cb.OpenDuration < 0 {
+		return config, fmt.Errorf("graph.circuit_breaker settings can't be negative")
+	}
+	if r := config.Graph.Retry; r.Attempts < 0 || r.InitialInterval < 0 || r.MaxInterval < 0 {
+		return config, fmt.Errorf("graph.retry settings can't be negative")
+	}
+	if config.Graph.Timeout < 0 || config.Graph.UploadTimeout < 0 {
+		return config, fmt.Errorf("graph.timeout and graph.upload_timeout can't be negative")
+	}
+	switch config.Graph.SendMode {
+	case "", "sendmail", "draft", "mime":
+	default:
+		return config, fmt.Errorf("invalid graph.send_mode %q", config.Graph.SendMode)
+	}
+	if strings.ContainsAny(config.Graph.CategoriesHeader, ": \t") {
+		return config, fmt.Errorf("invalid graph.categories_header %q", config.Graph.CategoriesHeader)
+	}
+	for _, name := range config.CustomHeaders {
+		if len(name) < 3 || !strings.EqualFold(name[:2], "x-") || strings.HasPrefix(strings.ToLower(name), controlHeaderPrefix) {
+			return config, fmt.Errorf("invalid custom_headers entry %q, Graph only takes X- headers", name)
+		}
+	}
+	for pattern, m := range config.SenderMap {
+		if !strings.Contains(pattern, "@") && pattern != "*" || m.Mailbox != "" && !strings.Contains(m.Mailbox, "@") {
+			return config, fmt.Errorf("invalid sender_map entry %q: %q", pattern, m.Mailbox)
+		}
+	}
+	if config.Workers.Count > 0 && config.Spool.Directory == "" {
+		return config, fmt.Errorf("workers need a spool.directory for messages that fail")
+	}
+	for priority, w := range config.Workers.Weights {
+		if !slices.Contains(priorities, priority) || w < 1 {
+			return config, fmt.Errorf("invalid workers.weights entry %s: %d, must be high, normal or low with a weight of 1 or more", priority, w)
+		}
+	}
+	switch config.Spool.OnExpiry {
+	case "", "bounce":
+	case "quarantine":
+		if config.Quarantine.Directory == "" {
+			return config, fmt.Errorf("spool.on_expiry: quarantine needs a quarantine.directory")
+		}
+	default:
+		return config, fmt.Errorf("invalid spool.on_expiry %q", config.Spool.OnExpiry)
+	}
+	switch config.DNSBL.Action {
+	case "", "reject", "greylist":
+	default:
+		return config, fmt.Errorf("invalid dnsbl.action %q", config.DNSBL.Action)
+	}
+	if err := config.Azure.validate(); err != nil {
+		return config, fmt.Errorf("azure: %v", err)
+	}
+	seen := map[string]bool{config.Azure.tenantName(): true}
+	for _, t := range config.Tenants {
+		if t.tenantName() == "" {
+			return config, fmt.Errorf("tenants entry without a name or tenant_id")
+		}
+		if err := t.validate(); err != nil {
+			return config, fmt.Errorf("tenant %s: %v", t.tenantName(), err)
+		}
+		if seen[t.tenantName()] {
+			return config, fmt.Errorf("tenant %s is configured twice, set a name", t.tenantName())
+		}
+		seen[t.tenantName()] = true
+		if len(t.Domains) == 0 && len(t.Senders) == 0 {
+			return config, fmt.Errorf("tenant %s has no domains or senders", t.tenantName())
+		}
+	}
+	switch config.Log.Level {
+	case "", "debug", "info", "warn", "error":
+	default:
+		return config, fmt.Errorf("invalid log.level %q", config.Log.Level)
+	}
+	switch config.Log.Format {
+	case "", "text", "json":
+	default:
+		return config, fmt.Errorf("invalid log.format %q", config.Log.Format)
+	}
+	if config.Log.MaxSizeMB < 0 || config.Log.RotateEvery < 0 || config.Log.MaxBackups < 0 || config.Log.MaxAge < 0 {
+		return config, fmt.Errorf("log rotation settings can't be negative")
+	}
+	if config.SMTP.MaxRecipients < 0 || config.SMTP.WriteTimeout < 0 {
+		return config, fmt.Errorf("smtp.max_recipients and smtp.write_timeout can't be negative")
+	}
+	if config.SMTP.IdleTimeout < 0 || config.SMTP.DataTimeout < 0 {
+		return config, fmt.Errorf("smtp.idle_timeout and smtp.data_timeout can't be negative")
+	}
+	if config.SMTP.DataSpoolBytes < 0 || config.SMTP.MaxMemoryBytes < 0 {
+		return config, fmt.Errorf("smtp.data_spool_bytes and smtp.max_memory_bytes can't be negative")
+	}
+	limits := []int64{config.SMTP.MaxMessageBytes}
+	for _, lc := range config.SMTP.Listeners {
+		limits = append(limits, lc.MaxMessageBytes)
+	}
+	for _, cc := range config.Clients {
+		limits = append(limits, cc.MaxMessageBytes)
+	}
+	limits = append(limits, config.Azure.MaxMessageBytes)
+	for _, tc := range config.Tenants {
+		limits = append(limits, tc.MaxMessageBytes)
+	}
+	for _, n := range limits {
+		if n < 0 || n > graphMaxMessageBytes {
+			return config, fmt.Errorf("max_message_bytes %d is outside 0 to %d, the most Exchange Online accepts", n, graphMaxMessageBytes)
+		}
+	}
+	if config.SMTP.MaxConnections < 0 || config.SMTP.MaxConnectionsPerIP < 0 {
+		return config, fmt.Errorf("smtp.max_connections and smtp.max_connections_per_ip can't be negative")
+	}
+	switch config.Scan.Action {
+	case "", "reject":
+	case "quarantine":
+		if config.Quarantine.Directory == "" {
+			return config, fmt.Errorf("scan.action: quarantine needs a quarantine.directory")
+		}
+	default:
+		return config, fmt.Errorf("invalid scan.action %q", config.Scan.Action)
+	}
+	switch config.Scan.OnError {
+	case "", "tempfail", "accept":
+	default:
+		return config, fmt.Errorf("invalid scan.on_error %q", config.Scan.OnError)
+	}
+	switch config.Milter.OnError {
+	case "", "tempfail", "accept":
+	default:
+		return config, fmt.Errorf("invalid milter.on_error %q", config.Milter.OnError)
+	}
+	if len(config.VRFY.Clients) > 0 && len(config.VRFY.Domains) == 0 {
+		return config, fmt.Errorf("vrfy.clients needs vrfy.domains to look addresses up in")
+	}
+	if err := checkAliases(config.Recipients.Aliases); err != nil {
+		return config, err
+	}
+	if config.Graph.SplitRecipients < 0 {
+		return config, fmt.Errorf("graph.split_recipients can't be negative")
+	}
+	if config.SMTP.ShutdownTimeout < 0 {
+		return config, fmt.Errorf("smtp.shutdown_timeout can't be negative")
+	}
+	if config.Auth.LDAP.URL != "" {
+		if err := config.Auth.LDAP.validate(); err != nil {
+			return config, err
+		}
+	}
+	if config.Archive.Retention < 0 {
+		return config, fmt.Errorf("archive.retention can't be negative")
+	}
+	if config.Tracing.SampleRatio < 0 || config.Tracing.SampleRatio > 1 {
+		return config, fmt.Errorf("tracing.sample_ratio must be between 0 and 1")
+	}
+	switch config.Metrics.SenderLabel {
+	case "", "mailbox", "domain", "none":
+	default:
+		return config, fmt.Errorf("invalid metrics.sender_label %q", config.Metrics.SenderLabel)
+	}
+
+	return config, nil
+}
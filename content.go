@@ -0,0 +1,289 @@
+// content.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/microcosm-cc/bluemonday"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// htmlPolicy sanitizes HTML bodies from semi-trusted sources. It keeps the
+// markup mail clients render, including inline styles and legacy table
+// attributes, but drops scripts, forms, event handler attributes and
+// javascript: links.
+var htmlPolicy = newHTMLPolicy()
+
+func newHTMLPolicy() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+
+	// Mail is sent as whole documents, not fragments
+	p.AllowElements("html", "head", "body", "title", "center")
+
+	p.AllowStyling()
+	p.AllowAttrs("style").Globally()
+	p.AllowAttrs("color", "face", "size").OnElements("font")
+	p.AllowAttrs("bgcolor", "background").OnElements("body", "table", "tr", "td", "th")
+	p.AllowAttrs("border", "cellpadding", "cellspacing").OnElements("table")
+	p.AllowAttrs("align", "valign", "width", "height").OnElements("table", "tr", "td", "th", "img", "div", "p")
+
+	// Inline images reference their MIME part by Content-ID
+	p.AllowURLSchemes("mailto", "http", "https", "cid")
+	return p
+}
+
+// sanitizeHTML strips active and form content from an HTML body
+func sanitizeHTML(body string) string {
+	return htmlPolicy.Sanitize(body)
+}
+
+// sanitizeMIMEHTML sanitizes the HTML bodies of a message that is posted
+// as MIME, re-encoded as UTF-8 quoted-printable. Every other part, e.g. the
+// text/calendar part of an invitation, and the header are kept byte for
+// byte.
+func sanitizeMIMEHTML(data []byte) ([]byte, error) {
+	br := bufio.NewReader(bytes.NewReader(data))
+	h, err := textproto.ReadHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(br)
+	if err != nil {
+		return nil, err
+	}
+	body, err = sanitizeEntity(&h, body)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := textproto.WriteHeader(&buf, h); err != nil {
+		return nil, err
+	}
+	buf.Write(body)
+	return buf.Bytes(), nil
+}
+
+// sanitizeEntity returns the body of a MIME entity with its HTML bodies
+// sanitized, updating h when the entity itself is one. Multiparts keep
+// their boundary; their preamble and epilogue are dropped.
+func sanitizeEntity(h *textproto.Header, body []byte) ([]byte, error) {
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return body, nil
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "":
+		var buf bytes.Buffer
+		mw := textproto.NewMultipartWriter(&buf)
+		if err := mw.SetBoundary(params["boundary"]); err != nil {
+			return nil, err
+		}
+		mr := textproto.NewMultipartReader(bytes.NewReader(body), params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			pb, err := io.ReadAll(p)
+			if err != nil {
+				return nil, err
+			}
+			if pb, err = sanitizeEntity(&p.Header, pb); err != nil {
+				return nil, err
+			}
+			pw, err := mw.CreatePart(p.Header)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := pw.Write(pb); err != nil {
+				return nil, err
+			}
+		}
+		if err := mw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case mediaType == "text/html":
+		// HTML files attached by name are left alone
+		disposition, dparams, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+		if disposition == "attachment" || dparams["filename"] != "" || params["name"] != "" {
+			return body, nil
+		}
+		clean := sanitizeHTML(decodeBody(h.Get("Content-Type"), h.Get("Content-Transfer-Encoding"), string(body)))
+		var buf bytes.Buffer
+		qp := quotedprintable.NewWriter(&buf)
+		if _, err := io.WriteString(qp, clean); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+		h.Set("Content-Type", mime.FormatMediaType("text/html", map[string]string{"charset": "utf-8"}))
+		h.Set("Content-Transfer-Encoding", "quoted-printable")
+		return buf.Bytes(), nil
+	}
+	return body, nil
+}
+
+// urlPattern finds links in plain text bodies
+var urlPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"]+[^\s<>".,;:!?)\]'}]`)
+
+// textToHTML renders a plain text body as a simple HTML document: a
+// monospace block that keeps the line breaks, with URLs made clickable
+func textToHTML(body string) string {
+	var b strings.Builder
+	b.WriteString(`<html><body><pre style="font-family: monospace; white-space: pre-wrap;">`)
+
+	last := 0
+	for _, m := range urlPattern.FindAllStringIndex(body, -1) {
+		b.WriteString(html.EscapeString(body[last:m[0]]))
+		link := body[m[0]:m[1]]
+		href := link
+		if strings.HasPrefix(strings.ToLower(href), "www.") {
+			href = "http://" + href
+		}
+		fmt.Fprintf(&b, `<a href="%s">%s</a>`, html.EscapeString(href), html.EscapeString(link))
+		last = m[1]
+	}
+	b.WriteString(html.EscapeString(body[last:]))
+
+	b.WriteString("</pre></body></html>")
+	return b.String()
+}
+
+// htmlBlockElements start a new line in the text rendering of HTML
+var htmlBlockElements = map[atom.Atom]bool{
+	atom.P: true, atom.Div: true, atom.Br: true, atom.Tr: true, atom.Li: true,
+	atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Table: true, atom.Ul: true, atom.Ol: true, atom.Blockquote: true, atom.Pre: true,
+	atom.Hr: true, atom.Section: true, atom.Article: true, atom.Header: true, atom.Footer: true,
+}
+
+// htmlParagraphElements are followed by a blank line
+var htmlParagraphElements = map[atom.Atom]bool{
+	atom.P: true, atom.Table: true, atom.Ul: true, atom.Ol: true,
+	atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+}
+
+// htmlToText renders an HTML body as readable plain text: block elements
+// become line breaks, list items get a bullet and links keep their target
+func htmlToText(body string) string {
+	var b strings.Builder
+	skip := 0      // inside script, style or head
+	pre := 0       // inside pre, where whitespace is kept
+	space := false // whitespace seen since the last text
+	var hrefs []string
+
+	// breaks ends the current line and makes sure there are n line breaks
+	breaks := func(n int) {
+		s := b.String()
+		if s == "" {
+			return
+		}
+		have := len(s) - len(strings.TrimRight(s, "\n"))
+		for ; have < n; have++ {
+			b.WriteString("\n")
+		}
+	}
+
+	z := html.NewTokenizer(strings.NewReader(body))
+	for {
+		tt := z.Next()
+		name, hasAttr := z.TagName()
+		a := atom.Lookup(name)
+
+		switch tt {
+		case html.ErrorToken:
+			return strings.TrimSpace(b.String()) + "\n"
+
+		case html.TextToken:
+			if skip > 0 {
+				continue
+			}
+			text := string(z.Text())
+			if pre == 0 {
+				// Collapse whitespace like a browser, keeping one space
+				// where the source had any
+				collapsed := strings.Join(strings.Fields(text), " ")
+				if collapsed == "" {
+					space = space || text != ""
+					continue
+				}
+				space = space || collapsed[0] != text[0]
+				if s := b.String(); space && s != "" && !strings.HasSuffix(s, "\n") {
+					b.WriteString(" ")
+				}
+				space = collapsed[len(collapsed)-1] != text[len(text)-1]
+				text = collapsed
+			}
+			b.WriteString(text)
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			switch a {
+			case atom.Script, atom.Style, atom.Head:
+				if tt == html.StartTagToken {
+					skip++
+				}
+				continue
+			case atom.Pre:
+				pre++
+			case atom.A:
+				href := ""
+				for hasAttr {
+					var key, val []byte
+					key, val, hasAttr = z.TagAttr()
+					if string(key) == "href" {
+						href = string(val)
+					}
+				}
+				if tt == html.StartTagToken {
+					hrefs = append(hrefs, href)
+				}
+			}
+			if htmlBlockElements[a] {
+				breaks(1)
+			}
+			if a == atom.Li {
+				b.WriteString("* ")
+			}
+
+		case html.EndTagToken:
+			switch a {
+			case atom.Script, atom.Style, atom.Head:
+				if skip > 0 {
+					skip--
+				}
+				continue
+			case atom.Pre:
+				if pre > 0 {
+					pre--
+				}
+			case atom.A:
+				if n := len(hrefs); n > 0 {
+					href := hrefs[n-1]
+					hrefs = hrefs[:n-1]
+					if strings.HasPrefix(href, "http://") || strings.HasPrefix(href, "https://") {
+						b.WriteString(" <" + href + ">")
+					}
+				}
+			}
+			if htmlParagraphElements[a] {
+				breaks(2)
+			} else if htmlBlockElements[a] {
+				breaks(1)
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// content_test.go
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// invitation is an Outlook meeting request with an unsafe HTML body
+const invitation = "From: app@example.com\r\n" +
+	"To: ops@example.com\r\n" +
+	"Subject: Maintenance\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/alternative; boundary=alt\r\n" +
+	"\r\n" +
+	"--alt\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"Maintenance window\r\n" +
+	"--alt\r\n" +
+	"Content-Type: text/html; charset=iso-8859-1\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"<p onclick=3D\"steal()\">Wartung f=FCr db1<script>alert(1)</script></p>\r\n" +
+	"--alt\r\n" +
+	calendarPart +
+	"--alt--\r\n"
+
+const calendarPart = "Content-Type: text/calendar; method=REQUEST; charset=utf-8\r\n" +
+	"\r\n" +
+	"BEGIN:VCALENDAR\r\n" +
+	"METHOD:REQUEST\r\n" +
+	"DESCRIPTION:<script>kept as written</script>\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestSanitizeMIMEHTML(t *testing.T) {
+	raw, err := sanitizeMIMEHTML([]byte(invitation))
+	if err != nil {
+		t.Fatalf("sanitizeMIMEHTML: %v", err)
+	}
+	message := string(raw)
+	if !strings.HasPrefix(message, "From: app@example.com\r\nTo: ops@example.com\r\nSubject: Maintenance\r\n") {
+		t.Errorf("header changed:\n%s", message)
+	}
+	if !strings.Contains(message, "\r\n"+calendarPart) || !strings.Contains(message, "Maintenance window\r\n") {
+		t.Errorf("calendar or text part changed:\n%s", message)
+	}
+	c, err := parseMIME(raw, mimeOptions{})
+	if err != nil {
+		t.Fatalf("parseMIME: %v", err)
+	}
+	if want := "<p>Wartung für db1</p>"; strings.TrimSpace(c.html) != want {
+		t.Errorf("html = %q, want %q", c.html, want)
+	}
+}
+
+func TestSanitizeHTMLSentAsMIME(t *testing.T) {
+	tests := []struct {
+		name     string
+		sendMode string
+		message  string
+	}{
+		{
+			name:     "graph.send_mode mime",
+			sendMode: "mime",
+			message: "From: app@example.com\r\n" +
+				"To: ops@example.com\r\n" +
+				"Subject: Report\r\n" +
+				"MIME-Version: 1.0\r\n" +
+				"Content-Type: text/html; charset=utf-8\r\n" +
+				"\r\n" +
+				"<p>Report<script>alert(1)</script><a href=\"javascript:steal()\">open</a></p>\r\n",
+		},
+		{name: "calendar invitation", message: invitation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var config Config
+			config.Graph.SendMode = tt.sendMode
+			config.Content.SanitizeHTML = true
+			bkd := newTestBackend(t, config)
+			graph := &fakeGraph{status: http.StatusAccepted}
+			bkd.tenants = []*graphTenant{newFakeTenant(t, graph)}
+			bkd.history = newDeliveryHistory(config)
+			bkd.labels = newMetricLabels(config)
+
+			listener := ListenerConfig{MaxMessageBytes: 1 << 20}
+			if err := relayMessage(t, bkd, listener, "app@example.com", []string{"ops@example.com"}, tt.message); err != nil {
+				t.Fatalf("submission: %v", err)
+			}
+			sent := string(sentMIME(t, graph))
+			for _, unwanted := range []string{"<script>alert", "javascript:", "onclick"} {
+				if strings.Contains(sent, unwanted) {
+					t.Errorf("sent message contains %q:\n%s", unwanted, sent)
+				}
+			}
+			if tt.message == invitation && !strings.Contains(sent, calendarPart) {
+				t.Errorf("calendar part changed:\n%s", sent)
+			}
+		})
+	}
+}
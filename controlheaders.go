@@ -0,0 +1,215 @@
+// controlheaders.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// controlHeaders are the headers that change how the relay handles a
+// message, with the name control_headers rules allow them by
+var controlHeaders = []struct{ name, header string }{
+	{"route", "X-GoGraph-Route"},
+	{"save_to_sent", "X-GoGraph-Save-To-Sent"},
+	{"importance", "X-GoGraph-Importance"},
+	{"dry_run", "X-GoGraph-Dry-Run"},
+	{"callback_url", "X-GoGraph-Callback-URL"},
+	{"send_at", "X-GoGraph-Send-At"},
+	{"delay", "X-GoGraph-Delay"},
+}
+
+// controlHeaderPrefix marks the headers that never leave the relay
+const controlHeaderPrefix = "x-gograph-"
+
+// callbackTimeout bounds one callback request
+const callbackTimeout = 10 * time.Second
+
+// messageControl is what the control headers of a message asked for
+type messageControl struct {
+	route      string // graph or direct_mx, empty for the default
+	saveToSent *bool
+	importance string // low, normal or high
+	dryRun     bool
+	callback   string
+	sendAt     time.Time // when a scheduled message is sent, zero for now
+}
+
+// parseControl reads the control headers of a message. Headers the
+// identity isn't allowed to use are refused with 550 5.7.1, invalid values
+// with 554 5.6.0.
+func (bkd *Backend) parseControl(identity string, headers map[string]string) (messageControl, error) {
+	var mc messageControl
+	for _, ch := range controlHeaders {
+		name, header := ch.name, ch.header
+		value := strings.TrimSpace(headerValue(headers, header))
+		if value == "" {
+			continue
+		}
+		if !bkd.controlAllowed(identity, name) {
+			return mc, bkd.replies.error(550, smtp.EnhancedCode{5, 7, 1}, "control_header_denied", "header", header, "identity", identity)
+		}
+
+		valid := true
+		switch name {
+		case "route":
+			mc.route = strings.ToLower(value)
+			valid = mc.route == "graph" || mc.route == "direct_mx"
+		case "save_to_sent":
+			var save bool
+			save, valid = parseYesNo(value)
+			mc.saveToSent = &save
+		case "importance":
+			mc.importance = strings.ToLower(value)
+			valid = mc.importance == "low" || mc.importance == "normal" || mc.importance == "high"
+		case "dry_run":
+			mc.dryRun, valid = parseYesNo(value)
+		case "callback_url":
+			u, err := url.Parse(value)
+			valid = err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+			mc.callback = value
+		case "send_at":
+			mc.sendAt, valid = parseSendAt(value)
+			valid = valid && bkd.scheduleAllowed(mc.sendAt)
+		case "delay":
+			d, err := time.ParseDuration(value)
+			mc.sendAt = time.Now().Add(d)
+			valid = err == nil && d >= 0 && bkd.scheduleAllowed(mc.sendAt)
+		}
+		if !valid {
+			return mc, bkd.replies.error(554, smtp.EnhancedCode{5, 6, 0}, "control_header_invalid", "header", header, "value", value)
+		}
+	}
+	return mc, nil
+}
+
+// controlAllowed reports whether a control_headers rule for the identity
+// allows the header
+func (bkd *Backend) controlAllowed(identity, name string) bool {
+	for _, rule := range bkd.policy().config.ControlHeaders {
+		matched := false
+		for _, pattern := range rule.Identities {
+			if matchAddress(pattern, identity) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		for _, allowed := range rule.Allow {
+			if allowed == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validControlHeader reports whether name is a control header name
+func validControlHeader(name string) bool {
+	for _, ch := range controlHeaders {
+		if ch.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func parseYesNo(value string) (bool, bool) {
+	switch strings.ToLower(value) {
+	case "yes", "true", "1", "on":
+		return true, true
+	case "no", "false", "0", "off":
+		return false, true
+	}
+	return false, false
+}
+
+// applyControl strips every X-GoGraph-* header from the message, which
+// carries the requested importance as a standard Importance header
+// instead
+func applyControl(data []byte, mc messageControl) []byte {
+	data = withoutHeaders(data, func(name string) bool {
+		name = strings.ToLower(name)
+		return strings.HasPrefix(name, controlHeaderPrefix) || mc.importance != "" && name == "importance"
+	})
+	if mc.importance != "" {
+		data = append([]byte("Importance: "+mc.importance+"\r\n"), data...)
+	}
+	return data
+}
+
+// callbackNotice is posted to the callback URL of a message
+type callbackNotice struct {
+	QueueID   string    `json:"queue_id"`
+	MessageID string    `json:"message_id,omitempty"`
+	From      string    `json:"from,omitempty"`
+	To        []string  `json:"to,omitempty"`
+	Status    string    `json:"status"`
+	Detail    string    `json:"detail,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// notifyCallback posts the outcome of a message to its callback URL and
+// the webhooks subscribed to it in the background. Failed callbacks are
+// logged, not retried.
+func (bkd *Backend) notifyCallback(callback, queueID, status, detail string) {
+	bkd.notifyWebhooks(queueID, status, detail)
+	if callback == "" {
+		return
+	}
+	notice := bkd.deliveryNotice(queueID, status, detail)
+
+	go func() {
+		body, err := json.Marshal(notice)
+		if err == nil {
+			err = postCallback(callback, nil, body)
+		}
+		if err != nil {
+			bkd.logger.Warn("delivery callback failed", "queueid", queueID, "callback", callback, "errormsg", err)
+		}
+	}()
+}
+
+// deliveryNotice describes an event of a message, with its envelope and
+// Message-ID from the history
+func (bkd *Backend) deliveryNotice(queueID, status, detail string) callbackNotice {
+	notice := callbackNotice{QueueID: queueID, Status: status, Detail: detail, Time: time.Now().UTC()}
+	if records := bkd.history.lookup(queueID); len(records) > 0 {
+		notice.MessageID = records[0].MessageID
+		notice.From = records[0].From
+		notice.To = records[0].To
+	}
+	return notice
+}
+
+func postCallback(callback string, headers map[string]string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), callbackTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callback, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("callback answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+// dataspool.go
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// defaultDataSpoolBytes is the size from which DATA is written to disk as
+// it arrives unless smtp.data_spool_bytes is set
+const defaultDataSpoolBytes = 1 << 20
+
+// dataSpool holds the DATA of a message while it's received: the first
+// bytes in memory and, once the message grows past the threshold, all of
+// it in a temp file. A slow client sending a large message then holds
+// disk rather than memory until it's done.
+type dataSpool struct {
+	head []byte
+	file *os.File
+	size int64
+}
+
+// dataSpoolBytes returns smtp.data_spool_bytes or its default
+func (c Config) dataSpoolBytes() int64 {
+	if c.SMTP.DataSpoolBytes > 0 {
+		return c.SMTP.DataSpoolBytes
+	}
+	return defaultDataSpoolBytes
+}
+
+// spoolData reads r into a dataSpool, keeping up to threshold bytes in
+// memory. The spool is returned with the error of r, so that its size is
+// known; it must be closed either way.
+func spoolData(r io.Reader, threshold int64, dir string) (*dataSpool, error) {
+	head, err := io.ReadAll(io.LimitReader(r, threshold+1))
+	d := &dataSpool{head: head, size: int64(len(head))}
+	if err != nil || d.size <= threshold {
+		return d, err
+	}
+
+	if d.file, err = os.CreateTemp(dir, "gographsmtp-data-*"); err != nil {
+		return d, err
+	}
+	d.head = nil
+	if _, err := d.file.Write(head); err != nil {
+		return d, err
+	}
+	n, err := io.Copy(d.file, r)
+	d.size += n
+	return d, err
+}
+
+// bytes returns the message, read back from the temp file when it was
+// spooled
+func (d *dataSpool) bytes() ([]byte, error) {
+	if d.file == nil {
+		return d.head, nil
+	}
+	data := make([]byte, d.size)
+	if _, err := d.file.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data, nil
+}
+
+// close removes the temp file
+func (d *dataSpool) close() {
+	if d == nil || d.file == nil {
+		return
+	}
+	d.file.Close()
+	os.Remove(d.file.Name())
+}
+
+// memoryBudget bounds the total size of the messages processed at once.
+// A message larger than the whole budget waits until it has it to
+// itself.
+type memoryBudget struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	limit int64
+	used  int64
+}
+
+// newMemoryBudget returns nil, no limit, unless smtp.max_memory_bytes is
+// set
+func newMemoryBudget(config Config) *memoryBudget {
+	if config.SMTP.MaxMemoryBytes <= 0 {
+		return nil
+	}
+	m := &memoryBudget{limit: config.SMTP.MaxMemoryBytes}
+	m.cond = sync.NewCond(&m.mu)
+	return m
+}
+
+// acquire waits until n bytes of the budget are free and takes them. It
+// returns the amount to release.
+func (m *memoryBudget) acquire(n int64) int64 {
+	if m == nil {
+		return 0
+	}
+	n = min(n, m.limit)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for m.used+n > m.limit {
+		m.cond.Wait()
+	}
+	m.used += n
+	return n
+}
+
+func (m *memoryBudget) release(n int64) {
+	if m == nil || n == 0 {
+		return
+	}
+	m.mu.Lock()
+	m.used -= n
+	m.mu.Unlock()
+	m.cond.Broadcast()
+}
+
+// inUse is the part of the budget taken, for the stats
+func (m *memoryBudget) inUse() int64 {
+	if m == nil {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.used
+}
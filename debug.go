@@ -0,0 +1,52 @@
+// debug.go
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+// checkDebugAddress makes sure the debug listener is only reachable from
+// the host: profiles show message content and the admin token is no
+// protection there
+func checkDebugAddress(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid debug.address: %v", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("debug.address %q must be a loopback address such as 127.0.0.1:6060", address)
+	}
+	return nil
+}
+
+// startDebugServer serves net/http/pprof and expvar on debug.address, when
+// set, for profiling CPU, heap and goroutines of a running relay
+func startDebugServer(bkd *Backend) {
+	address := bkd.policy().config.Debug.Address
+	if address == "" {
+		return
+	}
+
+	expvar.Publish("goroutines", expvar.Func(func() any { return runtime.NumGoroutine() }))
+	expvar.Publish("memory_budget_bytes", expvar.Func(func() any { return bkd.memory.inUse() }))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	go func() {
+		log.Printf("Starting debug server at %s", address)
+		if err := newHTTPServer(address, mux).ListenAndServe(); err != nil {
+			log.Fatalf("Failed to start debug server: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,25 @@
+// debug_test.go
+package main
+
+import "testing"
+
+func TestCheckDebugAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		ok      bool
+	}{
+		{"127.0.0.1:6060", true},
+		{"[::1]:6060", true},
+		{"localhost:6060", true},
+		{"0.0.0.0:6060", false},
+		{"[::]:6060", false},
+		{":6060", false},
+		{"203.0.113.5:6060", false},
+		{"127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if err := checkDebugAddress(tt.address); (err == nil) != tt.ok {
+			t.Errorf("checkDebugAddress(%q) = %v, want ok %v", tt.address, err, tt.ok)
+		}
+	}
+}
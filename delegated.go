@@ -0,0 +1,274 @@
+// delegated.go
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+// meUserID is the user ID the Graph client turns into /me
+const meUserID = "me-token-to-replace"
+
+// delegatedScope is requested next to the Graph scope, for a refresh token
+const delegatedScope = "offline_access"
+
+// delegatedCache is the token_cache file of the delegated auth method
+type delegatedCache struct {
+	Username     string `json:"username"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// delegatedCredential signs in as a user instead of the app, for tenants
+// that don't grant Mail.Send as an application permission. The user signs
+// in once with the login command; the refresh token is kept in
+// azure.token_cache and replaced whenever Azure AD rotates it.
+type delegatedCredential struct {
+	azure  AzureConfig
+	client *http.Client
+
+	mu     sync.Mutex
+	cache  delegatedCache
+	access azcore.AccessToken
+}
+
+func newDelegatedCredential(azure AzureConfig, client *http.Client) (*delegatedCredential, error) {
+	data, err := os.ReadFile(azure.TokenCache)
+	if err != nil {
+		return nil, fmt.Errorf("no signed-in user, run the login command first: %v", err)
+	}
+	c := &delegatedCredential{azure: azure, client: client}
+	if err := json.Unmarshal(data, &c.cache); err != nil || c.cache.RefreshToken == "" {
+		return nil, fmt.Errorf("invalid token cache %s, run the login command again", azure.TokenCache)
+	}
+	return c, nil
+}
+
+// username returns the signed-in user, the mailbox /me sends from
+func (c *delegatedCredential) username() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cache.Username
+}
+
+func (c *delegatedCredential) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Until(c.access.ExpiresOn) > 2*time.Minute {
+		return c.access, nil
+	}
+	resp, err := requestToken(ctx, c.client, c.azure, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {c.cache.RefreshToken},
+		"scope":         {strings.Join(append(opts.Scopes, delegatedScope), " ")},
+	})
+	if err != nil {
+		return azcore.AccessToken{}, err
+	}
+	if resp.RefreshToken != "" && resp.RefreshToken != c.cache.RefreshToken {
+		c.cache.RefreshToken = resp.RefreshToken
+		if err := writeDelegatedCache(c.azure.TokenCache, c.cache); err != nil {
+			return azcore.AccessToken{}, err
+		}
+	}
+	c.access = azcore.AccessToken{Token: resp.AccessToken, ExpiresOn: time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)}
+	return c.access, nil
+}
+
+// tokenResponse is the answer of the Azure AD token endpoint
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	IDToken      string `json:"id_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	Error        string `json:"error"`
+	Description  string `json:"error_description"`
+}
+
+// oauthURL returns an OAuth 2.0 endpoint of the tenant
+func oauthURL(azure AzureConfig, endpoint string) string {
+	return azure.cloud().authority + "/" + url.PathEscape(azure.TenantID) + "/oauth2/v2.0/" + endpoint
+}
+
+// requestToken posts a grant to the token endpoint. Error answers are
+// returned as tokenResponse with Error set and no error, so the login can
+// keep polling while authorization is pending.
+func requestToken(ctx context.Context, client *http.Client, azure AzureConfig, form url.Values) (tokenResponse, error) {
+	form.Set("client_id", azure.ClientID)
+	var tr tokenResponse
+	if err := postForm(ctx, client, oauthURL(azure, "token"), form, &tr); err != nil {
+		return tr, err
+	}
+	if tr.Error != "" && tr.Error != "authorization_pending" && tr.Error != "slow_down" {
+		return tr, fmt.Errorf("token request failed: %s: %s", tr.Error, tr.Description)
+	}
+	return tr, nil
+}
+
+func postForm(ctx context.Context, client *http.Client, u string, form url.Values, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("invalid answer from Azure AD (%s)", resp.Status)
+	}
+	return nil
+}
+
+// writeDelegatedCache replaces the token cache, readable by the relay's
+// user only
+func writeDelegatedCache(name string, cache delegatedCache) error {
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".token-*")
+	if err != nil {
+		return fmt.Errorf("failed to write token cache: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write token cache: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write token cache: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return fmt.Errorf("failed to write token cache: %v", err)
+	}
+	return nil
+}
+
+// idTokenUser returns the preferred_username claim of an ID token. The
+// token comes straight from Azure AD and only names the user, so its
+// signature isn't checked.
+func idTokenUser(idToken string) string {
+	var claims struct {
+		PreferredUsername string `json:"preferred_username"`
+	}
+	tokenClaims(idToken, &claims)
+	return claims.PreferredUsername
+}
+
+// tokenClaims decodes the payload of a JWT into claims, without checking
+// its signature
+func tokenClaims(token string, claims any) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return
+	}
+	json.Unmarshal(payload, claims)
+}
+
+// runLoginCommand signs in the user of a tenant with auth_method:
+// delegated using the device code flow and stores the refresh token
+func runLoginCommand(config Config, args []string) error {
+	fs := flag.NewFlagSet("login", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return fmt.Errorf("usage: login [tenant-name]")
+	}
+	azure := config.Azure
+	if name := fs.Arg(0); name != "" && name != azure.tenantName() {
+		found := false
+		for _, t := range config.Tenants {
+			if t.tenantName() == name {
+				azure, found = t.AzureConfig, true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown tenant %s", name)
+		}
+	}
+	if azure.AuthMethod != "delegated" {
+		return fmt.Errorf("tenant %s doesn't use auth_method: delegated", azure.tenantName())
+	}
+
+	transport, err := graphTransport(config)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Transport: transport, Timeout: time.Minute}
+	ctx := context.Background()
+
+	var dc struct {
+		DeviceCode string `json:"device_code"`
+		Message    string `json:"message"`
+		ExpiresIn  int    `json:"expires_in"`
+		Interval   int    `json:"interval"`
+		Error      string `json:"error"`
+		Desc       string `json:"error_description"`
+	}
+	form := url.Values{
+		"client_id": {azure.ClientID},
+		"scope":     {"openid profile " + delegatedScope + " " + azure.cloud().scope()},
+	}
+	if err := postForm(ctx, client, oauthURL(azure, "devicecode"), form, &dc); err != nil {
+		return err
+	}
+	if dc.Error != "" {
+		return fmt.Errorf("device code request failed: %s: %s", dc.Error, dc.Desc)
+	}
+	fmt.Println(dc.Message)
+
+	interval := time.Duration(max(dc.Interval, 1)) * time.Second
+	deadline := time.Now().Add(time.Duration(dc.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+		tr, err := requestToken(ctx, client, azure, url.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code": {dc.DeviceCode},
+		})
+		if err != nil {
+			return err
+		}
+		switch tr.Error {
+		case "authorization_pending":
+			continue
+		case "slow_down":
+			interval += 5 * time.Second
+			continue
+		}
+		cache := delegatedCache{Username: idTokenUser(tr.IDToken), RefreshToken: tr.RefreshToken}
+		if cache.RefreshToken == "" {
+			return fmt.Errorf("Azure AD returned no refresh token")
+		}
+		if err := writeDelegatedCache(azure.TokenCache, cache); err != nil {
+			return err
+		}
+		fmt.Printf("Signed in as %s, the relay sends from this mailbox\n", cache.Username)
+		return nil
+	}
+	return fmt.Errorf("the device code expired before sign-in")
+}
@@ -0,0 +1,214 @@
+// directmx.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultDirectMXTimeout bounds the delivery to one MX host
+const defaultDirectMXTimeout = 2 * time.Minute
+
+// sendDirect delivers the message by SMTP to the MX hosts of the
+// recipients' domains, the last resort for senders whose domain enables
+// direct_mx when Graph failed. data is sent as received, without its Bcc
+// header. It fails unless every domain took the message.
+func (bkd *Backend) sendDirect(from string, rcpts []string, data []byte) error {
+	byDomain := make(map[string][]string)
+	for _, rcpt := range rcpts {
+		at := strings.LastIndex(rcpt, "@")
+		if at < 0 {
+			return fmt.Errorf("direct delivery: invalid recipient <%s>", rcpt)
+		}
+		domain := strings.ToLower(rcpt[at+1:])
+		byDomain[domain] = append(byDomain[domain], rcpt)
+	}
+	domains := make([]string, 0, len(byDomain))
+	for domain := range byDomain {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	msg := withoutBcc(data)
+	var failed []string
+	for _, domain := range domains {
+		host, err := bkd.sendToDomain(domain, from, byDomain[domain], msg)
+		if err != nil {
+			bkd.logger.Error("direct MX delivery failed", "from", from, "domain", domain, "transport", "direct_mx", "errormsg", err)
+			failed = append(failed, domain)
+			continue
+		}
+		bkd.logger.Info("message sent", "from", from, "host", host, "transport", "direct_mx", "recipients", strings.Join(byDomain[domain], ","), "status", "sent")
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("direct delivery failed for %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// sendToDomain tries the MX hosts of domain in order of preference and
+// returns the one that took the message
+func (bkd *Backend) sendToDomain(domain, from string, rcpts []string, msg []byte) (string, error) {
+	hosts, err := mxHosts(domain)
+	if err != nil {
+		return "", err
+	}
+	var lastErr error
+	for _, host := range hosts {
+		if lastErr = bkd.sendToHost(host, from, rcpts, msg); lastErr == nil {
+			return host, nil
+		}
+		// A permanent rejection won't be different on the next host
+		if pe, ok := lastErr.(*textproto.Error); ok && pe.Code >= 500 {
+			break
+		}
+	}
+	return "", lastErr
+}
+
+// mxHosts returns the mail hosts of domain, the domain itself when it has
+// no MX records (RFC 5321 section 5.1)
+func mxHosts(domain string) ([]string, error) {
+	mxs, err := net.LookupMX(domain)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return []string{domain}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("MX lookup: %v", err)
+	}
+	var hosts []string
+	for _, mx := range mxs {
+		host := strings.TrimSuffix(mx.Host, ".")
+		if host == "" {
+			// Null MX, RFC 7505
+			return nil, fmt.Errorf("%s accepts no mail", domain)
+		}
+		hosts = append(hosts, host)
+	}
+	if len(hosts) == 0 {
+		return []string{domain}, nil
+	}
+	return hosts, nil
+}
+
+// sendToHost runs one SMTP transaction with an MX host. STARTTLS is used
+// when offered, and required with a verified certificate when
+// direct_mx.require_tls is set.
+func (bkd *Backend) sendToHost(host, from string, rcpts []string, msg []byte) error {
+	timeout := bkd.policy().config.DirectMX.Timeout
+	if timeout <= 0 {
+		timeout = defaultDirectMXTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, "25"))
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Hello(bkd.policy().config.hostname()); err != nil {
+		return err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		requireTLS := bkd.policy().config.DirectMX.RequireTLS
+		if err := c.StartTLS(&tls.Config{ServerName: host, InsecureSkipVerify: !requireTLS}); err != nil {
+			return fmt.Errorf("STARTTLS: %v", err)
+		}
+	} else if bkd.policy().config.DirectMX.RequireTLS {
+		return fmt.Errorf("%s does not offer STARTTLS", host)
+	}
+
+	return smtpTransaction(c, host, from, rcpts, msg)
+}
+
+// smtpTransaction sends msg to rcpts on an open SMTP connection to host
+func smtpTransaction(c *smtp.Client, host, from string, rcpts []string, msg []byte) error {
+	// net/smtp asks for SMTPUTF8 and 8BITMIME itself when they're offered,
+	// but can't downgrade UTF-8 addresses for hosts without SMTPUTF8
+	if ok, _ := c.Extension("SMTPUTF8"); !ok && !envelopeASCII(from, rcpts) {
+		return fmt.Errorf("%s does not support SMTPUTF8, needed for the UTF-8 addresses", host)
+	}
+	if err := c.Mail(graphAddress(from)); err != nil {
+		return err
+	}
+	for _, rcpt := range rcpts {
+		if err := c.Rcpt(graphAddress(rcpt)); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// envelopeASCII reports whether the envelope addresses are ASCII, with
+// internationalized domains in punycode
+func envelopeASCII(from string, rcpts []string) bool {
+	for _, addr := range append([]string{from}, rcpts...) {
+		if !isASCII(graphAddress(addr)) {
+			return false
+		}
+	}
+	return true
+}
+
+// withoutBcc removes the Bcc header, which must not reach the recipients
+func withoutBcc(data []byte) []byte {
+	return withoutHeaders(data, func(name string) bool {
+		return strings.EqualFold(name, "Bcc")
+	})
+}
+
+// withoutHeaders removes the header fields whose name drop matches,
+// including their continuation lines
+func withoutHeaders(data []byte, drop func(name string) bool) []byte {
+	header, body, found := bytes.Cut(data, []byte("\r\n\r\n"))
+	if !found {
+		return data
+	}
+
+	var out bytes.Buffer
+	skip := false
+	header = append(header[:len(header):len(header)], "\r\n"...)
+	for _, line := range bytes.SplitAfter(header, []byte("\r\n")) {
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			if !skip {
+				out.Write(line)
+			}
+			continue
+		}
+		name, _, _ := bytes.Cut(line, []byte(":"))
+		skip = drop(strings.TrimSpace(string(name)))
+		if !skip {
+			out.Write(line)
+		}
+	}
+	out.WriteString("\r\n")
+	out.Write(body)
+	return out.Bytes()
+}
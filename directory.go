@@ -0,0 +1,123 @@
+// directory.go
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/microsoftgraph/msgraph-sdk-go/groups"
+	"github.com/microsoftgraph/msgraph-sdk-go/users"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Defaults of recipients.verify_domains
+const (
+	defaultDirectoryCacheTTL = 10 * time.Minute
+	directoryLookupTimeout   = 10 * time.Second
+)
+
+var directoryLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "gographsmtp_directory_lookups_total",
+	Help: "Recipient lookups in the Graph directory, per result (found, unknown, error).",
+}, []string{"result"})
+
+// recipientDirectory checks recipients of the domains in
+// recipients.verify_domains against the users and groups of their tenant,
+// caching the answers
+type recipientDirectory struct {
+	domains []string
+	ttl     time.Duration
+
+	mu    sync.Mutex
+	cache map[string]directoryResult
+}
+
+type directoryResult struct {
+	exists  bool
+	expires time.Time
+}
+
+func newRecipientDirectory(config Config) *recipientDirectory {
+	if len(config.Recipients.VerifyDomains) == 0 {
+		return nil
+	}
+	ttl := config.Recipients.VerifyCacheTTL
+	if ttl <= 0 {
+		ttl = defaultDirectoryCacheTTL
+	}
+	return &recipientDirectory{
+		domains: config.Recipients.VerifyDomains,
+		ttl:     ttl,
+		cache:   make(map[string]directoryResult),
+	}
+}
+
+// covers reports whether recipients of the domain are verified
+func (d *recipientDirectory) covers(domain string) bool {
+	return matchDomains(d.domains, domain)
+}
+
+// exists reports whether a user or group of the tenant has the address,
+// as its mail or one of its proxy addresses. Failed lookups aren't cached.
+func (d *recipientDirectory) exists(t *graphTenant, addr string) (bool, error) {
+	key := strings.ToLower(graphAddress(addr))
+	now := time.Now()
+	d.mu.Lock()
+	if r, ok := d.cache[key]; ok && now.Before(r.expires) {
+		d.mu.Unlock()
+		return r.exists, nil
+	}
+	d.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), directoryLookupTimeout)
+	defer cancel()
+	exists, err := lookupDirectory(ctx, t, key)
+	if err != nil {
+		directoryLookups.WithLabelValues("error").Inc()
+		return false, err
+	}
+	if exists {
+		directoryLookups.WithLabelValues("found").Inc()
+	} else {
+		directoryLookups.WithLabelValues("unknown").Inc()
+	}
+
+	d.mu.Lock()
+	// Drop expired answers while the lock is held anyway
+	for k, r := range d.cache {
+		if now.After(r.expires) {
+			delete(d.cache, k)
+		}
+	}
+	d.cache[key] = directoryResult{exists: exists, expires: now.Add(d.ttl)}
+	d.mu.Unlock()
+	return exists, nil
+}
+
+// lookupDirectory searches the users of the tenant for the address, then
+// its groups, which covers distribution lists and Microsoft 365 groups
+func lookupDirectory(ctx context.Context, t *graphTenant, addr string) (bool, error) {
+	quoted := strings.ReplaceAll(addr, "'", "''")
+	filter := "mail eq '" + quoted + "' or proxyAddresses/any(p:p eq 'smtp:" + quoted + "')"
+	top := int32(1)
+
+	found, err := t.client.Users().Get(ctx, &users.UsersRequestBuilderGetRequestConfiguration{
+		QueryParameters: &users.UsersRequestBuilderGetQueryParameters{Filter: &filter, Select: []string{"id"}, Top: &top},
+	})
+	if err != nil {
+		return false, err
+	}
+	if len(found.GetValue()) > 0 {
+		return true, nil
+	}
+	groupsFound, err := t.client.Groups().Get(ctx, &groups.GroupsRequestBuilderGetRequestConfiguration{
+		QueryParameters: &groups.GroupsRequestBuilderGetQueryParameters{Filter: &filter, Select: []string{"id"}, Top: &top},
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(groupsFound.GetValue()) > 0, nil
+}
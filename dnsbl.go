@@ -0,0 +1,204 @@
+// dnsbl.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Defaults of the dnsbl section
+const (
+	defaultDNSBLCacheTTL = 10 * time.Minute
+	defaultGreylistDelay = 5 * time.Minute
+	dnsblLookupTimeout   = 5 * time.Second
+	greylistRetryWindow  = 24 * time.Hour
+	greylistPassedTTL    = 7 * 24 * time.Hour
+)
+
+var dnsblListings = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "gographsmtp_dnsbl_listed_total",
+	Help: "MAIL commands from clients found on a DNS blocklist, per zone and action (reject, greylist, passed).",
+}, []string{"zone", "action"})
+
+// dnsblChecker looks up client IPs in DNS blocklists and caches the
+// answers, listed or not
+type dnsblChecker struct {
+	zones    []string
+	ttl      time.Duration
+	resolver *net.Resolver
+
+	mu    sync.Mutex
+	cache map[string]dnsblResult
+}
+
+type dnsblResult struct {
+	zone    string // first zone listing the IP, empty when none does
+	expires time.Time
+}
+
+func newDNSBLChecker(config Config) *dnsblChecker {
+	if len(config.DNSBL.Zones) == 0 {
+		return nil
+	}
+	ttl := config.DNSBL.CacheTTL
+	if ttl <= 0 {
+		ttl = defaultDNSBLCacheTTL
+	}
+	return &dnsblChecker{
+		zones:    config.DNSBL.Zones,
+		ttl:      ttl,
+		resolver: net.DefaultResolver,
+		cache:    make(map[string]dnsblResult),
+	}
+}
+
+// listed returns the first configured zone that lists ip, or "". Zones are
+// queried in parallel; a zone that doesn't answer in time counts as not
+// listing the IP.
+func (d *dnsblChecker) listed(ip net.IP) string {
+	key := ip.String()
+	now := time.Now()
+	d.mu.Lock()
+	if r, ok := d.cache[key]; ok && now.Before(r.expires) {
+		d.mu.Unlock()
+		return r.zone
+	}
+	d.mu.Unlock()
+
+	name := reverseName(ip)
+	ctx, cancel := context.WithTimeout(context.Background(), dnsblLookupTimeout)
+	defer cancel()
+
+	hits := make([]bool, len(d.zones))
+	var wg sync.WaitGroup
+	for i, zone := range d.zones {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hits[i] = d.lookup(ctx, name+"."+zone)
+		}()
+	}
+	wg.Wait()
+
+	zone := ""
+	for i, hit := range hits {
+		if hit {
+			zone = d.zones[i]
+			break
+		}
+	}
+
+	d.mu.Lock()
+	// Drop expired answers while the lock is held anyway
+	for k, r := range d.cache {
+		if now.After(r.expires) {
+			delete(d.cache, k)
+		}
+	}
+	d.cache[key] = dnsblResult{zone: zone, expires: now.Add(d.ttl)}
+	d.mu.Unlock()
+	return zone
+}
+
+// lookup reports whether the zone answers the query with a listing, an
+// address in 127.0.0.0/8. 127.255.255.0/24 are error codes, e.g. Spamhaus
+// refusing queries from public resolvers.
+func (d *dnsblChecker) lookup(ctx context.Context, name string) bool {
+	addrs, err := d.resolver.LookupHost(ctx, name)
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		ip := net.ParseIP(a).To4()
+		if ip != nil && ip[0] == 127 && !(ip[1] == 255 && ip[2] == 255) {
+			return true
+		}
+	}
+	return false
+}
+
+// reverseName returns the DNSBL query name of ip without the zone:
+// reversed octets for IPv4, reversed nibbles for IPv6
+func reverseName(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", v4[3], v4[2], v4[1], v4[0])
+	}
+	const hex = "0123456789abcdef"
+	ip = ip.To16()
+	labels := make([]string, 0, 32)
+	for i := len(ip) - 1; i >= 0; i-- {
+		labels = append(labels, string(hex[ip[i]&0x0f]), string(hex[ip[i]>>4]))
+	}
+	return strings.Join(labels, ".")
+}
+
+// checkDNSBL refuses MAIL from clients on a configured blocklist, with 554
+// or, with dnsbl.action: greylist, with 451 until they retry after the
+// greylist delay like a real MTA would. Private and loopback addresses are
+// never looked up.
+func (bkd *Backend) checkDNSBL(ip net.IP) error {
+	policy := bkd.policy()
+	if policy.dnsbl == nil || ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() {
+		return nil
+	}
+	zone := policy.dnsbl.listed(ip)
+	if zone == "" {
+		return nil
+	}
+
+	if policy.config.DNSBL.Action != "greylist" {
+		dnsblListings.WithLabelValues(zone, "reject").Inc()
+		return bkd.replies.error(554, smtp.EnhancedCode{5, 7, 1}, "client_blocklisted", "ip", ip.String(), "zone", zone)
+	}
+	passed, err := bkd.greylistPassed(ip)
+	if err != nil {
+		// Don't turn a store outage into refused mail
+		bkd.logger.Warn("greylist store failed", "client", ip, "errormsg", err)
+		return nil
+	}
+	if passed {
+		dnsblListings.WithLabelValues(zone, "passed").Inc()
+		return nil
+	}
+	dnsblListings.WithLabelValues(zone, "greylist").Inc()
+	return bkd.replies.error(451, smtp.EnhancedCode{4, 7, 1}, "client_greylisted", "ip", ip.String())
+}
+
+// greylistPassed reports whether a listed client retried after the
+// greylist delay, within a day of its first attempt. Clients that passed
+// are let through for a week. The state is in the shared store, so
+// replicas greylist together.
+func (bkd *Backend) greylistPassed(ip net.IP) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	key := "greylist:" + ip.String()
+	if passed, err := bkd.store.Exists(ctx, key+":passed"); err != nil || passed {
+		return passed, err
+	}
+	delay := bkd.policy().config.DNSBL.GreylistDelay
+	if delay <= 0 {
+		delay = defaultGreylistDelay
+	}
+	first, err := bkd.store.SetNX(ctx, key, greylistRetryWindow)
+	if err != nil {
+		return false, err
+	}
+	if first {
+		_, err := bkd.store.SetNX(ctx, key+":wait", delay)
+		return false, err
+	}
+	if waiting, err := bkd.store.Exists(ctx, key+":wait"); err != nil || waiting {
+		return false, err
+	}
+	_, err = bkd.store.SetNX(ctx, key+":passed", greylistPassedTTL)
+	return err == nil, err
+}
@@ -0,0 +1,181 @@
+// dsn.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// dsnRequest holds the delivery status notifications (RFC 3461) the
+// client asked for with MAIL FROM and RCPT TO parameters
+type dsnRequest struct {
+	EnvelopeID string              `json:"envid,omitempty"`
+	Return     string              `json:"ret,omitempty"`    // FULL or HDRS
+	Notify     map[string][]string `json:"notify,omitempty"` // NEVER, or SUCCESS, FAILURE and DELAY, by recipient
+	Original   map[string]string   `json:"orcpt,omitempty"`  // ORCPT as type;address, by recipient
+}
+
+// newDSNRequest reads the MAIL FROM parameters; it returns nil when the
+// client used none
+func newDSNRequest(opts *smtp.MailOptions) *dsnRequest {
+	if opts == nil || opts.EnvelopeID == "" && opts.Return == "" {
+		return nil
+	}
+	return &dsnRequest{EnvelopeID: opts.EnvelopeID, Return: string(opts.Return)}
+}
+
+// addRecipient records the RCPT TO parameters of a recipient
+func (d *dsnRequest) addRecipient(rcpt string, opts *smtp.RcptOptions) *dsnRequest {
+	if opts == nil || len(opts.Notify) == 0 && opts.OriginalRecipient == "" {
+		return d
+	}
+	if d == nil {
+		d = &dsnRequest{}
+	}
+	if len(opts.Notify) > 0 {
+		if d.Notify == nil {
+			d.Notify = make(map[string][]string)
+		}
+		for _, n := range opts.Notify {
+			d.Notify[rcpt] = append(d.Notify[rcpt], string(n))
+		}
+	}
+	if opts.OriginalRecipient != "" {
+		if d.Original == nil {
+			d.Original = make(map[string]string)
+		}
+		typ := opts.OriginalRecipientType
+		if typ == "" {
+			typ = smtp.DSNAddressTypeRFC822
+		}
+		d.Original[rcpt] = strings.ToLower(string(typ)) + "; " + opts.OriginalRecipient
+	}
+	return d
+}
+
+// envelopeID returns the ENVID, "" without one
+func (d *dsnRequest) envelopeID() string {
+	if d == nil {
+		return ""
+	}
+	return d.EnvelopeID
+}
+
+// recipients returns the recipients that asked to be told about the
+// event, SUCCESS, FAILURE or DELAY. Without NOTIFY only failures are
+// reported.
+func (d *dsnRequest) recipients(rcpts []string, event string) []string {
+	var list []string
+	for _, rcpt := range rcpts {
+		notify, ok := []string(nil), false
+		if d != nil {
+			notify, ok = d.Notify[rcpt]
+		}
+		if !ok {
+			notify = []string{"FAILURE"}
+		}
+		for _, n := range notify {
+			if n == event {
+				list = append(list, rcpt)
+				break
+			}
+		}
+	}
+	return list
+}
+
+// dsnActions maps the events to the action, status and subject of the
+// report
+var dsnActions = map[string]struct{ action, status, subject, text string }{
+	"SUCCESS": {"relayed", "2.0.0", "Delivery Status Notification (Relayed)", "was handed to Microsoft 365 for delivery to"},
+	"FAILURE": {"failed", "5.0.0", "Delivery Status Notification (Failure)", "could not be delivered to"},
+	"DELAY":   {"delayed", "4.0.0", "Delivery Status Notification (Delay)", "has not been delivered yet to"},
+}
+
+// buildDSN returns a delivery status notification (RFC 3464) about the
+// recipients, from and to the sender's mailbox like a bounce. The message
+// is returned in full with RET=FULL, else its headers.
+func buildDSN(hostname string, entry spoolEntry, event string, rcpts []string, data []byte) []byte {
+	a := dsnActions[event]
+	boundary := "dsn-" + entry.ID
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: Mail Delivery System <%s>\r\n", entry.From)
+	fmt.Fprintf(&b, "To: <%s>\r\n", entry.From)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", a.subject+": "+entry.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("Auto-Submitted: auto-replied\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/report; report-type=delivery-status; boundary=\"%s\"\r\n\r\n", boundary)
+
+	fmt.Fprintf(&b, "--%s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n", boundary)
+	fmt.Fprintf(&b, "Your message received %s %s:\r\n\r\n", entry.Received.Format(time.RFC1123Z), a.text)
+	for _, rcpt := range rcpts {
+		fmt.Fprintf(&b, "  %s\r\n", rcpt)
+	}
+	if event != "SUCCESS" && entry.Reason != "" {
+		fmt.Fprintf(&b, "\r\nLast error:\r\n  %s\r\n", entry.Reason)
+	}
+
+	fmt.Fprintf(&b, "\r\n--%s\r\nContent-Type: message/delivery-status\r\n\r\n", boundary)
+	fmt.Fprintf(&b, "Reporting-MTA: dns; %s\r\n", hostname)
+	if id := entry.DSN.envelopeID(); id != "" {
+		fmt.Fprintf(&b, "Original-Envelope-Id: %s\r\n", id)
+	}
+	fmt.Fprintf(&b, "Arrival-Date: %s\r\n", entry.Received.Format(time.RFC1123Z))
+	for _, rcpt := range rcpts {
+		b.WriteString("\r\n")
+		if entry.DSN != nil && entry.DSN.Original[rcpt] != "" {
+			fmt.Fprintf(&b, "Original-Recipient: %s\r\n", entry.DSN.Original[rcpt])
+		}
+		fmt.Fprintf(&b, "Final-Recipient: rfc822; %s\r\n", rcpt)
+		fmt.Fprintf(&b, "Action: %s\r\nStatus: %s\r\n", a.action, a.status)
+		if event != "SUCCESS" && entry.Reason != "" {
+			fmt.Fprintf(&b, "Diagnostic-Code: smtp; %s\r\n", strings.Join(strings.Fields(entry.Reason), " "))
+		}
+	}
+
+	if entry.DSN != nil && entry.DSN.Return == string(smtp.DSNReturnFull) {
+		fmt.Fprintf(&b, "\r\n--%s\r\nContent-Type: message/rfc822\r\n\r\n", boundary)
+		b.Write(data)
+	} else {
+		header, _, _ := strings.Cut(string(data), "\r\n\r\n")
+		fmt.Fprintf(&b, "\r\n--%s\r\nContent-Type: text/rfc822-headers\r\n\r\n", boundary)
+		b.WriteString(header)
+		b.WriteString("\r\n")
+	}
+	fmt.Fprintf(&b, "\r\n--%s--\r\n", boundary)
+	return []byte(b.String())
+}
+
+// sendDSN notifies the sender of the event for the recipients that asked
+// for it and reports whether a notification was needed and sent.
+// Notifications are only sent with smtp.dsn.
+func (bkd *Backend) sendDSN(entry spoolEntry, data []byte, event string) (bool, error) {
+	config := bkd.policy().config
+	if !config.SMTP.DSN {
+		return false, nil
+	}
+	rcpts := entry.DSN.recipients(entry.To, event)
+	if len(rcpts) == 0 {
+		return false, nil
+	}
+	// Messages that were never spooled arrived just now
+	if entry.Received.IsZero() {
+		entry.Received = time.Now().UTC()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := bkd.sendMIME(ctx, entry.From, buildDSN(config.hostname(), entry, event, rcpts, data)); err != nil {
+		bkd.logger.Error("sending DSN failed", "queueid", entry.ID, "from", entry.From, "envid", entry.DSN.envelopeID(), "action", dsnActions[event].action, "errormsg", err)
+		return true, err
+	}
+	bkd.history.add(entry.ID, historyEvent{Event: "dsn", Detail: dsnActions[event].action})
+	bkd.logger.Info("DSN sent", "queueid", entry.ID, "from", entry.From, "envid", entry.DSN.envelopeID(), "action", dsnActions[event].action,
+		"recipients", strings.Join(rcpts, ","), "status", "dsn_sent")
+	return true, nil
+}
@@ -0,0 +1,187 @@
+// envconfig.go
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix starts the environment variables that override config values,
+// e.g. GOGRAPHSMTP_AZURE_CLIENT_SECRET for azure.client_secret
+const envPrefix = "GOGRAPHSMTP_"
+
+// fileSuffix marks a key or variable naming a file that holds the value,
+// e.g. client_secret_file or GOGRAPHSMTP_AZURE_CLIENT_SECRET_FILE
+const fileSuffix = "_file"
+
+// applyOverrides sets the config values given in files and environment
+// variables on the parsed config, before secrets are resolved. Scalars and
+// lists of strings (comma-separated) can be overridden; lists of
+// structures and maps only in the file. Variables win over the file.
+func applyOverrides(root *yaml.Node) error {
+	if root.Kind == 0 {
+		*root = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	if root.Kind != yaml.DocumentNode || len(root.Content) == 0 || root.Content[0].Kind != yaml.MappingNode {
+		return nil
+	}
+	return overrideStruct(root.Content[0], reflect.TypeOf(Config{}), "", true)
+}
+
+// overrideStruct applies the overrides to the mapping m of the structure
+// t. Entries of lists only read _file keys, env is false for them.
+func overrideStruct(m *yaml.Node, t reflect.Type, path string, env bool) error {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key, opts, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if opts == "inline" && f.Type.Kind() == reflect.Struct {
+			if err := overrideStruct(m, f.Type, path, env); err != nil {
+				return err
+			}
+			continue
+		}
+		if key == "" || key == "-" {
+			continue
+		}
+		p := key
+		if path != "" {
+			p = path + "." + key
+		}
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(p, ".", "_"))
+
+		if f.Type.Kind() == reflect.Struct {
+			child := mappingValue(m, key)
+			created := child == nil
+			if created {
+				child = &yaml.Node{Kind: yaml.MappingNode}
+			}
+			if child.Kind != yaml.MappingNode {
+				continue
+			}
+			if err := overrideStruct(child, f.Type, p, env); err != nil {
+				return err
+			}
+			if created && len(child.Content) > 0 {
+				m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, child)
+			}
+			continue
+		}
+		if f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() == reflect.Struct {
+			if seq := mappingValue(m, key); seq != nil && seq.Kind == yaml.SequenceNode {
+				for j, item := range seq.Content {
+					if item.Kind != yaml.MappingNode {
+						continue
+					}
+					if err := overrideStruct(item, f.Type.Elem(), fmt.Sprintf("%s[%d]", p, j), false); err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		}
+
+		list := f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() == reflect.String
+		if !list && !scalarKind(f.Type.Kind()) {
+			continue
+		}
+
+		// key_file next to key, unless key_file is a setting of its own
+		// like smtp.tls.cert_file
+		if f.Type.Kind() == reflect.String && !hasYAMLKey(t, key+fileSuffix) {
+			if file := mappingValue(m, key+fileSuffix); file != nil && file.Value != "" {
+				value, err := readSecretFile(file.Value)
+				if err != nil {
+					return fmt.Errorf("failed to read %s%s: %v", p, fileSuffix, err)
+				}
+				setScalar(m, key, value, true)
+			}
+			if file := os.Getenv(name + strings.ToUpper(fileSuffix)); env && file != "" {
+				value, err := readSecretFile(file)
+				if err != nil {
+					return fmt.Errorf("failed to read %s%s: %v", name, strings.ToUpper(fileSuffix), err)
+				}
+				setScalar(m, key, value, true)
+			}
+		}
+
+		value, ok := os.LookupEnv(name)
+		if !env || !ok {
+			continue
+		}
+		if list {
+			seq := &yaml.Node{Kind: yaml.SequenceNode}
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					seq.Content = append(seq.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: item})
+				}
+			}
+			setValue(m, key, seq)
+			continue
+		}
+		setScalar(m, key, value, f.Type.Kind() == reflect.String)
+	}
+	return nil
+}
+
+func scalarKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int64, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// hasYAMLKey reports whether the structure has a field for key
+func hasYAMLKey(t reflect.Type, key string) bool {
+	for i := 0; i < t.NumField(); i++ {
+		name, opts, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		if name == key || opts == "inline" && t.Field(i).Type.Kind() == reflect.Struct && hasYAMLKey(t.Field(i).Type, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// mappingValue returns the value node of key, or nil
+func mappingValue(m *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func setValue(m *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			m.Content[i+1] = value
+			return
+		}
+	}
+	m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, value)
+}
+
+// setScalar sets key to value; strings are tagged so values like "no" or
+// "123" stay strings
+func setScalar(m *yaml.Node, key, value string, str bool) {
+	n := &yaml.Node{Kind: yaml.ScalarNode, Value: value}
+	if str {
+		n.Tag = "!!str"
+	}
+	setValue(m, key, n)
+}
+
+// readSecretFile reads a value from a file such as a Docker or Kubernetes
+// secret, without the trailing line break
+func readSecretFile(name string) (string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
@@ -0,0 +1,92 @@
+// etrn.go
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// etrnAllowed reports whether the client may use ETRN. Other clients are
+// neither offered the command nor is it answered for them.
+func (bkd *Backend) etrnAllowed(ip net.IP) bool {
+	for _, n := range bkd.policy().etrnClients {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// etrn answers ETRN <domain> (RFC 1985) by retrying the queued messages
+// with a recipient in the domain right away, e.g. after a Graph outage.
+// "@domain" includes its subdomains. Only messages waiting after a failed
+// send are retried, from the retry spool or deferred; messages held for
+// their send window stay there.
+func (bkd *Backend) etrn(client, arg string) string {
+	domain, subdomains := strings.ToLower(arg), false
+	if strings.HasPrefix(domain, "#") {
+		// Named queues aren't supported
+		return "458 4.3.0 " + bkd.replies.text("etrn_failed", "domain", arg)
+	}
+	if strings.HasPrefix(domain, "@") {
+		domain, subdomains = domain[1:], true
+	}
+
+	var due, queued []spoolEntry
+	if bkd.retry != nil {
+		entries, err := bkd.retry.list()
+		if err != nil {
+			bkd.logger.Warn("listing queued messages failed", "client", client, "etrn", arg, "errormsg", err)
+			return "458 4.3.0 " + bkd.replies.text("etrn_failed", "domain", arg)
+		}
+		for _, entry := range entries {
+			if recipientInDomain(entry.To, domain, subdomains) {
+				queued = append(queued, entry)
+			}
+		}
+	}
+	if bkd.deferred != nil {
+		entries, err := bkd.deferred.list()
+		if err != nil {
+			bkd.logger.Warn("listing deferred messages failed", "client", client, "etrn", arg, "errormsg", err)
+			return "458 4.3.0 " + bkd.replies.text("etrn_failed", "domain", arg)
+		}
+		for _, entry := range entries {
+			if entry.Attempts > 0 && recipientInDomain(entry.To, domain, subdomains) {
+				due = append(due, entry)
+			}
+		}
+	}
+	count := len(queued) + len(due)
+	bkd.logger.Info("queue flush started", "client", client, "etrn", arg, "status", "flush", "messages", count)
+	if count == 0 {
+		return "251 2.0.0 " + bkd.replies.text("etrn_none", "domain", arg)
+	}
+
+	go func() {
+		for _, entry := range queued {
+			bkd.sendRetry(entry)
+		}
+		for _, entry := range due {
+			bkd.sendDeferred(entry)
+		}
+	}()
+	return "253 2.0.0 " + bkd.replies.text("etrn_started", "count", strconv.Itoa(count), "domain", arg)
+}
+
+// recipientInDomain reports whether any of the addresses is in domain, or
+// below it with subdomains set
+func recipientInDomain(addrs []string, domain string, subdomains bool) bool {
+	for _, addr := range addrs {
+		at := strings.LastIndex(addr, "@")
+		if at < 0 {
+			continue
+		}
+		d := strings.ToLower(addr[at+1:])
+		if d == domain || subdomains && strings.HasSuffix(d, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
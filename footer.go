@@ -0,0 +1,65 @@
+// footer.go
+package main
+
+import (
+	"html"
+	"strings"
+)
+
+// FooterConfig is a disclaimer appended to message bodies, which Exchange
+// transport rules would add to mail sent through Exchange but not to mail
+// sent through Graph. Either text may be left out; it is then derived from
+// the other.
+type FooterConfig struct {
+	Text string `yaml:"text"`
+	HTML string `yaml:"html"`
+}
+
+func (f FooterConfig) empty() bool {
+	return strings.TrimSpace(f.Text) == "" && strings.TrimSpace(f.HTML) == ""
+}
+
+// footer returns the footer of the session's messages: the sender domain's,
+// or else the listener's
+func (s *Session) footer() FooterConfig {
+	if !s.domain.Footer.empty() {
+		return s.domain.Footer
+	}
+	return s.listener.Footer
+}
+
+// text returns the footer for plain text bodies
+func (f FooterConfig) text() string {
+	if f.Text != "" {
+		return strings.TrimSpace(f.Text)
+	}
+	return strings.TrimSpace(htmlToText(f.HTML))
+}
+
+// html returns the footer for HTML bodies
+func (f FooterConfig) html() string {
+	if f.HTML != "" {
+		return f.HTML
+	}
+	lines := strings.Split(strings.TrimSpace(f.Text), "\n")
+	for i, line := range lines {
+		lines[i] = html.EscapeString(strings.TrimRight(line, "\r"))
+	}
+	return "<p>" + strings.Join(lines, "<br>") + "</p>"
+}
+
+// appendFooter adds the footer to a body, in HTML before the closing body
+// tag if there is one
+func appendFooter(body string, isHTML bool, f FooterConfig) string {
+	if f.empty() {
+		return body
+	}
+	if !isHTML {
+		return strings.TrimRight(body, "\r\n") + "\r\n\r\n" + f.text() + "\r\n"
+	}
+	footer := f.html()
+	if i := strings.LastIndex(strings.ToLower(body), "</body>"); i >= 0 {
+		return body[:i] + footer + body[i:]
+	}
+	return body + footer
+}
@@ -0,0 +1,74 @@
+// forwarded.go
+package main
+
+import (
+	"bytes"
+	"net/mail"
+
+	"github.com/emersion/go-message"
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+)
+
+// messageReadFlag is PR_MESSAGE_FLAGS set to MSGFLAG_READ. Without it
+// Outlook shows a message Graph created as an unsent draft.
+const messageReadFlag = "Integer 0x0E07"
+
+// messageItem converts an attached message to a Graph item attachment
+// carrying its headers and body. Graph can't create item attachments with
+// attachments of their own, so nil is returned for messages that have
+// any, or that can't be read, and they stay .eml files.
+func messageItem(data []byte) models.Attachmentable {
+	e, err := message.Read(bytes.NewReader(data))
+	if err != nil && !message.IsUnknownCharset(err) {
+		return nil
+	}
+	content, err := parseMIME(data, mimeOptions{})
+	if err != nil || content.damaged || len(content.attachments) > 0 {
+		return nil
+	}
+	headers := make(map[string]string)
+	for fields := e.Header.Fields(); fields.Next(); {
+		headers[fields.Key()] = fields.Value()
+	}
+
+	msg := models.NewMessage()
+	subject, _ := e.Header.Text("Subject")
+	msg.SetSubject(&subject)
+	text, isHTML := content.body()
+	contentType := models.TEXT_BODYTYPE
+	if isHTML {
+		contentType = models.HTML_BODYTYPE
+	}
+	body := models.NewItemBody()
+	body.SetContent(&text)
+	body.SetContentType(&contentType)
+	msg.SetBody(body)
+	if from, names := headerAddresses(headers, "From"); len(from) > 0 {
+		msg.SetFrom(graphRecipients(from[:1], names)[0])
+	}
+	names := displayNames(headers)
+	if to, _ := headerAddresses(headers, "To"); len(to) > 0 {
+		msg.SetToRecipients(graphRecipients(to, names))
+	}
+	if cc, _ := headerAddresses(headers, "Cc"); len(cc) > 0 {
+		msg.SetCcRecipients(graphRecipients(cc, names))
+	}
+	if date, err := mail.ParseDate(headerValue(headers, "Date")); err == nil {
+		msg.SetSentDateTime(&date)
+		msg.SetReceivedDateTime(&date)
+	}
+	flag := models.NewSingleValueLegacyExtendedProperty()
+	id, read := messageReadFlag, "1"
+	flag.SetId(&id)
+	flag.SetValue(&read)
+	msg.SetSingleValueExtendedProperties([]models.SingleValueLegacyExtendedPropertyable{flag})
+
+	attachment := models.NewItemAttachment()
+	name := subject
+	if name == "" {
+		name = "forwarded message"
+	}
+	attachment.SetName(&name)
+	attachment.SetItem(msg)
+	return attachment
+}
@@ -0,0 +1,225 @@
+// graphdebug.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	khttp "github.com/microsoft/kiota-http-go"
+	"github.com/microsoftgraph/msgraph-sdk-go/models/odataerrors"
+)
+
+// graphDebugBodyBytes is how much of a request or response body the wire
+// log shows
+const graphDebugBodyBytes = 4096
+
+// addressPattern matches email addresses, whose local part is redacted. A
+// local part doesn't start with an apostrophe, which quotes a $filter value.
+var addressPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-][A-Za-z0-9._%+'\-]*@([A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)+)`)
+
+func redactAddresses(s string) string {
+	return addressPattern.ReplaceAllString(s, "***@$1")
+}
+
+// graphWireLogger logs every Graph request and its response with
+// graph.debug set, as the innermost middleware so retries show as well.
+// Tokens, message content and recipients are redacted.
+type graphWireLogger struct {
+	tenant string
+	logger *slog.Logger
+}
+
+func (g graphWireLogger) Intercept(pipeline khttp.Pipeline, middlewareIndex int, req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	reqBody := wireBody(&req.Body, req.Header.Get("Content-Type"), req.ContentLength)
+	resp, err := pipeline.Next(req, middlewareIndex)
+
+	attrs := []any{"tenant", g.tenant, "queueid", queueIDFrom(req.Context()), "method", req.Method, "url", redactURL(req),
+		"request_headers", redactHeaders(req.Header), "request_body", reqBody, "duration_ms", time.Since(start).Milliseconds()}
+	if err != nil {
+		g.logger.Info("Graph wire", append(attrs, "errormsg", err)...)
+		return resp, err
+	}
+	respBody := wireBody(&resp.Body, resp.Header.Get("Content-Type"), resp.ContentLength)
+	attrs = append(attrs, "code", resp.StatusCode, "response_headers", redactHeaders(resp.Header), "response_body", respBody)
+	if resp.StatusCode >= 400 {
+		attrs = append(attrs, odataAttrs([]byte(respBody))...)
+	}
+	g.logger.Info("Graph wire", attrs...)
+	return resp, nil
+}
+
+// redactURL returns the request URL with the addresses in its query, such
+// as those of a $filter, redacted. The mailbox in the path is the sender.
+func redactURL(req *http.Request) string {
+	u := *req.URL
+	if query, err := url.QueryUnescape(u.RawQuery); err == nil {
+		u.RawQuery = redactAddresses(query)
+	}
+	return u.String()
+}
+
+// redactHeaders returns the headers in name order, without the values of
+// credentials
+func redactHeaders(h http.Header) string {
+	var fields []string
+	for _, name := range slices.Sorted(maps.Keys(h)) {
+		value := strings.Join(h.Values(name), ", ")
+		lower := strings.ToLower(name)
+		if lower == "authorization" || strings.Contains(lower, "cookie") || strings.Contains(lower, "token") || strings.Contains(lower, "secret") {
+			value = "[redacted]"
+		}
+		fields = append(fields, name+": "+redactAddresses(value))
+	}
+	return strings.Join(fields, "; ")
+}
+
+// wireBody reads a JSON body and puts it back for the pipeline, and
+// returns it redacted and truncated. Other bodies, such as MIME messages
+// and attachment chunks, are only described.
+func wireBody(body *io.ReadCloser, contentType string, length int64) string {
+	if *body == nil || *body == http.NoBody {
+		return ""
+	}
+	if !strings.Contains(strings.ToLower(contentType), "json") {
+		if length < 0 {
+			return "[" + contentType + "]"
+		}
+		return fmt.Sprintf("[%d bytes %s]", length, contentType)
+	}
+	data, err := io.ReadAll(*body)
+	(*body).Close()
+	*body = io.NopCloser(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Sprintf("[unreadable: %v]", err)
+	}
+
+	var v any
+	if json.Unmarshal(data, &v) == nil {
+		data, _ = json.Marshal(redactJSON(v, ""))
+	} else {
+		data = []byte(redactAddresses(string(data)))
+	}
+	if len(data) > graphDebugBodyBytes {
+		// Cut at a character boundary so the log stays valid UTF-8
+		cut := graphDebugBodyBytes
+		for cut > 0 && !utf8.RuneStart(data[cut]) {
+			cut--
+		}
+		return fmt.Sprintf("%s... (%d bytes)", data[:cut], len(data))
+	}
+	return string(data)
+}
+
+// redactJSON replaces message bodies and attachment data by their size,
+// the display names of recipients, and the local part of addresses
+func redactJSON(v any, parent string) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			lower := strings.ToLower(key)
+			switch s, isString := value.(string); {
+			case isString && (lower == "content" || lower == "contentbytes"):
+				v[key] = fmt.Sprintf("[%d chars]", len(s))
+			case isString && lower == "name" && parent == "emailaddress":
+				v[key] = "[redacted]"
+			default:
+				v[key] = redactJSON(value, lower)
+			}
+		}
+	case []any:
+		for i := range v {
+			v[i] = redactJSON(v[i], parent)
+		}
+	case string:
+		return redactAddresses(v)
+	}
+	return v
+}
+
+// odataAttrs returns the log attributes of an OData error response
+func odataAttrs(body []byte) []any {
+	var resp struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+			Details []struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+				Target  string `json:"target"`
+			} `json:"details"`
+			InnerError struct {
+				RequestID string `json:"request-id"`
+				Date      string `json:"date"`
+			} `json:"innerError"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &resp) != nil || resp.Error.Code == "" {
+		return nil
+	}
+	attrs := []any{"graph_code", resp.Error.Code, "graph_message", resp.Error.Message}
+	var details []string
+	for _, d := range resp.Error.Details {
+		details = append(details, odataDetail(d.Code, d.Message, d.Target))
+	}
+	if len(details) > 0 {
+		attrs = append(attrs, "graph_details", strings.Join(details, "; "))
+	}
+	if id := resp.Error.InnerError.RequestID; id != "" {
+		attrs = append(attrs, "request_id", id, "request_date", resp.Error.InnerError.Date)
+	}
+	return attrs
+}
+
+func odataDetail(code, message, target string) string {
+	s := code + ": " + message
+	if target != "" {
+		s += " (" + target + ")"
+	}
+	return s
+}
+
+// graphErrorAttrs returns the OData error code, details and request ID of
+// a failed Graph request for its log line; errormsg only has the message
+func graphErrorAttrs(err error) []any {
+	var odataErr *odataerrors.ODataError
+	if !errors.As(err, &odataErr) || odataErr.GetErrorEscaped() == nil {
+		return nil
+	}
+	mainErr := odataErr.GetErrorEscaped()
+	var attrs []any
+	if code := mainErr.GetCode(); code != nil {
+		attrs = append(attrs, "graph_code", *code)
+	}
+	var details []string
+	for _, d := range mainErr.GetDetails() {
+		details = append(details, odataDetail(stringValue(d.GetCode()), stringValue(d.GetMessage()), stringValue(d.GetTarget())))
+	}
+	if len(details) > 0 {
+		attrs = append(attrs, "graph_details", redactAddresses(strings.Join(details, "; ")))
+	}
+	if inner := mainErr.GetInnerError(); inner != nil && inner.GetRequestId() != nil {
+		attrs = append(attrs, "request_id", *inner.GetRequestId())
+	}
+	return attrs
+}
+
+// stringValue returns the string a Graph model points to, or ""
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
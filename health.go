@@ -0,0 +1,66 @@
+// health.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+// readinessTimeout bounds the token requests of a readiness check
+const readinessTimeout = 10 * time.Second
+
+// readiness is the answer of /readyz, one entry per check
+type readiness struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// handleHealthz answers as long as the process serves HTTP, for liveness
+// probes
+func (bkd *Backend) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz reports whether the relay can take mail: every SMTP
+// listener is bound, every tenant gets a Graph token and no shutdown is
+// under way. Tokens come from the credential's cache while they are valid.
+func (bkd *Backend) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	result := readiness{Status: "ready", Checks: make(map[string]string)}
+	fail := func(check, msg string) {
+		result.Status = "not_ready"
+		result.Checks[check] = msg
+	}
+
+	if n, total := int(bkd.listening.Load()), len(bkd.listeners); n < total {
+		fail("smtp", fmt.Sprintf("%d of %d listeners bound", n, total))
+	} else if bkd.sessions.isDraining() {
+		fail("smtp", "shutting down")
+	} else {
+		result.Checks["smtp"] = "ok"
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+	for _, t := range bkd.tenants {
+		check := "graph_token:" + t.name
+		if _, err := t.credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{t.cloud.scope()}}); err != nil {
+			fail(check, err.Error())
+			continue
+		}
+		result.Checks[check] = "ok"
+	}
+
+	if result.Status != "ready" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+	writeJSON(w, result)
+}
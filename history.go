@@ -0,0 +1,386 @@
+// history.go
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/microsoftgraph/msgraph-sdk-go/users"
+)
+
+// Defaults of the history section
+const (
+	defaultHistoryMessages  = 10000
+	defaultHistoryRetention = 7 * 24 * time.Hour
+)
+
+// deliveryRecord is the lifecycle of one accepted message
+type deliveryRecord struct {
+	QueueID   string         `json:"queue_id"`
+	MessageID string         `json:"message_id,omitempty"`
+	Client    string         `json:"client"`
+	From      string         `json:"from"`
+	To        []string       `json:"to"`
+	Subject   string         `json:"subject"`
+	Accepted  time.Time      `json:"accepted"`
+	Status    string         `json:"status"` // last outcome
+	Attempts  int            `json:"attempts"`
+	Events    []historyEvent `json:"events"`
+}
+
+// historyEvent is one step of a record: accepted, graph_request, sent,
+// failed, queued, bounced, quarantined, deferred, released, duplicate,
+// dry_run or rejected
+type historyEvent struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	Transport string    `json:"transport,omitempty"` // graph or direct_mx
+	Detail    string    `json:"detail,omitempty"`
+	RequestID string    `json:"request_id,omitempty"` // Graph request-id
+	Status    int       `json:"status,omitempty"`     // Graph HTTP status
+}
+
+// deliveryHistory keeps the records of recent messages in memory, by
+// queue ID and Message-ID. It is per instance, like the pacing report.
+type deliveryHistory struct {
+	mu          sync.Mutex
+	max         int
+	retention   time.Duration
+	records     map[string]*deliveryRecord
+	byMessageID map[string][]string
+	order       []string // queue IDs, oldest first
+}
+
+func newDeliveryHistory(config Config) *deliveryHistory {
+	h := &deliveryHistory{
+		max:         config.History.MaxMessages,
+		retention:   config.History.Retention,
+		records:     make(map[string]*deliveryRecord),
+		byMessageID: make(map[string][]string),
+	}
+	if h.max <= 0 {
+		h.max = defaultHistoryMessages
+	}
+	if h.retention <= 0 {
+		h.retention = defaultHistoryRetention
+	}
+	return h
+}
+
+// newQueueID returns a random ID for an accepted message
+func newQueueID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// accept starts the record of a message
+func (h *deliveryHistory) accept(rec deliveryRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	rec.Accepted = time.Now().UTC()
+	rec.Status = "accepted"
+	rec.Events = []historyEvent{{Time: rec.Accepted, Event: "accepted"}}
+	h.records[rec.QueueID] = &rec
+	h.order = append(h.order, rec.QueueID)
+	if rec.MessageID != "" {
+		key := messageIDKey(rec.MessageID)
+		h.byMessageID[key] = append(h.byMessageID[key], rec.QueueID)
+	}
+	h.prune(rec.Accepted)
+}
+
+// prune drops the oldest records beyond the size and age limits
+func (h *deliveryHistory) prune(now time.Time) {
+	for len(h.order) > 0 {
+		rec, ok := h.records[h.order[0]]
+		if ok && len(h.order) <= h.max && now.Sub(rec.Accepted) < h.retention {
+			return
+		}
+		h.order = h.order[1:]
+		if !ok {
+			continue
+		}
+		delete(h.records, rec.QueueID)
+		if rec.MessageID != "" {
+			key := messageIDKey(rec.MessageID)
+			ids := h.byMessageID[key]
+			for i, id := range ids {
+				if id == rec.QueueID {
+					ids = append(ids[:i], ids[i+1:]...)
+					break
+				}
+			}
+			if len(ids) == 0 {
+				delete(h.byMessageID, key)
+			} else {
+				h.byMessageID[key] = ids
+			}
+		}
+	}
+}
+
+// sweep drops records beyond the retention
+func (h *deliveryHistory) sweep() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.prune(time.Now().UTC())
+}
+
+// summary counts the records accepted since the given time by status,
+// and by sender
+func (h *deliveryHistory) summary(since time.Time) (map[string]int, map[string]int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	counts := make(map[string]int)
+	senders := make(map[string]int)
+	for _, rec := range h.records {
+		if !rec.Accepted.Before(since) {
+			counts[rec.Status]++
+			senders[strings.ToLower(rec.From)]++
+		}
+	}
+	return counts, senders
+}
+
+// add appends an event to the record of a message, if it is still known.
+// Outcomes update the record's status; sent and failed count attempts.
+func (h *deliveryHistory) add(queueID string, ev historyEvent) {
+	if queueID == "" {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	rec, ok := h.records[queueID]
+	if !ok {
+		return
+	}
+	ev.Time = time.Now().UTC()
+	rec.Events = append(rec.Events, ev)
+	switch ev.Event {
+	case "sent", "failed":
+		rec.Attempts++
+		rec.Status = ev.Event
+	case "queued", "bounced", "quarantined", "deferred", "released", "duplicate", "dry_run":
+		rec.Status = ev.Event
+	}
+}
+
+// reject records the error the client got for a message that ended
+// without a send attempt, e.g. a template that failed to render
+func (h *deliveryHistory) reject(queueID string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	rec, ok := h.records[queueID]
+	if !ok || rec.Status != "accepted" {
+		return
+	}
+	rec.Status = "rejected"
+	rec.Events = append(rec.Events, historyEvent{Time: time.Now().UTC(), Event: "rejected", Detail: err.Error()})
+}
+
+// lookup returns the records for a queue ID, or for a Message-ID (with or
+// without angle brackets), newest first
+func (h *deliveryHistory) lookup(id string) []deliveryRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ids := []string{id}
+	if _, ok := h.records[id]; !ok {
+		ids = h.byMessageID[messageIDKey(id)]
+	}
+	records := []deliveryRecord{}
+	for i := len(ids) - 1; i >= 0; i-- {
+		if rec, ok := h.records[ids[i]]; ok {
+			copied := *rec
+			copied.Events = append([]historyEvent(nil), rec.Events...)
+			records = append(records, copied)
+		}
+	}
+	return records
+}
+
+func messageIDKey(id string) string {
+	return strings.ToLower(strings.Trim(strings.TrimSpace(id), "<>"))
+}
+
+// queueIDKey carries the queue ID of the message a Graph request is made
+// for, so the pacing observer can add the request to its history
+type queueIDKey struct{}
+
+func withQueueID(ctx context.Context, queueID string) context.Context {
+	return context.WithValue(ctx, queueIDKey{}, queueID)
+}
+
+func queueIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(queueIDKey{}).(string)
+	return id
+}
+
+// graphRequestEvent describes one Graph request and its answer
+func graphRequestEvent(resp *http.Response, err error) historyEvent {
+	ev := historyEvent{Event: "graph_request", Transport: "graph"}
+	if err != nil {
+		ev.Detail = err.Error()
+		return ev
+	}
+	ev.Status = resp.StatusCode
+	ev.RequestID = resp.Header.Get("request-id")
+	return ev
+}
+
+// deliveryEvent records the outcome of a send over transport
+func deliveryEvent(transport string, err error) historyEvent {
+	if err != nil {
+		return historyEvent{Event: "failed", Transport: transport, Detail: err.Error()}
+	}
+	return historyEvent{Event: "sent", Transport: transport}
+}
+
+// sentItem is a message found in the sender's Sent Items
+type sentItem struct {
+	ID                string    `json:"id"`
+	InternetMessageID string    `json:"internet_message_id"`
+	Subject           string    `json:"subject"`
+	SentDateTime      time.Time `json:"sent"`
+}
+
+// findSentItems looks for the message in the sender's Sent Items: by
+// Message-ID, which Graph keeps for MIME sends, or else by subject within
+// an hour of its acceptance. Needs the Mail.ReadBasic.All permission.
+func (bkd *Backend) findSentItems(ctx context.Context, rec deliveryRecord) ([]sentItem, error) {
+	var items []sentItem
+	if rec.MessageID != "" {
+		id := "<" + strings.Trim(strings.TrimSpace(rec.MessageID), "<>") + ">"
+		filter := fmt.Sprintf("internetMessageId eq '%s'", strings.ReplaceAll(id, "'", "''"))
+		found, err := bkd.querySentItems(ctx, rec.From, filter)
+		if err != nil || len(found) > 0 {
+			return found, err
+		}
+	}
+
+	filter := fmt.Sprintf("sentDateTime ge %s and sentDateTime le %s",
+		rec.Accepted.Add(-time.Minute).Format(time.RFC3339), rec.Accepted.Add(time.Hour).Format(time.RFC3339))
+	candidates, err := bkd.querySentItems(ctx, rec.From, filter)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range candidates {
+		if item.Subject == rec.Subject {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+func (bkd *Backend) querySentItems(ctx context.Context, mailbox, filter string) ([]sentItem, error) {
+	top := int32(50)
+	config := &users.ItemMailFoldersItemMessagesRequestBuilderGetRequestConfiguration{
+		QueryParameters: &users.ItemMailFoldersItemMessagesRequestBuilderGetQueryParameters{
+			Filter: &filter,
+			Select: []string{"id", "internetMessageId", "subject", "sentDateTime"},
+			Top:    &top,
+		},
+	}
+	resp, err := bkd.tenant(mailbox).user(mailbox).MailFolders().ByMailFolderId("sentitems").Messages().Get(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []sentItem
+	for _, m := range resp.GetValue() {
+		item := sentItem{}
+		if v := m.GetId(); v != nil {
+			item.ID = *v
+		}
+		if v := m.GetInternetMessageId(); v != nil {
+			item.InternetMessageID = *v
+		}
+		if v := m.GetSubject(); v != nil {
+			item.Subject = *v
+		}
+		if v := m.GetSentDateTime(); v != nil {
+			item.SentDateTime = *v
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// runLookupCommand prints the history of a message from the running
+// relay: lookup [-live] <queue-id|message-id>
+func runLookupCommand(config Config, args []string) error {
+	fs := flag.NewFlagSet("lookup", flag.ContinueOnError)
+	live := fs.Bool("live", false, "also search the sender's Sent Items in Graph")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: lookup [-live] <queue-id|message-id>")
+	}
+
+	query := url.Values{}
+	if *live {
+		query.Set("live", "1")
+	}
+	var result lookupResult
+	if err := adminGet(config, "/messages/"+url.PathEscape(fs.Arg(0)), query, &result); err != nil {
+		return err
+	}
+
+	for i, rec := range result.Records {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("Queue ID:   %s\n", rec.QueueID)
+		fmt.Printf("Message-ID: %s\n", rec.MessageID)
+		fmt.Printf("From:       %s (client %s)\n", rec.From, rec.Client)
+		fmt.Printf("To:         %s\n", strings.Join(rec.To, ", "))
+		fmt.Printf("Subject:    %s\n", rec.Subject)
+		fmt.Printf("Status:     %s after %d attempts\n\n", rec.Status, rec.Attempts)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TIME\tEVENT\tTRANSPORT\tSTATUS\tREQUEST-ID\tDETAIL")
+		for _, ev := range rec.Events {
+			status := ""
+			if ev.Status != 0 {
+				status = strconv.Itoa(ev.Status)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", ev.Time.Local().Format(time.RFC3339), ev.Event, ev.Transport, status, ev.RequestID, ev.Detail)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if *live {
+		fmt.Println()
+		switch {
+		case result.LiveError != "":
+			fmt.Printf("Sent Items lookup failed: %s\n", result.LiveError)
+		case len(result.SentItems) == 0:
+			fmt.Println("Not found in the sender's Sent Items")
+		}
+		for _, item := range result.SentItems {
+			fmt.Printf("In Sent Items since %s: %s\n", item.SentDateTime.Local().Format(time.RFC3339), item.InternetMessageID)
+		}
+	}
+	return nil
+}
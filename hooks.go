@@ -0,0 +1,154 @@
+// hooks.go
+package main
+
+// messageHook is a step of message processing. Site-specific policy,
+// enrichment or side effects are added as a hook in a file of their own
+// that registers it from init, without changing the session code:
+//
+//	func init() { registerHook(tagHook{}) }
+//
+// Hooks run in the order registered, after the built-in ones. A step
+// returns nil to go on, or the error to refuse the command with, usually
+// one of bkd.replies. Embed noopHook to implement only some of the steps.
+type messageHook interface {
+	hookName() string
+	// onConnect runs once per connection, when the client first greets
+	// with HELO or EHLO
+	onConnect(s *Session) error
+	// onAuth runs when the client authenticated as user, before the
+	// session takes it
+	onAuth(s *Session, user string) error
+	// onMail runs for MAIL FROM, before the sender is rewritten or
+	// mapped; from is empty for bounces
+	onMail(s *Session, from string) error
+	// onRcpt runs for every recipient, after rewrites and aliases
+	onRcpt(s *Session, rcpt string) error
+	// preSend runs for a received message before it's held, deferred or
+	// sent. Changes to m.headers are seen by the hooks after it, not
+	// sent.
+	preSend(s *Session, m *hookMessage) error
+	// postSend is told the result of the first delivery attempt: sent,
+	// queued or failed. It can't change the reply.
+	postSend(s *Session, m *hookMessage, result string, err error)
+}
+
+// hookMessage is the message the send hooks see. attachments are only
+// given to preSend, and not for messages that weren't parsed, such as
+// encrypted ones.
+type hookMessage struct {
+	headers     map[string]string
+	subject     string
+	attachments []mimeAttachment
+	data        []byte
+}
+
+// noopHook implements every step by going on
+type noopHook struct{}
+
+func (noopHook) onConnect(s *Session) error                                    { return nil }
+func (noopHook) onAuth(s *Session, user string) error                          { return nil }
+func (noopHook) onMail(s *Session, from string) error                          { return nil }
+func (noopHook) onRcpt(s *Session, rcpt string) error                          { return nil }
+func (noopHook) preSend(s *Session, m *hookMessage) error                      { return nil }
+func (noopHook) postSend(s *Session, m *hookMessage, result string, err error) {}
+
+// registeredHooks are the hooks added with registerHook
+var registeredHooks []messageHook
+
+// registerHook adds a hook to every backend created after it, so it must
+// be called from init
+func registerHook(h messageHook) {
+	registeredHooks = append(registeredHooks, h)
+}
+
+// hookChain runs the hooks of a backend in order; the first error ends a
+// step
+type hookChain []messageHook
+
+// newHookChain returns the built-in hooks followed by the registered ones
+func newHookChain() hookChain {
+	chain := hookChain{senderACLHook{}, attachmentHook{}, scriptHook{}}
+	return append(chain, registeredHooks...)
+}
+
+func (c hookChain) onConnect(s *Session) error {
+	for _, h := range c {
+		if err := h.onConnect(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c hookChain) onAuth(s *Session, user string) error {
+	for _, h := range c {
+		if err := h.onAuth(s, user); err != nil {
+			s.log().Warn("authentication refused", "client", s.clientIP, "listener", s.listener.Name, "user", user, "hook", h.hookName(), "errormsg", err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (c hookChain) onMail(s *Session, from string) error {
+	for _, h := range c {
+		if err := h.onMail(s, from); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c hookChain) onRcpt(s *Session, rcpt string) error {
+	for _, h := range c {
+		if err := h.onRcpt(s, rcpt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c hookChain) preSend(s *Session, m *hookMessage) error {
+	for _, h := range c {
+		if err := h.preSend(s, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c hookChain) postSend(s *Session, m *hookMessage, result string, err error) {
+	for _, h := range c {
+		h.postSend(s, m, result, err)
+	}
+}
+
+// senderACLHook applies the senders section
+type senderACLHook struct{ noopHook }
+
+func (senderACLHook) hookName() string { return "sender_acl" }
+
+func (senderACLHook) onMail(s *Session, from string) error {
+	// The null sender of bounces is left to fallback_sender
+	if from == "" {
+		return nil
+	}
+	if err := s.backend.checkSenderACL(from); err != nil {
+		s.log().Warn("sender rejected", "client", s.clientIP, "from", from, "errormsg", err)
+		return err
+	}
+	return nil
+}
+
+// attachmentHook applies the attachment policy of the content section
+type attachmentHook struct{ noopHook }
+
+func (attachmentHook) hookName() string { return "attachment_policy" }
+
+func (attachmentHook) preSend(s *Session, m *hookMessage) error {
+	if err := s.backend.checkAttachments(m.attachments); err != nil {
+		s.log().Warn("attachment blocked", "client", s.clientIP, "from", s.from, "status", "attachment_blocked", "errormsg", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+// httpserver.go
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// httpReadHeaderTimeout bounds reading the request headers on the relay's
+// HTTP listeners, so clients that never finish a request don't hold
+// connections open. Responses aren't bounded, a CPU profile takes its time.
+const httpReadHeaderTimeout = 10 * time.Second
+
+// newHTTPServer returns the server for one of the relay's HTTP listeners
+func newHTTPServer(address string, handler http.Handler) *http.Server {
+	return &http.Server{Addr: address, Handler: handler, ReadHeaderTimeout: httpReadHeaderTimeout}
+}
+
+// startHTTPServer serves the operational HTTP endpoints (metrics, and the
+// admin API when a token is set) when an http address is configured
+func startHTTPServer(bkd *Backend) {
+	config := bkd.policy().config
+	if config.HTTP.Address == "" {
+		return
+	}
+
+	prometheus.MustRegister(queueCollector{bkd: bkd})
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("GET /healthz", bkd.handleHealthz)
+	mux.HandleFunc("GET /readyz", bkd.handleReadyz)
+	mux.Handle("GET /status", bkd.adminOnly(bkd.handleStatus))
+	mux.Handle("GET /messages/{id}", bkd.adminOnly(bkd.handleLookup))
+	mux.Handle("GET /sessions", bkd.adminOnly(bkd.handleSessions))
+	mux.Handle("GET /limits", bkd.adminOnly(bkd.handleLimits))
+	mux.Handle("GET /limits/{sender}", bkd.adminOnly(bkd.handleSenderLimits))
+	if config.HTTP.AdminToken != "" && bkd.quarantine != nil {
+		mux.Handle("GET /quarantine", bkd.adminOnly(bkd.handleQuarantineList))
+		mux.Handle("GET /quarantine/{id}", bkd.adminOnly(bkd.handleQuarantineShow))
+		mux.Handle("POST /quarantine/{id}/release", bkd.adminOnly(bkd.handleQuarantineRelease))
+		mux.Handle("DELETE /quarantine/{id}", bkd.adminOnly(bkd.handleQuarantineDelete))
+	}
+	if config.HTTP.AdminToken != "" && bkd.retry != nil {
+		mux.Handle("GET /queue", bkd.adminOnly(bkd.handleQueueList))
+		mux.Handle("GET /queue/{id}", bkd.adminOnly(bkd.handleQueueShow))
+		mux.Handle("POST /queue/{id}/retry", bkd.adminOnly(bkd.handleQueueRetry))
+		mux.Handle("POST /queue/flush", bkd.adminOnly(bkd.handleQueueFlush))
+		mux.Handle("DELETE /queue/{id}", bkd.adminOnly(bkd.handleQueueDelete))
+	}
+	if config.HTTP.AdminToken != "" && bkd.quarantine != nil && bkd.retry != nil {
+		mux.Handle("POST /quarantine/{id}/requeue", bkd.adminOnly(bkd.handleQuarantineRequeue))
+	}
+
+	go func() {
+		log.Printf("Starting HTTP server at %s", config.HTTP.Address)
+		if err := newHTTPServer(config.HTTP.Address, mux).ListenAndServe(); err != nil {
+			log.Fatalf("Failed to start HTTP server: %v", err)
+		}
+	}()
+}
+
+// adminOnly requires the admin token as a bearer token, when one is set
+func (bkd *Backend) adminOnly(h http.HandlerFunc) http.Handler {
+	want := []byte("Bearer " + bkd.policy().config.HTTP.AdminToken)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if bkd.policy().config.HTTP.AdminToken != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	})
+}
+
+// handleStatus reports the Graph send pacing for the status command
+func (bkd *Backend) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, pacing.report(bkd.policy().config.mailboxBudget()))
+}
+
+// lookupResult is the history of a message, with what Graph knows about
+// it when asked for
+type lookupResult struct {
+	Records   []deliveryRecord `json:"records"`
+	SentItems []sentItem       `json:"sent_items,omitempty"`
+	LiveError string           `json:"live_error,omitempty"`
+}
+
+// handleLookup returns the history for a queue ID or Message-ID. With
+// live=1 the sender's Sent Items are searched for the newest record.
+func (bkd *Backend) handleLookup(w http.ResponseWriter, r *http.Request) {
+	result := lookupResult{Records: bkd.history.lookup(r.PathValue("id"))}
+	if len(result.Records) == 0 {
+		http.Error(w, "no such message", http.StatusNotFound)
+		return
+	}
+	if r.URL.Query().Get("live") == "1" {
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+		items, err := bkd.findSentItems(ctx, result.Records[0])
+		if err != nil {
+			result.LiveError = err.Error()
+		}
+		result.SentItems = items
+	}
+	writeJSON(w, result)
+}
+
+func (bkd *Backend) handleQuarantineList(w http.ResponseWriter, r *http.Request) {
+	entries, err := bkd.quarantine.list()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, entries)
+}
+
+// handleQuarantineShow returns the held message as received
+func (bkd *Backend) handleQuarantineShow(w http.ResponseWriter, r *http.Request) {
+	_, data, err := bkd.quarantine.get(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Write(data)
+}
+
+func (bkd *Backend) handleQuarantineRelease(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, err := bkd.quarantine.entry(id); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	entry, err := bkd.releaseQuarantined(ctx, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, entry)
+}
+
+func (bkd *Backend) handleQuarantineRequeue(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, err := bkd.quarantine.entry(id); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	entry, err := bkd.requeue(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, entry)
+}
+
+func (bkd *Backend) handleQuarantineDelete(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := bkd.quarantine.remove(id); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	bkd.logger.Info("quarantined message deleted", "quarantine", id, "status", "deleted")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// errRelayUnreachable is returned by adminRequest when the running relay
+// can't be reached, e.g. because it is stopped
+var errRelayUnreachable = errors.New("failed to reach the relay")
+
+// adminGet queries the running relay's HTTP server, as the CLI does, and
+// decodes its JSON answer into v
+func adminGet(config Config, path string, query url.Values, v interface{}) error {
+	return adminRequest(config, "GET", path, query, v)
+}
+
+// adminRequest sends a request to the running relay's HTTP server and
+// decodes its JSON answer into v; a *[]byte receives the answer as it is,
+// and a nil v ignores it
+func adminRequest(config Config, method, path string, query url.Values, v interface{}) error {
+	if config.HTTP.Address == "" {
+		return fmt.Errorf("http.address is not configured")
+	}
+	host, err := localAddress(config.HTTP.Address)
+	if err != nil {
+		return fmt.Errorf("invalid http.address: %v", err)
+	}
+
+	u := url.URL{Scheme: "http", Host: host, Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if config.HTTP.AdminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+config.HTTP.AdminToken)
+	}
+	client := &http.Client{Timeout: time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errRelayUnreachable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("relay answered %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case *[]byte:
+		*v, err = io.ReadAll(resp.Body)
+		return err
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid answer: %v", err)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,76 @@
+// journal.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+	"github.com/microsoftgraph/msgraph-sdk-go/users"
+)
+
+// journalBcc reports whether the journal address is added as a Bcc
+// recipient of every message rather than sent a separate report
+func (c Config) journalBcc() bool {
+	return c.Journal.Address != "" && c.Journal.Mode != "separate"
+}
+
+// journalSeparate reports whether every message is journaled with a
+// separate report
+func (c Config) journalSeparate() bool {
+	return c.Journal.Address != "" && c.Journal.Mode == "separate"
+}
+
+// journalEnvelope is what a journal report records about a message
+type journalEnvelope struct {
+	client     string
+	from       string
+	recipients []string
+	messageID  string
+	subject    string
+}
+
+// sendJournal sends a journal report for a relayed message: the envelope
+// in the body and the message as received attached as .eml, like an
+// Exchange journal report
+func (bkd *Backend) sendJournal(ctx context.Context, env journalEnvelope, data []byte) error {
+	sender := bkd.policy().config.Journal.Sender
+	if sender == "" {
+		sender = env.from
+	}
+
+	subject := "Journal: " + env.subject
+	text := fmt.Sprintf("Sender: %s\r\nRecipients: %s\r\nMessage-ID: %s\r\nSubject: %s\r\nClient: %s\r\n",
+		env.from, strings.Join(env.recipients, ", "), env.messageID, env.subject, env.client)
+	contentType := models.TEXT_BODYTYPE
+	body := models.NewItemBody()
+	body.SetContent(&text)
+	body.SetContentType(&contentType)
+
+	addr := graphAddress(bkd.policy().config.Journal.Address)
+	emailAddress := models.NewEmailAddress()
+	emailAddress.SetAddress(&addr)
+	recipient := models.NewRecipient()
+	recipient.SetEmailAddress(emailAddress)
+
+	msg := models.NewMessage()
+	msg.SetSubject(&subject)
+	msg.SetBody(body)
+	msg.SetToRecipients([]models.Recipientable{recipient})
+	msg.SetAttachments(graphAttachments([]mimeAttachment{{
+		name:        "message.eml",
+		contentType: "message/rfc822",
+		data:        data,
+	}}))
+
+	requestBody := users.NewItemSendMailPostRequestBody()
+	requestBody.SetMessage(msg)
+	saveToSent := false
+	requestBody.SetSaveToSentItems(&saveToSent)
+
+	if err := bkd.tenant(sender).user(sender).SendMail().Post(ctx, requestBody, nil); err != nil {
+		return fmt.Errorf("journal copy to %s failed: %v", bkd.policy().config.Journal.Address, err)
+	}
+	return nil
+}
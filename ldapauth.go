@@ -0,0 +1,141 @@
+// ldapauth.go
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// defaultLDAPTimeout bounds the connection and each request to the
+// directory
+const defaultLDAPTimeout = 10 * time.Second
+
+// LDAPConfig checks SMTP AUTH passwords by binding to an LDAP server or
+// Active Directory as the user
+type LDAPConfig struct {
+	// URL is ldap://host:389 or ldaps://host:636
+	URL string `yaml:"url"`
+	// StartTLS upgrades ldap:// connections before the bind
+	StartTLS bool `yaml:"start_tls"`
+	// CAFile verifies the server certificate, instead of the system CAs
+	CAFile string `yaml:"ca_file"`
+	// BindDN is the DN or, for Active Directory, the user principal name
+	// to bind as; {user} stands for the user name, e.g.
+	// "uid={user},ou=people,dc=example,dc=com" or "{user}@corp.example.com"
+	BindDN string `yaml:"bind_dn"`
+	// GroupFilter, when set, must find an entry below BaseDN once bound,
+	// e.g. the user as a member of the group allowed to relay
+	BaseDN      string        `yaml:"base_dn"`
+	GroupFilter string        `yaml:"group_filter"`
+	Timeout     time.Duration `yaml:"timeout"`
+}
+
+// validate checks the settings of auth.ldap
+func (lc LDAPConfig) validate() error {
+	u, err := url.Parse(lc.URL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		return fmt.Errorf("invalid auth.ldap.url %q, must be ldap:// or ldaps://", lc.URL)
+	}
+	if lc.StartTLS && u.Scheme == "ldaps" {
+		return fmt.Errorf("auth.ldap.start_tls doesn't apply to ldaps://")
+	}
+	if !strings.Contains(lc.BindDN, "{user}") {
+		return fmt.Errorf("auth.ldap.bind_dn must contain {user}")
+	}
+	if lc.GroupFilter != "" && lc.BaseDN == "" {
+		return fmt.Errorf("auth.ldap.group_filter needs a base_dn")
+	}
+	return nil
+}
+
+// ldapError is a directory that couldn't answer, which fails AUTH with a
+// temporary error rather than as wrong credentials
+type ldapError struct {
+	err error
+}
+
+func (e ldapError) Error() string { return e.err.Error() }
+
+// ldapAuthenticator binds to the directory with the user's credentials
+type ldapAuthenticator struct {
+	config    LDAPConfig
+	tlsConfig *tls.Config
+	timeout   time.Duration
+}
+
+func newLDAPAuthenticator(lc LDAPConfig) (*ldapAuthenticator, error) {
+	if lc.URL == "" {
+		return nil, nil
+	}
+	u, _ := url.Parse(lc.URL)
+	la := &ldapAuthenticator{
+		config:    lc,
+		tlsConfig: &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12},
+		timeout:   lc.Timeout,
+	}
+	if la.timeout <= 0 {
+		la.timeout = defaultLDAPTimeout
+	}
+	if lc.CAFile != "" {
+		pem, err := os.ReadFile(lc.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read auth.ldap.ca_file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("auth.ldap.ca_file holds no PEM certificate")
+		}
+		la.tlsConfig.RootCAs = pool
+	}
+	return la, nil
+}
+
+// verify reports whether the directory accepts the password of the user
+// and, with a group_filter, finds the user in the group. The error is set
+// when the directory couldn't answer.
+func (la *ldapAuthenticator) verify(username, password string) (bool, error) {
+	// An empty password would be an unauthenticated bind, which servers
+	// accept for any DN
+	if username == "" || password == "" {
+		return false, nil
+	}
+	conn, err := ldap.DialURL(la.config.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: la.timeout}), ldap.DialWithTLSConfig(la.tlsConfig))
+	if err != nil {
+		return false, ldapError{fmt.Errorf("failed to connect to LDAP server: %v", err)}
+	}
+	defer conn.Close()
+	conn.SetTimeout(la.timeout)
+	if la.config.StartTLS {
+		if err := conn.StartTLS(la.tlsConfig); err != nil {
+			return false, ldapError{fmt.Errorf("LDAP StartTLS failed: %v", err)}
+		}
+	}
+
+	dn := strings.ReplaceAll(la.config.BindDN, "{user}", ldap.EscapeDN(username))
+	if err := conn.Bind(dn, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return false, nil
+		}
+		return false, ldapError{fmt.Errorf("LDAP bind failed: %v", err)}
+	}
+	if la.config.GroupFilter == "" {
+		return true, nil
+	}
+
+	filter := strings.ReplaceAll(la.config.GroupFilter, "{user}", ldap.EscapeFilter(username))
+	result, err := conn.Search(ldap.NewSearchRequest(la.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		1, int(la.timeout.Seconds()), false, filter, []string{"dn"}, nil))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return false, ldapError{fmt.Errorf("LDAP group search failed: %v", err)}
+	}
+	return result != nil && len(result.Entries) > 0, nil
+}
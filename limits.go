@@ -0,0 +1,252 @@
+// limits.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	quotaExceeded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gographsmtp_quota_exceeded_total",
+		Help: "MAIL commands refused because the sender used up its quota, per sender and period (hourly, daily).",
+	}, []string{"sender", "period"})
+	submissionsLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gographsmtp_submission_limited_total",
+		Help: "MAIL and RCPT commands refused by the submission rate limits, per scope (global, client, user) and unit (messages, recipients).",
+	}, []string{"scope", "unit"})
+)
+
+// messageTooLarge is returned for a message beyond the session's size
+// limit, declared with SIZE in MAIL FROM or found as soon as DATA grows
+// past it; the rest of the message is then discarded without being
+// buffered. It wraps go-smtp's ErrDataTooLarge so statusError answers both
+// the same way.
+type messageTooLarge struct {
+	limit int64
+}
+
+func (e messageTooLarge) Error() string {
+	return fmt.Sprintf("message exceeds %d bytes", e.limit)
+}
+
+func (e messageTooLarge) Unwrap() error {
+	return smtp.ErrDataTooLarge
+}
+
+// errMessageTooLarge answers a message beyond the size limit with 552 5.3.4,
+// the code go-smtp uses for its own size checks
+func (bkd *Backend) errMessageTooLarge(limit int64) error {
+	return bkd.replies.error(552, smtp.EnhancedCode{5, 3, 4}, "message_too_large", "limit", strconv.FormatInt(limit, 10))
+}
+
+// errLineTooLong reports content lines beyond the RFC 5321 limit
+func (bkd *Backend) errLineTooLong(limit int) error {
+	return bkd.replies.error(554, smtp.EnhancedCode{5, 6, 0}, "line_too_long", "limit", strconv.Itoa(limit))
+}
+
+// errBareLineEndings rejects content with bare CR or LF line endings when
+// line_endings is set to reject
+func (bkd *Backend) errBareLineEndings() error {
+	return bkd.replies.error(554, smtp.EnhancedCode{5, 6, 0}, "bare_line_endings")
+}
+
+// rateLimit returns the messages per minute allowed for senders of the
+// domain, 0 for no limit
+func (c Config) rateLimit(dc DomainConfig) int {
+	if dc.RateLimit.MessagesPerMinute > 0 {
+		return dc.RateLimit.MessagesPerMinute
+	}
+	return c.RateLimit.MessagesPerMinute
+}
+
+// rateKey is the store key counting the sender's messages in the minute
+func rateKey(from string, now time.Time) string {
+	return fmt.Sprintf("rate:%s:%d", strings.ToLower(from), now.Unix()/60)
+}
+
+// checkSenderRate counts a new transaction for the sender and rejects it
+// once the per-minute limit of its domain, or the global one, is exceeded. Store errors fail open so a Redis
+// outage never stops mail flow.
+func (bkd *Backend) checkSenderRate(from string, dc DomainConfig) error {
+	limit := bkd.policy().config.rateLimit(dc)
+	if limit <= 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	count, err := bkd.store.Incr(ctx, rateKey(from, time.Now()), time.Minute)
+	if err != nil {
+		bkd.logger.Warn("rate limit store failed", "from", from, "errormsg", err)
+		return nil
+	}
+
+	if count > int64(limit) {
+		return bkd.replies.error(450, smtp.EnhancedCode{4, 7, 1}, "rate_limited", "limit", strconv.Itoa(limit), "sender", from)
+	}
+	return nil
+}
+
+// quota returns the quotas of an authenticated user or envelope sender:
+// its quotas.overrides entry, an address winning over a domain, or else
+// the default quotas
+func (c Config) quota(identity string) QuotaConfig {
+	best, quota := "", c.Quotas.QuotaConfig
+	for pattern, q := range c.Quotas.Overrides {
+		if !matchAddress(pattern, identity) {
+			continue
+		}
+		if !strings.Contains(pattern, "*") && !strings.HasPrefix(pattern, "@") {
+			return q
+		}
+		if len(pattern) > len(best) {
+			best, quota = pattern, q
+		}
+	}
+	return quota
+}
+
+// quotaPeriod is a quota's limit in an hour or day, with the store key
+// counting the sender's messages in the current one
+type quotaPeriod struct {
+	name, unit string
+	limit      int
+	key        string
+	window     time.Duration
+}
+
+// periods returns the hourly and daily quota periods of the identity;
+// hours and days are UTC
+func (q QuotaConfig) periods(identity string, now time.Time) []quotaPeriod {
+	id, now := strings.ToLower(identity), now.UTC()
+	return []quotaPeriod{
+		{"hourly", "hour", q.MessagesPerHour, fmt.Sprintf("quota:%s:%s", id, now.Format("2006010215")), time.Hour},
+		{"daily", "day", q.MessagesPerDay, fmt.Sprintf("quota:%s:%s", id, now.Format("20060102")), 24 * time.Hour},
+	}
+}
+
+// checkSenderQuota counts a new transaction against the hourly and daily
+// quotas of the authenticated user, or else the envelope sender, and
+// rejects it with 452 once one is used up. Hours and days are UTC. Like
+// the rate limit, store errors fail open.
+func (bkd *Backend) checkSenderQuota(identity string) error {
+	quota := bkd.policy().config.quota(identity)
+	if quota.MessagesPerHour <= 0 && quota.MessagesPerDay <= 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	for _, p := range quota.periods(identity, time.Now()) {
+		if p.limit <= 0 {
+			continue
+		}
+		count, err := bkd.store.Incr(ctx, p.key, p.window)
+		if err != nil {
+			bkd.logger.Warn("quota store failed", "from", identity, "errormsg", err)
+			return nil
+		}
+		if count > int64(p.limit) {
+			quotaExceeded.WithLabelValues(bkd.labels.sender(identity), p.name).Inc()
+			return bkd.replies.error(452, smtp.EnhancedCode{4, 7, 1}, "quota_exceeded", "period", p.unit, "limit", strconv.Itoa(p.limit), "sender", identity)
+		}
+	}
+	return nil
+}
+
+// claimMessageID records the Message-ID for the sender and reports whether
+// this is the first submission inside the dedup window. The returned
+// release func undoes the claim when the send fails so a retry goes through.
+func (bkd *Backend) claimMessageID(from, messageID string) (bool, func()) {
+	noop := func() {}
+	if !bkd.policy().config.Dedup.Enabled || messageID == "" {
+		return true, noop
+	}
+
+	ttl := bkd.policy().config.Dedup.TTL
+	if ttl <= 0 {
+		ttl = 10 * time.Minute
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	key := fmt.Sprintf("dedup:%s:%s", strings.ToLower(from), messageID)
+	first, err := bkd.store.SetNX(ctx, key, ttl)
+	if err != nil {
+		bkd.logger.Warn("dedup store failed", "from", from, "errormsg", err)
+		return true, noop
+	}
+
+	release := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if err := bkd.store.Del(ctx, key); err != nil {
+			bkd.logger.Warn("dedup store failed", "from", from, "errormsg", err)
+		}
+	}
+	return first, release
+}
+
+// submissionScope is a submission rate limit that applies to a session
+type submissionScope struct {
+	name  string // global, client or user
+	id    string // the client IP or user, "" for global
+	limit SubmissionLimit
+}
+
+// perMinute returns the limit of messages or recipients
+func (l SubmissionLimit) perMinute(unit string) int {
+	if unit == "recipients" {
+		return l.RecipientsPerMinute
+	}
+	return l.MessagesPerMinute
+}
+
+// checkSubmissionRate counts a message (at MAIL) or recipient (at RCPT)
+// against the global submission limit and those of the client IP and the
+// authenticated user, and refuses it with 450 once one is exceeded in the
+// current minute. Like the sender rate limit, store errors fail open.
+func (s *Session) checkSubmissionRate(unit string) error {
+	rl := s.backend.policy().config.RateLimit
+	scopes := []submissionScope{{"global", "", rl.Global}, {"client", s.clientIP, rl.PerClient}}
+	if s.authUser != "" {
+		scopes = append(scopes, submissionScope{"user", s.authUser, rl.PerUser})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	minute := time.Now().Unix() / 60
+	for _, scope := range scopes {
+		limit := scope.limit.perMinute(unit)
+		if limit <= 0 {
+			continue
+		}
+		key := fmt.Sprintf("submit:%s:%s:%s:%d", unit, scope.name, strings.ToLower(scope.id), minute)
+		count, err := s.backend.store.Incr(ctx, key, time.Minute)
+		if err != nil {
+			s.log().Warn("rate limit store failed", "client", s.clientIP, "errormsg", err)
+			return nil
+		}
+		if count > int64(limit) {
+			submissionsLimited.WithLabelValues(scope.name, unit).Inc()
+			who := scope.id
+			if who == "" {
+				who = "all clients"
+			}
+			return s.backend.replies.error(450, smtp.EnhancedCode{4, 7, 1}, "submission_limited", "limit", strconv.Itoa(limit), "unit", unit, "scope", scope.name, "who", who)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+// listener.go
+package main
+
+import (
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+const (
+	// defaultMaxMessageBytes is the message size limit without a
+	// max_message_bytes setting
+	defaultMaxMessageBytes = 1024 * 1024
+	// graphMaxMessageBytes is the largest message Exchange Online accepts,
+	// with attachments uploaded in chunks
+	graphMaxMessageBytes = 150 << 20
+	// defaultMaxRecipients is the recipient limit without a max_recipients
+	// setting
+	defaultMaxRecipients = 50
+	// defaultWriteTimeout bounds writing a reply without a write_timeout
+	// setting
+	defaultWriteTimeout = 10 * time.Second
+	// defaultIdleTimeout and defaultDataTimeout are a listener's read
+	// timeouts without idle_timeout and data_timeout settings. The DATA
+	// timeout bounds the whole transfer, which takes minutes for a large
+	// message over a slow link; a transfer that stalls is cut off by the
+	// idle timeout, which also applies between reads of the content.
+	defaultIdleTimeout = 10 * time.Second
+	defaultDataTimeout = 10 * time.Minute
+)
+
+// newServer creates the go-smtp server for one listener using TLS as
+// tlsMode says. Read deadlines are managed by sessionConn so idle and DATA
+// timeouts can differ.
+func newServer(backend *Backend, lc ListenerConfig, tlsMode string) *smtp.Server {
+	s := smtp.NewServer(backend)
+
+	s.Addr = lc.Address
+	s.Domain = lc.Hostname
+	s.WriteTimeout = defaultWriteTimeout
+	if d := backend.policy().config.SMTP.WriteTimeout; d > 0 {
+		s.WriteTimeout = d
+	}
+	// SIZE advertises the limit, and MAIL FROM with a larger SIZE gets 552
+	s.MaxMessageBytes = backend.policy().config.maxMessageBytes(lc)
+	s.MaxRecipients = lc.MaxRecipients
+	s.MaxLineLength = 1000
+	if n := backend.policy().config.SMTP.MaxLineLength; n > 0 {
+		s.MaxLineLength = n
+	}
+	// TLS is handled by sessionConn below go-smtp, so go-smtp always sees
+	// a plaintext connection and only offers AUTH with AllowInsecureAuth.
+	// It's off where plaintext_auth: deny leaves no connection AUTH is
+	// allowed on; elsewhere the session enforces plaintext_auth.
+	s.AllowInsecureAuth = lc.PlaintextAuth != "deny" || tlsMode != "none"
+	s.EnableDSN = backend.policy().config.SMTP.DSN
+	// UTF-8 addresses and headers (RFC 6531) are passed on to Graph;
+	// go-smtp always offers 8BITMIME
+	s.EnableSMTPUTF8 = true
+	s.LMTP = lc.LMTP
+
+	backend.listeners[s] = lc
+	return s
+}
@@ -0,0 +1,60 @@
+// lmtp.go
+package main
+
+import (
+	"io"
+
+	"github.com/emersion/go-smtp"
+)
+
+// LMTPData receives a message on an LMTP listener. The message is sent
+// before the reply, and every recipient gets its own: a recipient whose
+// batch failed is deferred or rejected while the others are accepted, so
+// the MTA in front retries or bounces only that one.
+func (s *Session) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	given, givenAs := s.given, s.givenAs
+	s.lmtp = make(map[string]error)
+	defer func() {
+		s.lmtp = nil
+	}()
+	err := s.Data(r)
+	// Once for every time a recipient was given; the rest get err. A
+	// rewritten recipient or an alias fails with the first of the
+	// recipients it gave that failed.
+	for _, rcpt := range given {
+		rcptErr, ok := s.lmtp[rcpt]
+		for member, original := range givenAs {
+			if original == rcpt && !ok {
+				rcptErr, ok = s.lmtp[member]
+			}
+		}
+		if ok {
+			status.SetStatus(rcpt, rcptErr)
+		}
+	}
+	return err
+}
+
+// lmtpStatus records the result of the send to an LMTP recipient
+func (s *Session) lmtpStatus(rcpt string, err error) {
+	if s.lmtp == nil {
+		return
+	}
+	// Only the client's recipients get replies, not the relay's own Bcc
+	found := false
+	for _, to := range s.to {
+		found = found || to == rcpt
+	}
+	if !found {
+		return
+	}
+	switch {
+	case throttled(err):
+		err = s.backend.replies.error(451, smtp.EnhancedCode{4, 4, 5}, "graph_throttled")
+	case permanentError(err):
+		err = s.backend.replies.error(550, smtp.EnhancedCode{5, 1, 1}, "recipient_failed", "recipient", rcpt)
+	default:
+		err = s.backend.replies.error(451, smtp.EnhancedCode{4, 4, 0}, "recipient_deferred", "recipient", rcpt)
+	}
+	s.lmtp[rcpt] = err
+}
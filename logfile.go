@@ -0,0 +1,148 @@
+// logfile.go
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rotatedSuffix is appended to a rotated log file; it sorts by time
+const rotatedSuffix = "20060102-150405.000"
+
+// logFile is the log_file, rotated when it reaches log.max_size_mb or is
+// older than log.rotate_every. Rotated files are renamed with a timestamp
+// and removed beyond log.max_backups and log.max_age.
+type logFile struct {
+	path       string
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+	maxAge     time.Duration
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func newLogFile(path string, config Config) (*logFile, error) {
+	lf := &logFile{
+		path:       path,
+		maxSize:    int64(config.Log.MaxSizeMB) << 20,
+		interval:   config.Log.RotateEvery,
+		maxBackups: config.Log.MaxBackups,
+		maxAge:     config.Log.MaxAge,
+	}
+	if err := lf.open(); err != nil {
+		return nil, fmt.Errorf("failed to open log file: %v", err)
+	}
+	return lf, nil
+}
+
+func (lf *logFile) open() error {
+	f, err := os.OpenFile(lf.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	lf.f, lf.size, lf.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+// reopen opens log_file again, e.g. after logrotate moved it away
+func (lf *logFile) reopen() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	old := lf.f
+	if err := lf.open(); err != nil {
+		return err
+	}
+	old.Close()
+	return nil
+}
+
+// reopenLogs opens the log and audit files again
+func (bkd *Backend) reopenLogs() {
+	for _, lf := range bkd.logFiles {
+		if err := lf.reopen(); err != nil {
+			bkd.logger.Error("reopening log file failed", "file", lf.path, "errormsg", err)
+			continue
+		}
+		bkd.logger.Info("log file reopened", "file", lf.path)
+	}
+}
+
+func (lf *logFile) Write(p []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.due(len(p)) {
+		// A failed rotation keeps writing to the current file rather than
+		// losing log lines
+		if err := lf.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "log rotation failed: %v\n", err)
+		}
+	}
+	n, err := lf.f.Write(p)
+	lf.size += int64(n)
+	return n, err
+}
+
+// due reports whether the file has to be rotated before writing n bytes
+func (lf *logFile) due(n int) bool {
+	if lf.size == 0 {
+		return false
+	}
+	if lf.maxSize > 0 && lf.size+int64(n) > lf.maxSize {
+		return true
+	}
+	return lf.interval > 0 && time.Since(lf.opened) >= lf.interval
+}
+
+func (lf *logFile) rotate() error {
+	rotated := lf.path + "." + time.Now().Format(rotatedSuffix)
+	if err := os.Rename(lf.path, rotated); err != nil {
+		return err
+	}
+	old := lf.f
+	if err := lf.open(); err != nil {
+		// Keep the renamed file open, lines still reach the disk
+		return err
+	}
+	old.Close()
+	lf.prune()
+	return nil
+}
+
+// prune removes the rotated files beyond max_backups or older than
+// max_age
+func (lf *logFile) prune() {
+	if lf.maxBackups <= 0 && lf.maxAge <= 0 {
+		return
+	}
+	rotated, err := filepath.Glob(lf.path + ".*")
+	if err != nil {
+		return
+	}
+	// Newest first
+	sort.Sort(sort.Reverse(sort.StringSlice(rotated)))
+	kept := 0
+	for _, name := range rotated {
+		stamp, err := time.ParseInLocation(rotatedSuffix, name[len(lf.path)+1:], time.Local)
+		if err != nil {
+			continue
+		}
+		if lf.maxBackups > 0 && kept >= lf.maxBackups || lf.maxAge > 0 && time.Since(stamp) > lf.maxAge {
+			os.Remove(name)
+			continue
+		}
+		kept++
+	}
+}
@@ -0,0 +1,62 @@
+// logging.go
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+)
+
+// newLogger returns the relay's logger, writing key=value lines or JSON
+// objects at log.level and above
+func newLogger(w io.Writer, config Config) *slog.Logger {
+	var level slog.Level
+	switch config.Log.Level {
+	case "debug":
+		level = slog.LevelDebug
+	case "warn":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler = slog.NewTextHandler(w, opts)
+	if config.Log.Format == "json" {
+		handler = slog.NewJSONHandler(w, opts)
+	}
+	// A Windows service also writes warnings and errors to the event log
+	if eventLog := newEventLogHandler(); eventLog != nil {
+		handler = teeHandler{handler, eventLog}
+	}
+	return slog.New(handler)
+}
+
+// teeHandler passes records to both handlers
+type teeHandler struct {
+	a, b slog.Handler
+}
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return t.a.Enabled(ctx, level) || t.b.Enabled(ctx, level)
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var err error
+	if t.a.Enabled(ctx, r.Level) {
+		err = t.a.Handle(ctx, r.Clone())
+	}
+	if t.b.Enabled(ctx, r.Level) {
+		if e := t.b.Handle(ctx, r); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return teeHandler{t.a.WithAttrs(attrs), t.b.WithAttrs(attrs)}
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	return teeHandler{t.a.WithGroup(name), t.b.WithGroup(name)}
+}
@@ -3,201 +3,1510 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"sort"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
-	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
-	msgraphsdk "github.com/microsoftgraph/msgraph-sdk-go"
 	"github.com/microsoftgraph/msgraph-sdk-go/models"
 	"github.com/microsoftgraph/msgraph-sdk-go/users"
-	"gopkg.in/yaml.v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// Config represents the structure of the configuration file
-type Config struct {
-	Azure struct {
-		ClientID     string `yaml:"client_id"`
-		ClientSecret string `yaml:"client_secret"`
-		TenantID     string `yaml:"tenant_id"`
-	} `yaml:"azure"`
-	SMTP struct {
-		Address string `yaml:"address"`
-		Domain  string `yaml:"domain"`
-	} `yaml:"smtp"`
-	LogFile string `yaml:"log_file"`
-}
-
 // Backend implements the go-smtp Backend interface
 type Backend struct {
-	graphClient *msgraphsdk.GraphServiceClient
-	config      Config
-	logger      *log.Logger
+	// tenants are the tenants messages are sent through, the default
+	// tenant first
+	tenants []*graphTenant
+	// uploadClient puts attachment chunks to Graph upload sessions
+	uploadClient *http.Client
+	// current holds the config and the policies built from it, replaced
+	// on SIGHUP
+	current    atomic.Pointer[policySet]
+	logger     *slog.Logger
+	store      SharedStore
+	replies    replyCatalog
+	quarantine *spoolStore
+	deferred   *spoolStore
+	retry      *spoolStore
+	workers    *workerPool
+	hooks      hookChain
+	memory     *memoryBudget
+	labels     *metricLabels
+	history    *deliveryHistory
+	audit      *auditLog
+	logFiles   []*logFile // log_file and audit.file, reopened on SIGUSR1
+	listeners  map[*smtp.Server]ListenerConfig
+	listening  atomic.Int32 // listeners bound to their address
+	sessions   *sessionTracker
 }
 
 // NewBackend creates a new backend with a configured Graph client
 func NewBackend(config Config) (*Backend, error) {
-	logFile, err := os.OpenFile(config.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	logFile, err := newLogFile(config.LogFile, config)
+	if err != nil {
+		return nil, err
+	}
+	logger := newLogger(logFile, config)
+
+	transport, err := graphTransport(config)
+	if err != nil {
+		return nil, err
+	}
+
+	chaos := false
+	if config.Chaos.Enabled {
+		if os.Getenv(chaosEnv) == "1" {
+			log.Printf("WARNING: chaos mode is on, Graph requests fail at random")
+			logger.Warn("chaos mode is on", "status", "chaos_mode", "throttle_rate", config.Chaos.ThrottleRate,
+				"server_error_rate", config.Chaos.ServerErrorRate, "timeout_rate", config.Chaos.TimeoutRate)
+			chaos = true
+		} else {
+			log.Printf("chaos.enabled is ignored unless %s=1 is set", chaosEnv)
+		}
+	}
+	labels := newMetricLabels(config)
+	history := newDeliveryHistory(config)
+	tenants, err := newGraphTenants(graphDeps{config: config, transport: transport, logger: logger, labels: labels, history: history, chaos: chaos})
+	if err != nil {
+		return nil, err
+	}
+
+	replies, err := newReplyCatalog(config.Replies)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open log file: %v", err)
+		return nil, err
+	}
+
+	policy, err := newPolicySet(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var quarantine *spoolStore
+	if len(config.Quarantine.Rules) > 0 && config.Quarantine.Directory == "" {
+		return nil, fmt.Errorf("quarantine rules need a quarantine.directory")
+	}
+	if config.Quarantine.Directory != "" {
+		quarantine, err = newSpoolStore(config.Quarantine.Directory)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var deferred *spoolStore
+	if len(policy.sendWindows) > 0 && config.SendWindows.Directory == "" {
+		return nil, fmt.Errorf("send windows need a send_windows.directory")
+	}
+	if config.SendWindows.Directory != "" {
+		deferred, err = newSpoolStore(config.SendWindows.Directory)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var retry *spoolStore
+	if config.Spool.Directory != "" {
+		retry, err = newSpoolStore(config.Spool.Directory)
+		if err != nil {
+			return nil, err
+		}
 	}
-	logger := log.New(logFile, "", 0)
 
-	cred, err := azidentity.NewClientSecretCredential(
-		config.Azure.TenantID,
-		config.Azure.ClientID,
-		config.Azure.ClientSecret,
-		nil,
-	)
+	store, err := newSharedStore(config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create credential: %v", err)
+		return nil, err
 	}
 
-	graphClient, err := msgraphsdk.NewGraphServiceClientWithCredentials(cred, []string{"https://graph.microsoft.com/.default"})
+	audit, err := newAuditLog(config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create graph client: %v", err)
+		return nil, err
 	}
 
-	return &Backend{
-		graphClient: graphClient,
-		config:      config,
-		logger:      logger,
-	}, nil
+	bkd := &Backend{
+		tenants:      tenants,
+		uploadClient: &http.Client{Transport: transport},
+		logger:       logger,
+		store:        store,
+		replies:      replies,
+		quarantine:   quarantine,
+		deferred:     deferred,
+		retry:        retry,
+		workers:      newWorkerPool(config),
+		memory:       newMemoryBudget(config),
+		hooks:        newHookChain(),
+		labels:       labels,
+		history:      history,
+		audit:        audit,
+		listeners:    make(map[*smtp.Server]ListenerConfig),
+		sessions:     newSessionTracker(),
+	}
+	bkd.logFiles = append(bkd.logFiles, logFile)
+	if audit != nil {
+		bkd.logFiles = append(bkd.logFiles, audit.file)
+	}
+	bkd.current.Store(policy)
+	return bkd, nil
 }
 
 // NewSession creates a new SMTP session
-func (bkd *Backend) NewSession(_ *smtp.Conn) (smtp.Session, error) {
-	return &Session{
-		backend: bkd,
-	}, nil
+func (bkd *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	s := &Session{
+		backend:         bkd,
+		conn:            c,
+		listener:        bkd.listeners[c.Server()],
+		clientIP:        clientIP(c.Conn().RemoteAddr()),
+		maxMessageBytes: bkd.listeners[c.Server()].MaxMessageBytes,
+	}
+
+	// Client overrides apply on top of the listener defaults
+	if cc, ok := bkd.clientConfig(addrIP(c.Conn().RemoteAddr()), c.Hostname()); ok {
+		s.client = cc
+		if cc.MaxMessageBytes > 0 {
+			s.maxMessageBytes = cc.MaxMessageBytes
+		}
+		if sc := sessionConnOf(c.Conn()); sc != nil {
+			sc.setTimeouts(cc.IdleTimeout, cc.DataTimeout)
+		}
+		bkd.logger.Info("client override applied", "client", s.clientIP, "helo", c.Hostname(), "status", "client_override")
+	}
+	if sc := sessionConnOf(c.Conn()); sc != nil {
+		sc.setMessageLimit(s.maxMessageBytes)
+	}
+	// go-smtp starts a new session at every HELO or EHLO, e.g. after
+	// STARTTLS, without ending the previous one. The connection is one
+	// trace, its commands and deliveries are spans in it, and the hooks
+	// see it once, at the first greeting.
+	prev, _ := c.Session().(*Session)
+	if prev != nil {
+		s.traceCtx, s.span = prev.traceCtx, prev.span
+	} else {
+		s.traceCtx, s.span = tracer.Start(context.Background(), "smtp.session", trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("client.address", s.clientIP), attribute.String("smtp.listener", s.listener.Name)))
+	}
+	s.dataCtx = s.traceCtx
+	if err := bkd.checkHelo(c.Hostname()); err != nil {
+		s.log().Warn("HELO rejected", "client", s.clientIP, "helo", c.Hostname(), "errormsg", err)
+		// The previous session stays and ends the span
+		if prev == nil {
+			endSpan(s.span, err)
+		}
+		return nil, err
+	}
+	if prev == nil {
+		if err := bkd.hooks.onConnect(s); err != nil {
+			endSpan(s.span, err)
+			return nil, err
+		}
+	}
+	return s, nil
 }
 
 // Session represents an SMTP session
 type Session struct {
-	backend *Backend
-	from    string
-	to      []string
+	backend  *Backend
+	conn     *smtp.Conn
+	listener ListenerConfig
+	clientIP string
+	client   ClientConfig // overrides for this client
+	authUser string
+	identity string         // authenticated user, or else envelope sender
+	queueID  string         // of the message being delivered
+	sentID   string         // Internet message ID Graph gave the message, when known
+	control  messageControl // X-GoGraph-* headers of the message
+	domain   DomainConfig   // settings of the sender's domain
+	from     string
+	mapped   bool  // from was mapped to a mailbox by sender_map
+	saveSent *bool // sender_map override of graph.save_to_sent
+	dsn      *dsnRequest
+	virus    string // found in the message by the virus scan
+	to       []string
+	given    []string           // recipients as given at RCPT TO, before rewrites and aliases
+	givenAs  map[string]string  // recipients from a rewrite or alias, to the address given
+	lmtp     map[string]error   // replies of failed recipients, during LMTPData
+	message  models.Messageable // Graph message being sent, unless sent as MIME
+
+	maxMessageBytes int64
+	// userToken sends the messages of an AUTH XOAUTH2 user as that user
+	userToken *userToken
+
+	// traceCtx holds the session's span, dataCtx the span of the message
+	// being delivered
+	traceCtx context.Context
+	dataCtx  context.Context
+	span     trace.Span
+}
+
+// AuthMechanisms returns the SASL mechanisms offered in the EHLO reply:
+// PLAIN and LOGIN with configured accounts, XOAUTH2 with auth.xoauth2.
+// Listeners with plaintext_auth: hidden or deny only offer them after
+// STARTTLS.
+func (s *Session) AuthMechanisms() []string {
+	if !s.tlsActive() && (s.listener.PlaintextAuth == "hidden" || s.listener.PlaintextAuth == "deny") {
+		return nil
+	}
+	var mechs []string
+	if s.backend.policy().auth != nil {
+		mechs = append(mechs, sasl.Plain, sasl.Login)
+	}
+	if s.backend.policy().config.Auth.XOAuth2 {
+		mechs = append(mechs, xoauth2Mechanism)
+	}
+	return mechs
+}
+
+// Auth starts the SASL exchange for the mechanism chosen by the client
+func (s *Session) Auth(mech string) (sasl.Server, error) {
+	accounts, xoauth2 := s.backend.policy().auth != nil, s.backend.policy().config.Auth.XOAuth2
+	if !accounts && !xoauth2 {
+		return nil, smtp.ErrAuthUnsupported
+	}
+	if !s.tlsActive() && s.listener.PlaintextAuth == "deny" {
+		return nil, s.backend.errTLSRequired()
+	}
+	switch {
+	case mech == sasl.Plain && accounts:
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			return s.AuthPlain(username, password)
+		}), nil
+	case mech == sasl.Login && accounts:
+		return sasl.NewLoginServer(s.AuthPlain), nil
+	case mech == xoauth2Mechanism && xoauth2:
+		return &xoauth2Server{authenticate: s.authXOAuth2}, nil
+	}
+	return nil, smtp.ErrAuthUnknownMechanism
 }
 
+// AuthPlain checks the credentials of AUTH PLAIN and LOGIN
 func (s *Session) AuthPlain(username, password string) error {
+	ok, err := s.backend.policy().auth.verify(username, password)
+	if err != nil {
+		s.log().Error("reading credentials", "errormsg", err)
+	}
+	var directoryErr ldapError
+	if !ok && errors.As(err, &directoryErr) {
+		return s.backend.replies.error(454, smtp.EnhancedCode{4, 7, 0}, "auth_unavailable")
+	}
+	if !ok {
+		s.log().Warn("authentication failed", "client", s.clientIP, "listener", s.listener.Name, "user", username)
+		return s.backend.replies.error(535, smtp.EnhancedCode{5, 7, 8}, "auth_failed")
+	}
+	if err := s.backend.hooks.onAuth(s, username); err != nil {
+		return err
+	}
+	s.authUser = username
 	s.from = username
+	s.log().Info("authenticated", "client", s.clientIP, "listener", s.listener.Name, "user", username, "status", "authenticated")
 	return nil
 }
 
-func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
+// authCertificate authenticates the session as the user of the client
+// certificate verified in the TLS handshake, if any
+func (s *Session) authCertificate() {
+	sc := sessionConnOf(s.conn.Conn())
+	if sc == nil {
+		return
+	}
+	if user := sc.authenticateCertificate(); user != "" {
+		// A hook refusing the user leaves the session unauthenticated
+		if s.backend.hooks.onAuth(s, user) != nil {
+			return
+		}
+		s.authUser = user
+		s.log().Info("authenticated", "client", s.clientIP, "listener", s.listener.Name, "user", user, "method", "certificate", "status", "authenticated")
+	}
+}
+
+// tlsActive reports whether the session is encrypted, by implicit TLS or
+// after STARTTLS
+func (s *Session) tlsActive() bool {
+	if _, ok := s.conn.TLSConnectionState(); ok {
+		return true
+	}
+	sc := sessionConnOf(s.conn.Conn())
+	return sc != nil && sc.tlsActive()
+}
+
+func (s *Session) Mail(from string, opts *smtp.MailOptions) (err error) {
+	_, span := s.startSpan("smtp.mail", attribute.String("smtp.mail_from", from))
+	defer func() {
+		endSpan(span, err)
+		err = s.backend.statusError(err)
+	}()
+
+	if s.authUser == "" {
+		s.authCertificate()
+	}
+	if s.listener.RequireAuth && s.authUser == "" {
+		s.log().Warn("authentication required", "client", s.clientIP, "listener", s.listener.Name, "from", from)
+		return s.backend.errAuthRequired()
+	}
+	if s.listener.DNSBL && s.authUser == "" {
+		if err := s.backend.checkDNSBL(addrIP(s.conn.Conn().RemoteAddr())); err != nil {
+			s.log().Warn("client blocklisted", "client", s.clientIP, "listener", s.listener.Name, "from", from, "errormsg", err)
+			return err
+		}
+	}
+
+	s.dsn = newDSNRequest(opts)
+	if opts != nil && opts.Size > s.maxMessageBytes {
+		s.log().Warn("message too large", "client", s.clientIP, "from", from, "errormsg", fmt.Sprintf("declared size %d exceeds %d bytes", opts.Size, s.maxMessageBytes))
+		return messageTooLarge{s.maxMessageBytes}
+	}
+	if s.client.Sender != "" && from != s.client.Sender {
+		s.log().Info("sender rewritten", "client", s.clientIP, "from", from, "status", "rewritten", "sender", s.client.Sender)
+		from = s.client.Sender
+	}
+
+	// The authenticated identity selects the domain settings, otherwise
+	// the envelope sender does
+	identity := from
+	if s.authUser != "" {
+		identity = s.authUser
+	}
+	s.identity = identity
+	s.domain = s.backend.policy().config.domain(identity)
+
+	if err := s.backend.hooks.onMail(s, from); err != nil {
+		return err
+	}
+	// The null sender of bounces is left to fallback_sender
+	if from != "" {
+		if s.authUser != "" {
+			if err := s.backend.checkSenderBinding(s.authUser, from); err != nil {
+				s.log().Warn("sender not allowed for user", "client", s.clientIP, "from", from, "user", s.authUser, "status", "sender_not_owned", "errormsg", err)
+				return err
+			}
+		}
+	}
+
+	if from == "" && s.domain.FallbackSender != "" {
+		s.log().Info("sender rewritten", "client", s.clientIP, "from", "", "status", "rewritten", "sender", s.domain.FallbackSender)
+		from = s.domain.FallbackSender
+	} else if err := s.backend.checkSender(from, s.domain); err != nil {
+		s.log().Warn("sender rejected", "client", s.clientIP, "from", from, "errormsg", err)
+		return err
+	}
+	// Policy applies to the sender the client used, rate limits to the
+	// mailbox that sends
+	s.saveSent = s.backend.senderMapping(from).SaveToSent
+	if mailbox := s.backend.mapSender(from); mailbox != from {
+		s.log().Info("sender mapped", "client", s.clientIP, "from", from, "status", "mapped", "sender", mailbox)
+		from = mailbox
+		s.mapped = true
+	}
+	if err := s.backend.checkSenderRate(from, s.domain); err != nil {
+		s.log().Warn("sender rate limited", "client", s.clientIP, "from", from, "errormsg", err)
+		return err
+	}
+	if err := s.checkSubmissionRate("messages"); err != nil {
+		s.log().Warn("submission rate limited", "client", s.clientIP, "from", from, "user", s.authUser, "status", "rate_limited", "errormsg", err)
+		return err
+	}
+	if err := s.backend.checkSenderQuota(s.identity); err != nil {
+		s.log().Warn("sender over quota", "client", s.clientIP, "from", from, "user", s.authUser, "status", "quota_exceeded", "errormsg", err)
+		return err
+	}
 	s.from = from
 	return nil
 }
 
-func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
-	s.to = append(s.to, to)
+func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) (err error) {
+	_, span := s.startSpan("smtp.rcpt", attribute.String("smtp.rcpt_to", to))
+	defer func() {
+		endSpan(span, err)
+		err = s.backend.statusError(err)
+	}()
+
+	// Rewrite rules and aliases replace the recipient, the policy checks
+	// what they give instead
+	given := to
+	if to = s.backend.rewriteRecipient(given); to != given {
+		s.log().Info("recipient rewritten", "client", s.clientIP, "from", s.from, "to", given, "status", "rewritten", "recipient", to)
+	}
+	rcpts := []string{to}
+	if members := s.backend.policy().config.expandAlias(to); members != nil {
+		if rcpts, err = s.rcptAlias(to, members); err != nil {
+			return err
+		}
+	} else if err := s.backend.checkRecipient(to); err != nil {
+		s.log().Warn("recipient rejected", "client", s.clientIP, "from", s.from, "to", to, "errormsg", err)
+		return err
+	}
+	if err := s.checkSubmissionRate("recipients"); err != nil {
+		s.log().Warn("submission rate limited", "client", s.clientIP, "from", s.from, "to", to, "user", s.authUser, "status", "rate_limited", "errormsg", err)
+		return err
+	}
+	for _, rcpt := range rcpts {
+		if err := s.backend.hooks.onRcpt(s, rcpt); err != nil {
+			return err
+		}
+	}
+	s.given = append(s.given, given)
+	for _, rcpt := range rcpts {
+		// A recipient given again, or also by an alias, is sent to once
+		if slices.ContainsFunc(s.to, func(r string) bool { return strings.EqualFold(r, rcpt) }) {
+			continue
+		}
+		if rcpt != given {
+			if s.givenAs == nil {
+				s.givenAs = make(map[string]string)
+			}
+			s.givenAs[rcpt] = given
+		}
+		s.to = append(s.to, rcpt)
+		s.dsn = s.dsn.addRecipient(rcpt, opts)
+	}
 	return nil
 }
 
-func (s *Session) Data(r io.Reader) error {
-	// Read the email data
-	data, err := io.ReadAll(r)
+// Data receives a message. The reply names it by queue ID, and by its
+// Internet message ID when it was sent right away through a draft.
+func (s *Session) Data(r io.Reader) (err error) {
+	start := time.Now()
+	cr := &countingReader{r: r}
+	defer func() { s.audit(start, cr.n, err) }()
+	var span trace.Span
+	s.dataCtx, span = s.startSpan("smtp.data", attribute.String("smtp.from", s.from), attribute.Int("smtp.recipients", len(s.to)))
+	defer func() {
+		span.SetAttributes(attribute.String("smtp.queue_id", s.queueID), attribute.Int64("smtp.size", cr.n))
+		endSpan(span, err)
+	}()
+
+	s.sentID = ""
+	if err := s.receive(cr); err != nil {
+		return s.backend.statusError(err)
+	}
+	// go-smtp sends a returned reply as it is, a 250 too
+	if s.sentID != "" {
+		return s.backend.replies.error(250, smtp.EnhancedCode{2, 0, 0}, "sent", "queueid", s.queueID, "msgid", s.sentID)
+	}
+	return s.backend.replies.error(250, smtp.EnhancedCode{2, 0, 0}, "accepted", "queueid", s.queueID)
+}
+
+func (s *Session) receive(r io.Reader) (err error) {
+	// Read the email data; large messages go to disk as they arrive
+	config := s.backend.policy().config
+	spool, err := spoolData(r, config.dataSpoolBytes(), config.SMTP.DataSpoolDirectory)
+	defer spool.close()
+	if err == smtp.ErrDataTooLarge || err == nil && spool.size > s.maxMessageBytes {
+		limit := s.maxMessageBytes
+		s.log().Warn("message too large", "client", s.clientIP, "from", s.from, "errormsg", fmt.Sprintf("message exceeds %d bytes", limit))
+		return messageTooLarge{limit}
+	}
+	if err == smtp.ErrTooLongLine {
+		limit := s.conn.Server().MaxLineLength
+		s.log().Warn("line too long", "client", s.clientIP, "from", s.from, "errormsg", fmt.Sprintf("line longer than %d characters", limit))
+		return s.backend.errLineTooLong(limit)
+	}
 	if err != nil {
 		return err
 	}
+	// The message is processed in memory, within smtp.max_memory_bytes
+	// for all sessions together
+	defer s.backend.memory.release(s.backend.memory.acquire(spool.size))
+	data, err := spool.bytes()
+	if err != nil {
+		return err
+	}
+
+	// Line endings were already rewritten on the wire for DATA; BDAT
+	// chunks arrive untouched
+	data, bare := normalizeLineEndings(data)
+	if sc := sessionConnOf(s.conn.Conn()); sc != nil && sc.bareLineEndings() {
+		bare = true
+	}
+	if bare {
+		if s.backend.policy().config.SMTP.LineEndings == "reject" {
+			s.log().Warn("bare line endings", "client", s.clientIP, "from", s.from, "errormsg", "bare CR/LF line endings")
+			return s.backend.errBareLineEndings()
+		}
+		s.log().Info("line endings normalized", "client", s.clientIP, "from", s.from, "status", "normalized", "reason", "bare CR/LF line endings")
+	}
 
-	// Parse headers and body
+	// Parse headers and body. Only the first blank line separates them;
+	// the body itself may contain any number of blank lines.
 	message := string(data)
-	parts := strings.Split(message, "\r\n\r\n")
+	parts := strings.SplitN(message, "\r\n\r\n", 2)
 	headers := parseHeaders(parts[0])
+	// Encoded words (RFC 2047) are decoded so Graph gets the subject as text
+	subject := decodeWords(headerValue(headers, "Subject"))
+
+	// The queue ID names the message in the history and the spools
+	if s.queueID, err = newQueueID(); err != nil {
+		return err
+	}
+	s.backend.history.accept(deliveryRecord{
+		QueueID:   s.queueID,
+		MessageID: headerValue(headers, "Message-ID"),
+		Client:    s.clientIP,
+		From:      s.from,
+		To:        s.envelopeRecipients(),
+		Subject:   subject,
+	})
+	s.backend.notifyWebhooks(s.queueID, "accepted", "")
+	defer func() {
+		if err != nil {
+			s.backend.history.reject(s.queueID, err)
+		}
+	}()
+
+	// Control headers are checked against the identity's permissions and
+	// never leave the relay
+	if s.control, err = s.backend.parseControl(s.identity, headers); err != nil {
+		s.log().Warn("control header rejected", "client", s.clientIP, "from", s.from, "errormsg", err)
+		return err
+	}
+	data = applyControl(data, s.control)
+	// The trace field goes on top; the client's own ones are kept below it
+	if s.backend.policy().config.SMTP.ReceivedHeader == nil || *s.backend.policy().config.SMTP.ReceivedHeader {
+		data = append([]byte(s.receivedHeader(time.Now())), data...)
+	}
+	if held, err := s.checkVirus(data, subject); held || err != nil {
+		return err
+	}
+	// Milters may refuse the message, or change its headers, body and
+	// recipients
+	milter, data, err := s.checkMilters(data, headers)
+	if err != nil {
+		return err
+	}
+	switch milter.action {
+	case "discard":
+		s.backend.recordMessage(s.from, "discarded")
+		s.backend.history.add(s.queueID, historyEvent{Event: "discarded", Detail: "by milter"})
+		s.backend.notifyCallback(s.control.callback, s.queueID, "discarded", "by milter")
+		s.log().Info("message discarded by milter", "client", s.clientIP, "from", s.from, "status", "discarded")
+		return nil
+	case "quarantine":
+		if s.backend.quarantine == nil {
+			s.log().Warn("message refused by milter", "client", s.clientIP, "from", s.from, "status", "milter_reject", "reason", milter.reason)
+			return s.backend.replies.error(550, smtp.EnhancedCode{5, 7, 1}, "milter_rejected")
+		}
+		return s.hold(data, subject, "milter "+milter.reason)
+	}
+	if milter.changed {
+		if milter.body != nil {
+			parts = []string{parts[0], string(milter.body)}
+		}
+		s.milterRecipients(milter)
+		s.log().Info("message changed by milter", "client", s.clientIP, "from", s.from, "status", "milter_changed")
+	}
+
+	// Signed and encrypted mail is sent as it is; parsing and rebuilding
+	// it would invalidate it
+	rawBody := ""
+	if len(parts) > 1 {
+		rawBody = parts[1]
+	}
+	if signed, encrypted := securedContent(headerValue(headers, "Content-Type"), rawBody); signed || encrypted {
+		if encrypted && s.backend.policy().config.Content.RejectEncrypted {
+			s.log().Warn("encrypted message rejected", "client", s.clientIP, "from", s.from, "errormsg", "encrypted content rejected")
+			return s.backend.replies.error(554, smtp.EnhancedCode{5, 7, 1}, "encrypted_rejected")
+		}
+		// Signed content is read for the attachment policy, not changed
+		m := &hookMessage{headers: headers, subject: subject, data: data}
+		if !encrypted {
+			if parsed, err := parseMIME(data, mimeOptions{}); err == nil {
+				m.attachments = parsed.attachments
+			}
+		}
+		if err := s.backend.hooks.preSend(s, m); err != nil {
+			return err
+		}
+		if reason := s.backend.quarantineReason(s.from, subject, "", nil); reason != "" {
+			return s.hold(data, subject, reason)
+		}
+		if err := s.checkGraphSize(len(data), true); err != nil {
+			return err
+		}
+		if until, reason := s.heldUntil(time.Now()); !until.IsZero() {
+			return s.deferUntil(data, subject, until, reason)
+		}
+		s.log().Info("signed or encrypted message passed through", "client", s.clientIP, "from", s.from, "status", "passthrough", "signed", signed, "encrypted", encrypted)
+		raw := s.mimeRecipients(data, headers)
+		return s.deliver(data, headers, func(ctx context.Context, batch []string) error {
+			return s.backend.sendMIME(ctx, s.from, batchMessage(raw, headers, batch))
+		})
+	}
 	body := ""
 	if len(parts) > 1 {
-		body = parts[1]
+		body = decodeBody(headerValue(headers, "Content-Type"), headerValue(headers, "Content-Transfer-Encoding"), parts[1])
 	}
+	mimeType := strings.ToLower(headerValue(headers, "Content-Type"))
+	isHTML := strings.Contains(mimeType, "html")
 
-	// Create recipients
-	var toRecipients []models.Recipientable
-	for _, addr := range s.to {
-		emailAddress := models.NewEmailAddress()
-		emailAddress.SetAddress(&addr)
+	// Every message is read as MIME: transfer encodings and charsets are
+	// decoded, also in single-part messages, and multipart messages and
+	// TNEF streams from Outlook are split into body and attachments. JSON
+	// bodies hold template variables and are kept as they are.
+	var parsed *mimeContent
+	opts := mimeOptions{
+		UnpackTNEF:   s.backend.policy().config.Content.UnpackTNEF,
+		MessageItems: s.backend.policy().config.Content.MessageItems,
+	}
+	if !strings.HasPrefix(mimeType, "application/json") {
+		parsed, err = parseMIME(data, opts)
+		if err != nil {
+			s.log().Warn("invalid MIME structure, sending raw body", "client", s.clientIP, "from", s.from, "errormsg", err)
+		} else {
+			body, isHTML = parsed.body()
+			if parsed.damaged {
+				s.log().Warn("damaged MIME parts skipped", "client", s.clientIP, "from", s.from, "status", "damaged_mime", "reason", "unreadable parts were skipped")
+			}
+		}
+	}
 
-		recipient := models.NewRecipient()
-		recipient.SetEmailAddress(emailAddress)
-		toRecipients = append(toRecipients, recipient)
+	// Render the template selected by the client
+	if name := headerValue(headers, "X-GoGraph-Template"); name != "" {
+		var templateSubject, rendered string
+		templateSubject, rendered, isHTML, err = s.backend.renderTemplate(name, headers, body)
+		if err != nil {
+			s.log().Warn("template failed", "client", s.clientIP, "from", s.from, "errormsg", err)
+			return err
+		}
+		body = rendered
+		if templateSubject != "" {
+			subject = templateSubject
+		}
 	}
 
+	// Recipients go where the headers put them, with their display names;
+	// the others, and the relay's own copies, are Bcc
+	names := displayNames(headers)
+	to, cc, bcc := splitRecipients(headers, s.to)
+	bcc = append(bcc, s.bccRecipients()...)
+
 	// Create the message body
 	messageBody := models.NewItemBody()
-	messageBody.SetContent(&body)
 
 	contentType := models.TEXT_BODYTYPE // Default to plain text
-	if strings.Contains(strings.ToLower(headers["Content-Type"]), "html") {
+	if isHTML {
+		contentType = models.HTML_BODYTYPE
+		if s.backend.policy().config.Content.SanitizeHTML {
+			body = sanitizeHTML(body)
+		}
+	} else if s.backend.textToHTML(s.from) {
+		body = textToHTML(body)
 		contentType = models.HTML_BODYTYPE
 	}
+	footer := s.footer()
+	body = appendFooter(body, contentType == models.HTML_BODYTYPE, footer)
+	messageBody.SetContent(&body)
 	messageBody.SetContentType(&contentType)
 
-	// Handle attachments
-	var attachments []models.Attachmentable
-	if len(headers["Attachments"]) > 0 {
-		attachmentPaths := strings.Split(headers["Attachments"], ",")
-		for _, path := range attachmentPaths {
-			data, err := os.ReadFile(strings.TrimSpace(path))
-			if err != nil {
-				s.backend.logger.Printf("Error reading attachment %s: %v\n", path, err)
-				continue
-			}
+	// Attachments are the files in MIME parts
+	var attachments []mimeAttachment
+	if parsed != nil {
+		attachments = parsed.attachments
+	}
+
+	if err := s.backend.hooks.preSend(s, &hookMessage{headers: headers, subject: subject, attachments: attachments, data: data}); err != nil {
+		return err
+	}
+	if reason := s.backend.quarantineReason(s.from, subject, body, attachments); reason != "" {
+		return s.hold(data, subject, reason)
+	}
+	// Graph's own size errors come after the client got its 250, so
+	// messages it would refuse are refused here
+	if err := s.checkGraphSize(graphPayloadBytes(body, attachments), false); err != nil {
+		return err
+	}
 
-			attachment := models.NewFileAttachment()
-			name := strings.TrimSpace(path)
-			attachment.SetName(&name)
-			attachment.SetContentBytes(data)
-			attachments = append(attachments, attachment)
+	// graph.send_mode: mime posts the message as received, unless a
+	// template replaced its body, a footer is added to it or it is too
+	// large for a single request.
+	// Meeting invitations are always sent that way: as a Graph message
+	// their text/calendar part is only an .ics attachment and Outlook
+	// doesn't offer to accept them.
+	// HTML parts are still sanitized with content.sanitize_html; a message
+	// whose parts can't be rewritten is sent as a Graph message instead.
+	invitation := parsed != nil && parsed.invitation
+	asMIME := (s.backend.policy().config.Graph.SendMode == "mime" && footer.empty() || invitation) && headerValue(headers, "X-GoGraph-Template") == ""
+	mimeData := data
+	if asMIME && s.backend.policy().config.Content.SanitizeHTML {
+		if mimeData, err = sanitizeMIMEHTML(data); err != nil {
+			s.log().Warn("sanitizing MIME parts failed, sending a Graph message", "client", s.clientIP, "from", s.from, "errormsg", err)
+			asMIME = false
 		}
 	}
+	if asMIME && len(mimeData) <= maxInlineAttachmentBytes {
+		if until, reason := s.heldUntil(time.Now()); !until.IsZero() {
+			return s.deferUntil(mimeData, subject, until, reason)
+		}
+		if invitation {
+			s.log().Info("calendar invitation sent as MIME", "client", s.clientIP, "from", s.from, "status", "invitation")
+		}
+		raw := s.mimeRecipients(mimeData, headers)
+		return s.deliver(mimeData, headers, func(ctx context.Context, batch []string) error {
+			return s.backend.sendMIME(ctx, s.from, batchMessage(raw, headers, batch))
+		})
+	}
+
+	// Graph takes a single body in JSON, so HTML mail that should keep its
+	// plain text part, or get a generated one, is sent as
+	// multipart/alternative MIME
+	text := ""
+	if contentType == models.HTML_BODYTYPE {
+		content := s.backend.policy().config.Content
+		switch {
+		case parsed != nil && parsed.text != "":
+			if content.KeepTextPart {
+				text = appendFooter(parsed.text, false, footer)
+			}
+		case content.TextAlternative:
+			text = htmlToText(body)
+		}
+	}
+	// The message as it is sent, rendered, sanitized and with its footer,
+	// is what the retry spool, the journal and the archive keep
+	plain, html := body, ""
+	if contentType == models.HTML_BODYTYPE {
+		plain, html = text, body
+	}
+	rendered, err := buildMessage(data, subject, plain, html, attachments)
+	if err != nil {
+		if text != "" {
+			s.log().Warn("building text alternative failed", "client", s.clientIP, "from", s.from, "errormsg", err)
+			return fmt.Errorf("failed to build message: %v", err)
+		}
+		s.log().Warn("building the rendered message failed, keeping it as received", "client", s.clientIP, "from", s.from, "errormsg", err)
+		rendered = data
+	}
+	// Deferred messages are kept as they would be sent now and go out as
+	// MIME, or through a draft when that is too large
+	if until, reason := s.heldUntil(time.Now()); !until.IsZero() {
+		return s.deferUntil(rendered, subject, until, reason)
+	}
+	if text != "" {
+		if err := s.checkGraphSize(len(rendered), true); err != nil {
+			return err
+		}
+		raw := s.mimeRecipients(rendered, headers)
+		return s.deliver(rendered, headers, func(ctx context.Context, batch []string) error {
+			return s.backend.sendMIME(ctx, s.from, batchMessage(raw, headers, batch))
+		})
+	}
 
 	// Create the message
 	msg := models.NewMessage()
-	subject := headers["Subject"]
 	msg.SetSubject(&subject)
 	msg.SetBody(messageBody)
-	msg.SetToRecipients(toRecipients)
-	msg.SetAttachments(attachments)
+	if len(to) > 0 {
+		msg.SetToRecipients(graphRecipients(to, names))
+	}
+	if len(cc) > 0 {
+		msg.SetCcRecipients(graphRecipients(cc, names))
+	}
+	if len(bcc) > 0 {
+		msg.SetBccRecipients(graphRecipients(bcc, names))
+	}
+	if allow := s.backend.policy().config.CustomHeaders; len(allow) > 0 {
+		list, dropped := graphHeaders(headers, allow)
+		if len(list) > 0 {
+			msg.SetInternetMessageHeaders(list)
+		}
+		if len(dropped) > 0 {
+			s.log().Warn("custom headers dropped", "client", s.clientIP, "from", s.from, "headers", strings.Join(dropped, ","),
+				"reason", fmt.Sprintf("Graph takes %d headers", maxCustomHeaders))
+		}
+	}
+	// Graph keeps the client's Message-ID, so replies and bounces can be
+	// matched to the message
+	if id := strings.TrimSpace(headerValue(headers, "Message-ID")); strings.HasPrefix(id, "<") && strings.HasSuffix(id, ">") {
+		msg.SetInternetMessageId(&id)
+	}
+	// Receipts requested the way mail clients do (RFC 8098, and the older
+	// Return-Receipt-To)
+	if headerValue(headers, "Disposition-Notification-To") != "" {
+		requested := true
+		msg.SetIsReadReceiptRequested(&requested)
+	}
+	if headerValue(headers, "Return-Receipt-To") != "" {
+		requested := true
+		msg.SetIsDeliveryReceiptRequested(&requested)
+	}
+	// Replies go where the sender asked for
+	if replyTo, replyNames := headerAddresses(headers, "Reply-To"); len(replyTo) > 0 {
+		msg.SetReplyTo(graphRecipients(replyTo, replyNames))
+	}
+	// A mapped sender keeps the From header it wrote; MIME messages carry
+	// it anyway
+	if s.mapped {
+		if addrs := parseAddressList(headerValue(headers, "From")); len(addrs) > 0 {
+			msg.SetFrom(graphRecipients([]string{addrs[0].Address}, map[string]string{
+				strings.ToLower(graphAddress(addrs[0].Address)): addrs[0].Name,
+			})[0])
+		}
+	}
+	setClassification(msg, headers, s.backend.policy().config.Graph.CategoriesHeader)
+	// X-GoGraph-Importance wins over the message's own priority headers
+	level := s.control.importance
+	if level == "" {
+		level = headerImportance(headers)
+	}
+	if level != "" {
+		importance := models.NORMAL_IMPORTANCE
+		switch level {
+		case "low":
+			importance = models.LOW_IMPORTANCE
+		case "high":
+			importance = models.HIGH_IMPORTANCE
+		}
+		msg.SetImportance(&importance)
+	}
+
+	s.message = msg
+
+	// Attachments too large for a sendMail request are uploaded to a draft
+	if attachmentBytes(attachments) > maxInlineAttachmentBytes {
+		return s.deliver(rendered, headers, func(ctx context.Context, batch []string) error {
+			if batch != nil {
+				setBatchRecipients(msg, to, cc, bcc, batch, names)
+			}
+			if parent := s.threadParent(ctx, headers); parent != "" {
+				return s.backend.sendReply(ctx, s.from, parent, msg, attachments)
+			}
+			return s.backend.sendDraft(ctx, s.from, msg, attachments)
+		})
+	}
+	msg.SetAttachments(graphAttachments(attachments))
+	if s.backend.policy().config.Graph.SendMode == "draft" {
+		return s.deliver(rendered, headers, func(ctx context.Context, batch []string) error {
+			if batch != nil {
+				setBatchRecipients(msg, to, cc, bcc, batch, names)
+			}
+			if parent := s.threadParent(ctx, headers); parent != "" {
+				return s.backend.sendReply(ctx, s.from, parent, msg, attachments)
+			}
+			return s.backend.sendDraft(ctx, s.from, msg, nil)
+		})
+	}
+
+	return s.deliver(rendered, headers, func(ctx context.Context, batch []string) error {
+		if batch != nil {
+			setBatchRecipients(msg, to, cc, bcc, batch, names)
+		}
+		// Replies to a message in the sender's mailbox join its
+		// conversation
+		if parent := s.threadParent(ctx, headers); parent != "" {
+			return s.backend.sendReply(ctx, s.from, parent, msg, attachments)
+		}
+		requestBody := users.NewItemSendMailPostRequestBody()
+		requestBody.SetMessage(msg)
+		// The control header wins over sender_map, which wins over
+		// graph.save_to_sent
+		saveToSent := true
+		for _, save := range []*bool{s.backend.policy().config.Graph.SaveToSent, s.saveSent, s.control.saveToSent} {
+			if save != nil {
+				saveToSent = *save
+			}
+		}
+		requestBody.SetSaveToSentItems(&saveToSent)
+
+		return s.backend.tenant(s.from).user(s.from).
+			SendMail().
+			Post(ctx, requestBody, nil)
+	})
+}
+
+// deliver hands the message to Graph through send, unless it is a
+// retransmission of a message that was already sent. data is the message
+// as send sends it, rebuilt when the relay rendered or changed it, for the
+// journal, the archive and the retry spool.
+func (s *Session) deliver(data []byte, headers map[string]string, send func(ctx context.Context, batch []string) error) error {
+	if s.control.dryRun {
+		return s.dryRun("sent")
+	}
+	if dir := s.backend.policy().config.Capture.Directory; dir != "" {
+		return s.capture(dir, data)
+	}
+
+	// Drop retransmissions of a message that was already sent
+	messageID := strings.TrimSpace(headerValue(headers, "Message-ID"))
+	first, release := s.backend.claimMessageID(s.from, messageID)
+	if !first {
+		s.log().Info("duplicate message dropped", "client", s.clientIP, "from", s.from, "msgid", messageID, "status", "duplicate")
+		s.backend.recordMessage(s.from, "duplicate")
+		s.backend.history.add(s.queueID, historyEvent{Event: "duplicate"})
+		s.backend.notifyCallback(s.control.callback, s.queueID, "duplicate", "")
+		return nil
+	}
+
+	// LMTP clients get per-recipient replies, so the message is sent before
+	// the reply, as are the messages of XOAUTH2 users, which can't be
+	// queued for a retry
+	if s.backend.workers != nil && s.lmtp == nil && s.userToken == nil {
+		// The session is reset for the next message while the job waits,
+		// so the job works on a copy
+		job := *s
+		priority := s.control.importance
+		if priority == "" {
+			priority = headerImportance(headers)
+		}
+		queued := s.backend.workers.submit(deliveryJob{
+			priority: priority,
+			run: func() string {
+				result, err := job.transmit(data, headers, send, release)
+				job.backend.hooks.postSend(&job, job.hookMessage(data, headers), result, err)
+				if err != nil {
+					// The client was told the message was accepted
+					job.backend.giveUp(job.spoolEntry(job.env(headers).subject, err.Error()), data)
+				}
+				return result
+			},
+			spool: func() error {
+				return job.queue(data, job.env(headers).subject, errShutdown)
+			},
+		})
+		if !queued {
+			release()
+			s.log().Warn("delivery queue full", "client", s.clientIP, "from", s.from)
+			return s.backend.replies.error(451, smtp.EnhancedCode{4, 3, 1}, "queue_full")
+		}
+		return nil
+	}
+	result, err := s.transmit(data, headers, send, release)
+	s.backend.hooks.postSend(s, s.hookMessage(data, headers), result, err)
+	return err
+}
 
-	// Send the email using Graph API
-	requestBody := users.NewItemSendMailPostRequestBody()
-	requestBody.SetMessage(msg)
-	saveToSent := true
-	requestBody.SetSaveToSentItems(&saveToSent)
+// hookMessage returns the message for the postSend hooks
+func (s *Session) hookMessage(data []byte, headers map[string]string) *hookMessage {
+	return &hookMessage{headers: headers, subject: s.env(headers).subject, data: data}
+}
+
+// env returns the journal envelope of the message
+func (s *Session) env(headers map[string]string) journalEnvelope {
+	return journalEnvelope{
+		client:     s.clientIP,
+		from:       s.from,
+		recipients: s.to,
+		messageID:  strings.TrimSpace(headerValue(headers, "Message-ID")),
+		subject:    decodeWords(headerValue(headers, "Subject")),
+	}
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+// transmit sends the message, through Graph or directly, and returns the
+// result for the worker metrics: sent, queued for a retry or failed.
+// release gives up the Message-ID claim of a message that wasn't sent.
+// Split into batches, the message counts as sent when any batch was; the
+// recipients of the others are queued or bounced on their own.
+func (s *Session) transmit(data []byte, headers map[string]string, send func(ctx context.Context, batch []string) error, release func()) (string, error) {
+	batches := s.backend.policy().config.recipientBatches(s.envelopeRecipients())
+	timeout := s.backend.policy().config.graphTimeout(len(data))
+	// The delivery may outlive the DATA command, only its span is kept
+	ctx, cancel := context.WithTimeout(trace.ContextWithSpan(context.Background(), trace.SpanFromContext(s.dataCtx)), timeout*time.Duration(len(batches)))
 	defer cancel()
 
-	err = s.backend.graphClient.Users().
-		ByUserId(s.from).
-		SendMail().
-		Post(ctx, requestBody, nil)
+	// A blocking journal report goes first so no message leaves without
+	// one
+	journal := s.backend.policy().config.journalSeparate()
+	blocking := journal && s.backend.policy().config.Journal.OnFailure == "block"
+	env := s.env(headers)
+	if blocking {
+		if err := s.backend.sendJournal(ctx, env, data); err != nil {
+			release()
+			s.log().Error("journaling failed", "client", s.clientIP, "from", s.from, "errormsg", err)
+			s.backend.history.add(s.queueID, historyEvent{Event: "failed", Detail: err.Error()})
+			s.backend.notifyCallback(s.control.callback, s.queueID, "failed", err.Error())
+			return "failed", s.backend.replies.error(451, smtp.EnhancedCode{4, 3, 0}, "journal_failed")
+		}
+	}
+
+	logger := s.log()
+	if id := s.dsn.envelopeID(); id != "" {
+		logger = logger.With("envid", id)
+	}
+
+	sent := &sentMessage{}
+	ctx = withSentMessage(ctx, sent)
+	var host string
+	var err error
+	var delivered []string
+	var permanent bool
+	failures := make(map[batchKey]batchFailure)
+	for _, batch := range batches {
+		var batchErr error
+		host, batchErr = s.sendBatch(ctx, logger, data, send, batch, len(batches) > 1)
+		if batchErr == nil {
+			delivered = append(delivered, batch.rcpts...)
+			continue
+		}
+		err = batchErr
+		for _, rcpt := range batch.rcpts {
+			s.lmtpStatus(rcpt, batchErr)
+		}
+		// Recipients of other routes are queued on their own, so a retry
+		// takes their route again
+		key := batchKey{permanent: permanentError(batchErr) || batch.transport == "reject", transport: batch.transport}
+		f := failures[key]
+		failures[key] = batchFailure{rcpts: append(f.rcpts, batch.rcpts...), err: batchErr, permanent: key.permanent}
+		permanent = key.permanent
+	}
+	// Failed routes are queued each on their own, so that a retry takes
+	// its route again
+	if err != nil && len(delivered) == 0 && failedRoutes(failures) > 1 && s.lmtp == nil && s.canQueue() {
+		for _, f := range failures {
+			s.failRecipients(logger, data, env.subject, f)
+		}
+		return "queued", nil
+	}
+	// LMTP clients were given the failed recipients' replies to retry
+	// or bounce them themselves
+	if err != nil && len(delivered) > 0 {
+		if s.lmtp == nil {
+			for _, f := range failures {
+				s.failRecipients(logger, data, env.subject, f)
+			}
+		}
+		err = nil
+	}
+	if err != nil && s.lmtp == nil && s.canQueue() && s.control.route != "direct_mx" && !permanent {
+		if err := s.queue(data, env.subject, err); err != nil {
+			return "failed", err
+		}
+		return "queued", nil
+	}
+	if err != nil {
+		release()
+		s.backend.notifyCallback(s.control.callback, s.queueID, "failed", err.Error())
+		logger.Error("delivery failed", append([]any{"client", s.clientIP, "from", s.from,
+			"host", host, "msgid", "NA", "errormsg", err}, graphErrorAttrs(err)...)...)
+		// The client resubmits temporary failures and bounces the others
+		return "failed", s.backend.statusError(err)
+	}
+
+	s.backend.notifyCallback(s.control.callback, s.queueID, "sent", "")
+	recipients := strings.Join(onlyRecipients(s.to, delivered), ",")
+	tlsState := "off"
+	if s.tlsActive() {
+		tlsState = "on"
+	}
+	msgid := "NA"
+	if sent.internetMessageID != "" {
+		msgid = sent.internetMessageID
+		s.sentID = msgid
+	}
+	logger.Info("message sent", "client", s.clientIP, "from", s.from,
+		"host", host, "msgid", msgid, "mailer", "GoGraphSmtp", "tls", tlsState, "recipients", recipients)
+	entry := s.spoolEntry(env.subject, "")
+	entry.To = delivered
+	go s.backend.sendDSN(entry, data, "SUCCESS")
+	s.backend.archive(entry, data, sent.internetMessageID, host)
+
+	if journal && !blocking {
+		if err := s.backend.sendJournal(ctx, env, data); err != nil {
+			s.log().Error("journaling failed", "client", s.clientIP, "from", s.from, "errormsg", err)
+		}
+	}
+	return "sent", nil
+}
+
+// sendBatch sends the message to the batch's recipients by its route:
+// through Graph, the smarthost or directly. Unless split, they are all
+// recipients and the message is sent as it is.
+func (s *Session) sendBatch(ctx context.Context, logger *slog.Logger, data []byte, send func(ctx context.Context, batch []string) error, route recipientRoute, split bool) (host string, err error) {
+	rcpts := route.rcpts
+	ctx, span := tracer.Start(ctx, "graph.send", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("smtp.queue_id", s.queueID), attribute.Int("smtp.recipients", len(rcpts))))
+	defer func() {
+		span.SetAttributes(attribute.String("server.address", host))
+		endSpan(span, err)
+	}()
+	var batch []string
+	if split {
+		batch = rcpts
+	}
+	start := time.Now()
+	host, transport := s.backend.tenant(s.from).cloud.host(), "graph"
+	switch {
+	case s.control.route == "direct_mx":
+		host, transport = "direct_mx", "direct_mx"
+		err = s.backend.sendDirect(s.from, rcpts, data)
+	case route.transport == "reject":
+		// Refused at RCPT TO unless the routes were reloaded since
+		host, transport = "none", "reject"
+		err = s.backend.replies.error(550, smtp.EnhancedCode{5, 7, 1}, "recipient_rejected", "recipient", strings.Join(rcpts, ","))
+	case route.transport == "smarthost":
+		host, transport = s.backend.policy().config.Smarthost.Address, "smarthost"
+		err = s.backend.sendSmarthost(s.from, rcpts, data)
+	default:
+		err = s.backend.withRetries(ctx, logger, s.from, s.queueID, func() error {
+			sendCtx := withQueueID(ctx, s.queueID)
+			if s.userToken != nil {
+				token, err := s.userToken.token(ctx)
+				if err != nil {
+					return err
+				}
+				sendCtx = withUserToken(sendCtx, token)
+			}
+			return send(sendCtx, batch)
+		})
+	}
+	if err != nil && transport == "graph" {
+		if rejected := rejectedRecipients(err, rcpts); len(rejected) > 0 {
+			logger.Warn("recipients rejected", "client", s.clientIP, "from", s.from,
+				"rejected", strings.Join(rejected, ","), "errormsg", err)
+		}
+	}
+	if err != nil && transport == "graph" && s.backend.policy().config.useSmarthost(err) {
+		logger.Warn("Graph failed, sending through the smarthost", "client", s.clientIP, "from", s.from,
+			"host", host, "msgid", "NA", "errormsg", err, "status", "smarthost_fallback")
+		s.backend.history.add(s.queueID, deliveryEvent(transport, err))
+		*sentMessageFrom(ctx) = sentMessage{}
+		err = s.backend.sendSmarthost(s.from, rcpts, data)
+		host, transport = s.backend.policy().config.Smarthost.Address, "smarthost"
+	}
+	if err != nil && transport != "direct_mx" && s.domain.DirectMX {
+		msg := "Graph failed, falling back to direct MX"
+		if transport == "smarthost" {
+			msg = "smarthost failed, falling back to direct MX"
+		}
+		logger.Warn(msg, "client", s.clientIP, "from", s.from,
+			"host", host, "msgid", "NA", "errormsg", err, "status", "direct_mx_fallback")
+		s.backend.history.add(s.queueID, deliveryEvent(transport, err))
+		*sentMessageFrom(ctx) = sentMessage{}
+		err = s.backend.sendDirect(s.from, rcpts, data)
+		host, transport = "direct_mx", "direct_mx"
+	}
+	s.backend.history.add(s.queueID, deliveryEvent(transport, err))
+	s.backend.recordDelivery(s.from, start, err)
+	return host, err
+}
+
+// batchKey tells apart the batches that failed alike
+type batchKey struct {
+	permanent bool
+	transport string
+}
+
+// failedRoutes counts the transports of the failed batches
+func failedRoutes(failures map[batchKey]batchFailure) int {
+	transports := make(map[string]bool)
+	for key := range failures {
+		transports[key.transport] = true
+	}
+	return len(transports)
+}
+
+// batchFailure holds the recipients of the batches that failed alike
+type batchFailure struct {
+	rcpts     []string
+	err       error
+	permanent bool
+}
+
+// failRecipients deals with the recipients of failed batches when others
+// were sent: they are queued for a retry of their own, or bounced when the
+// error is permanent or there is no retry spool
+func (s *Session) failRecipients(logger *slog.Logger, data []byte, subject string, f batchFailure) {
+	logger.Warn("delivery failed for some recipients", "client", s.clientIP, "from", s.from,
+		"recipients", strings.Join(f.rcpts, ","), "errormsg", f.err, "status", "partial")
+	entry := s.spoolEntry(subject, f.err.Error())
+	entry.To = f.rcpts
+	entry.Partial = true
+	if s.canQueue() && s.control.route != "direct_mx" && !f.permanent {
+		if s.queueEntry(entry, data, f.err) == nil {
+			return
+		}
+	}
+	entry.Attempts = 1
+	s.backend.giveUp(entry, data)
+}
 
+// hold puts the message into the quarantine instead of sending it. The
+// client is told the message was accepted.
+func (s *Session) hold(data []byte, subject, reason string) error {
+	if s.control.dryRun {
+		return s.dryRun("quarantined")
+	}
+	entry, err := s.backend.quarantine.put(s.spoolEntry(subject, reason), data)
 	if err != nil {
-		s.backend.logger.Printf("from=<%s>, host=graph.microsoft.com, msgid=NA, errormsg=\"%v\"\n",
-			s.from, err)
-		return fmt.Errorf("failed to send email: %v", err)
+		s.log().Error("quarantining failed", "client", s.clientIP, "from", s.from, "errormsg", err)
+		return fmt.Errorf("failed to quarantine message: %v", err)
 	}
+	s.backend.recordMessage(s.from, "quarantined")
+	s.backend.history.add(s.queueID, historyEvent{Event: "quarantined", Detail: reason})
+	s.backend.notifyCallback(s.control.callback, s.queueID, "quarantined", reason)
+	s.log().Info("message quarantined", "client", s.clientIP, "from", s.from, "quarantine", entry.ID, "status", "quarantined", "reason", reason)
+	return nil
+}
 
-	recipients := strings.Join(s.to, ",")
-	s.backend.logger.Printf("from=<%s>, host=graph.microsoft.com, msgid=NA, mailer=GoGraphSmtp, tls=on, recipients=%s\n",
-		s.from, recipients)
+// deferUntil keeps the message until the sender's send window opens, or
+// the time it was scheduled for
+func (s *Session) deferUntil(data []byte, subject string, until time.Time, reason string) error {
+	if s.control.dryRun {
+		return s.dryRun("deferred")
+	}
+	entry := s.spoolEntry(subject, reason)
+	entry.NotBefore = until
+	entry, err := s.backend.deferred.put(entry, data)
+	if err != nil {
+		s.log().Error("deferring failed", "client", s.clientIP, "from", s.from, "errormsg", err)
+		return fmt.Errorf("failed to defer message: %v", err)
+	}
+	s.backend.recordMessage(s.from, "deferred")
+	s.backend.history.add(s.queueID, historyEvent{Event: "deferred", Detail: "until " + until.Format(time.RFC3339)})
+	s.backend.notifyCallback(s.control.callback, s.queueID, "deferred", "until "+until.Format(time.RFC3339))
+	s.log().Info("message deferred", "client", s.clientIP, "from", s.from, "deferred", entry.ID, "status", "deferred", "until", until.Format(time.RFC3339))
+	return nil
+}
+
+// dryRun accepts a message that asked for X-GoGraph-Dry-Run after every
+// check passed, without sending or keeping it. outcome is what would have
+// happened to it.
+func (s *Session) dryRun(outcome string) error {
+	s.backend.recordMessage(s.from, "dry_run")
+	s.backend.history.add(s.queueID, historyEvent{Event: "dry_run", Detail: "would be " + outcome})
+	s.backend.notifyCallback(s.control.callback, s.queueID, "dry_run", "would be "+outcome)
+	s.log().Info("dry run", "client", s.clientIP, "from", s.from, "status", "dry_run", "outcome", outcome)
 	return nil
 }
 
+// spoolEntry describes the current transaction for a spool store
+func (s *Session) spoolEntry(subject, reason string) spoolEntry {
+	return spoolEntry{
+		ID:       s.queueID,
+		Client:   s.clientIP,
+		From:     s.from,
+		To:       s.envelopeRecipients(),
+		Subject:  subject,
+		Reason:   reason,
+		Callback: s.control.callback,
+		DSN:      s.dsn,
+		Partial:  len(s.givenAs) > 0,
+	}
+}
+
+// envelopeRecipients returns the recipients of the transaction plus the
+// silent Bcc recipients
+func (s *Session) envelopeRecipients() []string {
+	return append(append([]string(nil), s.to...), s.bccRecipients()...)
+}
+
+// bccRecipients returns the archive mailbox of the sender's domain, or
+// else archive_bcc, and the journal address, which get a copy the client
+// didn't ask for
+func (s *Session) bccRecipients() []string {
+	var rcpts []string
+	if s.domain.Archive != "" {
+		rcpts = append(rcpts, s.domain.Archive)
+	} else if archive := s.backend.policy().config.ArchiveBcc; archive != "" {
+		rcpts = append(rcpts, archive)
+	}
+	if s.backend.policy().config.journalBcc() {
+		rcpts = append(rcpts, s.backend.policy().config.Journal.Address)
+	}
+	return rcpts
+}
+
 func (s *Session) Reset() {
+	s.queueID = ""
+	s.control = messageControl{}
+	s.identity = ""
 	s.from = ""
+	s.mapped = false
+	s.saveSent = nil
+	s.message = nil
+	s.dsn = nil
+	s.virus = ""
 	s.to = []string{}
+	s.given = nil
+	s.givenAs = nil
+	s.domain = DomainConfig{}
 }
 
 func (s *Session) Logout() error {
+	s.span.End()
 	return nil
 }
 
 // Helper functions
+
+// graphRecipients converts addresses to Graph recipients, with the display
+// names from names where known
+func graphRecipients(addrs []string, names map[string]string) []models.Recipientable {
+	var recipients []models.Recipientable
+	for _, rcpt := range addrs {
+		addr := graphAddress(rcpt)
+		emailAddress := models.NewEmailAddress()
+		emailAddress.SetAddress(&addr)
+		if name, ok := names[strings.ToLower(addr)]; ok {
+			emailAddress.SetName(&name)
+		}
+
+		recipient := models.NewRecipient()
+		recipient.SetEmailAddress(emailAddress)
+		recipients = append(recipients, recipient)
+	}
+	return recipients
+}
+
+// graphAttachments converts attachments to Graph file attachments, and
+// attached messages marked as items to item attachments
+func graphAttachments(list []mimeAttachment) []models.Attachmentable {
+	var attachments []models.Attachmentable
+	for _, a := range list {
+		if a.item {
+			if item := messageItem(a.data); item != nil {
+				attachments = append(attachments, item)
+				continue
+			}
+		}
+		attachment := models.NewFileAttachment()
+		name := a.name
+		attachment.SetName(&name)
+		if a.contentType != "" {
+			contentType := a.contentType
+			attachment.SetContentType(&contentType)
+		}
+		if a.contentID != "" {
+			contentID := a.contentID
+			attachment.SetContentId(&contentID)
+		}
+		if a.inline {
+			inline := true
+			attachment.SetIsInline(&inline)
+		}
+		attachment.SetContentBytes(a.data)
+		attachments = append(attachments, attachment)
+	}
+	return attachments
+}
+
+// maxCustomHeaders is the number of internet message headers Graph takes
+// on a message
+const maxCustomHeaders = 5
+
+// graphHeaders returns the message headers listed in custom_headers as
+// Graph internet message headers, in header name order, and the names of
+// those left out beyond Graph's limit
+func graphHeaders(headers map[string]string, allow []string) ([]models.InternetMessageHeaderable, []string) {
+	var names []string
+	for name := range headers {
+		if strings.HasPrefix(strings.ToLower(name), controlHeaderPrefix) {
+			continue
+		}
+		for _, pattern := range allow {
+			prefix, wildcard := strings.CutSuffix(pattern, "*")
+			if strings.EqualFold(name, pattern) || wildcard && len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+
+	var list []models.InternetMessageHeaderable
+	for i, name := range names {
+		if i == maxCustomHeaders {
+			return list, names[i:]
+		}
+		h := models.NewInternetMessageHeader()
+		name, value := name, headers[name]
+		h.SetName(&name)
+		h.SetValue(&value)
+		list = append(list, h)
+	}
+	return list, nil
+}
+
+// headerImportance reads the importance of a message from the Importance
+// header, else X-Priority, X-MSMail-Priority or Priority, and returns low,
+// normal, high or "" without any
+func headerImportance(headers map[string]string) string {
+	switch v := strings.ToLower(strings.TrimSpace(headerValue(headers, "Importance"))); v {
+	case "low", "normal", "high":
+		return v
+	}
+	// "1 (Highest)" to "5 (Lowest)"
+	if v := strings.TrimSpace(headerValue(headers, "X-Priority")); v != "" {
+		switch v[0] {
+		case '1', '2':
+			return "high"
+		case '3':
+			return "normal"
+		case '4', '5':
+			return "low"
+		}
+	}
+	switch v := strings.ToLower(strings.TrimSpace(headerValue(headers, "X-MSMail-Priority"))); v {
+	case "low", "normal", "high":
+		return v
+	}
+	switch strings.ToLower(strings.TrimSpace(headerValue(headers, "Priority"))) {
+	case "non-urgent":
+		return "low"
+	case "normal":
+		return "normal"
+	case "urgent":
+		return "high"
+	}
+	return ""
+}
+
+// textContent makes raw message text safe to carry in the JSON body of a
+// Graph request: NUL bytes are dropped and content that isn't valid UTF-8
+// is read as Latin-1 instead of being replaced with U+FFFD
+func textContent(body string) string {
+	body = strings.ReplaceAll(body, "\x00", "")
+	if utf8.ValidString(body) {
+		return body
+	}
+
+	runes := make([]rune, len(body))
+	for i := 0; i < len(body); i++ {
+		runes[i] = rune(body[i])
+	}
+	return string(runes)
+}
+
+// normalizeLineEndings rewrites bare CR and LF line endings to CRLF and
+// reports whether any were found
+func normalizeLineEndings(data []byte) ([]byte, bool) {
+	bare := false
+	for i, ch := range data {
+		if (ch == '\n' && (i == 0 || data[i-1] != '\r')) || (ch == '\r' && (i+1 == len(data) || data[i+1] != '\n')) {
+			bare = true
+			break
+		}
+	}
+	if !bare {
+		return data, false
+	}
+
+	out := make([]byte, 0, len(data)+len(data)/32)
+	for i := 0; i < len(data); i++ {
+		switch data[i] {
+		case '\r':
+			out = append(out, '\r', '\n')
+			if i+1 < len(data) && data[i+1] == '\n' {
+				i++
+			}
+		case '\n':
+			out = append(out, '\r', '\n')
+		default:
+			out = append(out, data[i])
+		}
+	}
+	return out, true
+}
+
 func parseHeaders(headerData string) map[string]string {
 	headers := make(map[string]string)
 	lines := strings.Split(headerData, "\r\n")
@@ -234,45 +1543,191 @@ func parseHeaders(headerData string) map[string]string {
 	return headers
 }
 
-func loadConfig(filename string) (Config, error) {
-	var config Config
+func main() {
+	opts, command, args, err := parseCLI(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		os.Exit(2)
+	}
+	// The service can be removed or stopped whatever the config holds
+	if command == "service" {
+		if err := runServiceCommand(opts, args); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	// validate reports the problems of a config that doesn't load
+	if command == "validate" || command == "validate-config" {
+		if err := runValidateCommand(opts, args); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	config, err := opts.loadConfig()
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
 
-	data, err := os.ReadFile(filename)
+	var run func(*Backend, []string) error
+	switch command {
+	case "serve":
+		if len(args) > 0 {
+			log.Fatalf("usage: serve")
+		}
+	case "status":
+		if err := runStatusCommand(config); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "lookup":
+		if err := runLookupCommand(config, args); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "login":
+		if err := runLoginCommand(config, args); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "replay":
+		if err := runReplayCommand(config, args); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "quarantine":
+		run = runQuarantineCommand
+	case "queue":
+		run = runQueueCommand
+	case "send-test":
+		run = runSendTestCommand
+	default:
+		log.Fatalf("unknown command %q, see -help", command)
+	}
+
+	stop := make(chan os.Signal, 1)
+	ready, stopped := func() {}, func() {}
+	if run == nil {
+		signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+		// Before the backend, whose log also goes to the event log
+		if ready, stopped, err = startService(config, stop); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	backend, err := NewBackend(config)
 	if err != nil {
-		return config, fmt.Errorf("error reading config file: %v", err)
+		log.Fatalf("Failed to create backend: %v", err)
+	}
+	if run != nil {
+		if err := run(backend, args); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	err = yaml.Unmarshal(data, &config)
+	stopTracing, err := startTracing(config)
 	if err != nil {
-		return config, fmt.Errorf("error parsing config file: %v", err)
+		log.Fatal(err)
 	}
 
-	return config, nil
-}
+	if config.Graph.Preflight.Enabled {
+		if err := backend.preflight(); err != nil {
+			log.Fatalf("Graph pre-flight check failed: %v", err)
+		}
+	}
 
-func main() {
-	config, err := loadConfig("config.yaml")
+	trusted, err := parseCIDRs(config.SMTP.TrustedProxies)
 	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+		log.Fatalf("Invalid smtp.trusted_proxies: %v", err)
 	}
 
-	backend, err := NewBackend(config)
+	tlsConfig, err := newTLSConfig(config, backend.logger)
 	if err != nil {
-		log.Fatalf("Failed to create backend: %v", err)
+		log.Fatal(err)
+	}
+
+	startHTTPServer(backend)
+	startDebugServer(backend)
+	go backend.reloadOnSignal(opts)
+	go backend.handleUserSignals()
+	if err := backend.startScheduler(); err != nil {
+		log.Fatal(err)
+	}
+
+	sockets, err := inheritedSockets()
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	s := smtp.NewServer(backend)
+	errc := make(chan error)
+	var servers []*smtp.Server
+	for _, lc := range config.listeners() {
+		mode := lc.tlsMode(tlsConfig != nil)
+		s := newServer(backend, lc, mode)
+		servers = append(servers, s)
+
+		l, ok := sockets.take(lc)
+		if ok {
+			log.Printf("Using socket %s from systemd for listener %s", l.Addr(), lc.Name)
+		} else if l, err = listen(lc); err != nil {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+		backend.listening.Add(1)
+		if len(trusted) > 0 || lc.ProxyProtocol {
+			l = &proxyListener{Listener: l, trusted: trusted, required: lc.ProxyProtocol, logger: backend.logger}
+		}
+		sl := &sessionListener{Listener: l, name: lc.Name, limits: newConnLimits(config, lc), replies: backend.replies, logger: backend.logger, backend: backend}
+		// Checked by loadConfig
+		sl.networks, _ = parseCIDRs(lc.Networks)
+		if mode != "none" && tlsConfig == nil {
+			log.Fatalf("Listener %s uses TLS, but smtp.tls has no certificate", lc.Name)
+		}
+		listenerTLS := tlsConfig
+		if mode != "none" {
+			if listenerTLS, err = listenerTLSConfig(tlsConfig, lc); err != nil {
+				log.Fatal(err)
+			}
+		}
+		switch mode {
+		case "starttls":
+			sl.tlsConfig = listenerTLS
+			sl.keepHello = lc.EHLOAfterSTARTTLS == "optional"
+		case "implicit":
+			sl.tlsConfig, sl.implicitTLS = listenerTLS, true
+		}
+		l = sl
+
+		log.Printf("Starting SMTP server %s at %s", lc.Name, s.Addr)
+		go func() {
+			errc <- s.Serve(l)
+		}()
+	}
 
-	s.Addr = config.SMTP.Address
-	s.Domain = config.SMTP.Domain
-	s.ReadTimeout = 10 * time.Second
-	s.WriteTimeout = 10 * time.Second
-	s.MaxMessageBytes = 1024 * 1024
-	s.MaxRecipients = 50
-	s.AllowInsecureAuth = true
+	for _, addr := range sockets.unused() {
+		backend.logger.Warn("closed socket from systemd that no listener uses", "address", addr)
+	}
+	if err := sdNotify(fmt.Sprintf("READY=1\nSTATUS=Relaying on %d listeners", len(servers))); err != nil {
+		backend.logger.Warn("systemd notification failed", "errormsg", err)
+	}
+	if interval := watchdogInterval(); interval > 0 {
+		go backend.notifyWatchdog(interval)
+	}
 
-	log.Printf("Starting SMTP server at %s", s.Addr)
-	if err := s.ListenAndServe(); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	ready()
+	select {
+	case err := <-errc:
+		if err != nil {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	case <-stop:
+		backend.shutdown(servers)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := stopTracing(ctx); err != nil {
+			backend.logger.Warn("flushing traces failed", "errormsg", err)
+		}
+		cancel()
+		stopped()
 	}
 }
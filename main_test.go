@@ -0,0 +1,73 @@
+// main_test.go
+package main
+
+import (
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// newTestBackend returns a backend with config as its policy, the default
+// replies and no Graph tenants
+func newTestBackend(t *testing.T, config Config) *Backend {
+	t.Helper()
+	p, err := newPolicySet(config)
+	if err != nil {
+		t.Fatalf("newPolicySet: %v", err)
+	}
+	replies, err := newReplyCatalog(nil)
+	if err != nil {
+		t.Fatalf("newReplyCatalog: %v", err)
+	}
+	bkd := &Backend{logger: slog.New(slog.NewTextHandler(io.Discard, nil)), replies: replies, store: newMemoryStore()}
+	bkd.current.Store(p)
+	return bkd
+}
+
+func TestEnvMessageID(t *testing.T) {
+	// parseHeaders keeps the client's spelling of the header name
+	for _, key := range []string{"Message-ID", "Message-Id", "message-id"} {
+		s := &Session{from: "app@example.com"}
+		env := s.env(parseHeaders(key + ":  <abc@example.com> \r\nSubject: hi"))
+		if env.messageID != "<abc@example.com>" {
+			t.Errorf("%s: messageID = %q, want %q", key, env.messageID, "<abc@example.com>")
+		}
+	}
+}
+
+func TestTextContent(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain ascii", "plain ascii"},
+		{"grüße ✓", "grüße ✓"},
+		{"nul\x00 byte", "nul byte"},
+		{"caf\xe9", "café"},
+		{"\xff\x00\xfe", "ÿþ"},
+	}
+	for _, tt := range tests {
+		if got := textContent(tt.in); got != tt.want {
+			t.Errorf("textContent(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func FuzzTextContent(f *testing.F) {
+	for _, seed := range []string{"", "hello\r\n.\r\n", "grüße ✓", "caf\xe9", "a\x00b", "\xf0\x9f\x98"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, in string) {
+		out := textContent(in)
+		if !utf8.ValidString(out) {
+			t.Fatalf("textContent(%q) = %q, not valid UTF-8", in, out)
+		}
+		if strings.ContainsRune(out, 0) {
+			t.Fatalf("textContent(%q) = %q, kept a NUL byte", in, out)
+		}
+		if utf8.ValidString(in) && !strings.ContainsRune(in, 0) && out != in {
+			t.Fatalf("textContent(%q) = %q, changed valid UTF-8", in, out)
+		}
+	})
+}
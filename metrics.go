@@ -0,0 +1,143 @@
+// metrics.go
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// maxClientLabels caps how many distinct client IPs are used as metric
+// labels; clients beyond that are counted as "other"
+const maxClientLabels = 1000
+
+var sessionEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "gographsmtp_smtp_session_events_total",
+	Help: "SMTP session events (rset, noop, quit, aborted_transaction, dropped_connection, refused_connection) per client IP.",
+}, []string{"event", "client_ip"})
+
+var clientLabels = &labelLimiter{max: maxClientLabels, seen: make(map[string]struct{})}
+
+// labelLimiter keeps the cardinality of a label bounded
+type labelLimiter struct {
+	mu   sync.Mutex
+	max  int
+	seen map[string]struct{}
+}
+
+func (l *labelLimiter) value(v string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.seen[v]; ok {
+		return v
+	}
+	if len(l.seen) >= l.max {
+		return "other"
+	}
+	l.seen[v] = struct{}{}
+	return v
+}
+
+// recordSessionEvent counts a session event for the client
+func recordSessionEvent(event, ip string) {
+	sessionEvents.WithLabelValues(event, clientLabels.value(ip)).Inc()
+}
+
+var (
+	messagesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gographsmtp_messages_total",
+		Help: "Messages per tenant, sender and result (sent, failed, quarantined, deferred).",
+	}, []string{"tenant", "sender", "result"})
+	deliveryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gographsmtp_delivery_duration_seconds",
+		Help:    "Time taken to hand a message to Graph, per tenant and sender.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+	}, []string{"tenant", "sender"})
+	queueDepth = prometheus.NewDesc("gographsmtp_queue_messages",
+		"Messages waiting in the quarantine, deferred or retry queue, per tenant.",
+		[]string{"tenant", "queue"}, nil)
+)
+
+// metricLabels turns tenants and senders into label values.
+// metrics.sender_label keeps the number of sender labels in check:
+// "mailbox" (default) labels by address, "domain" by its domain and
+// "none" drops the sender. Senders beyond max_sender_labels are "other".
+type metricLabels struct {
+	mode    string
+	senders *labelLimiter
+}
+
+func newMetricLabels(config Config) *metricLabels {
+	max := config.Metrics.MaxSenderLabels
+	if max <= 0 {
+		max = maxClientLabels
+	}
+	return &metricLabels{
+		mode:    config.Metrics.SenderLabel,
+		senders: &labelLimiter{max: max, seen: make(map[string]struct{})},
+	}
+}
+
+// sender returns the label value for a sending mailbox
+func (m *metricLabels) sender(addr string) string {
+	addr = strings.ToLower(addr)
+	switch m.mode {
+	case "none":
+		return ""
+	case "domain":
+		if at := strings.LastIndex(addr, "@"); at >= 0 {
+			addr = addr[at+1:]
+		}
+	}
+	return m.senders.value(addr)
+}
+
+// recordMessage counts a message of the sender with its result
+func (bkd *Backend) recordMessage(from, result string) {
+	messagesTotal.WithLabelValues(bkd.tenant(from).name, bkd.labels.sender(from), result).Inc()
+}
+
+// recordDelivery counts a send attempt to Graph and its duration
+func (bkd *Backend) recordDelivery(from string, start time.Time, err error) {
+	if err != nil {
+		bkd.recordMessage(from, "failed")
+		return
+	}
+	bkd.recordMessage(from, "sent")
+	deliveryDuration.WithLabelValues(bkd.tenant(from).name, bkd.labels.sender(from)).Observe(time.Since(start).Seconds())
+}
+
+// queueCollector reports the depth of the spool stores when scraped
+type queueCollector struct {
+	bkd *Backend
+}
+
+func (c queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepth
+}
+
+func (c queueCollector) Collect(ch chan<- prometheus.Metric) {
+	for queue, store := range map[string]*spoolStore{"quarantine": c.bkd.quarantine, "deferred": c.bkd.deferred, "retry": c.bkd.retry} {
+		if store == nil {
+			continue
+		}
+		entries, err := store.list()
+		if err != nil {
+			continue
+		}
+		counts := make(map[string]int, len(c.bkd.tenants))
+		for _, t := range c.bkd.tenants {
+			counts[t.name] = 0
+		}
+		for _, entry := range entries {
+			counts[c.bkd.tenant(entry.From).name]++
+		}
+		for tenant, n := range counts {
+			ch <- prometheus.MustNewConstMetric(queueDepth, prometheus.GaugeValue, float64(n), tenant, queue)
+		}
+	}
+}
@@ -0,0 +1,581 @@
+// milter.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// defaultMilterTimeout bounds the conversation with a milter unless
+// milter.timeout is set
+const defaultMilterTimeout = 30 * time.Second
+
+// Milter protocol version 6, as spoken by Postfix and Sendmail
+const (
+	milterVersion = 6
+
+	// Commands of the MTA
+	milterOptNeg  = 'O'
+	milterMacro   = 'D'
+	milterConnect = 'C'
+	milterHelo    = 'H'
+	milterMail    = 'M'
+	milterRcpt    = 'R'
+	milterData    = 'T'
+	milterHeader  = 'L'
+	milterEOH     = 'N'
+	milterBody    = 'B'
+	milterEOB     = 'E'
+	milterQuit    = 'Q'
+
+	// Actions the relay lets milters take: add, change and insert
+	// headers, replace the body, add and delete recipients, quarantine
+	milterActions = 0x01 | 0x02 | 0x04 | 0x08 | 0x10 | 0x20 | 0x80
+	// Protocol steps milters may skip or not answer, all but
+	// SMFIP_HDR_LEADSPC
+	milterProtocol = 0xfffff
+
+	// milterBodyChunk is the largest body chunk of the protocol
+	milterBodyChunk = 65535
+	// milterMaxPacket bounds a packet from a milter
+	milterMaxPacket = 1 << 24
+)
+
+// milterSteps maps the commands a milter may skip, or not answer, to the
+// SMFIP_NO* and SMFIP_NR_* flags for them
+var milterSteps = map[byte]struct{ skip, noReply uint32 }{
+	milterConnect: {0x1, 0x1000},
+	milterHelo:    {0x2, 0x2000},
+	milterMail:    {0x4, 0x4000},
+	milterRcpt:    {0x8, 0x8000},
+	milterData:    {0x200, 0x10000},
+	milterHeader:  {0x20, 0x80},
+	milterEOH:     {0x40, 0x40000},
+	milterBody:    {0x10, 0x80000},
+}
+
+var miltersTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "gographsmtp_milter_results_total",
+	Help: "Messages passed through a milter, per result (continue, accept, reject, tempfail, discard, quarantine, error).",
+}, []string{"result"})
+
+// milterResult is the verdict of the milters on a message and the changes
+// they asked for
+type milterResult struct {
+	// action is "" to go on, or discard or quarantine
+	action string
+	reason string
+	// edits are the header changes, in the order given
+	edits []headerEdit
+	// body replaces the message body when not nil
+	body      []byte
+	addRcpts  []string
+	delRcpts  []string
+	changed   bool
+	skipOther bool // a milter accepted the message outright
+}
+
+// headerEdit adds, inserts or changes (deletes, with an empty value) a
+// header field. index is the position of an insert, or which occurrence
+// of the name a change is for, counted from 1.
+type headerEdit struct {
+	op    byte // 'h' add, 'i' insert, 'm' change
+	index int
+	name  string
+	value string
+}
+
+// milterStep is a command of the SMTP transaction, with the macros sent
+// before it
+type milterStep struct {
+	cmd    byte
+	macros []string
+	data   []byte
+}
+
+// milterConn is a conversation with a milter about one message
+type milterConn struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	protocol uint32 // steps the milter skips or doesn't answer
+}
+
+// checkMilters passes the message through the milters of milter.addresses
+// in order, each seeing the changes of the ones before it. A rejection
+// is returned as the SMTP reply; a failed milter refuses the message with
+// 451 unless milter.on_error is accept.
+func (s *Session) checkMilters(data []byte, headers map[string]string) (*milterResult, []byte, error) {
+	config := s.backend.policy().config.Milter
+	total := &milterResult{}
+	if len(config.Addresses) == 0 {
+		return total, data, nil
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultMilterTimeout
+	}
+	for _, address := range config.Addresses {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		res, reply, err := s.runMilter(ctx, address, data)
+		cancel()
+		if err != nil {
+			miltersTotal.WithLabelValues("error").Inc()
+			if config.OnError == "accept" {
+				s.log().Warn("milter failed, message accepted", "client", s.clientIP, "from", s.from, "milter", address, "status", "milter_failed", "errormsg", err)
+				continue
+			}
+			s.log().Error("milter failed", "client", s.clientIP, "from", s.from, "milter", address, "status", "milter_failed", "errormsg", err)
+			return nil, nil, s.backend.replies.error(451, smtp.EnhancedCode{4, 3, 0}, "milter_failed")
+		}
+		if reply != nil {
+			result := "reject"
+			if reply.Code/100 == 4 {
+				result = "tempfail"
+			}
+			if reply.Message == "" {
+				name := "milter_rejected"
+				if result == "tempfail" {
+					name = "milter_deferred"
+				}
+				reply = s.backend.replies.error(reply.Code, reply.EnhancedCode, name)
+			}
+			miltersTotal.WithLabelValues(result).Inc()
+			s.log().Warn("message refused by milter", "client", s.clientIP, "from", s.from, "milter", address, "status", "milter_"+result, "reason", reply.Message)
+			return nil, nil, reply
+		}
+		switch res.action {
+		case "discard", "quarantine":
+			miltersTotal.WithLabelValues(res.action).Inc()
+			return res, data, nil
+		}
+		if res.skipOther {
+			miltersTotal.WithLabelValues("accept").Inc()
+		} else {
+			miltersTotal.WithLabelValues("continue").Inc()
+		}
+
+		// The changes apply to the message for the next milter and to the
+		// headers the relay reads
+		data = applyHeaderEdits(data, res.edits)
+		if res.body != nil {
+			header, _, _ := bytes.Cut(data, []byte("\r\n\r\n"))
+			data = append(append(header[:len(header):len(header)], "\r\n\r\n"...), res.body...)
+			total.body = res.body
+		}
+		for _, e := range res.edits {
+			setHeaderValue(headers, e)
+		}
+		total.edits = append(total.edits, res.edits...)
+		total.addRcpts = append(total.addRcpts, res.addRcpts...)
+		total.delRcpts = append(total.delRcpts, res.delRcpts...)
+		total.changed = total.changed || res.changed
+		if res.skipOther {
+			break
+		}
+	}
+	return total, data, nil
+}
+
+// milterRecipients adds and removes the recipients the milters asked for
+func (s *Session) milterRecipients(res *milterResult) {
+	for _, rcpt := range res.delRcpts {
+		s.to = slices.DeleteFunc(s.to, func(r string) bool { return strings.EqualFold(r, rcpt) })
+	}
+	for _, rcpt := range res.addRcpts {
+		if !slices.ContainsFunc(s.to, func(r string) bool { return strings.EqualFold(r, rcpt) }) {
+			s.to = append(s.to, rcpt)
+		}
+	}
+}
+
+// runMilter has one milter check the message. A rejection comes back as
+// the reply to send.
+func (s *Session) runMilter(ctx context.Context, address string, data []byte) (*milterResult, *smtp.SMTPError, error) {
+	conn, err := dialScanner(ctx, address)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	m := &milterConn{conn: conn, r: bufio.NewReader(conn)}
+	if err := m.negotiate(); err != nil {
+		return nil, nil, err
+	}
+	defer m.send(milterQuit, nil)
+
+	config := s.backend.policy().config
+	addr := s.conn.Conn().RemoteAddr()
+	steps := []milterStep{
+		{milterConnect, []string{"j", config.hostname(), "{daemon_name}", "gographsmtp"}, milterConnectInfo(s.conn.Hostname(), addr)},
+		{milterHelo, nil, cstrings(s.conn.Hostname())},
+		{milterMail, []string{"{mail_addr}", s.from, "{auth_authen}", s.authUser}, cstrings("<" + s.from + ">")},
+	}
+	for _, rcpt := range s.envelopeRecipients() {
+		steps = append(steps, milterStep{milterRcpt, []string{"{rcpt_addr}", rcpt}, cstrings("<" + rcpt + ">")})
+	}
+	for _, step := range steps {
+		if step.macros != nil {
+			if err := m.send(milterMacro, append([]byte{step.cmd}, cstrings(step.macros...)...)); err != nil {
+				return nil, nil, err
+			}
+		}
+		if res, reply, err := m.step(step.cmd, step.data); res != nil || reply != nil || err != nil {
+			return res, reply, err
+		}
+	}
+
+	header, body, _ := bytes.Cut(data, []byte("\r\n\r\n"))
+	if res, reply, err := m.step(milterData, nil); res != nil || reply != nil || err != nil {
+		return res, reply, err
+	}
+	for _, f := range headerFields(header) {
+		if res, reply, err := m.step(milterHeader, cstrings(f[0], f[1])); res != nil || reply != nil || err != nil {
+			return res, reply, err
+		}
+	}
+	if res, reply, err := m.step(milterEOH, nil); res != nil || reply != nil || err != nil {
+		return res, reply, err
+	}
+	for len(body) > 0 {
+		chunk := body[:min(len(body), milterBodyChunk)]
+		body = body[len(chunk):]
+		res, reply, err := m.step(milterBody, chunk)
+		if err == errMilterSkip {
+			break
+		}
+		if res != nil || reply != nil || err != nil {
+			return res, reply, err
+		}
+	}
+
+	if err := m.send(milterMacro, append([]byte{milterEOB}, cstrings("i", s.queueID)...)); err != nil {
+		return nil, nil, err
+	}
+	if err := m.send(milterEOB, nil); err != nil {
+		return nil, nil, err
+	}
+	return m.endOfMessage()
+}
+
+// errMilterSkip is a milter's request to skip the rest of the body
+var errMilterSkip = errors.New("skip")
+
+// negotiate agrees on the version, actions and protocol steps
+func (m *milterConn) negotiate() error {
+	var opts [12]byte
+	binary.BigEndian.PutUint32(opts[0:], milterVersion)
+	binary.BigEndian.PutUint32(opts[4:], milterActions)
+	binary.BigEndian.PutUint32(opts[8:], milterProtocol)
+	if err := m.send(milterOptNeg, opts[:]); err != nil {
+		return err
+	}
+	cmd, data, err := m.read()
+	if err != nil {
+		return err
+	}
+	if cmd != milterOptNeg || len(data) < 12 {
+		return fmt.Errorf("unexpected reply %q to option negotiation", cmd)
+	}
+	if v := binary.BigEndian.Uint32(data[0:]); v < 2 {
+		return fmt.Errorf("unsupported milter version %d", v)
+	}
+	m.protocol = binary.BigEndian.Uint32(data[8:]) & milterProtocol
+	return nil
+}
+
+// step sends a command the milter hasn't asked to skip and reads its
+// reply, unless the milter doesn't send one. It returns a result only
+// when the milter decided about the message.
+func (m *milterConn) step(cmd byte, data []byte) (*milterResult, *smtp.SMTPError, error) {
+	flags := milterSteps[cmd]
+	if m.protocol&flags.skip != 0 {
+		return nil, nil, nil
+	}
+	if err := m.send(cmd, data); err != nil {
+		return nil, nil, err
+	}
+	if m.protocol&flags.noReply != 0 {
+		return nil, nil, nil
+	}
+	for {
+		reply, data, err := m.read()
+		if err != nil {
+			return nil, nil, err
+		}
+		switch reply {
+		case 'p': // progress
+			continue
+		case 'c':
+			return nil, nil, nil
+		case 's':
+			if cmd == milterBody {
+				return nil, nil, errMilterSkip
+			}
+			return nil, nil, nil
+		}
+		return milterVerdict(reply, data, &milterResult{})
+	}
+}
+
+// endOfMessage reads the changes the milter asks for and its verdict
+func (m *milterConn) endOfMessage() (*milterResult, *smtp.SMTPError, error) {
+	res := &milterResult{}
+	for {
+		reply, data, err := m.read()
+		if err != nil {
+			return nil, nil, err
+		}
+		switch reply {
+		case 'p':
+		case 'h', 'i', 'm':
+			e := headerEdit{op: reply}
+			if reply != 'h' {
+				if len(data) < 4 {
+					return nil, nil, fmt.Errorf("short header change")
+				}
+				e.index, data = int(binary.BigEndian.Uint32(data)), data[4:]
+			}
+			fields := splitCStrings(data)
+			if len(fields) < 2 {
+				return nil, nil, fmt.Errorf("malformed header change")
+			}
+			e.name, e.value = fields[0], fields[1]
+			res.edits = append(res.edits, e)
+			res.changed = true
+		case 'b':
+			res.body = append(res.body, data...)
+			res.changed = true
+		case '+', '2':
+			if fields := splitCStrings(data); len(fields) > 0 {
+				res.addRcpts = append(res.addRcpts, strings.Trim(fields[0], "<>"))
+				res.changed = true
+			}
+		case '-':
+			if fields := splitCStrings(data); len(fields) > 0 {
+				res.delRcpts = append(res.delRcpts, strings.Trim(fields[0], "<>"))
+				res.changed = true
+			}
+		case 'q':
+			res.action = "quarantine"
+			if fields := splitCStrings(data); len(fields) > 0 {
+				res.reason = fields[0]
+			}
+		case 'c':
+			return res, nil, nil
+		default:
+			return milterVerdict(reply, data, res)
+		}
+	}
+}
+
+// milterVerdict turns a final reply of a milter into the result: accept,
+// discard, or a rejection as the SMTP reply
+func milterVerdict(reply byte, data []byte, res *milterResult) (*milterResult, *smtp.SMTPError, error) {
+	switch reply {
+	case 'a':
+		res.skipOther = true
+		return res, nil, nil
+	case 'd':
+		res.action = "discard"
+		return res, nil, nil
+	// The reply texts of SMFIR_REJECT and SMFIR_TEMPFAIL come from the
+	// catalog
+	case 'r':
+		return nil, &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}}, nil
+	case 't':
+		return nil, &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 7, 1}}, nil
+	case 'y':
+		return nil, milterReply(strings.TrimRight(string(data), "\x00")), nil
+	}
+	return nil, nil, fmt.Errorf("unexpected reply %q", reply)
+}
+
+// milterReply reads the reply of SMFIR_REPLYCODE, e.g. "550 5.7.1 Spam
+// message rejected". The lines of a multiline reply are joined.
+func milterReply(text string) *smtp.SMTPError {
+	reply := &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}}
+	var lines []string
+	for i, line := range strings.FieldsFunc(text, func(r rune) bool { return r == '\r' || r == '\n' }) {
+		if code, err := strconv.Atoi(line[:min(len(line), 3)]); err == nil && code >= 400 && code < 600 {
+			line = strings.TrimLeft(line[3:], "- ")
+			if i == 0 {
+				reply.Code, reply.EnhancedCode = code, smtp.EnhancedCode{code / 100, 7, 1}
+			}
+			first, rest, _ := strings.Cut(line, " ")
+			var e smtp.EnhancedCode
+			if n, _ := fmt.Sscanf(first, "%d.%d.%d", &e[0], &e[1], &e[2]); n == 3 && e[0] == code/100 {
+				if i == 0 {
+					reply.EnhancedCode = e
+				}
+				line = rest
+			}
+		}
+		lines = append(lines, strings.TrimSpace(line))
+	}
+	reply.Message = strings.Join(lines, " ")
+	return reply
+}
+
+func (m *milterConn) send(cmd byte, data []byte) error {
+	packet := make([]byte, 5+len(data))
+	binary.BigEndian.PutUint32(packet, uint32(1+len(data)))
+	packet[4] = cmd
+	copy(packet[5:], data)
+	_, err := m.conn.Write(packet)
+	return err
+}
+
+func (m *milterConn) read() (byte, []byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(m.r, size[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n == 0 || n > milterMaxPacket {
+		return 0, nil, fmt.Errorf("invalid packet size %d", n)
+	}
+	packet := make([]byte, n)
+	if _, err := io.ReadFull(m.r, packet); err != nil {
+		return 0, nil, err
+	}
+	return packet[0], packet[1:], nil
+}
+
+// milterConnectInfo is the SMFIC_CONNECT data: the client's host name,
+// address family, port and address
+func milterConnectInfo(helo string, addr net.Addr) []byte {
+	info := cstrings(helo)
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return append(info, 'U')
+	}
+	family := byte('4')
+	if tcp.IP.To4() == nil {
+		family = '6'
+	}
+	info = append(info, family)
+	info = binary.BigEndian.AppendUint16(info, uint16(tcp.Port))
+	return append(info, cstrings(tcp.IP.String())...)
+}
+
+// cstrings joins NUL-terminated strings
+func cstrings(s ...string) []byte {
+	var b []byte
+	for _, v := range s {
+		b = append(append(b, v...), 0)
+	}
+	return b
+}
+
+func splitCStrings(data []byte) []string {
+	var fields []string
+	for _, f := range bytes.Split(bytes.TrimSuffix(data, []byte{0}), []byte{0}) {
+		fields = append(fields, string(f))
+	}
+	return fields
+}
+
+// headerFields returns the header fields in order as name and value, the
+// value without the space after the colon and with folded lines joined
+// by LF, as milters expect
+func headerFields(header []byte) [][2]string {
+	var fields [][2]string
+	for _, line := range strings.Split(string(header), "\r\n") {
+		if len(fields) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			fields[len(fields)-1][1] += "\n" + line
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fields = append(fields, [2]string{strings.TrimSpace(name), strings.TrimLeft(value, " \t")})
+	}
+	return fields
+}
+
+// applyHeaderEdits makes the header changes of a milter in the message
+func applyHeaderEdits(data []byte, edits []headerEdit) []byte {
+	if len(edits) == 0 {
+		return data
+	}
+	header, body, found := bytes.Cut(data, []byte("\r\n\r\n"))
+	if !found {
+		return data
+	}
+	// The fields with their continuation lines
+	var fields []string
+	for _, line := range strings.SplitAfter(string(header)+"\r\n", "\r\n") {
+		if line == "" {
+			continue
+		}
+		if len(fields) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	field := func(name, value string) string {
+		return name + ": " + strings.ReplaceAll(strings.ReplaceAll(value, "\r\n", "\n"), "\n", "\r\n") + "\r\n"
+	}
+	for _, e := range edits {
+		switch e.op {
+		case 'h':
+			fields = append(fields, field(e.name, e.value))
+		case 'i':
+			i := min(max(e.index, 0), len(fields))
+			fields = append(fields[:i], append([]string{field(e.name, e.value)}, fields[i:]...)...)
+		case 'm':
+			n, at := 0, -1
+			for i, f := range fields {
+				name, _, _ := strings.Cut(f, ":")
+				if strings.EqualFold(strings.TrimSpace(name), e.name) {
+					if n++; n == max(e.index, 1) {
+						at = i
+						break
+					}
+				}
+			}
+			switch {
+			case at < 0 && e.value != "":
+				fields = append(fields, field(e.name, e.value))
+			case at >= 0 && e.value == "":
+				fields = append(fields[:at], fields[at+1:]...)
+			case at >= 0:
+				fields[at] = field(e.name, e.value)
+			}
+		}
+	}
+	out := []byte(strings.Join(fields, "") + "\r\n")
+	return append(out, body...)
+}
+
+// setHeaderValue carries a milter's header change over to the headers the
+// relay reads
+func setHeaderValue(headers map[string]string, e headerEdit) {
+	key := e.name
+	for k := range headers {
+		if strings.EqualFold(k, e.name) {
+			key = k
+			break
+		}
+	}
+	if e.op == 'm' && e.value == "" {
+		delete(headers, key)
+		return
+	}
+	headers[key] = strings.Join(strings.Fields(e.value), " ")
+}
@@ -0,0 +1,656 @@
+// mime.go
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/textproto"
+	"golang.org/x/net/html"
+)
+
+// mimeContent is what the relay takes from a MIME message: the body
+// to send and the attached files
+type mimeContent struct {
+	opts        mimeOptions
+	text        string
+	html        string
+	attachments []mimeAttachment
+	damaged     bool // some parts were unreadable and skipped
+	invitation  bool // has a text/calendar part with a method, a meeting request or reply
+}
+
+// mimeOptions selects the optional conversions applied while parsing
+type mimeOptions struct {
+	UnpackTNEF   bool // replace winmail.dat parts with their contents
+	MessageItems bool // attach message/rfc822 parts as Outlook items
+}
+
+// mimeAttachment is a file carried in a MIME part, transfer-decoded
+type mimeAttachment struct {
+	name        string
+	contentType string
+	contentID   string // without angle brackets
+	location    string // Content-Location, an alternative to Content-ID
+	inline      bool   // referenced from the HTML body
+	item        bool   // an attached message to send as an Outlook item
+	data        []byte
+}
+
+// body returns the message body, preferring HTML over plain text
+func (c *mimeContent) body() (string, bool) {
+	if c.html != "" {
+		return c.html, true
+	}
+	return c.text, false
+}
+
+// parseMIME reads a single-part or multipart message. Transfer encodings
+// and text charsets are decoded; parts with an unknown charset are kept as
+// they are.
+func parseMIME(data []byte, opts mimeOptions) (*mimeContent, error) {
+	e, err := message.Read(bytes.NewReader(data))
+	if err != nil && !message.IsUnknownCharset(err) {
+		return nil, err
+	}
+
+	c := &mimeContent{opts: opts}
+	if err := c.walk(e, false); err != nil {
+		return nil, err
+	}
+	if c.damaged && c.text == "" && c.html == "" && len(c.attachments) == 0 {
+		return nil, fmt.Errorf("no readable parts")
+	}
+	c.linkInline()
+	return c, nil
+}
+
+// walk adds an entity and its parts to c. The rules, applied recursively:
+//
+//   - multipart/alternative: only the richest alternative is used, i.e. the
+//     last one with an HTML body, and the last plain text alternative. Other
+//     alternatives (text/enriched, text/watch-html, AMP ...) are dropped.
+//   - multipart/related: the root part is walked as usual, every other part
+//     is an inline attachment the HTML refers to by Content-ID.
+//   - any other multipart (mixed, digest, report, unknown subtypes): the
+//     parts are walked in order.
+//   - text/plain and text/html that are neither named nor marked as
+//     attachment are body. Body parts after the first are appended, e.g.
+//     footers added by list servers.
+//   - message/rfc822 is attached as <subject>.eml, or with MessageItems
+//     as an Outlook item.
+//   - detached signatures and empty non-text parts are dropped.
+//   - everything else is an attachment.
+//
+// Unreadable parts are skipped so a broken boundary doesn't cost the parts
+// before it.
+func (c *mimeContent) walk(e *message.Entity, related bool) error {
+	mediaType := entityMediaType(e.Header)
+
+	// The boundary is read leniently: go-message ignores all parameters
+	// when any of them is malformed
+	boundary := headerParam(e.Header.Get("Content-Type"), "boundary")
+	if strings.HasPrefix(mediaType, "multipart/") && boundary != "" {
+		var parts []*message.Entity
+		mr := textproto.NewMultipartReader(e.Body, boundary)
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				c.damaged = true
+				break
+			}
+			// Parts with an unknown charset or encoding are read as they are
+			part, _ := message.New(message.Header{Header: p.Header}, p)
+			// Parts must be read in order, so buffer each before moving
+			// on. A part cut short by a missing boundary keeps what it has.
+			body, err := io.ReadAll(part.Body)
+			part.Body = bytes.NewReader(body)
+			if err != nil {
+				c.damaged = true
+				if len(body) > 0 {
+					parts = append(parts, part)
+				}
+				break
+			}
+			parts = append(parts, part)
+		}
+
+		switch mediaType {
+		case "multipart/alternative":
+			return c.walkAlternative(parts, related)
+		case "multipart/related":
+			for i, part := range parts {
+				if err := c.walk(part, related || i > 0); err != nil {
+					return err
+				}
+			}
+		default:
+			for _, part := range parts {
+				if err := c.walk(part, related); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	data, err := io.ReadAll(e.Body)
+	if err != nil {
+		c.damaged = true
+		return nil
+	}
+
+	if _, params, _ := e.Header.ContentType(); mediaType == "text/calendar" && params["method"] != "" {
+		c.invitation = true
+	}
+
+	disposition, _, _ := e.Header.ContentDisposition()
+	name := attachmentFilename(e.Header)
+	isBody := !related && disposition != "attachment" && name == ""
+
+	// A multipart without a usable boundary can't be split
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mediaType, c.damaged = "text/plain", true
+	}
+
+	if c.opts.UnpackTNEF && (mediaType == "application/ms-tnef" || strings.EqualFold(name, "winmail.dat")) && c.unpackTNEF(data) {
+		return nil
+	}
+
+	switch {
+	case isBody && mediaType == "text/html":
+		c.appendBody("", textContent(string(data)))
+		return nil
+	case isBody && mediaType == "text/plain":
+		c.appendBody(textContent(string(data)), "")
+		return nil
+	case mediaType == "application/pgp-signature", mediaType == "application/pkcs7-signature", mediaType == "application/x-pkcs7-signature":
+		return nil
+	case len(data) == 0 && !strings.HasPrefix(mediaType, "text/"):
+		return nil
+	case mediaType == "message/rfc822" && name == "":
+		name = embeddedMessageName(data)
+	}
+
+	if name == "" {
+		name = "attachment"
+		if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+			name += exts[0]
+		}
+	}
+	c.attachments = append(c.attachments, mimeAttachment{
+		name:        name,
+		contentType: mediaType,
+		contentID:   strings.Trim(strings.TrimSpace(e.Header.Get("Content-Id")), "<>"),
+		location:    strings.TrimSpace(e.Header.Get("Content-Location")),
+		inline:      related || disposition == "inline",
+		item:        c.opts.MessageItems && mediaType == "message/rfc822",
+		data:        data,
+	})
+	return nil
+}
+
+// walkAlternative keeps the last alternative with an HTML body and the last
+// plain text alternative. Calendar alternatives, as sent with Outlook
+// meeting invitations, are kept as attachments.
+func (c *mimeContent) walkAlternative(parts []*message.Entity, related bool) error {
+	var htmlAlt, textAlt *mimeContent
+	for _, part := range parts {
+		alt := &mimeContent{opts: c.opts}
+		if err := alt.walk(part, related); err != nil {
+			return err
+		}
+		c.damaged = c.damaged || alt.damaged
+		c.invitation = c.invitation || alt.invitation
+		switch {
+		case alt.html != "":
+			htmlAlt = alt
+		case alt.text != "":
+			textAlt = alt
+		case entityMediaType(part.Header) == "text/calendar":
+			c.attachments = append(c.attachments, alt.attachments...)
+		}
+	}
+
+	var text, htmlBody string
+	if textAlt != nil {
+		text = textAlt.text
+	}
+	switch {
+	case htmlAlt != nil:
+		htmlBody = htmlAlt.html
+		c.attachments = append(c.attachments, htmlAlt.attachments...)
+	case textAlt != nil:
+		c.attachments = append(c.attachments, textAlt.attachments...)
+	}
+	c.appendBody(text, htmlBody)
+	return nil
+}
+
+// appendBody adds a body part given as plain text, HTML or both (from a
+// multipart/alternative). Once there is an HTML body, text-only parts are
+// added to it as well so the HTML version doesn't miss anything.
+func (c *mimeContent) appendBody(text, htmlBody string) {
+	if htmlBody != "" {
+		if c.html == "" && c.text != "" {
+			c.html = "<pre>" + html.EscapeString(c.text) + "</pre>"
+		}
+		c.html += htmlBody
+	} else if c.html != "" && text != "" {
+		c.html += "<pre>" + html.EscapeString(text) + "</pre>"
+	}
+
+	if text != "" {
+		if c.text != "" {
+			c.text += "\r\n"
+		}
+		c.text += text
+	}
+}
+
+// cidReference matches cid: URLs (RFC 2392) in HTML attributes and CSS
+var cidReference = regexp.MustCompile(`(?i)cid:([^"'\s)>]+)`)
+
+// linkInline matches the inline parts to the HTML body. Outlook doesn't
+// list inline attachments, so only parts the HTML refers to stay inline
+// and all others are shown as attachments. Parts referred to by their
+// Content-Location (RFC 2557) get a Content-ID, and the references are
+// rewritten to cid: URLs, since Graph only resolves those.
+func (c *mimeContent) linkInline() {
+	for i := range c.attachments {
+		a := &c.attachments[i]
+		if !a.inline || a.location == "" || c.html == "" {
+			continue
+		}
+		for _, quote := range []string{`"`, `'`} {
+			ref := quote + a.location + quote
+			if !strings.Contains(c.html, ref) {
+				continue
+			}
+			if a.contentID == "" {
+				a.contentID = "part" + strconv.Itoa(i+1) + ".location@gographsmtp"
+			}
+			c.html = strings.ReplaceAll(c.html, ref, quote+"cid:"+a.contentID+quote)
+		}
+	}
+
+	// References are URL-encoded and, by many clients, case-insensitive
+	refs := make(map[string]string)
+	for _, m := range cidReference.FindAllStringSubmatch(c.html, -1) {
+		id := m[1]
+		if unescaped, err := url.PathUnescape(id); err == nil {
+			id = unescaped
+		}
+		refs[strings.ToLower(id)] = m[1]
+	}
+	for i := range c.attachments {
+		a := &c.attachments[i]
+		ref, ok := refs[strings.ToLower(a.contentID)]
+		a.inline = a.contentID != "" && ok
+		if a.inline && ref != a.contentID {
+			c.html = strings.ReplaceAll(c.html, "cid:"+ref, "cid:"+a.contentID)
+		}
+	}
+}
+
+// entityMediaType returns the lower-cased media type of an entity, also
+// when its parameters are malformed
+func entityMediaType(h message.Header) string {
+	mediaType, _, err := h.ContentType()
+	if err != nil {
+		mediaType, _, _ = strings.Cut(h.Get("Content-Type"), ";")
+	}
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if mediaType == "" {
+		return "text/plain"
+	}
+	return mediaType
+}
+
+// embeddedMessageName names an attached message after its subject
+func embeddedMessageName(data []byte) string {
+	subject := ""
+	if e, err := message.Read(bytes.NewReader(data)); e != nil && (err == nil || message.IsUnknownCharset(err)) {
+		subject, _ = e.Header.Text("Subject")
+	}
+	subject = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) || r < 0x20 {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(subject))
+	if len([]rune(subject)) > 100 {
+		subject = string([]rune(subject)[:100])
+	}
+	if subject == "" {
+		subject = "forwarded message"
+	}
+	return subject + ".eml"
+}
+
+// unpackTNEF adds the body and attachments of a winmail.dat part. Streams
+// that can't be decoded are reported false and attached as they are.
+func (c *mimeContent) unpackTNEF(data []byte) bool {
+	t, err := decodeTNEF(data)
+	if err != nil {
+		return false
+	}
+	if c.html == "" {
+		c.html = t.html
+	}
+	if c.text == "" {
+		c.text = t.text
+	}
+	c.attachments = append(c.attachments, t.attachments...)
+	return true
+}
+
+// attachmentFilename returns the decoded file name of a part. RFC 2231
+// parameters (filename*=charset'lang'...) and their continuations, RFC 2047
+// encoded words and the legacy Content-Type name parameter are all
+// understood, in any charset. Directory components are dropped.
+func attachmentFilename(h message.Header) string {
+	name := ""
+	for _, field := range []struct{ header, param string }{
+		{"Content-Disposition", "filename"},
+		{"Content-Type", "name"},
+	} {
+		if name = headerParam(h.Get(field.header), field.param); name != "" {
+			break
+		}
+	}
+
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	return strings.TrimSpace(name)
+}
+
+// headerParam extracts a parameter from a structured header value. The
+// standard library only decodes RFC 2231 values in UTF-8 and rejects the
+// whole header on any syntax error, so parameters are parsed leniently
+// here: mailers in the wild send unquoted spaces and Latin-1 file names.
+func headerParam(value, param string) string {
+	plain := ""
+	type section struct {
+		value   string
+		encoded bool
+	}
+	var sections map[int]section
+
+	for _, p := range splitParams(value) {
+		key, v, ok := strings.Cut(p, "=")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		v = unquoteParam(strings.TrimSpace(v))
+
+		switch {
+		case key == param:
+			plain = v
+		case strings.HasPrefix(key, param+"*"):
+			// name*, name*0*, name*1* ... are encoded; name*0, name*1 ... aren't
+			rest := key[len(param)+1:]
+			encoded := rest == "" || strings.HasSuffix(rest, "*")
+			rest = strings.TrimSuffix(rest, "*")
+			n := 0
+			if rest != "" {
+				var err error
+				if n, err = strconv.Atoi(rest); err != nil {
+					continue
+				}
+			}
+			if sections == nil {
+				sections = make(map[int]section)
+			}
+			sections[n] = section{v, encoded}
+		}
+	}
+
+	if len(sections) > 0 {
+		indexes := make([]int, 0, len(sections))
+		for n := range sections {
+			indexes = append(indexes, n)
+		}
+		sort.Ints(indexes)
+
+		// The charset is only given in the first section
+		cs := ""
+		var raw []byte
+		for i, n := range indexes {
+			s := sections[n]
+			if !s.encoded {
+				raw = append(raw, s.value...)
+				continue
+			}
+			v := s.value
+			if i == 0 {
+				parts := strings.SplitN(v, "'", 3)
+				if len(parts) == 3 {
+					cs, v = parts[0], parts[2]
+				}
+			}
+			if decoded, err := url.PathUnescape(v); err == nil {
+				v = decoded
+			}
+			raw = append(raw, v...)
+		}
+		if name := decodeCharset(cs, raw); name != "" {
+			return name
+		}
+	}
+
+	return decodeWords(plain)
+}
+
+// splitParams splits a header value at semicolons outside quoted strings
+func splitParams(value string) []string {
+	var params []string
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(value); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case value[i] == '\\' && quoted:
+			escaped = true
+		case value[i] == '"':
+			quoted = !quoted
+		case value[i] == ';' && !quoted:
+			params = append(params, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(params, value[start:])
+}
+
+func unquoteParam(v string) string {
+	if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+		v = v[1 : len(v)-1]
+		v = strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(v)
+	}
+	return v
+}
+
+// decodeCharset converts text in the named charset to UTF-8
+func decodeCharset(cs string, raw []byte) string {
+	if cs == "" || strings.EqualFold(cs, "utf-8") || strings.EqualFold(cs, "us-ascii") {
+		return textContent(string(raw))
+	}
+	r, err := charset.Reader(cs, bytes.NewReader(raw))
+	if err != nil {
+		return textContent(string(raw))
+	}
+	decoded, err := io.ReadAll(r)
+	if err != nil {
+		return textContent(string(raw))
+	}
+	return string(decoded)
+}
+
+// decodeBody decodes a single-part body by its Content-Transfer-Encoding
+// and charset, for bodies parseMIME doesn't read: JSON template variables
+// and messages it gave up on. Undecodable bodies are kept as they are.
+func decodeBody(contentType, encoding, raw string) string {
+	data := []byte(raw)
+	var r io.Reader
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "quoted-printable":
+		r = quotedprintable.NewReader(bytes.NewReader(data))
+	case "base64":
+		// Line breaks are skipped by the decoder
+		r = base64.NewDecoder(base64.StdEncoding, bytes.NewReader(data))
+	}
+	if r != nil {
+		if decoded, err := io.ReadAll(r); err == nil {
+			data = decoded
+		}
+	}
+	_, params, _ := mime.ParseMediaType(contentType)
+	return decodeCharset(params["charset"], data)
+}
+
+// decodeWords decodes RFC 2047 encoded words, which many mailers put in
+// file names even though the RFC doesn't allow them inside parameters.
+// Raw UTF-8 (RFC 6532) is kept and raw 8-bit Latin-1 is tolerated.
+func decodeWords(s string) string {
+	dec := mime.WordDecoder{CharsetReader: charset.Reader}
+	s = textContent(s)
+	decoded, err := dec.DecodeHeader(s)
+	if err != nil {
+		return s
+	}
+	return decoded
+}
+
+// buildMessage rebuilds a message with the given plain text and HTML
+// bodies, followed by the attachments: as multipart/alternative when it has
+// both, as a single part when it has one. This is the message as the relay
+// sends it, rendered from a template and with its footer, for the plain
+// text alternative and for everything that keeps the message to send it
+// later. The original header fields are kept except for the MIME ones and
+// the relay's own control headers.
+func buildMessage(data []byte, subject, text, htmlBody string, attachments []mimeAttachment) ([]byte, error) {
+	e, err := message.Read(bytes.NewReader(data))
+	if err != nil && !message.IsUnknownCharset(err) {
+		return nil, err
+	}
+
+	h := e.Header.Copy()
+	fields := h.Fields()
+	for fields.Next() {
+		key := strings.ToLower(fields.Key())
+		if strings.HasPrefix(key, "content-") || key == "mime-version" || key == "attachments" || strings.HasPrefix(key, "x-gograph-") {
+			fields.Del()
+		}
+	}
+	h.Set("MIME-Version", "1.0")
+	h.SetText("Subject", subject)
+
+	type textBody struct{ mediaType, content string }
+	var bodies []textBody
+	if text != "" || htmlBody == "" {
+		bodies = append(bodies, textBody{"text/plain", text})
+	}
+	if htmlBody != "" {
+		bodies = append(bodies, textBody{"text/html", htmlBody})
+	}
+	setTextType := func(h *message.Header, mediaType string) {
+		h.SetContentType(mediaType, map[string]string{"charset": "utf-8"})
+		h.Set("Content-Transfer-Encoding", "quoted-printable")
+	}
+
+	var buf bytes.Buffer
+	switch {
+	case len(attachments) > 0:
+		h.SetContentType("multipart/mixed", nil)
+	case len(bodies) > 1:
+		h.SetContentType("multipart/alternative", nil)
+	default:
+		setTextType(&h, bodies[0].mediaType)
+	}
+	w, err := message.CreateWriter(&buf, h)
+	if err != nil {
+		return nil, err
+	}
+	if len(attachments) == 0 && len(bodies) == 1 {
+		if _, err := io.WriteString(w, bodies[0].content); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	alt := w
+	if len(attachments) > 0 && len(bodies) > 1 {
+		var ah message.Header
+		ah.SetContentType("multipart/alternative", nil)
+		if alt, err = w.CreatePart(ah); err != nil {
+			return nil, err
+		}
+	}
+	for _, body := range bodies {
+		var ph message.Header
+		setTextType(&ph, body.mediaType)
+		if err := writePart(alt, ph, []byte(body.content)); err != nil {
+			return nil, err
+		}
+	}
+	if alt != w {
+		if err := alt.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, a := range attachments {
+		contentType := a.contentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		var ph message.Header
+		ph.SetContentType(contentType, nil)
+		// Inline images keep the Content-ID the HTML body refers to
+		if a.inline && a.contentID != "" {
+			ph.SetContentDisposition("inline", map[string]string{"filename": a.name})
+			ph.Set("Content-ID", "<"+a.contentID+">")
+		} else {
+			ph.SetContentDisposition("attachment", map[string]string{"filename": a.name})
+		}
+		ph.Set("Content-Transfer-Encoding", "base64")
+		if err := writePart(w, ph, a.data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writePart(w *message.Writer, h message.Header, data []byte) error {
+	pw, err := w.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	if _, err := pw.Write(data); err != nil {
+		return err
+	}
+	return pw.Close()
+}
@@ -0,0 +1,274 @@
+// mime_test.go
+package main
+
+import (
+	"mime"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMIMETree(t *testing.T) {
+	type part struct {
+		name, contentType, contentID string
+		inline                       bool
+	}
+	tests := []struct {
+		name        string
+		message     string
+		text, html  string
+		attachments []part
+		damaged     bool
+	}{
+		{
+			name: "single part",
+			message: "Content-Type: text/plain; charset=utf-8\r\n" +
+				"\r\n" +
+				"Hello\r\n",
+			text: "Hello\r\n",
+		},
+		{
+			// Outlook and Apple Mail: mixed > alternative > related
+			name: "related inside alternative inside mixed",
+			message: "Content-Type: multipart/mixed; boundary=mixed\r\n" +
+				"\r\n" +
+				"--mixed\r\n" +
+				"Content-Type: multipart/alternative; boundary=alt\r\n" +
+				"\r\n" +
+				"--alt\r\n" +
+				"Content-Type: text/plain\r\n" +
+				"\r\n" +
+				"Hi\r\n" +
+				"--alt\r\n" +
+				"Content-Type: multipart/related; boundary=rel\r\n" +
+				"\r\n" +
+				"--rel\r\n" +
+				"Content-Type: text/html\r\n" +
+				"\r\n" +
+				"<p>Hi <img src=\"cid:logo@x\"></p>\r\n" +
+				"--rel\r\n" +
+				"Content-Type: image/png\r\n" +
+				"Content-ID: <logo@x>\r\n" +
+				"Content-Transfer-Encoding: base64\r\n" +
+				"\r\n" +
+				"iVBORw0KGgo=\r\n" +
+				"--rel--\r\n" +
+				"--alt--\r\n" +
+				"--mixed\r\n" +
+				"Content-Type: application/pdf; name=report.pdf\r\n" +
+				"Content-Disposition: attachment; filename=report.pdf\r\n" +
+				"\r\n" +
+				"%PDF-1.4\r\n" +
+				"--mixed--\r\n",
+			text: "Hi",
+			html: "<p>Hi <img src=\"cid:logo@x\"></p>",
+			attachments: []part{
+				{"attachment.png", "image/png", "logo@x", true},
+				{"report.pdf", "application/pdf", "", false},
+			},
+		},
+		{
+			// Only the richest alternative is kept
+			name: "alternative drops enriched text",
+			message: "Content-Type: multipart/alternative; boundary=alt\r\n" +
+				"\r\n" +
+				"--alt\r\n" +
+				"Content-Type: text/plain\r\n" +
+				"\r\n" +
+				"plain\r\n" +
+				"--alt\r\n" +
+				"Content-Type: text/enriched\r\n" +
+				"\r\n" +
+				"<bold>rich</bold>\r\n" +
+				"--alt\r\n" +
+				"Content-Type: text/html\r\n" +
+				"\r\n" +
+				"<b>html</b>\r\n" +
+				"--alt--\r\n",
+			text: "plain",
+			html: "<b>html</b>",
+		},
+		{
+			// Outlook meeting requests carry the invitation as an
+			// alternative
+			name: "calendar alternative",
+			message: "Content-Type: multipart/alternative; boundary=alt\r\n" +
+				"\r\n" +
+				"--alt\r\n" +
+				"Content-Type: text/plain\r\n" +
+				"\r\n" +
+				"Meeting\r\n" +
+				"--alt\r\n" +
+				"Content-Type: text/calendar; method=REQUEST\r\n" +
+				"\r\n" +
+				"BEGIN:VCALENDAR\r\n" +
+				"END:VCALENDAR\r\n" +
+				"--alt--\r\n",
+			text:        "Meeting",
+			attachments: []part{{"attachment.ics", "text/calendar", "", false}},
+		},
+		{
+			// Mailing lists append their footer as another text part
+			name: "list footer after html",
+			message: "Content-Type: multipart/mixed; boundary=mixed\r\n" +
+				"\r\n" +
+				"--mixed\r\n" +
+				"Content-Type: text/html\r\n" +
+				"\r\n" +
+				"<p>Body</p>\r\n" +
+				"--mixed\r\n" +
+				"Content-Type: text/plain\r\n" +
+				"\r\n" +
+				"-- list footer <unsubscribe>\r\n" +
+				"--mixed--\r\n",
+			text: "-- list footer <unsubscribe>",
+			html: "<p>Body</p><pre>-- list footer &lt;unsubscribe&gt;</pre>",
+		},
+		{
+			name: "signed message drops the signature",
+			message: "Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\"; boundary=sig\r\n" +
+				"\r\n" +
+				"--sig\r\n" +
+				"Content-Type: text/plain\r\n" +
+				"\r\n" +
+				"Signed\r\n" +
+				"--sig\r\n" +
+				"Content-Type: application/pkcs7-signature; name=smime.p7s\r\n" +
+				"\r\n" +
+				"MIAGCSqGSIb3\r\n" +
+				"--sig--\r\n",
+			text: "Signed",
+		},
+		{
+			name: "forwarded message named after its subject",
+			message: "Content-Type: multipart/mixed; boundary=mixed\r\n" +
+				"\r\n" +
+				"--mixed\r\n" +
+				"Content-Type: text/plain\r\n" +
+				"\r\n" +
+				"See below\r\n" +
+				"--mixed\r\n" +
+				"Content-Type: message/rfc822\r\n" +
+				"\r\n" +
+				"Subject: Q3: numbers?\r\n" +
+				"\r\n" +
+				"inner\r\n" +
+				"--mixed--\r\n",
+			text:        "See below",
+			attachments: []part{{"Q3_ numbers_.eml", "message/rfc822", "", false}},
+		},
+		{
+			// Unknown subtypes are walked like multipart/mixed
+			name: "unknown multipart subtype",
+			message: "Content-Type: multipart/x-custom; boundary=x\r\n" +
+				"\r\n" +
+				"--x\r\n" +
+				"Content-Type: text/plain\r\n" +
+				"\r\n" +
+				"one\r\n" +
+				"--x\r\n" +
+				"Content-Type: text/plain\r\n" +
+				"\r\n" +
+				"two\r\n" +
+				"--x--\r\n",
+			text: "one\r\ntwo",
+		},
+		{
+			name: "missing closing boundary keeps the parts",
+			message: "Content-Type: multipart/mixed; boundary=mixed\r\n" +
+				"\r\n" +
+				"--mixed\r\n" +
+				"Content-Type: text/plain\r\n" +
+				"\r\n" +
+				"kept\r\n" +
+				"--mixed\r\n" +
+				"Content-Type: text/csv; name=data.csv\r\n" +
+				"\r\n" +
+				"a,b\r\n",
+			text:        "kept",
+			attachments: []part{{"data.csv", "text/csv", "", false}},
+			damaged:     true,
+		},
+		{
+			name: "multipart without boundary",
+			message: "Content-Type: multipart/mixed\r\n" +
+				"\r\n" +
+				"just text\r\n",
+			text:    "just text\r\n",
+			damaged: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseMIME([]byte(tt.message), mimeOptions{})
+			if err != nil {
+				t.Fatalf("parseMIME: %v", err)
+			}
+			if c.text != tt.text {
+				t.Errorf("text = %q, want %q", c.text, tt.text)
+			}
+			if strings.TrimSpace(c.html) != tt.html {
+				t.Errorf("html = %q, want %q", c.html, tt.html)
+			}
+			var got []part
+			for _, a := range c.attachments {
+				got = append(got, part{a.name, a.contentType, a.contentID, a.inline})
+			}
+			if !reflect.DeepEqual(got, tt.attachments) {
+				t.Errorf("attachments = %+v, want %+v", got, tt.attachments)
+			}
+			if c.damaged != tt.damaged {
+				t.Errorf("damaged = %v, want %v", c.damaged, tt.damaged)
+			}
+		})
+	}
+}
+
+func TestBuildMessage(t *testing.T) {
+	original := "From: app@example.com\r\n" +
+		"Subject: original\r\n" +
+		"X-GoGraph-Template: alert\r\n" +
+		"Content-Type: application/json\r\n" +
+		"\r\n" +
+		"{}\r\n"
+	logo := mimeAttachment{name: "logo.png", contentType: "image/png", contentID: "logo@x", inline: true, data: []byte("png")}
+	tests := []struct {
+		name        string
+		text, html  string
+		attachments []mimeAttachment
+		contentType string
+	}{
+		{"plain text", "Hello", "", nil, "text/plain"},
+		{"html", "", "<p>Hello</p>", nil, "text/html"},
+		{"alternative", "Hello", "<p>Hello</p>", nil, "multipart/alternative"},
+		{"inline image", "", `<p><img src="cid:logo@x"></p>`, []mimeAttachment{logo}, "multipart/mixed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := buildMessage([]byte(original), "rendered", tt.text, tt.html, tt.attachments)
+			if err != nil {
+				t.Fatalf("buildMessage: %v", err)
+			}
+			header, _, _ := strings.Cut(string(raw), "\r\n\r\n")
+			headers := parseHeaders(header)
+			if got, _, _ := mime.ParseMediaType(headerValue(headers, "Content-Type")); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			if headerValue(headers, "X-GoGraph-Template") != "" || headerValue(headers, "Subject") != "rendered" {
+				t.Errorf("headers = %q, want the control header gone and the new subject", headers)
+			}
+			c, err := parseMIME(raw, mimeOptions{})
+			if err != nil {
+				t.Fatalf("parseMIME: %v", err)
+			}
+			if strings.TrimSpace(c.text) != tt.text || strings.TrimSpace(c.html) != tt.html {
+				t.Errorf("bodies = %q, %q; want %q, %q", c.text, c.html, tt.text, tt.html)
+			}
+			for i, a := range c.attachments {
+				if a.contentID != tt.attachments[i].contentID || a.inline != tt.attachments[i].inline {
+					t.Errorf("attachment %s: Content-ID %q, inline %v; want %q, %v", a.name, a.contentID, a.inline, tt.attachments[i].contentID, tt.attachments[i].inline)
+				}
+			}
+		})
+	}
+}
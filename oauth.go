@@ -0,0 +1,140 @@
+// oauth.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	khttp "github.com/microsoft/kiota-http-go"
+)
+
+// xoauth2Mechanism is the SASL mechanism of Google and Microsoft for OAuth
+// 2.0 bearer tokens
+const xoauth2Mechanism = "XOAUTH2"
+
+// xoauth2Timeout bounds the token exchange of AUTH XOAUTH2
+const xoauth2Timeout = 30 * time.Second
+
+// xoauth2Server is the server side of AUTH XOAUTH2. The client's response
+// is "user=<user>\x01auth=Bearer <token>\x01\x01".
+type xoauth2Server struct {
+	authenticate func(user, token string) error
+}
+
+func (a *xoauth2Server) Next(response []byte) ([]byte, bool, error) {
+	// Without an initial response the client is asked for it
+	if response == nil {
+		return []byte{}, false, nil
+	}
+	var user, token string
+	for _, field := range bytes.Split(response, []byte{1}) {
+		k, v, _ := strings.Cut(string(field), "=")
+		switch k {
+		case "user":
+			user = v
+		case "auth":
+			scheme, t, _ := strings.Cut(v, " ")
+			if strings.EqualFold(scheme, "Bearer") {
+				token = strings.TrimSpace(t)
+			}
+		}
+	}
+	if user == "" || token == "" {
+		return nil, true, errors.New("malformed XOAUTH2 response")
+	}
+	return nil, true, a.authenticate(user, token)
+}
+
+var _ sasl.Server = (*xoauth2Server)(nil)
+
+// userToken gets Graph tokens for the user of an AUTH XOAUTH2 session
+type userToken struct {
+	user       string
+	scope      string
+	credential azcore.TokenCredential
+}
+
+// token returns a Graph access token of the user, exchanged again once the
+// previous one expires
+func (u *userToken) token(ctx context.Context) (string, error) {
+	at, err := u.credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{u.scope}})
+	if err != nil {
+		return "", fmt.Errorf("failed to get a token for %s: %v", u.user, err)
+	}
+	return at.Token, nil
+}
+
+// authXOAuth2 checks the token of AUTH XOAUTH2: the tenant of the user
+// exchanges it for a Graph token of the user, which must be the one the
+// client named
+func (s *Session) authXOAuth2(user, assertion string) error {
+	fail := func(err error) error {
+		s.log().Warn("authentication failed", "client", s.clientIP, "listener", s.listener.Name, "user", user, "method", "xoauth2", "errormsg", err)
+		return s.backend.replies.error(535, smtp.EnhancedCode{5, 7, 8}, "auth_failed")
+	}
+	tenant := s.backend.tenant(user)
+	credential, err := tenant.onBehalfOf(assertion)
+	if err != nil {
+		return fail(err)
+	}
+	ut := &userToken{user: user, scope: tenant.cloud.scope(), credential: credential}
+	ctx, cancel := context.WithTimeout(context.Background(), xoauth2Timeout)
+	defer cancel()
+	token, err := ut.token(ctx)
+	if err != nil {
+		return fail(err)
+	}
+	if name := tokenUser(token); !strings.EqualFold(name, graphAddress(user)) {
+		return fail(fmt.Errorf("the token belongs to %q", name))
+	}
+
+	if err := s.backend.hooks.onAuth(s, user); err != nil {
+		return err
+	}
+	s.authUser = user
+	s.userToken = ut
+	s.log().Info("authenticated", "client", s.clientIP, "listener", s.listener.Name, "user", user, "method", "xoauth2", "status", "authenticated")
+	return nil
+}
+
+// tokenUser returns the user a Graph access token was issued to. The
+// token comes straight from Azure AD, so its signature isn't checked.
+func tokenUser(token string) string {
+	var claims struct {
+		UPN               string `json:"upn"`
+		PreferredUsername string `json:"preferred_username"`
+	}
+	tokenClaims(token, &claims)
+	if claims.UPN != "" {
+		return claims.UPN
+	}
+	return claims.PreferredUsername
+}
+
+// userTokenKey carries the Graph token of an AUTH XOAUTH2 user to the
+// requests made for the user's message
+type userTokenKey struct{}
+
+func withUserToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, userTokenKey{}, token)
+}
+
+// userAuthorizer sends a request with the user's token when its context
+// carries one, instead of the app's
+type userAuthorizer struct{}
+
+func (userAuthorizer) Intercept(pipeline khttp.Pipeline, middlewareIndex int, req *http.Request) (*http.Response, error) {
+	if token, _ := req.Context().Value(userTokenKey{}).(string); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return pipeline.Next(req, middlewareIndex)
+}
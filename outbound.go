@@ -0,0 +1,109 @@
+// outbound.go
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	khttp "github.com/microsoft/kiota-http-go"
+)
+
+// graphTransport returns the transport for Graph and token requests. With
+// graph.source_address or graph.interface set, connections leave from
+// that address, e.g. when only one IP of the host may reach Graph.
+// Requests go through graph.proxy, else the proxy of the HTTPS_PROXY and
+// NO_PROXY variables.
+func graphTransport(config Config) (*http.Transport, error) {
+	transport := khttp.GetDefaultTransport().(*http.Transport)
+	proxy, err := graphProxy(config)
+	if err != nil {
+		return nil, err
+	}
+	if proxy != nil {
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	ip, err := sourceIP(config.Graph.SourceAddress, config.Graph.Interface)
+	if err != nil {
+		return nil, err
+	}
+	if ip != nil {
+		dialer := &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			LocalAddr: &net.TCPAddr{IP: ip},
+		}
+		transport.DialContext = dialer.DialContext
+	}
+	return transport, nil
+}
+
+// graphProxy returns the URL of graph.proxy with its credentials, or nil
+// without one. An https:// proxy is reached over TLS, and Graph's TLS
+// runs inside the CONNECT tunnel either way.
+func graphProxy(config Config) (*url.URL, error) {
+	p := config.Graph.Proxy
+	if p.URL == "" {
+		if p.Username != "" || p.Password != "" {
+			return nil, fmt.Errorf("graph.proxy.username and password need a graph.proxy.url")
+		}
+		return nil, nil
+	}
+	u, err := url.Parse(p.URL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid graph.proxy.url %q", p.URL)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("invalid graph.proxy.url %q, must be http://, https:// or socks5://", p.URL)
+	}
+	if p.Username != "" {
+		u.User = url.UserPassword(p.Username, p.Password)
+	}
+	return u, nil
+}
+
+// sourceIP returns the configured source address, or the first address
+// of the interface (IPv4 preferred), or nil for the system's choice
+func sourceIP(address, iface string) (net.IP, error) {
+	if address != "" {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid graph.source_address %q", address)
+		}
+		return ip, nil
+	}
+	if iface == "" {
+		return nil, nil
+	}
+
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("invalid graph.interface %q: %v", iface, err)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("reading addresses of %s: %v", iface, err)
+	}
+	var found net.IP
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok || n.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if n.IP.To4() != nil {
+			return n.IP, nil
+		}
+		if found == nil {
+			found = n.IP
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("interface %s has no usable address", iface)
+	}
+	return found, nil
+}
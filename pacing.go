@@ -0,0 +1,220 @@
+// pacing.go
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	khttp "github.com/microsoft/kiota-http-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// defaultMailboxBudget is Exchange Online's sending limit of 30 messages
+// per minute per mailbox
+const defaultMailboxBudget = 30
+
+var (
+	graphSends = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gographsmtp_graph_sendmail_requests_total",
+		Help: "sendMail requests to Graph per sending mailbox and status (HTTP code or error), retries included.",
+	}, []string{"tenant", "mailbox", "status"})
+	graphRetryAfter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gographsmtp_graph_retry_after_seconds_total",
+		Help: "Delay imposed by Graph with Retry-After on throttled sendMail requests, per sending mailbox.",
+	}, []string{"tenant", "mailbox"})
+)
+
+// sendMailPath matches the sendMail endpoint and captures the mailbox,
+// empty for /me
+var sendMailPath = regexp.MustCompile(`(?i)/(?:users/([^/]+)|me)/sendMail$`)
+
+// pacing tracks how much of the Graph sending budget the relay uses
+var pacing = &sendPacing{mailboxes: make(map[string]*mailboxPacing)}
+
+// sendPacing keeps the sends and throttling of the last hour per mailbox
+type sendPacing struct {
+	mu        sync.Mutex
+	mailboxes map[string]*mailboxPacing
+}
+
+type mailboxPacing struct {
+	sent          []time.Time // successful sends in the last hour
+	throttled     int
+	retryAfter    time.Duration
+	lastThrottled time.Time
+}
+
+// record counts one sendMail attempt of the mailbox
+func (p *sendPacing) record(mailbox string, status int, retryAfter time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	m, ok := p.mailboxes[mailbox]
+	if !ok {
+		m = &mailboxPacing{}
+		p.mailboxes[mailbox] = m
+	}
+	switch {
+	case status >= 200 && status < 300:
+		m.sent = append(m.sent, now)
+	case status == http.StatusTooManyRequests:
+		m.throttled++
+		m.retryAfter += retryAfter
+		m.lastThrottled = now
+	}
+
+	// Forget what happened more than an hour ago
+	for name, m := range p.mailboxes {
+		i := sort.Search(len(m.sent), func(i int) bool { return now.Sub(m.sent[i]) < time.Hour })
+		m.sent = m.sent[i:]
+		if len(m.sent) == 0 && now.Sub(m.lastThrottled) > time.Hour {
+			delete(p.mailboxes, name)
+		}
+	}
+}
+
+// pacingReport is the status the relay reports for capacity planning
+type pacingReport struct {
+	MailboxBudget      int              `json:"mailbox_budget"`
+	MessagesLastMinute int              `json:"messages_last_minute"`
+	MessagesLastHour   int              `json:"messages_last_hour"`
+	Throttled          int              `json:"throttled"`
+	RetryAfterSeconds  float64          `json:"retry_after_seconds"`
+	Mailboxes          []mailboxSummary `json:"mailboxes"`
+}
+
+type mailboxSummary struct {
+	Mailbox            string    `json:"mailbox"`
+	MessagesLastMinute int       `json:"messages_last_minute"`
+	MessagesLastHour   int       `json:"messages_last_hour"`
+	BudgetUsedPercent  int       `json:"budget_used_percent"`
+	Throttled          int       `json:"throttled"`
+	RetryAfterSeconds  float64   `json:"retry_after_seconds"`
+	LastThrottled      time.Time `json:"last_throttled"`
+}
+
+// report summarizes the last hour, busiest mailboxes first. Throttling
+// counts cover the mailboxes' activity since their last quiet hour.
+func (p *sendPacing) report(budget int) pacingReport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	r := pacingReport{MailboxBudget: budget, Mailboxes: []mailboxSummary{}}
+	for name, m := range p.mailboxes {
+		s := mailboxSummary{
+			Mailbox:           name,
+			Throttled:         m.throttled,
+			RetryAfterSeconds: m.retryAfter.Seconds(),
+			LastThrottled:     m.lastThrottled,
+		}
+		for _, t := range m.sent {
+			if now.Sub(t) < time.Hour {
+				s.MessagesLastHour++
+			}
+			if now.Sub(t) < time.Minute {
+				s.MessagesLastMinute++
+			}
+		}
+		s.BudgetUsedPercent = s.MessagesLastMinute * 100 / budget
+
+		r.MessagesLastMinute += s.MessagesLastMinute
+		r.MessagesLastHour += s.MessagesLastHour
+		r.Throttled += s.Throttled
+		r.RetryAfterSeconds += s.RetryAfterSeconds
+		r.Mailboxes = append(r.Mailboxes, s)
+	}
+	sort.Slice(r.Mailboxes, func(i, j int) bool {
+		a, b := r.Mailboxes[i], r.Mailboxes[j]
+		if a.MessagesLastMinute != b.MessagesLastMinute {
+			return a.MessagesLastMinute > b.MessagesLastMinute
+		}
+		return a.Mailbox < b.Mailbox
+	})
+	return r
+}
+
+// mailboxBudget returns the configured messages per minute per mailbox
+func (c Config) mailboxBudget() int {
+	if c.Pacing.MailboxMessagesPerMinute > 0 {
+		return c.Pacing.MailboxMessagesPerMinute
+	}
+	return defaultMailboxBudget
+}
+
+// pacingObserver is the innermost Graph middleware, so it sees every
+// attempt the retry handler makes, including throttled ones
+type pacingObserver struct {
+	tenant string
+	// me is the delegated user, for requests to /me
+	me      string
+	labels  *metricLabels
+	history *deliveryHistory
+	logger  *slog.Logger
+}
+
+func (p pacingObserver) Intercept(pipeline khttp.Pipeline, middlewareIndex int, req *http.Request) (*http.Response, error) {
+	resp, err := pipeline.Next(req, middlewareIndex)
+
+	match := sendMailPath.FindStringSubmatch(req.URL.Path)
+	if match == nil {
+		return resp, err
+	}
+	mailbox := strings.ToLower(match[1])
+	if mailbox == "" {
+		mailbox = strings.ToLower(p.me)
+	}
+	p.history.add(queueIDFrom(req.Context()), graphRequestEvent(resp, err))
+	tenant, label := p.tenant, p.labels.sender(mailbox)
+	if err != nil {
+		graphSends.WithLabelValues(tenant, label, "error").Inc()
+		p.logger.Debug("Graph request", "queueid", queueIDFrom(req.Context()), "mailbox", mailbox, "errormsg", err)
+		return resp, err
+	}
+	p.logger.Debug("Graph request", "queueid", queueIDFrom(req.Context()), "mailbox", mailbox, "code", resp.StatusCode)
+
+	var retryAfter time.Duration
+	if resp.StatusCode == http.StatusTooManyRequests {
+		retryAfter = max(parseRetryAfter(resp.Header.Get("Retry-After")), 0)
+		graphRetryAfter.WithLabelValues(tenant, label).Add(retryAfter.Seconds())
+	}
+	graphSends.WithLabelValues(tenant, label, strconv.Itoa(resp.StatusCode)).Inc()
+	pacing.record(mailbox, resp.StatusCode, retryAfter)
+	return resp, err
+}
+
+// runStatusCommand prints the pacing report of the running relay, read
+// from its HTTP server
+func runStatusCommand(config Config) error {
+	var r pacingReport
+	if err := adminGet(config, "/status", nil, &r); err != nil {
+		return err
+	}
+
+	fmt.Printf("Messages: %d in the last minute, %d in the last hour\n", r.MessagesLastMinute, r.MessagesLastHour)
+	fmt.Printf("Throttled: %d requests, %.0fs Retry-After delay\n", r.Throttled, r.RetryAfterSeconds)
+	fmt.Printf("Mailbox budget: %d messages per minute\n\n", r.MailboxBudget)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MAILBOX\tLAST MIN\tBUDGET\tLAST HOUR\tTHROTTLED\tRETRY-AFTER\tLAST THROTTLED")
+	for _, m := range r.Mailboxes {
+		last := "-"
+		if !m.LastThrottled.IsZero() {
+			last = m.LastThrottled.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d%%\t%d\t%d\t%.0fs\t%s\n", m.Mailbox, m.MessagesLastMinute, m.BudgetUsedPercent,
+			m.MessagesLastHour, m.Throttled, m.RetryAfterSeconds, last)
+	}
+	return w.Flush()
+}
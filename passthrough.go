@@ -0,0 +1,110 @@
+// passthrough.go
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"mime"
+	"regexp"
+	"strings"
+
+	abstractions "github.com/microsoft/kiota-abstractions-go"
+	"github.com/microsoftgraph/msgraph-sdk-go/models/odataerrors"
+)
+
+// securedPartPattern finds signed or encrypted parts nested in a multipart
+// message, e.g. a signed message a mailing list added a footer to
+var securedPartPattern = regexp.MustCompile(`(?im)^content-type:[ \t]*(multipart/signed|multipart/encrypted|application/(?:x-)?pkcs7-mime)`)
+
+// securedContent reports whether the message is signed or encrypted with
+// S/MIME or PGP. Such messages must reach Graph byte for byte; rebuilding
+// them from their parts would break the signature or lose the encrypted
+// payload.
+func securedContent(contentType, body string) (signed, encrypted bool) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, _, _ = strings.Cut(strings.ToLower(contentType), ";")
+		mediaType = strings.TrimSpace(mediaType)
+	}
+
+	switch mediaType {
+	case "multipart/signed":
+		return true, false
+	case "multipart/encrypted":
+		return false, true
+	case "application/pkcs7-mime", "application/x-pkcs7-mime":
+		if strings.EqualFold(params["smime-type"], "signed-data") {
+			return true, false
+		}
+		return false, true
+	case "", "text/plain":
+		// Inline PGP
+		if strings.Contains(body, "-----BEGIN PGP MESSAGE-----") {
+			return false, true
+		}
+		return strings.Contains(body, "-----BEGIN PGP SIGNED MESSAGE-----"), false
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		for _, m := range securedPartPattern.FindAllStringSubmatch(body, -1) {
+			if strings.EqualFold(m[1], "multipart/signed") {
+				signed = true
+			} else {
+				encrypted = true
+			}
+		}
+	}
+	return signed, encrypted
+}
+
+// withEnvelopeRecipients adds the envelope recipients that aren't named in
+// the To, Cc or Bcc headers as a Bcc header, since Graph only delivers MIME
+// messages to the addresses in their headers. The header block is outside
+// the signed content, so this doesn't affect signatures.
+func withEnvelopeRecipients(data []byte, headers map[string]string, rcpts []string) []byte {
+	var named []string
+	for _, field := range []string{"To", "Cc", "Bcc"} {
+		for _, addr := range parseAddressList(headerValue(headers, field)) {
+			named = append(named, addr.Address)
+		}
+	}
+
+	var missing []string
+	for _, rcpt := range rcpts {
+		found := false
+		for _, addr := range named {
+			if sameAddress(addr, rcpt) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, rcpt)
+		}
+	}
+	if len(missing) == 0 {
+		return data
+	}
+	return append([]byte("Bcc: "+strings.Join(missing, ", ")+"\r\n"), data...)
+}
+
+// sendMIME submits a raw MIME message, which Graph sends unchanged
+func (bkd *Backend) sendMIME(ctx context.Context, from string, data []byte) error {
+	tenant := bkd.tenant(from)
+	adapter := tenant.client.GetAdapter()
+	requestInfo := abstractions.NewRequestInformationWithMethodAndUrlTemplateAndPathParameters(
+		abstractions.POST,
+		"{+baseurl}/users/{user%2Did}/sendMail",
+		map[string]string{"user%2Did": tenant.userID(from)},
+	)
+	requestInfo.Headers.TryAdd("Accept", "application/json")
+
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
+	base64.StdEncoding.Encode(encoded, data)
+	requestInfo.SetStreamContentAndContentType(encoded, "text/plain")
+
+	errorMapping := abstractions.ErrorMappings{
+		"XXX": odataerrors.CreateODataErrorFromDiscriminatorValue,
+	}
+	return adapter.SendNoContent(ctx, requestInfo, errorMapping)
+}
@@ -0,0 +1,214 @@
+// policy.go
+package main
+
+import (
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// errAuthRequired rejects MAIL on listeners that only accept authenticated
+// submissions
+func (bkd *Backend) errAuthRequired() error {
+	return bkd.replies.error(530, smtp.EnhancedCode{5, 7, 0}, "auth_required")
+}
+
+// errTLSRequired rejects AUTH before STARTTLS on listeners with
+// plaintext_auth: deny
+func (bkd *Backend) errTLSRequired() error {
+	return bkd.replies.error(523, smtp.EnhancedCode{5, 7, 10}, "tls_required")
+}
+
+// checkHelo rejects clients that claim to be the relay itself or a host
+// inside our own domain, a common trait of spoofing bots
+func (bkd *Backend) checkHelo(helo string) error {
+	name := strings.ToLower(strings.TrimSuffix(helo, "."))
+	own := strings.ToLower(bkd.policy().config.hostname())
+	domain := strings.ToLower(strings.TrimPrefix(bkd.policy().config.SMTP.HeloValidationDomain, "."))
+	if domain == "" {
+		return nil
+	}
+
+	if name == own || name == domain || strings.HasSuffix(name, "."+domain) {
+		return bkd.replies.error(550, smtp.EnhancedCode{5, 7, 1}, "helo_rejected", "helo", helo)
+	}
+	return nil
+}
+
+// matchAddress reports whether addr matches pattern. Patterns are a full
+// address, "*@domain" or "@domain" for a whole domain, or "*" for anything.
+func matchAddress(pattern, addr string) bool {
+	// Internationalized domains match in either form
+	pattern = strings.ToLower(graphAddress(strings.TrimSpace(pattern)))
+	addr = strings.ToLower(graphAddress(addr))
+
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasPrefix(pattern, "*@"):
+		return strings.HasSuffix(addr, pattern[1:])
+	case strings.HasPrefix(pattern, "@"):
+		return strings.HasSuffix(addr, pattern)
+	}
+	return pattern == addr
+}
+
+// checkRecipient applies the recipient policy at RCPT time so clients get
+// a precise answer per recipient instead of a failure after DATA
+func (bkd *Backend) checkRecipient(to string) error {
+	for old, moved := range bkd.policy().config.Recipients.Moved {
+		if strings.EqualFold(old, to) {
+			return bkd.replies.error(551, smtp.EnhancedCode{5, 1, 6}, "recipient_moved", "address", moved)
+		}
+	}
+
+	for _, pattern := range bkd.policy().config.Recipients.Suppressed {
+		if matchAddress(pattern, to) {
+			return bkd.replies.error(550, smtp.EnhancedCode{5, 7, 1}, "recipient_suppressed", "recipient", to)
+		}
+	}
+
+	_, domain, _ := strings.Cut(to, "@")
+	if matchDomains(bkd.policy().config.Recipients.DeniedDomains, domain) ||
+		len(bkd.policy().config.Recipients.AllowedDomains) > 0 && !matchDomains(bkd.policy().config.Recipients.AllowedDomains, domain) ||
+		bkd.policy().config.routeTransport(to) == "reject" {
+		return bkd.replies.error(550, smtp.EnhancedCode{5, 7, 1}, "recipient_rejected", "recipient", to)
+	}
+
+	// Lookups that fail let the recipient through rather than refuse
+	// mail while Graph is unreachable
+	if d := bkd.policy().directory; d != nil && d.covers(domain) {
+		exists, err := d.exists(bkd.tenant(to), to)
+		if err != nil {
+			bkd.logger.Warn("recipient lookup failed", "to", to, "errormsg", err, "status", "directory_error")
+		} else if !exists {
+			return bkd.replies.error(550, smtp.EnhancedCode{5, 1, 1}, "recipient_unknown", "recipient", to)
+		}
+	}
+	return nil
+}
+
+// checkAttachments refuses messages with a blocked attachment, or with
+// one of a type not in the allowed list when there is one
+func (bkd *Backend) checkAttachments(attachments []mimeAttachment) error {
+	content := bkd.policy().config.Content
+	for _, a := range attachments {
+		if attachmentListed(content.BlockedAttachments, a) ||
+			len(content.AllowedAttachments) > 0 && !attachmentListed(content.AllowedAttachments, a) {
+			return bkd.replies.error(550, smtp.EnhancedCode{5, 7, 1}, "attachment_blocked", "name", a.label())
+		}
+	}
+	return nil
+}
+
+// matchDomains reports whether a pattern matches the domain: the domain
+// itself, or "*.example.com" for its subdomains and itself
+func matchDomains(patterns []string, domain string) bool {
+	domain = strings.ToLower(asciiDomain(strings.TrimSuffix(domain, ".")))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if base, ok := strings.CutPrefix(pattern, "*."); ok {
+			pattern = "*." + strings.ToLower(asciiDomain(base))
+		} else {
+			pattern = strings.ToLower(asciiDomain(pattern))
+		}
+		if base, ok := strings.CutPrefix(pattern, "*."); ok {
+			if domain == base || strings.HasSuffix(domain, "."+base) {
+				return true
+			}
+		} else if pattern == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSenderACL applies the senders section, which covers all domains
+func (bkd *Backend) checkSenderACL(from string) error {
+	for _, pattern := range bkd.policy().config.Senders.Denied {
+		if matchAddress(pattern, from) {
+			return bkd.replies.error(550, smtp.EnhancedCode{5, 7, 1}, "sender_rejected", "sender", from)
+		}
+	}
+	if len(bkd.policy().config.Senders.Allowed) == 0 {
+		return nil
+	}
+	for _, pattern := range bkd.policy().config.Senders.Allowed {
+		if matchAddress(pattern, from) {
+			return nil
+		}
+	}
+	return bkd.replies.error(550, smtp.EnhancedCode{5, 7, 1}, "sender_rejected", "sender", from)
+}
+
+// checkSenderBinding checks that the authenticated user may send as the
+// envelope sender per auth.senders
+func (bkd *Backend) checkSenderBinding(user, from string) error {
+	bindings := bkd.policy().config.Auth.Senders
+	patterns, ok := bindings[user]
+	if !ok {
+		if patterns, ok = bindings["*"]; !ok {
+			return nil
+		}
+	}
+	for _, pattern := range patterns {
+		if matchAddress(strings.ReplaceAll(pattern, "{user}", user), from) {
+			return nil
+		}
+	}
+	return bkd.replies.error(553, smtp.EnhancedCode{5, 7, 1}, "sender_not_owned", "sender", from, "user", user)
+}
+
+// textToHTML reports whether plain text mail from the sender is upgraded
+// to HTML
+func (bkd *Backend) textToHTML(from string) bool {
+	for _, pattern := range bkd.policy().config.Content.TextToHTML {
+		if matchAddress(pattern, from) {
+			return true
+		}
+	}
+	return false
+}
+
+// senderMapping returns the sender_map entry of the envelope sender. An
+// address entry wins over a domain entry, which wins over "*".
+func (bkd *Backend) senderMapping(from string) SenderMapping {
+	if from == "" {
+		return SenderMapping{}
+	}
+	best, mapping := "", SenderMapping{}
+	for pattern, m := range bkd.policy().config.SenderMap {
+		if !matchAddress(pattern, from) {
+			continue
+		}
+		if !strings.Contains(pattern, "*") && !strings.HasPrefix(pattern, "@") {
+			return m
+		}
+		if len(pattern) > len(best) {
+			best, mapping = pattern, m
+		}
+	}
+	return mapping
+}
+
+// mapSender returns the Graph mailbox that sends mail from the envelope
+// sender per sender_map, or the sender itself
+func (bkd *Backend) mapSender(from string) string {
+	if m := bkd.senderMapping(from); m.Mailbox != "" {
+		return m.Mailbox
+	}
+	return from
+}
+
+// checkSender applies the sender policy of the domain
+func (bkd *Backend) checkSender(from string, dc DomainConfig) error {
+	if len(dc.AllowedSenders) == 0 {
+		return nil
+	}
+	for _, pattern := range dc.AllowedSenders {
+		if matchAddress(pattern, from) {
+			return nil
+		}
+	}
+	return bkd.replies.error(550, smtp.EnhancedCode{5, 7, 1}, "sender_rejected", "sender", from)
+}
@@ -0,0 +1,99 @@
+// preflight.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	abstractions "github.com/microsoft/kiota-abstractions-go"
+	"github.com/microsoftgraph/msgraph-sdk-go/users"
+)
+
+// defaultPreflightTimeout bounds the checks of each tenant unless
+// graph.preflight.timeout is set
+const defaultPreflightTimeout = 30 * time.Second
+
+// preflight checks every tenant before the listeners are bound, so a
+// wrong app registration stops the relay at once instead of failing the
+// first message
+func (bkd *Backend) preflight() error {
+	config := bkd.policy().config.Graph.Preflight
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultPreflightTimeout
+	}
+	for _, t := range bkd.tenants {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := t.preflight(ctx, bkd, config.Mailbox)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("tenant %s: %v", t.name, err)
+		}
+		bkd.logger.Info("Graph pre-flight check passed", "tenant", t.name)
+	}
+	return nil
+}
+
+// preflight gets a token, checks that it grants Mail.Send and looks up
+// the signed-in user of delegated auth, or the mailbox when it belongs to
+// the tenant
+func (t *graphTenant) preflight(ctx context.Context, bkd *Backend, mailbox string) error {
+	at, err := t.credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{t.cloud.scope()}})
+	if err != nil {
+		return fmt.Errorf("failed to get a token, check tenant_id, client_id and the secret or certificate: %v", err)
+	}
+	if err := checkMailSend(at.Token); err != nil {
+		return err
+	}
+
+	if t.me == "" && (mailbox == "" || bkd.tenant(mailbox) != t) {
+		return nil
+	}
+	_, err = t.user(mailbox).Get(ctx, &users.UserItemRequestBuilderGetRequestConfiguration{
+		QueryParameters: &users.UserItemRequestBuilderGetQueryParameters{Select: []string{"id"}},
+	})
+	if err == nil {
+		return nil
+	}
+	if t.me != "" {
+		mailbox = t.me
+	}
+	var apiErr abstractions.ApiErrorable
+	if errors.As(err, &apiErr) {
+		switch apiErr.GetStatusCode() {
+		case 403:
+			return fmt.Errorf("looking up %s was refused, the app needs User.Read.All for the pre-flight mailbox: %v", mailbox, err)
+		case 404:
+			return fmt.Errorf("mailbox %s doesn't exist", mailbox)
+		}
+	}
+	return fmt.Errorf("failed to look up %s: %v", mailbox, err)
+}
+
+// checkMailSend reports an error when the token grants neither Mail.Send
+// nor Mail.Send.Shared, as application roles or delegated scopes. Tokens
+// that aren't JWTs aren't checked.
+func checkMailSend(token string) error {
+	var claims struct {
+		TenantID string   `json:"tid"`
+		Roles    []string `json:"roles"`
+		Scope    string   `json:"scp"`
+	}
+	tokenClaims(token, &claims)
+	if claims.TenantID == "" {
+		return nil
+	}
+	granted := append(claims.Roles, strings.Fields(claims.Scope)...)
+	if slices.ContainsFunc(granted, func(p string) bool { return strings.HasPrefix(strings.ToLower(p), "mail.send") }) {
+		return nil
+	}
+	if len(granted) == 0 {
+		return errors.New("the token grants no permissions, add Mail.Send to the app registration and grant admin consent")
+	}
+	return fmt.Errorf("the token lacks the Mail.Send permission (granted: %s), add it to the app registration and grant admin consent", strings.Join(granted, ", "))
+}
@@ -0,0 +1,337 @@
+// proxy.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyV2Signature is the fixed preamble of a binary PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// parseCIDRs parses a list of CIDRs or bare IP addresses
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", v)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %v", v, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// containsIP reports whether ip is inside any of the networks
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP extracts the IP of a TCP address, or nil for other address types.
+// Unix socket peers are local and count as the loopback address.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UnixAddr:
+		return net.IPv4(127, 0, 0, 1)
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// clientIP returns the end-client IP of a connection as a string for logs
+// and policy keys. Connections wrapped by proxyListener already report the
+// forwarded address.
+func clientIP(addr net.Addr) string {
+	if ip := addrIP(addr); ip != nil {
+		return ip.String()
+	}
+	if addr == nil {
+		return "unknown"
+	}
+	return addr.String()
+}
+
+// proxyHeaderTimeout bounds the wait for the PROXY header of a listener
+// with proxy_protocol
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyListener accepts PROXY protocol headers, but only from trusted load
+// balancers. Forwarding information sent by any other peer is never parsed,
+// so it can't be used to spoof the client address. With required, set by
+// the listener's proxy_protocol, every connection must start with a header
+// and other peers than the trusted ones are dropped; without trusted
+// proxies every peer is trusted.
+type proxyListener struct {
+	net.Listener
+	trusted  []*net.IPNet
+	required bool
+	logger   *slog.Logger
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		trusted := containsIP(l.trusted, addrIP(c.RemoteAddr()))
+		if !l.required {
+			if !trusted {
+				return c, nil
+			}
+		} else if len(l.trusted) > 0 && !trusted {
+			l.logger.Warn("connection from untrusted proxy dropped", "proxy", clientIP(c.RemoteAddr()), "status", "untrusted_proxy")
+			c.Close()
+			continue
+		}
+		return &proxyConn{Conn: c, r: bufio.NewReader(c), required: l.required, logger: l.logger}, nil
+	}
+}
+
+// proxyConn reads an optional PROXY header from a trusted peer before the
+// first byte of SMTP traffic. The server greets first, so a peer that
+// doesn't speak PROXY protocol simply answers with EHLO and is passed
+// through unchanged.
+type proxyConn struct {
+	net.Conn
+	r        *bufio.Reader
+	required bool // the connection must start with a header
+	logger   *slog.Logger
+
+	once   sync.Once
+	mu     sync.Mutex
+	read   bool // the header, if any, was read
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if err := c.header(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
+
+// header reads the PROXY header once, before the first byte of SMTP
+func (c *proxyConn) header() error {
+	c.once.Do(func() {
+		var addr net.Addr
+		var err error
+		if c.required && !hasProxyHeader(c.r) {
+			err = fmt.Errorf("missing PROXY header")
+		} else {
+			addr, err = readProxyHeader(c.r)
+		}
+		c.mu.Lock()
+		c.remote, c.err, c.read = addr, err, true
+		c.mu.Unlock()
+		if err != nil {
+			c.logger.Warn("invalid PROXY header", "proxy", clientIP(c.Conn.RemoteAddr()), "errormsg", err)
+		}
+	})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// hasProxyHeader reports whether the connection starts with a PROXY v1 or
+// v2 header
+func hasProxyHeader(r *bufio.Reader) bool {
+	first, err := r.Peek(1)
+	if err != nil {
+		return false
+	}
+	switch first[0] {
+	case 'P':
+		prefix, err := r.Peek(6)
+		return err == nil && string(prefix) == "PROXY "
+	case '\r':
+		prefix, err := r.Peek(len(proxyV2Signature))
+		return err == nil && bytes.Equal(prefix, proxyV2Signature)
+	}
+	return false
+}
+
+// RemoteAddr returns the client address announced by the proxy, or the
+// peer address when no header was sent
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// requiredProxyHeader reads the PROXY header of a listener with
+// proxy_protocol, which comes before the greeting. Other connections are
+// left alone.
+func requiredProxyHeader(c net.Conn) error {
+	for {
+		switch v := c.(type) {
+		case *proxyConn:
+			if !v.required {
+				return nil
+			}
+			v.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+			err := v.header()
+			// Bounds an implicit TLS handshake until the first command
+			// read sets the idle deadline
+			v.Conn.SetReadDeadline(time.Now().Add(tlsHandshakeTimeout))
+			return err
+		case *tls.Conn:
+			c = v.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// awaitingProxyHeader reports whether the client address of a connection
+// still depends on a PROXY header that hasn't been read
+func awaitingProxyHeader(c net.Conn) bool {
+	for {
+		switch v := c.(type) {
+		case *proxyConn:
+			v.mu.Lock()
+			defer v.mu.Unlock()
+			return !v.read
+		case *tls.Conn:
+			c = v.NetConn()
+		default:
+			return false
+		}
+	}
+}
+
+// readProxyHeader consumes a PROXY v1 or v2 header if one is present and
+// returns the source address it carries. A nil address without an error
+// means there was no header or the proxy sent a LOCAL/UNKNOWN connection.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, nil
+	}
+
+	switch first[0] {
+	case 'P':
+		prefix, err := r.Peek(6)
+		if err != nil || string(prefix) != "PROXY " {
+			return nil, nil
+		}
+		return readProxyV1(r)
+	case '\r':
+		prefix, err := r.Peek(len(proxyV2Signature))
+		if err != nil || !bytes.Equal(prefix, proxyV2Signature) {
+			return nil, nil
+		}
+		return readProxyV2(r)
+	}
+	return nil, nil
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// The v1 header is at most 107 bytes including CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("v1 header not terminated by CRLF")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", strings.TrimSpace(string(line)))
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("malformed v1 source address %s:%s", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	verCmd, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", verCmd>>4)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	// LOCAL command: health checks from the proxy itself
+	if verCmd&0x0f == 0 {
+		return nil, nil
+	}
+
+	switch family >> 4 {
+	case 1: // AF_INET
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("short v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("short v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,171 @@
+// quarantine.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// quarantineReason returns why the message matches a quarantine rule, or
+// "" when it may be sent. Within a rule every configured condition must
+// match; any entry of a list does.
+func (bkd *Backend) quarantineReason(from, subject, body string, attachments []mimeAttachment) string {
+	for _, rule := range bkd.policy().config.Quarantine.Rules {
+		var reasons []string
+		if len(rule.Senders) > 0 {
+			matched := false
+			for _, pattern := range rule.Senders {
+				if matchAddress(pattern, from) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+			reasons = append(reasons, "sender")
+		}
+		if len(rule.Keywords) > 0 {
+			keyword := matchKeyword(rule.Keywords, subject, body)
+			if keyword == "" {
+				continue
+			}
+			reasons = append(reasons, "keyword "+keyword)
+		}
+		if len(rule.AttachmentTypes) > 0 {
+			name := matchAttachmentType(rule.AttachmentTypes, attachments)
+			if name == "" {
+				continue
+			}
+			reasons = append(reasons, "attachment "+name)
+		}
+		if len(reasons) > 0 {
+			return strings.Join(reasons, ", ")
+		}
+	}
+	return ""
+}
+
+// matchKeyword returns the first keyword found in the subject or body,
+// ignoring case
+func matchKeyword(keywords []string, subject, body string) string {
+	subject = strings.ToLower(subject)
+	body = strings.ToLower(body)
+	for _, keyword := range keywords {
+		k := strings.ToLower(keyword)
+		if k != "" && (strings.Contains(subject, k) || strings.Contains(body, k)) {
+			return keyword
+		}
+	}
+	return ""
+}
+
+// matchAttachmentType returns the name, or else the content type, of the
+// first attachment with a listed file extension (".exe") or content type
+// ("application/zip")
+func matchAttachmentType(types []string, attachments []mimeAttachment) string {
+	for _, a := range attachments {
+		if attachmentListed(types, a) {
+			return a.label()
+		}
+	}
+	return ""
+}
+
+// attachmentListed reports whether the attachment's file extension or
+// content type is in the list
+func attachmentListed(types []string, a mimeAttachment) bool {
+	ext := strings.ToLower(filepath.Ext(a.name))
+	contentType := strings.ToLower(a.contentType)
+	for _, t := range types {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t != "" && (t == ext || t == contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// label names the attachment in logs and replies
+func (a mimeAttachment) label() string {
+	if a.name != "" {
+		return a.name
+	}
+	return a.contentType
+}
+
+// releaseQuarantined sends a held message as it was received and removes
+// it from the quarantine
+func (bkd *Backend) releaseQuarantined(ctx context.Context, id string) (spoolEntry, error) {
+	entry, data, err := bkd.quarantine.get(id)
+	if err != nil {
+		return entry, err
+	}
+
+	bkd.history.add(entry.ID, historyEvent{Event: "released"})
+	if err := bkd.sendSpooled(ctx, entry, data); err != nil {
+		return entry, err
+	}
+	bkd.logger.Info("quarantined message released", "quarantine", entry.ID, "from", entry.From, "recipients", strings.Join(entry.To, ","), "status", "released")
+
+	if err := bkd.quarantine.remove(id); err != nil {
+		return entry, fmt.Errorf("released, but failed to remove from quarantine: %v", err)
+	}
+	return entry, nil
+}
+
+// runQuarantineCommand implements the quarantine subcommands of the
+// binary: list, show <id>, release <id> and delete <id>
+func runQuarantineCommand(bkd *Backend, args []string) error {
+	if bkd.quarantine == nil {
+		return fmt.Errorf("quarantine.directory is not configured")
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("usage: quarantine list | show <id> | release <id> | delete <id>")
+	}
+	if args[0] != "list" && len(args) != 2 {
+		return fmt.Errorf("usage: quarantine %s <id>", args[0])
+	}
+
+	switch args[0] {
+	case "list":
+		entries, err := bkd.quarantine.list()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tRECEIVED\tFROM\tSUBJECT\tATTEMPTS\tREASON")
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", e.ID, e.Received.Format(time.RFC3339), e.From, e.Subject, e.Attempts, e.Reason)
+		}
+		return w.Flush()
+	case "show":
+		_, data, err := bkd.quarantine.get(args[1])
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	case "release":
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if _, err := bkd.releaseQuarantined(ctx, args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("Released %s\n", args[1])
+		return nil
+	case "delete":
+		if err := bkd.quarantine.remove(args[1]); err != nil {
+			return err
+		}
+		bkd.logger.Info("quarantined message deleted", "quarantine", args[1], "status", "deleted")
+		fmt.Printf("Deleted %s\n", args[1])
+		return nil
+	}
+	return fmt.Errorf("unknown quarantine command %q", args[0])
+}
@@ -0,0 +1,72 @@
+// received.go
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// receivedHeader returns the Received trace field (RFC 5321 section 4.4)
+// the relay adds on top of the message: the client's EHLO name and
+// address, the relay's name, the protocol (RFC 3848), the TLS version and
+// cipher and the queue ID. The recipient is only named when there is one,
+// so a Bcc recipient isn't revealed to the others.
+func (s *Session) receivedHeader(now time.Time) string {
+	helo := s.conn.Hostname()
+	if helo == "" {
+		helo = "unknown"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Received: from %s (%s)\r\n\tby %s (GoGraphSMTP) with %s id %s", helo, receivedAddress(s.clientIP), s.conn.Server().Domain, s.receivedProtocol(), s.queueID)
+	if state, ok := s.tlsState(); ok {
+		fmt.Fprintf(&b, "\r\n\t(using %s with cipher %s)", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+	}
+	if len(s.to) == 1 {
+		fmt.Fprintf(&b, "\r\n\tfor <%s>", s.to[0])
+	}
+	fmt.Fprintf(&b, ";\r\n\t%s\r\n", now.Format(time.RFC1123Z))
+	return b.String()
+}
+
+// receivedAddress writes the client address as an address literal
+func receivedAddress(client string) string {
+	ip, err := netip.ParseAddr(client)
+	switch {
+	case err != nil:
+		return client
+	case ip.Unmap().Is4():
+		return "[" + ip.Unmap().String() + "]"
+	}
+	return "[IPv6:" + ip.String() + "]"
+}
+
+// receivedProtocol names the protocol the message came in with: ESMTP or
+// LMTP, with S for TLS and A for an authenticated client
+func (s *Session) receivedProtocol() string {
+	protocol := "ESMTP"
+	if s.listener.LMTP {
+		protocol = "LMTP"
+	}
+	if s.tlsActive() {
+		protocol += "S"
+	}
+	if s.authUser != "" {
+		protocol += "A"
+	}
+	return protocol
+}
+
+// tlsState returns the TLS state of an implicit TLS or STARTTLS
+// connection
+func (s *Session) tlsState() (tls.ConnectionState, bool) {
+	if state, ok := s.conn.TLSConnectionState(); ok {
+		return state, true
+	}
+	if sc := sessionConnOf(s.conn.Conn()); sc != nil {
+		return sc.tlsState()
+	}
+	return tls.ConnectionState{}, false
+}
@@ -0,0 +1,135 @@
+// reload.go
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+
+	"github.com/expr-lang/expr/vm"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var configReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "gographsmtp_config_reloads_total",
+	Help: "Configuration reloads on SIGHUP, per result (ok, failed).",
+}, []string{"result"})
+
+// policySet is the part of the backend that a reload replaces: the config
+// and everything built from it for checking messages. Sessions already
+// running keep the settings they looked up.
+type policySet struct {
+	config      Config
+	templates   map[string]*messageTemplate
+	script      *vm.Program
+	clients     []clientOverride
+	sendWindows []sendWindow
+	rewrites    []recipientRewrite
+	etrnClients []*net.IPNet
+	vrfyClients []*net.IPNet
+	vrfy        *recipientDirectory
+	networks    []*net.IPNet
+	dnsbl       *dnsblChecker
+	directory   *recipientDirectory
+	auth        *credentialStore
+}
+
+func newPolicySet(config Config) (*policySet, error) {
+	p := &policySet{config: config, dnsbl: newDNSBLChecker(config), directory: newRecipientDirectory(config), vrfy: newVRFYDirectory(config)}
+	var err error
+	if config.Templates.Directory != "" {
+		p.templates, err = loadTemplates(config.Templates.Directory)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.Script.File != "" {
+		if p.script, err = loadPolicyScript(config.Script.File); err != nil {
+			return nil, err
+		}
+	}
+	p.clients, err = newClientOverrides(config.Clients)
+	if err != nil {
+		return nil, fmt.Errorf("invalid clients config: %v", err)
+	}
+	p.sendWindows, err = newSendWindows(config.SendWindows.Windows)
+	if err != nil {
+		return nil, err
+	}
+	p.rewrites, err = newRecipientRewrites(config.Recipients.Rewrite)
+	if err != nil {
+		return nil, err
+	}
+	p.etrnClients, err = parseCIDRs(config.ETRN.Clients)
+	if err != nil {
+		return nil, fmt.Errorf("invalid etrn.clients: %v", err)
+	}
+	p.vrfyClients, err = parseCIDRs(config.VRFY.Clients)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vrfy.clients: %v", err)
+	}
+	p.networks, err = parseCIDRs(config.Networks)
+	if err != nil {
+		return nil, fmt.Errorf("invalid networks: %v", err)
+	}
+	p.auth, err = newCredentialStore(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth config: %v", err)
+	}
+	return p, nil
+}
+
+// policy returns the current config and policies
+func (bkd *Backend) policy() *policySet {
+	return bkd.current.Load()
+}
+
+// restartSettings returns the settings a reload can't apply: listeners,
+// the Graph app, stores and the HTTP server are set up once at startup
+func restartSettings(c Config) []any {
+	return []any{c.Azure, c.Tenants, c.Graph.Proxy, c.Graph.CircuitBreaker, c.Graph.Preflight, c.Graph.Debug, c.SMTP.Address, c.SMTP.Listeners, c.SMTP.TLS, c.SMTP.TrustedProxies, c.SMTP.DSN,
+		c.SMTP.MaxMessageBytes, c.SMTP.MaxRecipients, c.SMTP.WriteTimeout, c.SMTP.IdleTimeout, c.SMTP.DataTimeout, c.SMTP.MaxMemoryBytes,
+		c.LogFile, c.Log, c.Audit, c.HTTP.Address, c.Debug, c.Redis, c.Replies, c.Spool, c.Workers,
+		c.Quarantine.Directory, c.SendWindows.Directory, c.Schedule, c.Chaos, c.Metrics, c.Tracing}
+}
+
+// reload reads the config file again and applies it to new sessions and
+// messages. An invalid config keeps the running one.
+func (bkd *Backend) reload(opts cliOptions) error {
+	config, err := opts.loadConfig()
+	if err != nil {
+		return err
+	}
+	p, err := newPolicySet(config)
+	if err != nil {
+		return err
+	}
+	// Deferred messages need the directory opened at startup
+	if (len(p.sendWindows) > 0 || config.SendWindows.Directory != "") && bkd.deferred == nil {
+		return fmt.Errorf("send windows and scheduled delivery need a send_windows.directory, which requires a restart")
+	}
+	if !reflect.DeepEqual(restartSettings(bkd.policy().config), restartSettings(config)) {
+		bkd.logger.Warn("some changed settings need a restart", "status", "restart_required")
+	}
+	bkd.current.Store(p)
+	return nil
+}
+
+// reloadOnSignal reloads the config file on every SIGHUP
+func (bkd *Backend) reloadOnSignal(opts cliOptions) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := bkd.reload(opts); err != nil {
+			configReloads.WithLabelValues("failed").Inc()
+			bkd.logger.Error("config reload failed", "status", "reload_failed", "errormsg", err)
+			continue
+		}
+		configReloads.WithLabelValues("ok").Inc()
+		bkd.logger.Info("config reloaded", "status", "reloaded")
+	}
+}
@@ -0,0 +1,202 @@
+// replay.go
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// replayAttempts is how often a message is offered to the relay while it
+// answers with temporary errors, e.g. rate limits
+const replayAttempts = 5
+
+// runReplayCommand submits .eml files to the running relay over SMTP, so
+// they pass the full pipeline (policies, rate limits, quarantine, send
+// windows) like mail from any client. Used to recover archived mail or to
+// migrate what is left in an old relay's queue.
+func runReplayCommand(config Config, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	server := fs.String("server", "", "relay address (default: the first listener without require_auth)")
+	from := fs.String("from", "", "envelope sender (default: Return-Path, Sender or From header)")
+	to := fs.String("to", "", "comma-separated envelope recipients (default: To, Cc and Bcc headers)")
+	delay := fs.Duration("delay", 0, "pause between messages")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: replay [-server host:port|unix:/path] [-from addr] [-to addrs] [-delay 1s] <dir|file.eml>...")
+	}
+
+	addr := *server
+	if addr == "" {
+		for _, lc := range config.listeners() {
+			if !lc.RequireAuth && !lc.LMTP {
+				addr = lc.Address
+				break
+			}
+		}
+		if addr == "" {
+			return fmt.Errorf("no listener without require_auth, use -server")
+		}
+	}
+	addr, err := localAddress(addr)
+	if err != nil {
+		return fmt.Errorf("invalid relay address: %v", err)
+	}
+
+	var files []string
+	for _, arg := range fs.Args() {
+		found, err := emlFiles(arg)
+		if err != nil {
+			return err
+		}
+		files = append(files, found...)
+	}
+
+	var sent, failed int
+	for i, file := range files {
+		if i > 0 && *delay > 0 {
+			time.Sleep(*delay)
+		}
+		if err := replayFile(addr, file, *from, *to); err != nil {
+			fmt.Printf("%s: %v\n", file, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: sent\n", file)
+		sent++
+	}
+	fmt.Printf("Replayed %d of %d messages\n", sent, len(files))
+	if failed > 0 {
+		return fmt.Errorf("%d messages failed", failed)
+	}
+	return nil
+}
+
+// emlFiles returns the file itself, or the .eml files below a directory
+// in name order
+func emlFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	var files []string
+	err = filepath.WalkDir(path, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.EqualFold(filepath.Ext(p), ".eml") {
+			files = append(files, p)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+// replayFile submits one message, retrying while the relay answers with
+// temporary errors
+func replayFile(addr, file, from, to string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	// Files on disk mostly have LF line endings
+	data, _ = normalizeLineEndings(data)
+	header, _, _ := bytes.Cut(data, []byte("\r\n\r\n"))
+	headers := parseHeaders(string(header))
+
+	if from == "" {
+		from = replaySender(headers)
+	}
+	var rcpts []string
+	if to != "" {
+		for _, rcpt := range strings.Split(to, ",") {
+			rcpts = append(rcpts, strings.TrimSpace(rcpt))
+		}
+	} else {
+		for _, field := range []string{"To", "Cc", "Bcc"} {
+			for _, a := range parseAddressList(headerValue(headers, field)) {
+				rcpts = append(rcpts, a.Address)
+			}
+		}
+	}
+	if len(rcpts) == 0 {
+		return fmt.Errorf("no recipients, use -to")
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = submit(addr, from, rcpts, data)
+		smtpErr, ok := err.(*smtp.SMTPError)
+		if err == nil || !ok || !smtpErr.Temporary() || attempt == replayAttempts {
+			return err
+		}
+		wait := time.Duration(attempt) * 10 * time.Second
+		fmt.Printf("%s: %v, retrying in %s\n", file, err, wait)
+		time.Sleep(wait)
+	}
+}
+
+// submit sends one message to the relay. TLS isn't needed on the
+// connection to a local listener.
+func submit(addr, from string, rcpts []string, data []byte) error {
+	network := "tcp"
+	if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		network, addr = "unix", path
+	}
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return err
+	}
+	c := smtp.NewClient(conn)
+	defer c.Close()
+	if hostname, err := os.Hostname(); err == nil {
+		if err := c.Hello(hostname); err != nil {
+			return err
+		}
+	}
+	if err := c.SendMail(from, rcpts, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// replaySender returns the envelope sender of an archived message
+func replaySender(headers map[string]string) string {
+	for _, field := range []string{"Return-Path", "Sender", "From"} {
+		if list := parseAddressList(headerValue(headers, field)); len(list) > 0 {
+			return list[0].Address
+		}
+	}
+	return ""
+}
+
+// localAddress turns a listen address into one to connect to, using the
+// loopback address for wildcard hosts. Unix socket addresses stay as they
+// are.
+func localAddress(addr string) (string, error) {
+	if strings.HasPrefix(addr, unixPrefix) {
+		return addr, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port), nil
+}
@@ -0,0 +1,147 @@
+// replies.go
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// defaultReplies holds the text of every reply that can be overridden in
+// the replies config section. {placeholders} are filled in when the reply
+// is sent; reply codes are fixed.
+var defaultReplies = map[string]string{
+	"accepted": "OK: queued as {queueid}",
+	"sent":     "OK: sent as {queueid} {msgid}",
+
+	// The greeting always starts with the hostname, this is the rest
+	"greeting": "ESMTP Service Ready",
+
+	"auth_required":          "Authentication required",
+	"tls_required":           "TLS is required",
+	"auth_failed":            "Authentication credentials invalid",
+	"auth_unavailable":       "Authentication temporarily unavailable, try again later",
+	"helo_rejected":          "HELO/EHLO rejected: {helo} is not you",
+	"sender_rejected":        "Sender <{sender}> is not allowed",
+	"sender_not_owned":       "Sender <{sender}> is not allowed for {user}",
+	"client_blocklisted":     "Client {ip} is listed in {zone}",
+	"client_greylisted":      "Greylisted, please try again later",
+	"recipient_moved":        "User not local; please try <{address}>",
+	"recipient_rejected":     "Relaying to <{recipient}> is not allowed",
+	"recipient_suppressed":   "Recipient <{recipient}> is suppressed",
+	"recipient_unknown":      "Recipient <{recipient}> does not exist",
+	"rate_limited":           "Rate limit of {limit} messages per minute exceeded for <{sender}>",
+	"quota_exceeded":         "Quota of {limit} messages per {period} used up for <{sender}>",
+	"submission_limited":     "Rate limit of {limit} {unit} per minute exceeded for {who}",
+	"message_too_large":      "Message size exceeds fixed maximum message size of {limit} bytes",
+	"graph_size_exceeded":    "Message of {size} bytes exceeds the {limit} bytes Microsoft 365 accepts",
+	"line_too_long":          "Message contains a line longer than {limit} characters (RFC 5321 section 4.5.3.1.6)",
+	"bare_line_endings":      "Message contains bare CR or LF line endings; lines must end with CRLF (RFC 5321 section 2.3.8)",
+	"encrypted_rejected":     "Encrypted messages are not accepted",
+	"attachment_blocked":     "Attachment {name} is not allowed",
+	"virus_found":            "Message contains a virus: {virus}",
+	"scan_failed":            "Message could not be scanned for viruses, try again later",
+	"milter_rejected":        "Message rejected by content filter",
+	"milter_deferred":        "Message deferred by content filter, try again later",
+	"milter_failed":          "Message could not be checked by the content filter, try again later",
+	"unknown_template":       "Unknown template {template}",
+	"template_failed":        "Template {template} could not be rendered",
+	"script_rejected":        "Message refused by policy: {reason}",
+	"script_deferred":        "Message deferred by policy: {reason}",
+	"script_failed":          "Message could not be checked against the policy, try again later",
+	"control_header_denied":  "Header {header} is not allowed for <{identity}>",
+	"control_header_invalid": "Invalid {header} value: {value}",
+	"queue_full":             "Too many messages waiting, try again later",
+	"graph_throttled":        "Graph is throttling the relay, try again later",
+	"graph_unavailable":      "Graph is unavailable, try again later",
+	"graph_timeout":          "Graph did not answer in time, try again later",
+	"graph_denied":           "Graph refused to send as this sender",
+	"graph_mailbox_unknown":  "Sending mailbox was not found in Microsoft 365",
+	"graph_too_large":        "Message exceeds the size Exchange Online accepts",
+	"graph_rejected":         "Graph rejected the message",
+	"delivery_deferred":      "Delivery failed temporarily, try again later",
+	"delivery_rejected":      "Delivery was refused by the next hop",
+	"local_error":            "Local error in processing, try again later",
+	"journal_failed":         "Message could not be journaled, try again later",
+	"recipient_failed":       "Delivery to <{recipient}> failed",
+	"recipient_deferred":     "Delivery to <{recipient}> failed, try again later",
+	"etrn_started":           "{count} pending messages for node {domain} started",
+	"etrn_none":              "No messages waiting for node {domain}",
+	"etrn_failed":            "Unable to queue messages for node {domain}",
+	"vrfy_found":             "<{address}> exists",
+	"vrfy_unknown":           "<{address}> does not exist",
+	"vrfy_unverified":        "Cannot VRFY user, but will accept message",
+	"vrfy_limited":           "Too many VRFY requests, at most {limit} per minute",
+
+	"bad_command":     "Syntax error in command",
+	"unknown_command": "Syntax error, command unrecognized",
+	"too_many_errors": "Too many errors, closing connection",
+	"idle_timeout":    "Idle timeout, closing connection",
+	"data_timeout":    "DATA timeout, closing connection",
+	"session_timeout": "Session time limit exceeded, closing connection",
+	"shutting_down":   "Service shutting down, try again later",
+
+	"network_denied":          "Connections from {client} are not accepted",
+	"too_many_connections":    "Too many connections, try again later",
+	"too_many_connections_ip": "Too many connections from {client}, try again later",
+}
+
+// replyCatalog maps reply names to their text, defaults merged with the
+// configured overrides
+type replyCatalog map[string]string
+
+// newReplyCatalog applies the configured overrides to the defaults. Unknown
+// names are rejected so a typo doesn't silently keep the default text.
+func newReplyCatalog(overrides map[string]string) (replyCatalog, error) {
+	rc := make(replyCatalog, len(defaultReplies))
+	for name, text := range defaultReplies {
+		rc[name] = text
+	}
+
+	var unknown []string
+	for name, text := range overrides {
+		if _, ok := defaultReplies[name]; !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		// Replies are single lines, a line break would end the reply early
+		text = strings.Join(strings.Fields(text), " ")
+		if text != "" {
+			rc[name] = text
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown reply names in replies: %s", strings.Join(unknown, ", "))
+	}
+	return rc, nil
+}
+
+// text returns the reply text with placeholders replaced. vars are pairs
+// of placeholder name and value.
+func (rc replyCatalog) text(name string, vars ...string) string {
+	text, ok := rc[name]
+	if !ok {
+		text = defaultReplies[name]
+	}
+	if len(vars) == 0 {
+		return text
+	}
+
+	pairs := make([]string, 0, len(vars))
+	for i := 0; i+1 < len(vars); i += 2 {
+		pairs = append(pairs, "{"+vars[i]+"}", vars[i+1])
+	}
+	return strings.NewReplacer(pairs...).Replace(text)
+}
+
+// error builds an SMTP error reply with the catalog text
+func (rc replyCatalog) error(code int, enhancedCode smtp.EnhancedCode, name string, vars ...string) *smtp.SMTPError {
+	return &smtp.SMTPError{
+		Code:         code,
+		EnhancedCode: enhancedCode,
+		Message:      rc.text(name, vars...),
+	}
+}
@@ -0,0 +1,258 @@
+// retry.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+
+	abstractions "github.com/microsoft/kiota-abstractions-go"
+)
+
+// Retry spool defaults and backoff bounds
+const (
+	defaultRetryExpiry = 48 * time.Hour
+	retryFirstDelay    = time.Minute
+	retryMaxDelay      = time.Hour
+)
+
+// retryDelay is the wait before the next attempt after attempts failed
+// ones: a minute, doubling up to an hour
+func retryDelay(attempts int) time.Duration {
+	delay := retryFirstDelay
+	for i := 1; i < attempts && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, retryMaxDelay)
+}
+
+// permanentError reports whether a failed send won't succeed on a retry:
+// Graph refused the request itself, e.g. an unknown mailbox or missing
+// Send As rights, rather than being throttled or unavailable
+func permanentError(err error) bool {
+	var apiErr abstractions.ApiErrorable
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch code := apiErr.GetStatusCode(); {
+	case code == 408 || code == 429:
+		return false
+	case code >= 400 && code < 500:
+		return true
+	}
+	return false
+}
+
+// retryExpiry returns how long a message is retried
+func (c Config) retryExpiry() time.Duration {
+	if c.Spool.Expiry > 0 {
+		return c.Spool.Expiry
+	}
+	return defaultRetryExpiry
+}
+
+// canQueue reports whether a failed message may be kept in the retry
+// spool. Retries are sent with the app's credential, so the messages of an
+// XOAUTH2 user are left to the client to retry.
+func (s *Session) canQueue() bool {
+	return s.backend.retry != nil && s.userToken == nil
+}
+
+// queue keeps a message whose send failed temporarily in the retry spool.
+// The client is told the message was accepted.
+func (s *Session) queue(data []byte, subject string, sendErr error) error {
+	return s.queueEntry(s.spoolEntry(subject, sendErr.Error()), data, sendErr)
+}
+
+// queueEntry keeps the message in the retry spool for the entry's
+// recipients
+func (s *Session) queueEntry(entry spoolEntry, data []byte, sendErr error) error {
+	entry.Attempts = 1
+	entry.NotBefore = time.Now().Add(retryDelay(1))
+	entry, err := s.backend.retry.put(entry, data)
+	if err != nil {
+		s.log().Error("queueing for retry failed", "client", s.clientIP, "from", s.from, "errormsg", err)
+		return s.backend.statusError(sendErr)
+	}
+	s.backend.history.add(s.queueID, historyEvent{Event: "queued", Detail: "retry at " + entry.NotBefore.Format(time.RFC3339)})
+	s.backend.notifyCallback(s.control.callback, s.queueID, "queued", sendErr.Error())
+	s.log().Warn("message queued for retry", "client", s.clientIP, "from", s.from, "retry", entry.ID, "status", "queued", "errormsg", sendErr)
+	go s.backend.sendDSN(entry, data, "DELAY")
+	return nil
+}
+
+// sweepRetries sends the messages in the retry spool that are due, run
+// by the retry_sweep task
+func (bkd *Backend) sweepRetries(ctx context.Context) error {
+	entries, err := bkd.retry.list()
+	if err != nil {
+		return fmt.Errorf("listing queued messages: %v", err)
+	}
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// Attempts during a throttling pause or an outage would only wait
+		// or fail
+		t := bkd.tenant(entry.From)
+		if time.Now().Before(entry.NotBefore) || t.throttle.remaining() > 0 || t.breaker.unavailable() {
+			continue
+		}
+		bkd.sendRetry(entry)
+	}
+	return nil
+}
+
+// sendRetry makes the next attempt for a queued message. A claim in the
+// shared store keeps replicas sharing the directory from sending it
+// twice. Messages that fail permanently or past spool.expiry are bounced
+// or quarantined. The error is that of the attempt, or why none was made.
+func (bkd *Backend) sendRetry(entry spoolEntry) error {
+	timeout := bkd.policy().config.uploadTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	claim := "retry:" + entry.ID
+	claimed, err := bkd.store.SetNX(ctx, claim, timeout)
+	if err != nil || !claimed {
+		return fmt.Errorf("message %s is being sent by another process", entry.ID)
+	}
+	defer bkd.store.Del(context.Background(), claim)
+
+	// Another replica may have sent it or counted a failure meanwhile
+	current, data, err := bkd.retry.get(entry.ID)
+	if err != nil || current.Attempts != entry.Attempts {
+		return fmt.Errorf("message %s was handled by another process", entry.ID)
+	}
+	entry = current
+
+	sendErr := bkd.sendSpooled(ctx, entry, data)
+	if sendErr == nil {
+		bkd.logger.Info("message sent", "retry", entry.ID, "from", entry.From, "host", bkd.tenant(entry.From).cloud.host(), "recipients", strings.Join(entry.To, ","), "attempts", entry.Attempts+1, "status", "sent")
+		go bkd.sendDSN(entry, data, "SUCCESS")
+		if err := bkd.retry.remove(entry.ID); err != nil {
+			bkd.logger.Error("sent, but failed to remove", "retry", entry.ID, "errormsg", err)
+		}
+		return nil
+	}
+
+	entry.Attempts++
+	entry.Reason = sendErr.Error()
+	if permanentError(sendErr) || time.Since(entry.retryingSince()) > bkd.policy().config.retryExpiry() {
+		if !bkd.giveUp(entry, data) {
+			// Keep the message rather than lose it without a trace
+			entry.NotBefore = time.Now().Add(retryMaxDelay)
+			bkd.retry.update(entry)
+			return sendErr
+		}
+		if err := bkd.retry.remove(entry.ID); err != nil {
+			bkd.logger.Error("expired, but failed to remove", "retry", entry.ID, "errormsg", err)
+		}
+		return sendErr
+	}
+	entry.NotBefore = time.Now().Add(retryDelay(entry.Attempts))
+	bkd.notifyWebhooks(entry.ID, "retried", "next attempt at "+entry.NotBefore.Format(time.RFC3339))
+	bkd.logger.Warn("retry failed", "retry", entry.ID, "from", entry.From, "attempts", entry.Attempts, "next", entry.NotBefore.Format(time.RFC3339), "errormsg", sendErr)
+	if err := bkd.retry.update(entry); err != nil {
+		bkd.logger.Error("failed to record attempt", "retry", entry.ID, "errormsg", err)
+	}
+	return sendErr
+}
+
+// retryingSince returns when the retries of the entry started: when it
+// was received, or requeued from the quarantine
+func (e spoolEntry) retryingSince() time.Time {
+	if e.Requeued.After(e.Received) {
+		return e.Requeued
+	}
+	return e.Received
+}
+
+// requeue moves a quarantined message back to the retry spool, e.g. once
+// the mailbox or permission it failed on is fixed. The next retry_sweep
+// sends it, with fresh attempts and spool.expiry.
+func (bkd *Backend) requeue(id string) (spoolEntry, error) {
+	entry, data, err := bkd.quarantine.get(id)
+	if err != nil {
+		return entry, err
+	}
+	entry.Attempts = 0
+	entry.NotBefore = time.Now()
+	entry.Requeued = time.Now()
+	entry.GaveUp = time.Time{}
+	if entry, err = bkd.retry.put(entry, data); err != nil {
+		return entry, fmt.Errorf("requeueing %s: %v", id, err)
+	}
+	bkd.history.add(entry.ID, historyEvent{Event: "requeued"})
+	bkd.logger.Info("quarantined message requeued", "quarantine", entry.ID, "from", entry.From, "recipients", strings.Join(entry.To, ","), "status", "requeued")
+	if err := bkd.quarantine.remove(id); err != nil {
+		return entry, fmt.Errorf("requeued, but failed to remove from quarantine: %v", err)
+	}
+	return entry, nil
+}
+
+// giveUp ends the delivery of a message that failed for good: it is moved
+// to the quarantine with spool.on_expiry: quarantine, otherwise the sender
+// gets a bounce. It reports false when neither worked.
+func (bkd *Backend) giveUp(entry spoolEntry, data []byte) bool {
+	if bkd.policy().config.Spool.OnExpiry == "quarantine" && bkd.quarantine != nil {
+		entry.GaveUp = time.Now()
+		if _, err := bkd.quarantine.put(entry, data); err != nil {
+			bkd.logger.Error("quarantining failed", "retry", entry.ID, "errormsg", err)
+			return false
+		}
+		bkd.history.add(entry.ID, historyEvent{Event: "quarantined", Detail: entry.Reason})
+		bkd.notifyCallback(entry.Callback, entry.ID, "quarantined", entry.Reason)
+		bkd.logger.Warn("message quarantined", "retry", entry.ID, "from", entry.From, "attempts", entry.Attempts, "status", "quarantined", "reason", entry.Reason)
+		return true
+	}
+
+	// With DSN the sender asked for a notice per recipient, or none with
+	// NOTIFY=NEVER
+	if bkd.policy().config.SMTP.DSN {
+		if _, err := bkd.sendDSN(entry, data, "FAILURE"); err != nil {
+			return false
+		}
+		bkd.history.add(entry.ID, historyEvent{Event: "bounced", Detail: entry.Reason})
+		bkd.notifyCallback(entry.Callback, entry.ID, "bounced", entry.Reason)
+		bkd.logger.Warn("message bounced", "retry", entry.ID, "from", entry.From, "envid", entry.DSN.envelopeID(), "attempts", entry.Attempts, "status", "bounced", "reason", entry.Reason)
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := bkd.sendMIME(ctx, entry.From, buildBounce(entry, data)); err != nil {
+		bkd.logger.Error("sending bounce failed", "retry", entry.ID, "from", entry.From, "errormsg", err)
+		return false
+	}
+	bkd.history.add(entry.ID, historyEvent{Event: "bounced", Detail: entry.Reason})
+	bkd.notifyCallback(entry.Callback, entry.ID, "bounced", entry.Reason)
+	bkd.logger.Warn("message bounced", "retry", entry.ID, "from", entry.From, "attempts", entry.Attempts, "status", "bounced", "reason", entry.Reason)
+	return true
+}
+
+// buildBounce returns a delivery failure notice for the sender of a
+// queued message, from and to its own mailbox, with the original headers
+func buildBounce(entry spoolEntry, data []byte) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: Mail Delivery System <%s>\r\n", entry.From)
+	fmt.Fprintf(&b, "To: <%s>\r\n", entry.From)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "Undeliverable: "+entry.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("Auto-Submitted: auto-replied\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&b, "Your message received %s could not be delivered to:\r\n\r\n", entry.Received.Format(time.RFC1123Z))
+	for _, rcpt := range entry.To {
+		fmt.Fprintf(&b, "  %s\r\n", rcpt)
+	}
+	fmt.Fprintf(&b, "\r\nGave up after %d attempts. Last error:\r\n  %s\r\n", entry.Attempts, entry.Reason)
+	header, _, _ := strings.Cut(string(data), "\r\n\r\n")
+	b.WriteString("\r\n----- Original message headers -----\r\n\r\n")
+	b.WriteString(header)
+	b.WriteString("\r\n")
+	return []byte(b.String())
+}
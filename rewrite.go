@@ -0,0 +1,47 @@
+// rewrite.go
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// RewriteRule replaces recipients matching a regular expression, e.g. to
+// send all mail for a staging domain to one test inbox
+type RewriteRule struct {
+	// Match is matched against the whole address, ignoring case
+	Match string `yaml:"match"`
+	// Replace is the new address; $1 or ${name} insert submatches
+	Replace string `yaml:"replace"`
+}
+
+type recipientRewrite struct {
+	pattern *regexp.Regexp
+	replace string
+}
+
+func newRecipientRewrites(rules []RewriteRule) ([]recipientRewrite, error) {
+	rewrites := make([]recipientRewrite, 0, len(rules))
+	for i, rule := range rules {
+		if rule.Replace == "" {
+			return nil, fmt.Errorf("recipients.rewrite %d: replace is empty", i+1)
+		}
+		pattern, err := regexp.Compile("(?i)^(?:" + rule.Match + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("recipients.rewrite %d: invalid match: %v", i+1, err)
+		}
+		rewrites = append(rewrites, recipientRewrite{pattern: pattern, replace: rule.Replace})
+	}
+	return rewrites, nil
+}
+
+// rewriteRecipient applies the rewrite rules in order, each to the result
+// of the one before
+func (bkd *Backend) rewriteRecipient(to string) string {
+	for _, r := range bkd.policy().rewrites {
+		if r.pattern.MatchString(to) {
+			to = r.pattern.ReplaceAllString(to, r.replace)
+		}
+	}
+	return to
+}
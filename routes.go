@@ -0,0 +1,89 @@
+// routes.go
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TransportRoute sends the recipients of some domains a way of their own,
+// e.g. internal domains through Graph and the rest through the smarthost
+type TransportRoute struct {
+	// Domains are recipient domains, "*.example.com" with its subdomains
+	// or "*" for any other
+	Domains []string `yaml:"domains"`
+	// Transport is "graph", "smarthost" or "reject"
+	Transport string `yaml:"transport"`
+}
+
+// validateRoutes checks the routes section
+func validateRoutes(config Config) error {
+	for i, r := range config.Routes {
+		if len(r.Domains) == 0 {
+			return fmt.Errorf("routes[%d] needs domains", i)
+		}
+		switch r.Transport {
+		case "graph", "reject":
+		case "smarthost":
+			if config.Smarthost.Address == "" {
+				return fmt.Errorf("routes[%d]: transport smarthost needs a smarthost.address", i)
+			}
+		default:
+			return fmt.Errorf("invalid routes[%d].transport %q", i, r.Transport)
+		}
+	}
+	return nil
+}
+
+// routeTransport returns the transport of the first route matching the
+// recipient's domain, graph when none does
+func (c Config) routeTransport(rcpt string) string {
+	_, domain, _ := strings.Cut(rcpt, "@")
+	for _, r := range c.Routes {
+		for _, d := range r.Domains {
+			if d == "*" || matchDomains([]string{d}, domain) {
+				return r.Transport
+			}
+		}
+	}
+	return "graph"
+}
+
+// recipientRoute is a batch of recipients of a message sent together
+type recipientRoute struct {
+	transport string
+	rcpts     []string
+}
+
+// recipientBatches groups the envelope recipients by route, in the order
+// their transports first appear, and splits those of Graph into batches
+// of graph.split_recipients, so a recipient Graph rejects only fails its
+// own batch. Without routes or the setting all recipients are one batch.
+func (c Config) recipientBatches(rcpts []string) []recipientRoute {
+	var routes []recipientRoute
+	index := make(map[string]int)
+	for _, rcpt := range rcpts {
+		transport := c.routeTransport(rcpt)
+		i, ok := index[transport]
+		if !ok {
+			i = len(routes)
+			index[transport] = i
+			routes = append(routes, recipientRoute{transport: transport})
+		}
+		routes[i].rcpts = append(routes[i].rcpts, rcpt)
+	}
+	if len(routes) == 0 {
+		return []recipientRoute{{transport: "graph", rcpts: rcpts}}
+	}
+
+	n := c.Graph.SplitRecipients
+	var batches []recipientRoute
+	for _, r := range routes {
+		for n > 0 && r.transport == "graph" && len(r.rcpts) > n {
+			batches = append(batches, recipientRoute{transport: r.transport, rcpts: r.rcpts[:n]})
+			r.rcpts = r.rcpts[n:]
+		}
+		batches = append(batches, r)
+	}
+	return batches
+}
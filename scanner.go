@@ -0,0 +1,225 @@
+// scanner.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// defaultScanTimeout bounds a scan unless scan.timeout is set
+const defaultScanTimeout = 30 * time.Second
+
+// clamdChunkSize is the size of the INSTREAM chunks sent to clamd
+const clamdChunkSize = 64 << 10
+
+var scansTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "gographsmtp_scans_total",
+	Help: "Messages scanned for viruses, per scanner (clamd, icap) and result (clean, infected, error).",
+}, []string{"scanner", "result"})
+
+// scanMessage has the message scanned by clamd and the ICAP server, as
+// configured, and returns the name of the virus found, or "" when the
+// message is clean
+func (bkd *Backend) scanMessage(data []byte) (string, error) {
+	config := bkd.policy().config.Scan
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultScanTimeout
+	}
+	scanners := []struct {
+		name    string
+		address string
+		scan    func(ctx context.Context, address string, data []byte) (string, error)
+	}{{"clamd", config.Clamd, scanClamd}, {"icap", config.ICAP, scanICAP}}
+	for _, s := range scanners {
+		if s.address == "" {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		virus, err := s.scan(ctx, s.address, data)
+		cancel()
+		switch {
+		case err != nil:
+			scansTotal.WithLabelValues(s.name, "error").Inc()
+			return "", fmt.Errorf("%s: %v", s.name, err)
+		case virus != "":
+			scansTotal.WithLabelValues(s.name, "infected").Inc()
+			return virus, nil
+		}
+		scansTotal.WithLabelValues(s.name, "clean").Inc()
+	}
+	return "", nil
+}
+
+// scanning reports whether a scanner is configured
+func (c Config) scanning() bool {
+	return c.Scan.Clamd != "" || c.Scan.ICAP != ""
+}
+
+// checkVirus scans the message. An infected message is refused, or
+// quarantined with scan.action: quarantine, in which case held is true.
+// A failed scan is refused with 451 unless scan.on_error is accept.
+func (s *Session) checkVirus(data []byte, subject string) (held bool, err error) {
+	config := s.backend.policy().config
+	if !config.scanning() {
+		return false, nil
+	}
+	virus, err := s.backend.scanMessage(data)
+	if err != nil {
+		if config.Scan.OnError == "accept" {
+			s.log().Warn("virus scan failed, message accepted", "client", s.clientIP, "from", s.from, "status", "scan_failed", "errormsg", err)
+			return false, nil
+		}
+		s.log().Error("virus scan failed", "client", s.clientIP, "from", s.from, "status", "scan_failed", "errormsg", err)
+		return false, s.backend.replies.error(451, smtp.EnhancedCode{4, 3, 0}, "scan_failed")
+	}
+	if virus == "" {
+		return false, nil
+	}
+	s.virus = virus
+	if config.Scan.Action == "quarantine" {
+		return true, s.hold(data, subject, "virus "+virus)
+	}
+	s.log().Warn("virus found", "client", s.clientIP, "from", s.from, "status", "infected", "virus", virus)
+	return false, s.backend.replies.error(554, smtp.EnhancedCode{5, 7, 1}, "virus_found", "virus", virus)
+}
+
+// dialScanner connects to host:port, or to a Unix socket given as
+// unix:/path
+func dialScanner(ctx context.Context, address string) (net.Conn, error) {
+	network := "tcp"
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		network, address = "unix", path
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return conn, nil
+}
+
+// scanClamd streams the message to clamd with INSTREAM
+func scanClamd(ctx context.Context, address string, data []byte) (string, error) {
+	conn, err := dialScanner(ctx, address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	var size [4]byte
+	for len(data) > 0 {
+		chunk := data[:min(len(data), clamdChunkSize)]
+		data = data[len(chunk):]
+		binary.BigEndian.PutUint32(size[:], uint32(len(chunk)))
+		w.Write(size[:])
+		w.Write(chunk)
+	}
+	binary.BigEndian.PutUint32(size[:], 0)
+	w.Write(size[:])
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !(errors.Is(err, io.EOF) && reply != "") {
+		return "", err
+	}
+	// "stream: OK", "stream: Eicar-Signature FOUND" or "... ERROR"
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	result := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	}
+	return "", fmt.Errorf("unexpected reply %q", reply)
+}
+
+// scanICAP sends the message to an ICAP service (RFC 3507) with RESPMOD,
+// as the body of an HTTP response. 204 means clean; a 200 means the
+// service replaced the message, which it does for infected ones.
+func scanICAP(ctx context.Context, service string, data []byte) (string, error) {
+	u, err := url.Parse(service)
+	if err != nil || u.Scheme != "icap" || u.Host == "" {
+		return "", fmt.Errorf("invalid service %q, must be icap://host[:port]/service", service)
+	}
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), "1344")
+	}
+	conn, err := dialScanner(ctx, address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	resHdr := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: message/rfc822\r\nContent-Length: %d\r\n\r\n", len(data))
+	var req bytes.Buffer
+	fmt.Fprintf(&req, "RESPMOD %s ICAP/1.0\r\n", u.String())
+	fmt.Fprintf(&req, "Host: %s\r\n", u.Host)
+	req.WriteString("Allow: 204\r\n")
+	fmt.Fprintf(&req, "Encapsulated: res-hdr=0, res-body=%d\r\n\r\n", len(resHdr))
+	req.WriteString(resHdr)
+	fmt.Fprintf(&req, "%x\r\n", len(data))
+	req.Write(data)
+	req.WriteString("\r\n0\r\n\r\n")
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		return "", err
+	}
+
+	tr := textproto.NewReader(bufio.NewReader(conn))
+	status, err := tr.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	headers, err := tr.ReadMIMEHeader()
+	if err != nil && len(headers) == 0 {
+		return "", err
+	}
+	_, code, _ := strings.Cut(status, " ")
+	switch {
+	case strings.HasPrefix(code, "204"):
+		return "", nil
+	case strings.HasPrefix(code, "200"):
+		return icapThreat(headers), nil
+	}
+	return "", fmt.Errorf("unexpected reply %q", status)
+}
+
+// icapThreat returns the virus an ICAP service reported, in the headers
+// the common services use
+func icapThreat(headers textproto.MIMEHeader) string {
+	// X-Infection-Found: Type=0; Resolution=2; Threat=Eicar-Test-Signature;
+	for _, field := range strings.Split(headers.Get("X-Infection-Found"), ";") {
+		if threat, ok := strings.CutPrefix(strings.TrimSpace(field), "Threat="); ok && threat != "" {
+			return threat
+		}
+	}
+	for _, name := range []string{"X-Virus-ID", "X-Virus-Name"} {
+		if v := strings.TrimSpace(headers.Get(name)); v != "" {
+			return v
+		}
+	}
+	return "unknown"
+}
@@ -0,0 +1,209 @@
+// scheduler.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/robfig/cron/v3"
+)
+
+// defaultSchedules are the schedules of the maintenance tasks unless the
+// schedule config section sets one; "off" disables a task
+var defaultSchedules = map[string]string{
+	"deferred_sweep": "@every 30s",
+	"retry_sweep":    "@every 30s",
+	"history_prune":  "@every 10m",
+	"token_refresh":  "@every 30m",
+	"summary_report": "off",
+	"bounce_watch":   "@every 5m",
+	"archive_prune":  "@hourly",
+}
+
+// taskTimeout bounds a single run of a task
+const taskTimeout = 5 * time.Minute
+
+var (
+	taskRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gographsmtp_task_runs_total",
+		Help: "Runs of the maintenance tasks per task and result (ok, failed).",
+	}, []string{"task", "result"})
+	taskDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gographsmtp_task_duration_seconds",
+		Help:    "Time taken by a run of a maintenance task.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 8),
+	}, []string{"task"})
+	taskLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gographsmtp_task_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful run of a maintenance task.",
+	}, []string{"task"})
+)
+
+// scheduledTask is a periodic maintenance task
+type scheduledTask struct {
+	name     string
+	schedule cron.Schedule
+	run      func(ctx context.Context) error
+}
+
+// parseSchedule reads a cron expression ("0 7 * * mon-fri"), a descriptor
+// such as "@hourly" or an interval ("@every 30s"). "off" returns nil.
+func parseSchedule(spec string) (cron.Schedule, error) {
+	if strings.TrimSpace(spec) == "off" {
+		return nil, nil
+	}
+	return cron.ParseStandard(spec)
+}
+
+// scheduleSpec returns the configured or default schedule of a task
+func (c Config) scheduleSpec(task string) string {
+	if spec := c.Schedule[task]; spec != "" {
+		return spec
+	}
+	return defaultSchedules[task]
+}
+
+// startScheduler starts the maintenance tasks, each in its own goroutine.
+// A task's runs never overlap; a run that takes longer than the interval
+// delays the next one.
+func (bkd *Backend) startScheduler() error {
+	runs := map[string]func(ctx context.Context) error{
+		"history_prune":  bkd.pruneHistory,
+		"token_refresh":  bkd.refreshToken,
+		"summary_report": bkd.summaryReport(),
+	}
+	if bkd.deferred != nil {
+		runs["deferred_sweep"] = bkd.sweepDeferred
+	}
+	if bkd.retry != nil {
+		runs["retry_sweep"] = bkd.sweepRetries
+	}
+	if bkd.policy().config.Archive.Directory != "" {
+		runs["archive_prune"] = bkd.pruneArchive
+	}
+	if len(bkd.policy().config.Bounces.Mailboxes) > 0 {
+		runs["bounce_watch"] = bkd.watchBounces()
+	}
+
+	names := make([]string, 0, len(runs))
+	for name := range runs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var tasks []scheduledTask
+	for _, name := range names {
+		spec := bkd.policy().config.scheduleSpec(name)
+		schedule, err := parseSchedule(spec)
+		if err != nil {
+			return fmt.Errorf("invalid schedule %q for %s: %v", spec, name, err)
+		}
+		if schedule == nil {
+			continue
+		}
+		tasks = append(tasks, scheduledTask{name: name, schedule: schedule, run: runs[name]})
+		bkd.logger.Info("task scheduled", "task", name, "schedule", spec, "status", "scheduled")
+	}
+	for _, task := range tasks {
+		go bkd.runTask(task)
+	}
+	return nil
+}
+
+func (bkd *Backend) runTask(task scheduledTask) {
+	for {
+		next := task.schedule.Next(time.Now())
+		time.Sleep(time.Until(next))
+
+		ctx, cancel := context.WithTimeout(context.Background(), taskTimeout)
+		start := time.Now()
+		err := task.run(ctx)
+		cancel()
+
+		taskDuration.WithLabelValues(task.name).Observe(time.Since(start).Seconds())
+		if err != nil {
+			taskRuns.WithLabelValues(task.name, "failed").Inc()
+			bkd.logger.Error("task failed", "task", task.name, "errormsg", err)
+			continue
+		}
+		taskRuns.WithLabelValues(task.name, "ok").Inc()
+		taskLastSuccess.WithLabelValues(task.name).SetToCurrentTime()
+	}
+}
+
+// pruneHistory drops history records beyond the retention, which
+// otherwise only happens when new messages arrive
+func (bkd *Backend) pruneHistory(ctx context.Context) error {
+	bkd.history.sweep()
+	return nil
+}
+
+// summaryReport logs the outcomes and top senders of the messages
+// accepted since the previous report, and the average time Graph took
+func (bkd *Backend) summaryReport() func(ctx context.Context) error {
+	since := time.Now()
+	lastSum, lastCount := histogramTotals("gographsmtp_delivery_duration_seconds")
+	return func(ctx context.Context) error {
+		now := time.Now()
+		counts, senders := bkd.history.summary(since)
+		since = now
+
+		statuses := make([]string, 0, len(counts))
+		total := 0
+		for status, n := range counts {
+			statuses = append(statuses, status)
+			total += n
+		}
+		sort.Strings(statuses)
+		attrs := []any{"task", "summary_report", "messages", total}
+		for _, status := range statuses {
+			attrs = append(attrs, status, counts[status])
+		}
+
+		// The average time Graph took for the messages handed to it since
+		// the last report
+		sum, count := histogramTotals("gographsmtp_delivery_duration_seconds")
+		if count > lastCount {
+			avg := time.Duration((sum - lastSum) / float64(count-lastCount) * float64(time.Second))
+			attrs = append(attrs, "graph_latency_avg", avg.Round(time.Millisecond).String())
+		}
+		lastSum, lastCount = sum, count
+
+		if top := topSenders(senders, summaryTopSenders); top != "" {
+			attrs = append(attrs, "top_senders", top)
+		}
+		bkd.logger.Info("summary report", attrs...)
+		return nil
+	}
+}
+
+// summaryTopSenders is the number of senders the summary report names
+const summaryTopSenders = 5
+
+// topSenders returns the n senders with the most messages as
+// "sender=count" pairs, most first
+func topSenders(senders map[string]int, n int) string {
+	list := make([]string, 0, len(senders))
+	for sender := range senders {
+		list = append(list, sender)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if senders[list[i]] != senders[list[j]] {
+			return senders[list[i]] > senders[list[j]]
+		}
+		return list[i] < list[j]
+	})
+	if len(list) > n {
+		list = list[:n]
+	}
+	pairs := make([]string, len(list))
+	for i, sender := range list {
+		pairs[i] = fmt.Sprintf("%s=%d", sender, senders[sender])
+	}
+	return strings.Join(pairs, " ")
+}
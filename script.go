@@ -0,0 +1,143 @@
+// script.go
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+// scriptFuncs are the functions a policy script can call besides the expr
+// builtins, which include lower, hasPrefix, hasSuffix and the contains
+// and matches operators
+var scriptFuncs = []expr.Option{
+	expr.Function("domain", func(params ...any) (any, error) {
+		_, domain, _ := strings.Cut(params[0].(string), "@")
+		return strings.ToLower(domain), nil
+	}, new(func(string) string)),
+	expr.Function("reject", func(params ...any) (any, error) {
+		return scriptDecision{action: "reject", arg: params[0].(string)}, nil
+	}, new(func(string) scriptDecision)),
+	expr.Function("defer", func(params ...any) (any, error) {
+		return scriptDecision{action: "defer", arg: params[0].(string)}, nil
+	}, new(func(string) scriptDecision)),
+	expr.Function("route", func(params ...any) (any, error) {
+		route := strings.ToLower(params[0].(string))
+		if route != "graph" && route != "direct_mx" {
+			return nil, fmt.Errorf("invalid route %q", route)
+		}
+		return scriptDecision{action: "route", arg: route}, nil
+	}, new(func(string) scriptDecision)),
+}
+
+// loadPolicyScript compiles script.file. Errors, including unknown names
+// and type errors, are reported at startup and on reload rather than for
+// the first message.
+func loadPolicyScript(file string) (*vm.Program, error) {
+	source, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load script.file: %v", err)
+	}
+	program, err := expr.Compile(string(source), append([]expr.Option{expr.Env(scriptInput{})}, scriptFuncs...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load script.file: %v", err)
+	}
+	return program, nil
+}
+
+// scriptInput is what a policy script sees of a message: From, To,
+// Header("X-Mailer") and so on
+type scriptInput struct {
+	From    string
+	To      []string
+	User    string // authenticated user, empty without AUTH
+	Client  string
+	Subject string
+	Size    int
+	headers map[string]string
+}
+
+// Header returns a header of the message, ignoring the case of its name
+func (in scriptInput) Header(name string) string {
+	return headerValue(in.headers, name)
+}
+
+// scriptDecision is made by the script's reject, defer and route
+// functions: an action and its argument
+type scriptDecision struct {
+	action string
+	arg    string
+}
+
+// runPolicyScript evaluates the script and returns its decisions. The
+// script results in a decision, a list of them, or nil for none.
+func runPolicyScript(program *vm.Program, in scriptInput) ([]scriptDecision, error) {
+	out, err := expr.Run(program, in)
+	if err != nil {
+		return nil, err
+	}
+	switch v := out.(type) {
+	case nil:
+		return nil, nil
+	case scriptDecision:
+		return []scriptDecision{v}, nil
+	case []any:
+		var decisions []scriptDecision
+		for _, item := range v {
+			switch d := item.(type) {
+			case nil:
+			case scriptDecision:
+				decisions = append(decisions, d)
+			default:
+				return nil, fmt.Errorf("script result holds %T, not a decision", item)
+			}
+		}
+		return decisions, nil
+	}
+	return nil, fmt.Errorf("script resulted in %T, not a decision", out)
+}
+
+// scriptHook runs the policy script of script.file for every message. The
+// first reject or defer ends it; a route applies unless one of them
+// follows.
+type scriptHook struct{ noopHook }
+
+func (scriptHook) hookName() string { return "script" }
+
+func (scriptHook) preSend(s *Session, m *hookMessage) error {
+	program := s.backend.policy().script
+	if program == nil {
+		return nil
+	}
+	decisions, err := runPolicyScript(program, scriptInput{
+		From:    s.from,
+		To:      s.envelopeRecipients(),
+		User:    s.authUser,
+		Client:  s.clientIP,
+		Subject: m.subject,
+		Size:    len(m.data),
+		headers: m.headers,
+	})
+	if err != nil {
+		// Mail isn't sent past a broken policy; the client tries again
+		s.log().Error("policy script failed", "client", s.clientIP, "from", s.from, "status", "script_failed", "errormsg", err)
+		return s.backend.replies.error(451, smtp.EnhancedCode{4, 3, 0}, "script_failed")
+	}
+	for _, d := range decisions {
+		switch d.action {
+		case "reject":
+			s.log().Warn("message rejected by script", "client", s.clientIP, "from", s.from, "status", "script_rejected", "reason", d.arg)
+			return s.backend.replies.error(550, smtp.EnhancedCode{5, 7, 1}, "script_rejected", "reason", d.arg)
+		case "defer":
+			s.log().Info("message deferred by script", "client", s.clientIP, "from", s.from, "status", "script_deferred", "reason", d.arg)
+			return s.backend.replies.error(451, smtp.EnhancedCode{4, 7, 1}, "script_deferred", "reason", d.arg)
+		case "route":
+			s.control.route = d.arg
+		}
+	}
+	return nil
+}
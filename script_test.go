@@ -0,0 +1,76 @@
+// script_test.go
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// policyScript is the example of the README
+const policyScript = `[
+  domain(From) == "hr.example.com" && any(To, domain(#) != "example.com") && Header("X-Case-Number") == ""
+    ? reject("external HR mail needs a case number") : nil,
+  Subject matches "(?i)^\\[bulk\\]" ? route("direct_mx") : nil
+]`
+
+func TestPolicyScript(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policy.expr")
+	if err := os.WriteFile(file, []byte(policyScript), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	program, err := loadPolicyScript(file)
+	if err != nil {
+		t.Fatalf("loadPolicyScript: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		in   scriptInput
+		want []scriptDecision
+	}{
+		{"internal HR mail", scriptInput{From: "pay@hr.example.com", To: []string{"boss@example.com"}}, nil},
+		{"external HR mail", scriptInput{From: "pay@HR.example.com", To: []string{"boss@example.com", "x@other.test"}},
+			[]scriptDecision{{action: "reject", arg: "external HR mail needs a case number"}}},
+		{"external HR mail with case", scriptInput{From: "pay@hr.example.com", To: []string{"x@other.test"}, headers: map[string]string{"X-Case-Number": "42"}}, nil},
+		{"bulk", scriptInput{From: "news@example.com", Subject: "[BULK] offers"}, []scriptDecision{{action: "route", arg: "direct_mx"}}},
+	}
+	for _, tt := range tests {
+		got, err := runPolicyScript(program, tt.in)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: decisions = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyScriptErrors(t *testing.T) {
+	dir := t.TempDir()
+	for name, script := range map[string]string{
+		"unknown name": `Sender == "x"`,
+		"type error":   `reject(Size)`,
+	} {
+		file := filepath.Join(dir, "policy.expr")
+		os.WriteFile(file, []byte(script), 0o644)
+		if _, err := loadPolicyScript(file); err == nil {
+			t.Errorf("%s: loadPolicyScript accepted %q", name, script)
+		}
+	}
+
+	for name, script := range map[string]string{
+		"bad route":   `route("smarthost")`,
+		"not decided": `"reject spam"`,
+	} {
+		file := filepath.Join(dir, "policy.expr")
+		os.WriteFile(file, []byte(script), 0o644)
+		program, err := loadPolicyScript(file)
+		if err != nil {
+			t.Fatalf("%s: loadPolicyScript: %v", name, err)
+		}
+		if _, err := runPolicyScript(program, scriptInput{}); err == nil {
+			t.Errorf("%s: runPolicyScript accepted %q", name, script)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// secrets.go
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"gopkg.in/yaml.v3"
+)
+
+// ageKeyFileEnv names the age identity file, taking precedence over
+// secrets.age_key_file
+const ageKeyFileEnv = "GOGRAPHSMTP_AGE_KEY_FILE"
+
+// agePrefix marks a config value holding base64 age ciphertext; armored
+// values start with the age armor header instead
+const agePrefix = "age:"
+
+// isSOPSFile reports whether the parsed config carries SOPS metadata
+func isSOPSFile(root *yaml.Node) bool {
+	if root.Kind == yaml.DocumentNode && len(root.Content) > 0 {
+		root = root.Content[0]
+	}
+	if root.Kind != yaml.MappingNode {
+		return false
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "sops" {
+			return true
+		}
+	}
+	return false
+}
+
+// decryptSOPS decrypts a SOPS-encrypted config with the sops binary, which
+// finds the key (age key file, KMS, Key Vault, ...) the usual SOPS way
+func decryptSOPS(filename string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("sops", "--decrypt", "--input-type", "yaml", "--output-type", "yaml", filename)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%v: %s", err, msg)
+		}
+		return nil, fmt.Errorf("sops failed to decrypt %s: %v", filename, err)
+	}
+	return out, nil
+}
+
+// encryptedValue reports whether a config value is age-encrypted
+func encryptedValue(value string) bool {
+	return strings.HasPrefix(value, agePrefix) || strings.HasPrefix(strings.TrimSpace(value), armor.Header)
+}
+
+// resolveSecrets replaces every age-encrypted scalar below node with its
+// plaintext and every vault://, aws-sm:// or keyvault:// reference with
+// the secret it points to. The identities are only loaded when an encrypted value is
+// found.
+func resolveSecrets(node *yaml.Node, keyFile string) error {
+	var identities []age.Identity
+	var walk func(n *yaml.Node, path string) error
+	walk = func(n *yaml.Node, path string) error {
+		switch n.Kind {
+		case yaml.DocumentNode, yaml.SequenceNode:
+			for i, c := range n.Content {
+				p := path
+				if n.Kind == yaml.SequenceNode {
+					p = fmt.Sprintf("%s[%d]", path, i)
+				}
+				if err := walk(c, p); err != nil {
+					return err
+				}
+			}
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				p := n.Content[i].Value
+				if path != "" {
+					p = path + "." + p
+				}
+				if err := walk(n.Content[i+1], p); err != nil {
+					return err
+				}
+			}
+		case yaml.ScalarNode:
+			if secretRef(n.Value) {
+				value, err := resolveSecretRef(n.Value)
+				if err != nil {
+					return fmt.Errorf("failed to resolve %s: %v", path, err)
+				}
+				n.Value = value
+				n.Tag = "!!str"
+				n.Style = 0
+				return nil
+			}
+			if !encryptedValue(n.Value) {
+				return nil
+			}
+			if identities == nil {
+				var err error
+				if identities, err = loadAgeIdentities(keyFile); err != nil {
+					return fmt.Errorf("%s is encrypted: %v", path, err)
+				}
+			}
+			plain, err := decryptAge(n.Value, identities)
+			if err != nil {
+				return fmt.Errorf("failed to decrypt %s: %v", path, err)
+			}
+			n.Value = plain
+			n.Tag = "!!str"
+			n.Style = 0
+		}
+		return nil
+	}
+	return walk(node, "")
+}
+
+// loadAgeIdentities reads the age identity file from the environment or
+// secrets.age_key_file
+func loadAgeIdentities(keyFile string) ([]age.Identity, error) {
+	if env := os.Getenv(ageKeyFileEnv); env != "" {
+		keyFile = env
+	}
+	if keyFile == "" {
+		return nil, fmt.Errorf("no age key file, set secrets.age_key_file or %s", ageKeyFileEnv)
+	}
+	f, err := os.Open(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading age key file: %v", err)
+	}
+	defer f.Close()
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid age key file %s: %v", keyFile, err)
+	}
+	return identities, nil
+}
+
+// decryptAge decrypts an armored or "age:"-prefixed base64 value
+func decryptAge(value string, identities []age.Identity) (string, error) {
+	var src io.Reader
+	if strings.HasPrefix(value, agePrefix) {
+		data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[len(agePrefix):]))
+		if err != nil {
+			return "", fmt.Errorf("invalid base64: %v", err)
+		}
+		src = bytes.NewReader(data)
+	} else {
+		src = armor.NewReader(strings.NewReader(strings.TrimSpace(value)))
+	}
+
+	r, err := age.Decrypt(src, identities...)
+	if err != nil {
+		return "", err
+	}
+	plain, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
@@ -0,0 +1,217 @@
+// secretsources.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// Prefixes of config values that reference a secret in an external store
+const (
+	vaultPrefix    = "vault://"
+	awsSMPrefix    = "aws-sm://"
+	keyVaultPrefix = "keyvault://"
+)
+
+// secretRef reports whether a config value references an external secret
+func secretRef(value string) bool {
+	return strings.HasPrefix(value, vaultPrefix) || strings.HasPrefix(value, awsSMPrefix) || strings.HasPrefix(value, keyVaultPrefix)
+}
+
+// resolveSecretRef fetches the secret a vault://, aws-sm:// or keyvault://
+// reference points to. The part after "#" selects a key of a JSON secret.
+func resolveSecretRef(ref string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	name, key, _ := strings.Cut(ref, "#")
+	switch {
+	case strings.HasPrefix(name, vaultPrefix):
+		return vaultSecret(ctx, strings.TrimPrefix(name, vaultPrefix), key)
+	case strings.HasPrefix(name, awsSMPrefix):
+		return awsSecret(ctx, strings.TrimPrefix(name, awsSMPrefix), key)
+	case strings.HasPrefix(name, keyVaultPrefix):
+		return keyVaultSecret(ctx, strings.TrimPrefix(name, keyVaultPrefix), key)
+	}
+	return "", fmt.Errorf("unknown secret reference %q", ref)
+}
+
+// vaultSecret reads a key of a Vault secret, e.g. path
+// "secret/data/gographsmtp" (KV v2) or "secret/gographsmtp" (KV v1). The
+// server and token come from VAULT_ADDR, VAULT_TOKEN (or ~/.vault-token)
+// and VAULT_NAMESPACE, as for the vault CLI.
+func vaultSecret(ctx context.Context, path, key string) (string, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", fmt.Errorf("VAULT_ADDR is not set")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			if b, err := os.ReadFile(filepath.Join(home, ".vault-token")); err == nil {
+				token = strings.TrimSpace(string(b))
+			}
+		}
+	}
+	if token == "" {
+		return "", fmt.Errorf("no Vault token, set VAULT_TOKEN")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimRight(addr, "/")+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("vault: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault answered %s for %s", resp.Status, path)
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", fmt.Errorf("vault: invalid response: %v", err)
+	}
+	data := secret.Data
+	// KV v2 nests the secret with its metadata
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+	return secretKey(data, key)
+}
+
+// awsSecret reads an AWS Secrets Manager secret by name or ARN, with the
+// credentials and region of the usual AWS chain (environment, shared
+// config, instance role). With a key the secret must be a JSON object.
+func awsSecret(ctx context.Context, id, key string) (string, error) {
+	var opts []func(*awsconfig.LoadOptions) error
+	if a, err := arn.Parse(id); err == nil {
+		opts = append(opts, awsconfig.WithRegion(a.Region))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return "", fmt.Errorf("aws: %v", err)
+	}
+
+	out, err := secretsmanager.NewFromConfig(cfg).GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(id),
+	})
+	if err != nil {
+		return "", fmt.Errorf("aws secrets manager: %v", err)
+	}
+	if out.SecretString == nil {
+		return "", fmt.Errorf("secret %s has no string value", id)
+	}
+	if key == "" {
+		return *out.SecretString, nil
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(*out.SecretString), &data); err != nil {
+		return "", fmt.Errorf("secret %s is not a JSON object", id)
+	}
+	return secretKey(data, key)
+}
+
+// keyVaultSecret reads an Azure Key Vault secret, "<vault>/<name>" or
+// "<vault>/<name>/<version>", the latest version unless one is given. A
+// vault name without dots is in the public cloud (<vault>.vault.azure.net);
+// sovereign clouds take the vault's host name. The token comes from the
+// usual Azure chain (environment, workload identity, managed identity,
+// Azure CLI). With a key the secret must be a JSON object.
+func keyVaultSecret(ctx context.Context, ref, key string) (string, error) {
+	vault, secret, ok := strings.Cut(ref, "/")
+	if !ok || vault == "" || secret == "" {
+		return "", fmt.Errorf("key vault reference must be keyvault://<vault>/<secret>[/<version>]")
+	}
+	host := vault
+	if !strings.Contains(host, ".") {
+		host += ".vault.azure.net"
+	}
+	// The token is for the vault service of the vault's cloud, e.g.
+	// https://vault.azure.net
+	_, domain, _ := strings.Cut(host, ".")
+
+	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return "", fmt.Errorf("key vault: %v", err)
+	}
+	at, err := cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{"https://" + domain + "/.default"}})
+	if err != nil {
+		return "", fmt.Errorf("key vault: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://"+host+"/secrets/"+secret+"?api-version=7.4", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+at.Token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("key vault: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("key vault answered %s for %s", resp.Status, ref)
+	}
+
+	var bundle struct {
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&bundle); err != nil {
+		return "", fmt.Errorf("key vault: invalid response: %v", err)
+	}
+	if key == "" {
+		return bundle.Value, nil
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(bundle.Value), &data); err != nil {
+		return "", fmt.Errorf("secret %s is not a JSON object", ref)
+	}
+	return secretKey(data, key)
+}
+
+// secretKey picks key from a secret's data. Without a key the secret
+// must hold exactly one value.
+func secretKey(data map[string]interface{}, key string) (string, error) {
+	if key == "" {
+		if len(data) != 1 {
+			return "", fmt.Errorf("secret has %d keys, select one with #key", len(data))
+		}
+		for k := range data {
+			key = k
+		}
+	}
+	v, ok := data[key]
+	if !ok {
+		return "", fmt.Errorf("secret has no key %q", key)
+	}
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
@@ -0,0 +1,220 @@
+// sendwindow.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+	_ "time/tzdata" // time zones also on hosts without a zoneinfo database
+)
+
+// deferredRetry is how long a deferred message waits after a failed send
+const deferredRetry = 5 * time.Minute
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// sendWindow is a send_windows entry with its times parsed
+type sendWindow struct {
+	SendWindowConfig
+	loc        *time.Location
+	start, end int // minutes after midnight
+	days       map[time.Weekday]bool
+}
+
+// newSendWindows parses the configured send windows
+func newSendWindows(list []SendWindowConfig) ([]sendWindow, error) {
+	windows := make([]sendWindow, 0, len(list))
+	for i, wc := range list {
+		w := sendWindow{SendWindowConfig: wc, loc: time.Local, days: make(map[time.Weekday]bool)}
+		if wc.Timezone != "" {
+			loc, err := time.LoadLocation(wc.Timezone)
+			if err != nil {
+				return nil, fmt.Errorf("send window %d: invalid timezone %q", i+1, wc.Timezone)
+			}
+			w.loc = loc
+		}
+
+		var err error
+		if w.start, err = parseClock(wc.Start); err != nil {
+			return nil, fmt.Errorf("send window %d: invalid start: %v", i+1, err)
+		}
+		if w.end, err = parseClock(wc.End); err != nil {
+			return nil, fmt.Errorf("send window %d: invalid end: %v", i+1, err)
+		}
+
+		if len(wc.Days) == 0 {
+			for _, d := range weekdays {
+				w.days[d] = true
+			}
+		}
+		for _, name := range wc.Days {
+			d, ok := weekdays[strings.ToLower(strings.TrimSpace(name))]
+			if !ok {
+				return nil, fmt.Errorf("send window %d: invalid day %q", i+1, name)
+			}
+			w.days[d] = true
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// parseClock parses "HH:MM" into minutes after midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// open reports whether the window is open at t. A window ending before it
+// starts runs overnight and belongs to the day it starts on; one ending
+// when it starts lasts the whole day.
+func (w sendWindow) open(t time.Time) bool {
+	lt := t.In(w.loc)
+	m := lt.Hour()*60 + lt.Minute()
+	switch {
+	case w.start < w.end:
+		return w.days[lt.Weekday()] && m >= w.start && m < w.end
+	case w.start > w.end:
+		yesterday := lt.AddDate(0, 0, -1).Weekday()
+		return (w.days[lt.Weekday()] && m >= w.start) || (w.days[yesterday] && m < w.end)
+	}
+	return w.days[lt.Weekday()]
+}
+
+// next returns when the window opens next after t
+func (w sendWindow) next(t time.Time) time.Time {
+	lt := t.In(w.loc)
+	for i := 0; i <= 7; i++ {
+		d := lt.AddDate(0, 0, i)
+		start := time.Date(d.Year(), d.Month(), d.Day(), w.start/60, w.start%60, 0, 0, w.loc)
+		if w.start == w.end {
+			start = time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, w.loc)
+		}
+		if start.After(t) && w.days[start.Weekday()] {
+			return start
+		}
+	}
+	return t
+}
+
+// deferredUntil returns when mail from the sender may be sent, or the
+// zero time when it may be sent now. The first window listing the sender
+// applies.
+func (bkd *Backend) deferredUntil(from string, now time.Time) time.Time {
+	for _, w := range bkd.policy().sendWindows {
+		for _, pattern := range w.Senders {
+			if !matchAddress(pattern, from) {
+				continue
+			}
+			if w.open(now) {
+				return time.Time{}
+			}
+			return w.next(now)
+		}
+	}
+	return time.Time{}
+}
+
+// defaultMaxDelay bounds the send time a message may ask for unless
+// send_windows.max_delay is set
+const defaultMaxDelay = 7 * 24 * time.Hour
+
+// parseSendAt reads the time of X-GoGraph-Send-At, RFC 3339 or an RFC 5322
+// date
+func parseSendAt(value string) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, true
+	}
+	t, err := mail.ParseDate(value)
+	return t, err == nil
+}
+
+// scheduleAllowed reports whether a message may wait until t
+func (bkd *Backend) scheduleAllowed(t time.Time) bool {
+	limit := bkd.policy().config.SendWindows.MaxDelay
+	if limit <= 0 {
+		limit = defaultMaxDelay
+	}
+	return t.Before(time.Now().Add(limit))
+}
+
+// heldUntil returns when the message may be sent, or the zero time when
+// it may be sent now, with the reason it waits: the time it was scheduled
+// for by a control header or send_windows.default_delay, moved on to the
+// sender's next send window, else the sender's send window
+func (s *Session) heldUntil(now time.Time) (time.Time, string) {
+	at := s.control.sendAt
+	if at.IsZero() {
+		if d := s.backend.policy().config.SendWindows.DefaultDelay; d > 0 {
+			at = now.Add(d)
+		}
+	}
+	if at.After(now) {
+		if window := s.backend.deferredUntil(s.from, at); !window.IsZero() {
+			at = window
+		}
+		return at, "scheduled"
+	}
+	return s.backend.deferredUntil(s.from, now), "outside send window"
+}
+
+// sweepDeferred sends deferred messages once their send window opens or
+// their scheduled time comes, run by the deferred_sweep task. A claim in the shared store keeps
+// replicas sharing the directory from sending a message twice; after a
+// failure the message is tried again deferredRetry later, or on ETRN.
+func (bkd *Backend) sweepDeferred(ctx context.Context) error {
+	entries, err := bkd.deferred.list()
+	if err != nil {
+		return fmt.Errorf("listing deferred messages: %v", err)
+	}
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if time.Now().Before(entry.NotBefore) {
+			continue
+		}
+		bkd.sendDeferred(entry)
+	}
+	return nil
+}
+
+func (bkd *Backend) sendDeferred(entry spoolEntry) {
+	ctx, cancel := context.WithTimeout(context.Background(), bkd.policy().config.graphTimeout(0))
+	defer cancel()
+
+	claim := "deferred:" + entry.ID
+	claimed, err := bkd.store.SetNX(ctx, claim, 5*time.Minute)
+	if err != nil || !claimed {
+		return
+	}
+	defer bkd.store.Del(context.Background(), claim)
+
+	// Another replica may have sent it or counted a failure meanwhile
+	current, data, err := bkd.deferred.get(entry.ID)
+	if err != nil || current.Attempts != entry.Attempts {
+		return
+	}
+	entry = current
+	if err := bkd.sendSpooled(ctx, entry, data); err != nil {
+		bkd.logger.Error("deferred delivery failed", "deferred", entry.ID, "from", entry.From, "errormsg", err)
+		entry.Attempts++
+		entry.NotBefore = time.Now().Add(deferredRetry)
+		if err := bkd.deferred.update(entry); err != nil {
+			bkd.logger.Error("failed to record attempt", "deferred", entry.ID, "errormsg", err)
+		}
+		return
+	}
+	bkd.logger.Info("message sent", "deferred", entry.ID, "from", entry.From, "host", bkd.tenant(entry.From).cloud.host(), "recipients", strings.Join(entry.To, ","), "status", "sent")
+	if err := bkd.deferred.remove(entry.ID); err != nil {
+		bkd.logger.Error("sent, but failed to remove", "deferred", entry.ID, "errormsg", err)
+	}
+}
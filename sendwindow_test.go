@@ -0,0 +1,49 @@
+// sendwindow_test.go
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDeferredMessageIsRendered(t *testing.T) {
+	var config Config
+	config.Templates.Directory = alertTemplates(t)
+	config.Content.SanitizeHTML = true
+	config.SendWindows.DefaultDelay = time.Hour
+
+	bkd := newTestBackend(t, config)
+	graph := &fakeGraph{status: http.StatusAccepted}
+	bkd.tenants = []*graphTenant{newFakeTenant(t, graph)}
+	bkd.history = newDeliveryHistory(config)
+	bkd.labels = newMetricLabels(config)
+	deferred, err := newSpoolStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newSpoolStore: %v", err)
+	}
+	bkd.deferred = deferred
+
+	var listener ListenerConfig
+	listener.MaxMessageBytes = 1 << 20
+	listener.Footer.Text = "Sent by the monitoring relay"
+	if err := relayMessage(t, bkd, listener, "app@example.com", []string{"ops@example.com"}, alertMessage); err != nil {
+		t.Fatalf("submission: %v, want the message deferred", err)
+	}
+	entries, err := deferred.list()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("send_windows.directory holds %d messages (%v), want 1", len(entries), err)
+	}
+	entry, data, err := deferred.get(entries[0].ID)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	checkRendered(t, data)
+
+	// Once due, the stored message is what goes out
+	if err := bkd.sendSpooled(context.Background(), entry, data); err != nil {
+		t.Fatalf("sendSpooled: %v", err)
+	}
+	checkRendered(t, sentMIME(t, graph))
+}
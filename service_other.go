@@ -0,0 +1,23 @@
+//go:build !windows
+
+// service_other.go
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+)
+
+// startService does nothing outside Windows
+func startService(config Config, stop chan<- os.Signal) (ready, stopped func(), err error) {
+	return func() {}, func() {}, nil
+}
+
+func newEventLogHandler() slog.Handler {
+	return nil
+}
+
+func runServiceCommand(opts cliOptions, args []string) error {
+	return errors.New("the service command is only available on Windows")
+}
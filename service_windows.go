@@ -0,0 +1,269 @@
+//go:build windows
+
+// service_windows.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const (
+	// serviceName names the Windows service and its event log source
+	serviceName = "GoGraphSMTP"
+	// serviceEventID is the event ID of the relay's event log entries
+	serviceEventID = 1
+	// serviceStopWait bounds how long service stop waits for the relay
+	serviceStopWait = 2 * time.Minute
+)
+
+// eventLog is the event log source while the relay runs as a service
+var eventLog *eventlog.Log
+
+// windowsService answers the service manager: it reports the relay
+// running once ready is closed, and a stop request stops it like SIGTERM
+type windowsService struct {
+	stop     chan<- os.Signal
+	waitHint time.Duration
+	ready    chan struct{}
+	done     chan struct{}
+}
+
+func (ws *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	ready := ws.ready
+	for {
+		select {
+		case <-ready:
+			status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+			ready = nil
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32(ws.waitHint.Milliseconds())}
+				select {
+				case ws.stop <- syscall.SIGTERM:
+				default:
+				}
+			}
+		case <-ws.done:
+			return false, 0
+		}
+	}
+}
+
+// startService connects to the service manager when it started the
+// relay, and sends the relay's log output to the event log. ready reports
+// the relay running; stopped reports it stopped once it shut down.
+func startService(config Config, stop chan<- os.Signal) (ready, stopped func(), err error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return func() {}, func() {}, err
+	}
+	if eventLog, err = eventlog.Open(serviceName); err != nil {
+		return nil, nil, fmt.Errorf("failed to open event log: %v", err)
+	}
+	// The event log records the time
+	log.SetFlags(0)
+	log.SetOutput(eventLogWriter{})
+
+	waitHint := config.SMTP.ShutdownTimeout
+	if waitHint <= 0 {
+		waitHint = defaultShutdownTimeout
+	}
+	ws := &windowsService{stop: stop, waitHint: waitHint + 10*time.Second, ready: make(chan struct{}), done: make(chan struct{})}
+	finished := make(chan struct{})
+	go func() {
+		if err := svc.Run(serviceName, ws); err != nil {
+			eventLog.Error(serviceEventID, fmt.Sprintf("service failed: %v", err))
+		}
+		close(finished)
+	}()
+	var once sync.Once
+	ready = func() { once.Do(func() { close(ws.ready) }) }
+	stopped = func() {
+		close(ws.done)
+		<-finished
+	}
+	return ready, stopped, nil
+}
+
+// eventLogWriter writes the lines of the standard logger, the relay's
+// startup messages and fatal errors, to the event log
+type eventLogWriter struct{}
+
+func (eventLogWriter) Write(p []byte) (int, error) {
+	return len(p), eventLog.Info(serviceEventID, strings.TrimSpace(string(p)))
+}
+
+// newEventLogHandler returns the handler that copies warnings and errors
+// of the relay's log to the event log, or nil when not running as a
+// service
+func newEventLogHandler() slog.Handler {
+	if eventLog == nil {
+		return nil
+	}
+	return &eventLogHandler{}
+}
+
+// eventLogHandler formats records like the text log. The attributes and
+// groups added to it are replayed on a text handler for every record.
+type eventLogHandler struct {
+	with []func(slog.Handler) slog.Handler
+}
+
+func (h *eventLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelWarn
+}
+
+func (h *eventLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	var b strings.Builder
+	var text slog.Handler = slog.NewTextHandler(&b, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	for _, with := range h.with {
+		text = with(text)
+	}
+	if err := text.Handle(ctx, r); err != nil {
+		return err
+	}
+	if r.Level >= slog.LevelError {
+		return eventLog.Error(serviceEventID, strings.TrimSpace(b.String()))
+	}
+	return eventLog.Warning(serviceEventID, strings.TrimSpace(b.String()))
+}
+
+func (h *eventLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &eventLogHandler{with: append(slices.Clip(h.with), func(t slog.Handler) slog.Handler { return t.WithAttrs(attrs) })}
+}
+
+func (h *eventLogHandler) WithGroup(name string) slog.Handler {
+	return &eventLogHandler{with: append(slices.Clip(h.with), func(t slog.Handler) slog.Handler { return t.WithGroup(name) })}
+}
+
+// runServiceCommand installs, uninstalls, starts or stops the Windows
+// service
+func runServiceCommand(opts cliOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: service install|uninstall|start|stop")
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager: %v", err)
+	}
+	defer m.Disconnect()
+
+	switch args[0] {
+	case "install":
+		return installService(m, opts)
+	case "uninstall":
+		s, err := m.OpenService(serviceName)
+		if err != nil {
+			return fmt.Errorf("service %s isn't installed: %v", serviceName, err)
+		}
+		defer s.Close()
+		if err := s.Delete(); err != nil {
+			return fmt.Errorf("failed to remove service: %v", err)
+		}
+		if err := eventlog.Remove(serviceName); err != nil {
+			return fmt.Errorf("failed to remove event log source: %v", err)
+		}
+		fmt.Printf("Service %s removed\n", serviceName)
+	case "start":
+		s, err := m.OpenService(serviceName)
+		if err != nil {
+			return fmt.Errorf("service %s isn't installed: %v", serviceName, err)
+		}
+		defer s.Close()
+		if err := s.Start(); err != nil {
+			return fmt.Errorf("failed to start service: %v", err)
+		}
+		fmt.Printf("Service %s started\n", serviceName)
+	case "stop":
+		s, err := m.OpenService(serviceName)
+		if err != nil {
+			return fmt.Errorf("service %s isn't installed: %v", serviceName, err)
+		}
+		defer s.Close()
+		status, err := s.Control(svc.Stop)
+		if err != nil {
+			return fmt.Errorf("failed to stop service: %v", err)
+		}
+		deadline := time.Now().Add(serviceStopWait)
+		for status.State != svc.Stopped {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("service %s didn't stop within %s", serviceName, serviceStopWait)
+			}
+			time.Sleep(500 * time.Millisecond)
+			if status, err = s.Query(); err != nil {
+				return fmt.Errorf("failed to query service: %v", err)
+			}
+		}
+		fmt.Printf("Service %s stopped\n", serviceName)
+	default:
+		return fmt.Errorf("usage: service install|uninstall|start|stop")
+	}
+	return nil
+}
+
+// installService registers the relay as an automatically started service
+// running with the given config file and flags, restarted when it fails
+func installService(m *mgr.Mgr, opts cliOptions) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the relay's executable: %v", err)
+	}
+	// The service starts in the system directory
+	config, err := filepath.Abs(opts.config)
+	if err != nil {
+		return err
+	}
+	args := []string{"-config", config}
+	if opts.logLevel != "" {
+		args = append(args, "-log-level", opts.logLevel)
+	}
+	if opts.listen != "" {
+		args = append(args, "-listen", opts.listen)
+	}
+
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "GoGraphSMTP relay",
+		Description: "SMTP relay that sends mail through Microsoft Graph",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return fmt.Errorf("failed to create service: %v", err)
+	}
+	defer s.Close()
+	// Restart after 10 seconds, like Restart=always of the systemd unit
+	if err := s.SetRecoveryActions([]mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: 10 * time.Second}}, uint32((24 * time.Hour).Seconds())); err != nil {
+		s.Delete()
+		return fmt.Errorf("failed to set service recovery: %v", err)
+	}
+	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("failed to register event log source: %v", err)
+	}
+	fmt.Printf("Service %s installed with config %s\n", serviceName, config)
+	return nil
+}
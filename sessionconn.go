@@ -0,0 +1,1011 @@
+// sessionconn.go
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// connLimits are the per-connection abuse defenses applied by sessionConn
+type connLimits struct {
+	MaxErrors    int     // protocol errors before disconnecting, 0 disables
+	CommandRate  float64 // sustained commands per second, 0 disables
+	CommandBurst int     // commands accepted back to back before throttling
+
+	IdleTimeout        time.Duration // max wait for the next command
+	DataTimeout        time.Duration // max duration of the DATA/BDAT transfer
+	MaxSessionDuration time.Duration // max connection lifetime, 0 disables
+}
+
+// newConnLimits reads the connection limits from the smtp config section
+// and the listener
+func newConnLimits(config Config, lc ListenerConfig) connLimits {
+	limits := connLimits{
+		MaxErrors:          config.SMTP.MaxErrors,
+		CommandRate:        config.SMTP.CommandRate,
+		CommandBurst:       config.SMTP.CommandBurst,
+		IdleTimeout:        lc.IdleTimeout,
+		DataTimeout:        lc.DataTimeout,
+		MaxSessionDuration: lc.MaxSessionDuration,
+	}
+	if limits.CommandBurst <= 0 {
+		limits.CommandBurst = 20
+	}
+	return limits
+}
+
+// Input states of the client side of the dialogue
+const (
+	inputCommand = iota // reading command lines
+	inputData           // message content until <CRLF>.<CRLF>
+	inputChunk          // raw BDAT chunk bytes
+)
+
+// maxPendingLine bounds how much of an unterminated command line is held
+// back; anything longer is passed on so go-smtp rejects it as too long
+const maxPendingLine = 4096
+
+// sessionConn sits between the listener and go-smtp and sees the plaintext
+// SMTP dialogue in both directions. go-smtp has no hooks for unknown
+// commands or raw replies, so connection-level policy lives here. TLS is
+// terminated here as well, below the dialogue, so STARTTLS is answered
+// here too and go-smtp always sees plaintext.
+type sessionConn struct {
+	net.Conn
+	limits    connLimits
+	replies   replyCatalog
+	logger    *slog.Logger
+	etrn      func(client, arg string) string // answers ETRN, nil when not offered
+	vrfy      func(client, arg string) string // answers VRFY, nil to leave it to go-smtp
+	tlsConfig *tls.Config                     // offers STARTTLS, nil when not offered
+	keepHello bool                            // the EHLO from before STARTTLS stays valid
+	sessions  *sessionTracker                 // ends the session on shutdown, nil when not tracked
+	admit     func() string                   // checks the client once its address is known, nil when done
+	sizeLimit int64                           // advertised with SIZE, 0 for the listener's
+	listener  string                          // name of the listener that accepted it
+
+	buf     []byte
+	raw     []byte // client bytes not yet processed
+	pending []byte // processed bytes ready for go-smtp
+	readErr error
+	held    bool // raw starts with a command answered here, waiting for go-smtp to catch up
+	state   int
+	dotLine int   // 1 at the start of a content line, 2 after a leading ".", 3 at the start of one after a bare CR or LF
+	prevCR  bool  // the last content byte was a CR, not yet passed on
+	chunk   int64 // remaining BDAT chunk bytes
+
+	tokens   float64
+	lastTick time.Time
+
+	started   time.Time
+	dataStart time.Time
+
+	mu       sync.Mutex
+	inflight []string // commands still waiting for their reply, in order
+	greeted  bool
+	helloed  bool // EHLO or HELO succeeded
+	authed   bool // AUTH succeeded
+	tlsOn    bool // the connection is encrypted
+	rehello  bool // STARTTLS succeeded, and the client hasn't sent EHLO since
+	sasl     bool // AUTH is waiting for the client's response line
+	inTx     bool // a MAIL transaction was started and not finished
+	bareEOL  bool // the current message had bare CR or LF line endings
+	quit     bool
+	ended    bool
+	partial  []byte // unterminated reply line written by go-smtp
+	errors   int
+	closed   bool
+}
+
+func newSessionConn(c net.Conn, limits connLimits, replies replyCatalog, logger *slog.Logger) *sessionConn {
+	return &sessionConn{
+		Conn:     c,
+		limits:   limits,
+		replies:  replies,
+		logger:   logger,
+		buf:      make([]byte, 4096),
+		tokens:   float64(limits.CommandBurst),
+		lastTick: time.Now(),
+		started:  time.Now(),
+	}
+}
+
+// setTimeouts replaces the idle and DATA timeouts for the rest of the
+// session; zero keeps the listener's value
+func (c *sessionConn) setTimeouts(idle, data time.Duration) {
+	if idle > 0 {
+		c.limits.IdleTimeout = idle
+	}
+	if data > 0 {
+		c.limits.DataTimeout = data
+	}
+}
+
+func (c *sessionConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.isClosed() {
+			return 0, io.EOF
+		}
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		if c.held {
+			c.held = false
+			c.process()
+			continue
+		}
+
+		timeout := c.setDeadline()
+		n, err := c.Conn.Read(c.buf)
+		// A PROXY header has been read by now
+		if !c.checkAdmission() {
+			return 0, io.EOF
+		}
+		if n > 0 {
+			c.raw = append(c.raw, c.buf[:n]...)
+			c.process()
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			c.abort(timeout+" timeout", "421 4.4.2 "+c.replies.text(timeout+"_timeout"))
+			return 0, io.EOF
+		}
+		if err != nil {
+			// Hand over whatever is left before reporting the error
+			c.pending = append(c.pending, c.raw...)
+			c.raw = nil
+			c.readErr = err
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// setDeadline arms the read deadline for the current phase of the
+// dialogue and returns which limit it enforces
+func (c *sessionConn) setDeadline() string {
+	c.mu.Lock()
+	state, dataStart := c.state, c.dataStart
+	c.mu.Unlock()
+
+	now := time.Now()
+	reason, deadline := "idle", now.Add(c.limits.IdleTimeout)
+	if (state == inputData || state == inputChunk) && c.limits.DataTimeout > 0 {
+		if end := dataStart.Add(c.limits.DataTimeout); end.Before(deadline) {
+			reason, deadline = "data", end
+		}
+	}
+	if c.limits.MaxSessionDuration > 0 {
+		if end := c.started.Add(c.limits.MaxSessionDuration); end.Before(deadline) {
+			reason, deadline = "session", end
+		}
+	}
+
+	c.Conn.SetReadDeadline(deadline)
+	return reason
+}
+
+// process moves complete units of client input from raw to pending,
+// looking at every command line on the way
+func (c *sessionConn) process() {
+	for len(c.raw) > 0 {
+		c.mu.Lock()
+		state := c.state
+		c.mu.Unlock()
+
+		switch state {
+		case inputData:
+			n := c.copyData(c.raw)
+			c.raw = c.raw[n:]
+		case inputChunk:
+			n := int64(len(c.raw))
+			if n > c.chunk {
+				n = c.chunk
+			}
+			c.pending = append(c.pending, c.raw[:n]...)
+			c.raw = c.raw[n:]
+			c.chunk -= n
+			if c.chunk == 0 {
+				c.setState(inputCommand)
+			}
+		default:
+			i := bytes.IndexByte(c.raw, '\n')
+			if i < 0 {
+				if len(c.raw) > maxPendingLine {
+					c.pending = append(c.pending, c.raw...)
+					c.raw = nil
+				}
+				return
+			}
+			line := c.raw[:i+1]
+			if c.offersTLS() && isVerb(line, "STARTTLS") {
+				if len(c.pending) > 0 {
+					c.held = true
+					return
+				}
+				c.raw = c.raw[i+1:]
+				c.startTLS(line)
+				continue
+			}
+			if c.etrn != nil && isVerb(line, "ETRN") {
+				// go-smtp must have answered every command before it, so
+				// the reply goes out in order
+				if len(c.pending) > 0 {
+					c.held = true
+					return
+				}
+				c.raw = c.raw[i+1:]
+				c.answerETRN(line)
+				continue
+			}
+			if c.awaitingHello() && (isVerb(line, "MAIL") || isVerb(line, "RCPT") || isVerb(line, "AUTH")) {
+				// go-smtp still has the EHLO from before STARTTLS; a
+				// pipelined EHLO is answered first
+				if len(c.pending) > 0 {
+					c.held = true
+					return
+				}
+				c.raw = c.raw[i+1:]
+				c.throttle()
+				c.refuse("503 5.5.1 Send EHLO again after STARTTLS")
+				continue
+			}
+			if c.vrfy != nil && isVerb(line, "VRFY") {
+				if len(c.pending) > 0 {
+					c.held = true
+					return
+				}
+				c.raw = c.raw[i+1:]
+				c.answerVRFY(line)
+				continue
+			}
+			if reply := c.badCommand(line); reply != "" {
+				// go-smtp would count it towards its own limit of 3
+				// errors, which ends the session before max_errors
+				if len(c.pending) > 0 {
+					c.held = true
+					return
+				}
+				c.raw = c.raw[i+1:]
+				c.throttle()
+				c.refuse(reply)
+				continue
+			}
+			c.raw = c.raw[i+1:]
+			c.command(line)
+			c.pending = append(c.pending, line...)
+		}
+	}
+}
+
+// command inspects a client command line before go-smtp sees it
+func (c *sessionConn) command(line []byte) {
+	verb, arg, _ := strings.Cut(strings.TrimRight(string(line), "\r\n"), " ")
+	verb = strings.ToUpper(verb)
+
+	c.throttle()
+
+	switch verb {
+	case "RSET", "NOOP", "QUIT":
+		recordSessionEvent(strings.ToLower(verb), clientIP(c.RemoteAddr()))
+	case "BDAT":
+		fields := strings.Fields(arg)
+		if len(fields) > 1 && strings.EqualFold(fields[len(fields)-1], "LAST") {
+			// The reply to the last chunk ends the transaction like "."
+			verb = "BDAT LAST"
+		}
+	}
+
+	c.mu.Lock()
+	c.inflight = append(c.inflight, verb)
+	if verb == "QUIT" {
+		c.quit = true
+	}
+	c.mu.Unlock()
+
+	switch verb {
+	case "BDAT", "BDAT LAST":
+		fields := strings.Fields(arg)
+		if len(fields) > 0 {
+			if size, err := strconv.ParseInt(fields[0], 10, 64); err == nil && size > 0 {
+				c.chunk = size
+				c.setState(inputChunk)
+				c.mu.Lock()
+				if c.dataStart.IsZero() {
+					c.dataStart = time.Now()
+				}
+				c.mu.Unlock()
+			}
+		}
+	}
+}
+
+// badCommand returns the reply to a command line go-smtp would refuse as
+// malformed or unknown, or "" to pass it on. Lines are parsed the way
+// go-smtp does: a four-letter verb, alone or followed by a space. With
+// max_errors off, go-smtp answers them itself.
+func (c *sessionConn) badCommand(line []byte) string {
+	if c.limits.MaxErrors <= 0 || c.inSASL() {
+		return ""
+	}
+	s := strings.TrimRight(string(line), "\r\n")
+	switch {
+	case len(s) >= 8 && strings.EqualFold(s[:8], "STARTTLS"):
+		return ""
+	case s == "":
+		return "500 5.5.2 " + c.replies.text("unknown_command")
+	case len(s) < 4 || len(s) == 5 || len(s) > 5 && s[4] != ' ':
+		return "501 5.5.2 " + c.replies.text("bad_command")
+	}
+	switch strings.ToUpper(s[:4]) {
+	case "HELO", "EHLO", "LHLO", "MAIL", "RCPT", "DATA", "BDAT", "RSET", "NOOP", "QUIT", "VRFY", "AUTH",
+		"SEND", "SOML", "SAML", "EXPN", "HELP", "TURN":
+		return ""
+	}
+	return "500 5.5.2 " + c.replies.text("unknown_command")
+}
+
+// inSASL reports whether the next line is a SASL response rather than a
+// command
+func (c *sessionConn) inSASL() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sasl
+}
+
+// isVerb reports whether a command line is the command verb
+func isVerb(line []byte, verb string) bool {
+	v, _, _ := strings.Cut(strings.TrimRight(string(line), "\r\n"), " ")
+	return strings.EqualFold(v, verb)
+}
+
+// offersTLS reports whether STARTTLS is available on the connection
+func (c *sessionConn) offersTLS() bool {
+	return c.tlsConfig != nil && !c.tlsActive()
+}
+
+// tlsActive reports whether the connection is encrypted
+func (c *sessionConn) tlsActive() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tlsOn
+}
+
+// awaitingHello reports whether the client has to send EHLO again after
+// STARTTLS before MAIL, RCPT or AUTH (RFC 3207, section 4.2), unless the
+// listener has ehlo_after_starttls: optional
+func (c *sessionConn) awaitingHello() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rehello
+}
+
+// tlsState returns the state of the TLS connection, once there is one
+func (c *sessionConn) tlsState() (tls.ConnectionState, bool) {
+	tc, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	return tc.ConnectionState(), true
+}
+
+// authenticateCertificate returns the identity of the client certificate
+// verified in the TLS handshake, if any, and counts the connection as
+// authenticated by it
+func (c *sessionConn) authenticateCertificate() string {
+	tc, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	state := tc.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return ""
+	}
+	identity := certificateIdentity(state.VerifiedChains[0][0])
+	if identity != "" {
+		c.mu.Lock()
+		c.authed = true
+		c.mu.Unlock()
+	}
+	return identity
+}
+
+// startTLS answers STARTTLS (RFC 3207) and replaces the connection with a
+// TLS server connection on top of it. The client has to send EHLO again,
+// see awaitingHello.
+func (c *sessionConn) startTLS(line []byte) {
+	c.throttle()
+
+	_, arg, _ := strings.Cut(strings.TrimRight(string(line), "\r\n"), " ")
+	c.mu.Lock()
+	helloed, inTx, authed := c.helloed, c.inTx, c.authed
+	c.mu.Unlock()
+
+	var reply string
+	switch {
+	case !helloed:
+		reply = "503 5.5.1 Send EHLO first"
+	case inTx || authed:
+		reply = "503 5.5.1 STARTTLS is only allowed before AUTH and MAIL"
+	case strings.TrimSpace(arg) != "":
+		reply = "501 5.5.4 Syntax: STARTTLS"
+	}
+	if reply != "" {
+		c.refuse(reply)
+		return
+	}
+
+	// Commands pipelined after STARTTLS are dropped, they could have been
+	// injected before the handshake
+	c.raw = nil
+	c.Conn.Write([]byte("220 2.0.0 Ready to start TLS\r\n"))
+	tc := tls.Server(c.Conn, c.tlsConfig)
+	tc.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		c.logger.Warn("TLS handshake failed", "client", clientIP(c.RemoteAddr()), "errormsg", err)
+		c.mu.Lock()
+		c.closed = true
+		c.mu.Unlock()
+		c.Conn.Close()
+		return
+	}
+	tc.SetDeadline(time.Time{})
+
+	state := tc.ConnectionState()
+	c.Conn = tc
+	c.mu.Lock()
+	c.tlsOn = true
+	c.rehello = !c.keepHello
+	c.helloed = c.keepHello
+	c.mu.Unlock()
+	c.logger.Info("TLS started", "client", clientIP(c.RemoteAddr()), "status", "starttls", "version", tls.VersionName(state.Version), "cipher", tls.CipherSuiteName(state.CipherSuite))
+}
+
+// answerETRN replies to ETRN, which go-smtp doesn't know, without passing
+// it on
+func (c *sessionConn) answerETRN(line []byte) {
+	c.throttle()
+
+	_, arg, _ := strings.Cut(strings.TrimRight(string(line), "\r\n"), " ")
+	arg = strings.TrimSpace(arg)
+	c.mu.Lock()
+	helloed, inTx := c.helloed, c.inTx
+	c.mu.Unlock()
+
+	var reply string
+	switch {
+	case !helloed:
+		reply = "503 5.5.1 Send EHLO first"
+	case inTx:
+		reply = "503 5.5.1 ETRN is not allowed during a mail transaction"
+	case arg == "" || strings.ContainsAny(arg, " \t"):
+		reply = "501 5.5.4 Syntax: ETRN <domain>"
+	default:
+		c.Conn.Write([]byte(c.etrn(clientIP(c.RemoteAddr()), arg) + "\r\n"))
+		return
+	}
+	c.refuse(reply)
+}
+
+// answerVRFY replies to VRFY from the directory instead of go-smtp, which
+// always answers 252
+func (c *sessionConn) answerVRFY(line []byte) {
+	c.throttle()
+
+	_, arg, _ := strings.Cut(strings.TrimRight(string(line), "\r\n"), " ")
+	if arg = strings.TrimSpace(arg); arg == "" {
+		c.refuse("501 5.5.4 Syntax: VRFY <address>")
+		return
+	}
+	c.Conn.Write([]byte(c.vrfy(clientIP(c.RemoteAddr()), arg) + "\r\n"))
+}
+
+// throttle delays commands once the client exceeds its command rate, so
+// bursts are slowed down instead of hammering the backend
+func (c *sessionConn) throttle() {
+	if c.limits.CommandRate <= 0 {
+		return
+	}
+
+	now := time.Now()
+	c.tokens += now.Sub(c.lastTick).Seconds() * c.limits.CommandRate
+	if max := float64(c.limits.CommandBurst); c.tokens > max {
+		c.tokens = max
+	}
+	c.lastTick = now
+
+	if c.tokens < 1 {
+		wait := time.Duration((1 - c.tokens) / c.limits.CommandRate * float64(time.Second))
+		time.Sleep(wait)
+		c.tokens = 1
+		c.lastTick = time.Now()
+	}
+	c.tokens--
+}
+
+// copyData moves message content from b to pending and returns how many
+// bytes were consumed. Only <CRLF>.<CRLF> ends the data: bare CR and LF
+// line endings are rewritten to CRLF inside the content, and a "." line
+// after one of them is dot-stuffed, so go-smtp keeps it as content. A
+// client can't end the data early with "\n.\n" and smuggle a second
+// message past the first one's checks.
+func (c *sessionConn) copyData(b []byte) int {
+	for i, ch := range b {
+		if c.prevCR {
+			c.prevCR = false
+			if ch == '\n' {
+				if c.endLine() {
+					return i + 1
+				}
+				continue
+			}
+			c.bareLine()
+		}
+
+		switch ch {
+		case '\r':
+			// Held back until the next byte tells CRLF from a bare CR
+			c.prevCR = true
+		case '\n':
+			c.bareLine()
+		case '.':
+			switch c.dotLine {
+			case 1:
+				c.dotLine = 2
+			case 3:
+				c.pending = append(c.pending, '.')
+				c.dotLine = 0
+			default:
+				c.dotLine = 0
+			}
+			c.pending = append(c.pending, ch)
+		default:
+			c.pending = append(c.pending, ch)
+			c.dotLine = 0
+		}
+	}
+	return len(b)
+}
+
+// endLine is called at every CRLF of the content and reports whether it
+// terminated the "." line that ends the data
+func (c *sessionConn) endLine() bool {
+	c.pending = append(c.pending, '\r', '\n')
+	if c.dotLine == 2 {
+		// The end of data is answered like a command
+		c.mu.Lock()
+		c.inflight = append(c.inflight, ".")
+		c.mu.Unlock()
+		c.setState(inputCommand)
+		return true
+	}
+	c.dotLine = 1
+	return false
+}
+
+// bareLine ends a content line at a bare CR or LF. A "." alone on the line
+// is stuffed, and so is a "." starting the next one, since neither ends
+// the data.
+func (c *sessionConn) bareLine() {
+	c.markBareEOL()
+	if c.dotLine == 2 {
+		c.pending = append(c.pending, '.')
+	}
+	c.pending = append(c.pending, '\r', '\n')
+	c.dotLine = 3
+}
+
+func (c *sessionConn) markBareEOL() {
+	c.mu.Lock()
+	c.bareEOL = true
+	c.mu.Unlock()
+}
+
+// bareLineEndings reports whether the last message content contained bare
+// CR or LF line endings that were rewritten
+func (c *sessionConn) bareLineEndings() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bareEOL
+}
+
+func (c *sessionConn) setState(state int) {
+	c.mu.Lock()
+	c.state = state
+	if state == inputCommand {
+		c.dataStart = time.Time{}
+	}
+	c.mu.Unlock()
+}
+
+func (c *sessionConn) Write(b []byte) (int, error) {
+	if c.isClosed() {
+		return len(b), nil
+	}
+
+	if greeting := c.greeting(b); greeting != nil {
+		// A connection without the PROXY header its listener requires
+		// is dropped without a word
+		if err := requiredProxyHeader(c.Conn); err != nil {
+			c.mu.Lock()
+			c.closed, c.ended = true, true
+			c.mu.Unlock()
+			c.Conn.Close()
+			return len(b), nil
+		}
+		if !awaitingProxyHeader(c.Conn) && !c.checkAdmission() {
+			return len(b), nil
+		}
+		if _, err := c.Conn.Write(greeting); err != nil {
+			return 0, err
+		}
+		c.observe(greeting)
+		return len(b), nil
+	}
+	if ehlo := c.advertise(b); ehlo != nil {
+		if _, err := c.Conn.Write(ehlo); err != nil {
+			return 0, err
+		}
+		c.observe(ehlo)
+		return len(b), nil
+	}
+
+	n, err := c.Conn.Write(b)
+	c.observe(b[:n])
+	return n, err
+}
+
+// checkAdmission runs the admission check of the session once and ends
+// the session with the refusing reply. It reports whether the session
+// may go on.
+func (c *sessionConn) checkAdmission() bool {
+	c.mu.Lock()
+	admit := c.admit
+	c.admit = nil
+	c.mu.Unlock()
+	if admit == nil {
+		return true
+	}
+	if reply := admit(); reply != "" {
+		// Refused connections are counted apart from dropped ones
+		c.mu.Lock()
+		c.ended = true
+		c.mu.Unlock()
+		c.abort("refused", reply)
+		return false
+	}
+	return true
+}
+
+// greeting rewrites go-smtp's fixed greeting with the configured text. The
+// hostname stays first as RFC 5321 requires.
+func (c *sessionConn) greeting(b []byte) []byte {
+	c.mu.Lock()
+	greeted := c.greeted
+	c.mu.Unlock()
+	if greeted || !bytes.HasPrefix(b, []byte("220 ")) || !bytes.HasSuffix(b, []byte("\r\n")) {
+		return nil
+	}
+
+	fields := strings.Fields(string(b[4:]))
+	if len(fields) == 0 {
+		return nil
+	}
+	text := c.replies.text("greeting")
+	// go-smtp names the protocol next, LMTP on LMTP listeners
+	if len(fields) > 1 && fields[1] == "LMTP" {
+		text = strings.Replace(text, "ESMTP", "LMTP", 1)
+	}
+	return []byte("220 " + fields[0] + " " + text + "\r\n")
+}
+
+// setMessageLimit sets the message size limit advertised with SIZE. go-smtp
+// advertises the largest limit of the listener, which a client override
+// may lower.
+func (c *sessionConn) setMessageLimit(n int64) {
+	c.mu.Lock()
+	c.sizeLimit = n
+	c.mu.Unlock()
+}
+
+// advertise adds the commands answered here, STARTTLS and ETRN, to the
+// EHLO keywords, before the last line of the reply so the hostname stays
+// first. The SIZE keyword gets the session's own limit.
+func (c *sessionConn) advertise(b []byte) []byte {
+	if size := c.advertisedSize(b); size != nil {
+		return size
+	}
+	var extra []byte
+	if c.offersTLS() {
+		extra = append(extra, "250-STARTTLS\r\n"...)
+	}
+	if c.etrn != nil {
+		extra = append(extra, "250-ETRN\r\n"...)
+	}
+	if extra == nil || !bytes.HasPrefix(b, []byte("250 ")) {
+		return nil
+	}
+	c.mu.Lock()
+	ehlo := len(c.inflight) > 0 && (c.inflight[0] == "EHLO" || c.inflight[0] == "LHLO")
+	c.mu.Unlock()
+	if !ehlo {
+		return nil
+	}
+	return append(extra, b...)
+}
+
+// advertisedSize rewrites the SIZE line of the EHLO reply, or returns nil
+func (c *sessionConn) advertisedSize(b []byte) []byte {
+	if !bytes.HasPrefix(b, []byte("250-SIZE ")) && !bytes.HasPrefix(b, []byte("250 SIZE ")) {
+		return nil
+	}
+	c.mu.Lock()
+	ehlo := len(c.inflight) > 0 && (c.inflight[0] == "EHLO" || c.inflight[0] == "LHLO")
+	size := c.sizeLimit
+	c.mu.Unlock()
+	if !ehlo || size <= 0 {
+		return nil
+	}
+	return fmt.Appendf(b[:4:4], "SIZE %d\r\n", size)
+}
+
+// observe looks at every final reply line go-smtp sends
+func (c *sessionConn) observe(b []byte) {
+	c.mu.Lock()
+	c.partial = append(c.partial, b...)
+	var codes []int
+	for {
+		i := bytes.IndexByte(c.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := c.partial[:i]
+		c.partial = c.partial[i+1:]
+		if len(line) < 4 || line[3] != ' ' {
+			continue
+		}
+		if code, err := strconv.Atoi(string(line[:3])); err == nil {
+			codes = append(codes, code)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, code := range codes {
+		c.reply(code)
+	}
+}
+
+func (c *sessionConn) reply(code int) {
+	c.mu.Lock()
+	// Match the reply to its command; with PIPELINING several commands
+	// may be outstanding. The greeting answers no command.
+	verb := ""
+	if !c.greeted {
+		c.greeted = true
+	} else if len(c.inflight) > 0 {
+		verb = c.inflight[0]
+		c.inflight = c.inflight[1:]
+	}
+	if verb == "DATA" && code == 354 {
+		c.state = inputData
+		c.dotLine = 1
+		c.prevCR = false
+		c.bareEOL = false
+		c.dataStart = time.Now()
+	}
+	aborted := false
+	switch verb {
+	case "MAIL":
+		c.inTx = code/100 == 2
+	case ".", "BDAT LAST":
+		c.inTx = false
+	case "RSET", "HELO", "EHLO", "LHLO":
+		aborted = c.inTx
+		c.inTx = false
+	}
+	switch verb {
+	case "HELO", "EHLO", "LHLO":
+		c.helloed = code == 250
+		if c.helloed {
+			c.rehello = false
+		}
+	}
+	// The verb is the last SASL response line here, not AUTH
+	if code == 235 {
+		c.authed = true
+	}
+	c.sasl = code == 334
+
+	// 500-504 are syntax errors, unknown commands and bad sequences
+	if code >= 500 && code <= 504 {
+		c.errors++
+	}
+	errors := c.errors
+	idle := !c.inTx && !c.quit && len(c.inflight) == 0
+	c.mu.Unlock()
+
+	if aborted {
+		recordSessionEvent("aborted_transaction", clientIP(c.RemoteAddr()))
+	}
+
+	c.checkErrors(errors)
+	// A shutdown waited for the transaction to finish
+	if idle && c.sessions != nil && c.sessions.isDraining() {
+		c.abort("shutting down", "421 4.3.2 "+c.replies.text("shutting_down"))
+	}
+}
+
+// refuse answers a command here with a syntax or sequence error, which
+// counts towards max_errors like go-smtp's
+func (c *sessionConn) refuse(reply string) {
+	c.Conn.Write([]byte(reply + "\r\n"))
+	c.mu.Lock()
+	c.errors++
+	errors := c.errors
+	c.mu.Unlock()
+	c.checkErrors(errors)
+}
+
+// checkErrors ends the session once the client made more than max_errors
+// errors
+func (c *sessionConn) checkErrors(errors int) {
+	if c.limits.MaxErrors > 0 && errors > c.limits.MaxErrors {
+		c.abort(fmt.Sprintf("too many errors (%d)", errors), "421 4.7.0 "+c.replies.text("too_many_errors"))
+	}
+}
+
+// endIfIdle ends the session with 421 unless a transaction or command is
+// open; those end with their last reply
+func (c *sessionConn) endIfIdle() {
+	c.mu.Lock()
+	idle := c.greeted && !c.inTx && !c.quit && len(c.inflight) == 0
+	c.mu.Unlock()
+	if idle {
+		c.abort("shutting down", "421 4.3.2 "+c.replies.text("shutting_down"))
+	}
+}
+
+// abort sends a final 421 and drops the connection. go-smtp keeps running
+// until its next read, which then sees EOF.
+func (c *sessionConn) abort(reason, reply string) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	c.mu.Unlock()
+
+	c.logger.Info("disconnected", "client", clientIP(c.RemoteAddr()), "status", "disconnected", "reason", reason)
+	c.Conn.Write([]byte(reply + "\r\n"))
+	c.Conn.Close()
+}
+
+// Close records how the session ended before closing the connection
+func (c *sessionConn) Close() error {
+	c.mu.Lock()
+	ended, inTx, quit := c.ended, c.inTx, c.quit
+	c.ended = true
+	c.mu.Unlock()
+
+	if !ended {
+		ip := clientIP(c.RemoteAddr())
+		if inTx {
+			recordSessionEvent("aborted_transaction", ip)
+		}
+		if !quit {
+			recordSessionEvent("dropped_connection", ip)
+			c.logger.Info("connection dropped", "client", ip, "status", "dropped", "in_transaction", inTx)
+		}
+		if c.sessions != nil {
+			c.sessions.remove(c)
+		}
+	}
+	return c.Conn.Close()
+}
+
+func (c *sessionConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// sessionConnOf finds the sessionConn under a connection handed out by
+// go-smtp, which may have been wrapped by STARTTLS
+func sessionConnOf(c net.Conn) *sessionConn {
+	for {
+		switch v := c.(type) {
+		case *sessionConn:
+			return v
+		case *tls.Conn:
+			c = v.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// sessionListener wraps every accepted connection in a sessionConn
+type sessionListener struct {
+	net.Listener
+	name   string
+	limits connLimits
+	// networks are the listener's own allowed clients, if any
+	networks []*net.IPNet
+	replies  replyCatalog
+	logger   *slog.Logger
+	backend  *Backend
+
+	tlsConfig   *tls.Config // STARTTLS, or implicit TLS with implicitTLS
+	implicitTLS bool
+	keepHello   bool // ehlo_after_starttls: optional
+}
+
+func (l *sessionListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if l.implicitTLS {
+		// The handshake runs with the greeting; its reads are bounded here
+		// until the first command read sets the idle deadline
+		c.SetReadDeadline(time.Now().Add(tlsHandshakeTimeout))
+		c = tls.Server(c, l.tlsConfig)
+	}
+	sc := newSessionConn(c, l.limits, l.replies, l.logger)
+	sc.listener = l.name
+	if l.implicitTLS {
+		sc.tlsOn = true
+	} else {
+		sc.tlsConfig = l.tlsConfig
+		sc.keepHello = l.keepHello
+	}
+	if l.backend != nil {
+		sc.sessions = l.backend.sessions
+		sc.admit = func() string {
+			return l.admit(sc)
+		}
+	}
+	return sc, nil
+}
+
+// admit checks a new connection against networks and the connection
+// limits, and adds it to the open sessions with ETRN and VRFY where the
+// client may use them. It returns the reply that refuses the connection, or "".
+func (l *sessionListener) admit(sc *sessionConn) string {
+	ip := clientIP(sc.RemoteAddr())
+	p := l.backend.policy()
+	name, code := "", ""
+	switch {
+	case len(p.networks) > 0 && !containsIP(p.networks, addrIP(sc.RemoteAddr())),
+		len(l.networks) > 0 && !containsIP(l.networks, addrIP(sc.RemoteAddr())):
+		name, code = "network_denied", "554 5.7.1 "
+	default:
+		name = l.backend.sessions.admit(sc, ip, p.config.SMTP.MaxConnections, p.config.SMTP.MaxConnectionsPerIP)
+		code = "421 4.3.2 "
+		if name == "too_many_connections_ip" {
+			code = "421 4.7.0 "
+		}
+	}
+	if name == "" {
+		if l.backend.etrnAllowed(addrIP(sc.RemoteAddr())) {
+			sc.etrn = l.backend.etrn
+		}
+		if l.backend.vrfyAllowed(addrIP(sc.RemoteAddr())) {
+			sc.vrfy = l.backend.vrfy
+		}
+		return ""
+	}
+	recordSessionEvent("refused_connection", ip)
+	l.logger.Warn("connection refused", "client", ip, "status", name)
+	return code + l.replies.text(name, "client", ip)
+}
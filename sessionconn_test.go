@@ -0,0 +1,436 @@
+// sessionconn_test.go
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// copyContent runs in through copyData as the content of one DATA command
+// and returns how much of it was consumed and the bytes handed to go-smtp
+func copyContent(in string) (int, string) {
+	c := &sessionConn{state: inputData, dotLine: 1}
+	n := c.copyData([]byte(in))
+	return n, string(c.pending)
+}
+
+func TestCopyDataBareLFDotDoesNotEndData(t *testing.T) {
+	in := "Subject: a\r\n\r\nhello\n.\nMAIL FROM:<evil@example.com>\r\nRCPT TO:<victim@example.com>\r\n.\r\n"
+	n, pending := copyContent(in)
+	if n != len(in) {
+		t.Fatalf("consumed %d of %d bytes, data ended early", n, len(in))
+	}
+	// The "." line is stuffed, so go-smtp reads it back as content
+	want := "Subject: a\r\n\r\nhello\r\n..\r\nMAIL FROM:<evil@example.com>\r\nRCPT TO:<victim@example.com>\r\n.\r\n"
+	if pending != want {
+		t.Errorf("pending = %q, want %q", pending, want)
+	}
+}
+
+func TestCopyDataLineEndings(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		ended   bool
+		bareEOL bool
+	}{
+		{"crlf", "a\r\nb\r\n.\r\n", "a\r\nb\r\n.\r\n", true, false},
+		{"mixed", "a\r\nb\nc\rd\r\n.\r\n", "a\r\nb\r\nc\r\nd\r\n.\r\n", true, true},
+		{"bare cr before dot", "a\r.\r\nb\r\n.\r\n", "a\r\n..\r\nb\r\n.\r\n", true, true},
+		{"bare cr dot", "a\r\n.\rb\r\n.\r\n", "a\r\n..\r\nb\r\n.\r\n", true, true},
+		{"bare lf dot line", "a\n.\n", "a\r\n..\r\n", false, true},
+		{"bare lf before dot", "a\n.\r\n", "a\r\n..\r\n", false, true},
+		{"dot text after bare lf", "a\n.b\r\n.\r\n", "a\r\n..b\r\n.\r\n", true, true},
+		{"stuffed dot", "..\r\n.\r\n", "..\r\n.\r\n", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &sessionConn{state: inputData, dotLine: 1}
+			n := c.copyData([]byte(tt.in))
+			if got := string(c.pending); got != tt.want {
+				t.Errorf("pending = %q, want %q", got, tt.want)
+			}
+			if ended := c.state == inputCommand; ended != tt.ended || ended && n != len(tt.in) {
+				t.Errorf("ended = %v after %d of %d bytes, want %v", ended, n, len(tt.in), tt.ended)
+			}
+			if c.bareLineEndings() != tt.bareEOL {
+				t.Errorf("bare line endings = %v, want %v", c.bareLineEndings(), tt.bareEOL)
+			}
+		})
+	}
+}
+
+func TestCopyDataSplitReads(t *testing.T) {
+	// A CR at the end of one read is only passed on once the next read
+	// shows whether it starts a CRLF
+	c := &sessionConn{state: inputData, dotLine: 1}
+	for _, b := range []string{"a\r", "\n.\r", "\n"} {
+		c.copyData([]byte(b))
+	}
+	if got := string(c.pending); got != "a\r\n.\r\n" || c.state != inputCommand {
+		t.Errorf("pending = %q, state = %d; want the data ended", got, c.state)
+	}
+}
+
+// unstuff removes the leading "." of every line, as go-smtp's reader of
+// the content does
+func unstuff(b []byte) []byte {
+	lines := bytes.SplitAfter(b, []byte("\r\n"))
+	for i, line := range lines {
+		lines[i] = bytes.TrimPrefix(line, []byte("."))
+	}
+	return bytes.Join(lines, nil)
+}
+
+// contentOf returns the message content a client sent as in, complete
+// lines before the end of data: every line ending becomes CRLF, and a
+// leading "." is the client's dot-stuffing only on a line after a CRLF,
+// and not alone on it
+func contentOf(in []byte) []byte {
+	var content []byte
+	afterCRLF := true
+	for len(in) > 0 {
+		i := bytes.IndexAny(in, "\r\n")
+		line, eol := in[:i], 1
+		if in[i] == '\r' && i+1 < len(in) && in[i+1] == '\n' {
+			eol = 2
+		}
+		if afterCRLF && len(line) > 1 && line[0] == '.' {
+			line = line[1:]
+		}
+		content = append(append(content, line...), "\r\n"...)
+		afterCRLF = eol == 2
+		in = in[i+eol:]
+	}
+	return content
+}
+
+func FuzzCopyData(f *testing.F) {
+	for _, seed := range []string{"a\r\nb", "a\n.\nMAIL FROM:<x@example.com>", "a\r.\r\nb", "..", ".", "", "a\r", "\r\n.\n.\r.", ".\r\n.\r\n"} {
+		f.Add([]byte(seed), uint(1))
+	}
+	f.Fuzz(func(t *testing.T, content []byte, split uint) {
+		in := append(bytes.Clone(content), "\r\n.\r\n"...)
+		// The data starts after the CRLF of the DATA command, and ends
+		// after the first <CRLF>.<CRLF>
+		end := bytes.Index(append([]byte("\r\n"), in...), []byte("\r\n.\r\n")) + 3
+
+		c := &sessionConn{state: inputData, dotLine: 1}
+		at := int(split % uint(len(in)+1))
+		n := 0
+		for _, read := range [][]byte{in[:at], in[at:]} {
+			if c.state != inputData {
+				break
+			}
+			n += c.copyData(read)
+		}
+		if c.state != inputCommand || n != end {
+			t.Fatalf("data ended = %v after %d bytes of %q, want it ended after %d", c.state == inputCommand, n, in, end)
+		}
+
+		pending := c.pending
+		if bytes.Count(pending, []byte("\r")) != bytes.Count(pending, []byte("\r\n")) || bytes.Count(pending, []byte("\n")) != bytes.Count(pending, []byte("\r\n")) {
+			t.Fatalf("pending %q has bare CR or LF", pending)
+		}
+		if !bytes.HasSuffix(pending, []byte(".\r\n")) {
+			t.Fatalf("pending %q doesn't end the data", pending)
+		}
+		if got, want := unstuff(pending[:len(pending)-3]), contentOf(in[:end-3]); !bytes.Equal(got, want) {
+			t.Fatalf("content %q reads back as %q, want %q", in[:end], got, want)
+		}
+	})
+}
+
+func TestSetDeadlineData(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	limits := connLimits{IdleTimeout: defaultIdleTimeout, DataTimeout: defaultDataTimeout}
+
+	tests := []struct {
+		name    string
+		started time.Duration // how long ago DATA started
+		want    string
+	}{
+		{"progressing transfer waits idle_timeout per read", time.Minute, "idle"},
+		{"whole transfer bounded by data_timeout", defaultDataTimeout - time.Second, "data"},
+	}
+	for _, tt := range tests {
+		c := &sessionConn{Conn: server, limits: limits, state: inputData, dataStart: time.Now().Add(-tt.started)}
+		if got := c.setDeadline(); got != tt.want {
+			t.Errorf("%s: deadline enforces %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// testTLSConfig returns a server configuration with a self-signed
+// certificate
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"relay.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// dialSession serves bkd on the loopback interface through a
+// sessionListener offering STARTTLS and returns the connection of a client
+// that read the greeting
+func dialSession(t *testing.T, bkd *Backend, listener ListenerConfig) (net.Conn, *textproto.Conn) {
+	t.Helper()
+	server := smtp.NewServer(bkd)
+	server.Domain = "relay.test"
+	server.AllowInsecureAuth = true
+	bkd.listeners = map[*smtp.Server]ListenerConfig{server: listener}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	limits := newConnLimits(bkd.policy().config, listener)
+	limits.IdleTimeout, limits.DataTimeout = defaultIdleTimeout, defaultDataTimeout
+	go server.Serve(&sessionListener{Listener: l, limits: limits, replies: bkd.replies, logger: bkd.logger, tlsConfig: testTLSConfig(t), keepHello: listener.EHLOAfterSTARTTLS == "optional"})
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := textproto.NewConn(conn)
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("greeting: %v", err)
+	}
+	return conn, c
+}
+
+// command sends a command line and returns the code of its reply
+func command(t *testing.T, c *textproto.Conn, line string) int {
+	t.Helper()
+	if err := c.PrintfLine("%s", line); err != nil {
+		t.Fatalf("%s: %v", line, err)
+	}
+	code, _, err := c.ReadResponse(0)
+	if _, ok := err.(*textproto.Error); err != nil && !ok {
+		t.Fatalf("%s: %v", line, err)
+	}
+	return code
+}
+
+// startTLS runs STARTTLS over conn and returns the client over TLS
+func startTLS(t *testing.T, conn net.Conn, c *textproto.Conn) *textproto.Conn {
+	t.Helper()
+	if code := command(t, c, "STARTTLS"); code != 220 {
+		t.Fatalf("STARTTLS: %d, want 220", code)
+	}
+	tc := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tc.Handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	return textproto.NewConn(tc)
+}
+
+func TestStartTLSRequiresNewEHLO(t *testing.T) {
+	bkd := newTestBackend(t, Config{})
+	bkd.history = newDeliveryHistory(Config{})
+	bkd.labels = newMetricLabels(Config{})
+	conn, c := dialSession(t, bkd, ListenerConfig{})
+
+	if code := command(t, c, "EHLO client.test"); code != 250 {
+		t.Fatalf("EHLO: %d, want 250", code)
+	}
+	c = startTLS(t, conn, c)
+	for _, line := range []string{"MAIL FROM:<app@example.com>", "RCPT TO:<ops@example.com>", "AUTH PLAIN AGFwcABzZWNyZXQ="} {
+		if code := command(t, c, line); code != 503 {
+			t.Errorf("%s before EHLO: %d, want 503", line, code)
+		}
+	}
+	if code := command(t, c, "EHLO client.test"); code != 250 {
+		t.Fatalf("EHLO after STARTTLS: %d, want 250", code)
+	}
+	if code := command(t, c, "MAIL FROM:<app@example.com>"); code != 250 {
+		t.Errorf("MAIL after EHLO: %d, want 250", code)
+	}
+}
+
+func TestEHLOAfterSTARTTLSOptional(t *testing.T) {
+	bkd := newTestBackend(t, Config{})
+	bkd.history = newDeliveryHistory(Config{})
+	bkd.labels = newMetricLabels(Config{})
+	conn, c := dialSession(t, bkd, ListenerConfig{EHLOAfterSTARTTLS: "optional"})
+
+	if code := command(t, c, "EHLO client.test"); code != 250 {
+		t.Fatalf("EHLO: %d, want 250", code)
+	}
+	c = startTLS(t, conn, c)
+	if code := command(t, c, "MAIL FROM:<app@example.com>"); code != 250 {
+		t.Errorf("MAIL after STARTTLS: %d, want 250 with the EHLO from before", code)
+	}
+}
+
+func TestUnknownCommandsCountTowardsMaxErrors(t *testing.T) {
+	var config Config
+	config.SMTP.MaxErrors = 5
+	bkd := newTestBackend(t, config)
+	_, c := dialSession(t, bkd, ListenerConfig{})
+
+	if code := command(t, c, "EHLO client.test"); code != 250 {
+		t.Fatalf("EHLO: %d, want 250", code)
+	}
+	// go-smtp alone would hang up after the fourth
+	for _, tt := range []struct {
+		line string
+		want int
+	}{{"FOOB", 500}, {"XYZ", 501}, {"EHLOX client.test", 501}, {"", 500}, {"ETRN example.com", 500}} {
+		if code := command(t, c, tt.line); code != tt.want {
+			t.Errorf("%q: %d, want %d", tt.line, code, tt.want)
+		}
+	}
+	if code := command(t, c, "NOOP"); code != 250 {
+		t.Fatalf("NOOP: %d, want 250", code)
+	}
+	if code := command(t, c, "FOOB"); code != 500 {
+		t.Errorf("sixth error: %d, want 500", code)
+	}
+	if code, _, _ := c.ReadResponse(0); code != 421 {
+		t.Errorf("after the sixth error: %d, want 421", code)
+	}
+}
+
+// connectHook counts the connections its onConnect saw
+type connectHook struct {
+	noopHook
+	calls *atomic.Int32
+}
+
+func (connectHook) hookName() string { return "connect" }
+
+func (h connectHook) onConnect(s *Session) error {
+	h.calls.Add(1)
+	return nil
+}
+
+func TestOnConnectOncePerConnection(t *testing.T) {
+	bkd := newTestBackend(t, Config{})
+	var calls atomic.Int32
+	bkd.hooks = hookChain{connectHook{calls: &calls}}
+	conn, c := dialSession(t, bkd, ListenerConfig{})
+
+	if code := command(t, c, "EHLO client.test"); code != 250 {
+		t.Fatalf("EHLO: %d, want 250", code)
+	}
+	c = startTLS(t, conn, c)
+	if code := command(t, c, "EHLO client.test"); code != 250 {
+		t.Fatalf("EHLO after STARTTLS: %d, want 250", code)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("onConnect ran %d times, want once", n)
+	}
+}
+
+func TestSessionSpanPerConnection(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	saved := tracer
+	tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+	t.Cleanup(func() { tracer = saved })
+
+	bkd := newTestBackend(t, Config{})
+	conn, c := dialSession(t, bkd, ListenerConfig{})
+	if code := command(t, c, "EHLO client.test"); code != 250 {
+		t.Fatalf("EHLO: %d, want 250", code)
+	}
+	c = startTLS(t, conn, c)
+	for _, line := range []string{"EHLO client.test", "EHLO client.test", "QUIT"} {
+		command(t, c, line)
+	}
+
+	// The session is logged out after the reply to QUIT
+	deadline := time.Now().Add(time.Second)
+	for len(recorder.Ended()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if started, ended := len(recorder.Started()), len(recorder.Ended()); started != 1 || ended != 1 {
+		t.Errorf("%d session spans started and %d ended, want one of each", started, ended)
+	}
+}
+
+func TestStartTLSResetsSession(t *testing.T) {
+	client, server := net.Pipe()
+	replies, err := newReplyCatalog(nil)
+	if err != nil {
+		t.Fatalf("newReplyCatalog: %v", err)
+	}
+	sc := newSessionConn(server, connLimits{IdleTimeout: time.Minute}, replies, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	sc.tlsConfig = testTLSConfig(t)
+	defer sc.Close()
+	defer client.Close()
+
+	// go-smtp's side: the greeting and the EHLO reply, then the first
+	// command it gets after STARTTLS
+	next := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 512)
+		sc.Write([]byte("220 relay.test ESMTP Service Ready\r\n"))
+		sc.Read(buf)
+		// go-smtp writes a line at a time
+		sc.Write([]byte("250-relay.test Hello\r\n"))
+		sc.Write([]byte("250 PIPELINING\r\n"))
+		n, _ := sc.Read(buf)
+		next <- string(buf[:n])
+	}()
+
+	c := textproto.NewConn(client)
+	c.ReadResponse(220)
+	c.PrintfLine("EHLO client.test")
+	if _, msg, err := c.ReadResponse(250); err != nil || !strings.Contains(msg, "STARTTLS") {
+		t.Fatalf("EHLO reply %q (%v) doesn't offer STARTTLS", msg, err)
+	}
+	// A command injected behind STARTTLS, before the handshake
+	c.PrintfLine("STARTTLS\r\nMAIL FROM:<evil@example.com>")
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("STARTTLS: %v", err)
+	}
+	tc := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+	if err := tc.Handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	io.WriteString(tc, "EHLO client.test\r\n")
+
+	if got := <-next; got != "EHLO client.test\r\n" {
+		t.Errorf("go-smtp got %q after STARTTLS, want the EHLO sent over TLS", got)
+	}
+	sc.mu.Lock()
+	tlsOn, helloed := sc.tlsOn, sc.helloed
+	sc.mu.Unlock()
+	if !tlsOn || helloed {
+		t.Errorf("after the handshake tls = %v and EHLO done = %v, want TLS on and EHLO required again", tlsOn, helloed)
+	}
+}
@@ -0,0 +1,119 @@
+// shutdown.go
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// defaultShutdownTimeout bounds a graceful shutdown unless
+// smtp.shutdown_timeout is set
+const defaultShutdownTimeout = 30 * time.Second
+
+// errShutdown is the reason recorded for messages spooled at shutdown
+var errShutdown = errors.New("relay shut down before delivery")
+
+// sessionTracker keeps the open SMTP connections with their client IPs,
+// so a shutdown can end the idle ones instead of waiting for their idle
+// timeout, and new connections can be held to the connection limits
+type sessionTracker struct {
+	mu       sync.Mutex
+	conns    map[*sessionConn]string
+	perIP    map[string]int
+	draining bool
+}
+
+func newSessionTracker() *sessionTracker {
+	return &sessionTracker{conns: make(map[*sessionConn]string), perIP: make(map[string]int)}
+}
+
+// admit adds the connection unless the relay is shutting down or it would
+// exceed smtp.max_connections or smtp.max_connections_per_ip, and else
+// returns the name of the reply that refuses it
+func (t *sessionTracker) admit(c *sessionConn, ip string, total, perIP int) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case t.draining:
+		return "shutting_down"
+	case total > 0 && len(t.conns) >= total:
+		return "too_many_connections"
+	case perIP > 0 && t.perIP[ip] >= perIP:
+		return "too_many_connections_ip"
+	}
+	t.conns[c] = ip
+	t.perIP[ip]++
+	return ""
+}
+
+func (t *sessionTracker) remove(c *sessionConn) {
+	t.mu.Lock()
+	if ip, ok := t.conns[c]; ok {
+		delete(t.conns, c)
+		if t.perIP[ip]--; t.perIP[ip] <= 0 {
+			delete(t.perIP, ip)
+		}
+	}
+	t.mu.Unlock()
+}
+
+// isDraining reports whether sessions end after their current transaction
+func (t *sessionTracker) isDraining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+// drain ends the idle sessions with 421; the others end with the reply
+// that finishes their transaction
+func (t *sessionTracker) drain() {
+	t.mu.Lock()
+	t.draining = true
+	conns := make([]*sessionConn, 0, len(t.conns))
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+	t.mu.Unlock()
+
+	for _, c := range conns {
+		c.endIfIdle()
+	}
+}
+
+// shutdown stops the relay on SIGTERM: the listeners close, open
+// transactions may finish and the delivery queue is worked off, all
+// within smtp.shutdown_timeout. Sessions still open then are cut off, and
+// queued messages no worker got to go to the retry spool.
+func (bkd *Backend) shutdown(servers []*smtp.Server) {
+	timeout := bkd.policy().config.SMTP.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	bkd.logger.Info("shutting down", "status", "shutting_down", "timeout", timeout)
+	sdNotify("STOPPING=1")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); errors.Is(err, context.DeadlineExceeded) {
+				bkd.logger.Warn("sessions cut off at shutdown timeout", "listener", bkd.listeners[s].Name, "status", "shutdown_timeout")
+				s.Close()
+			}
+		}()
+	}
+	bkd.sessions.drain()
+	wg.Wait()
+
+	if bkd.workers != nil {
+		bkd.workers.stop(ctx)
+	}
+	bkd.logger.Info("shutdown complete", "status", "stopped")
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+
+// signals_other.go
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleUserSignals reopens the log files on SIGUSR1, after logrotate
+// moved them away, and logs runtime stats on SIGUSR2
+func (bkd *Backend) handleUserSignals() {
+	usr := make(chan os.Signal, 1)
+	signal.Notify(usr, syscall.SIGUSR1, syscall.SIGUSR2)
+	for sig := range usr {
+		switch sig {
+		case syscall.SIGUSR1:
+			bkd.reopenLogs()
+		case syscall.SIGUSR2:
+			bkd.logStats()
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build windows
+
+// signals_windows.go
+package main
+
+// handleUserSignals does nothing on Windows, which has no SIGUSR1 and
+// SIGUSR2
+func (bkd *Backend) handleUserSignals() {}
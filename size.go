@@ -0,0 +1,60 @@
+// size.go
+package main
+
+import (
+	"strconv"
+
+	"github.com/emersion/go-smtp"
+)
+
+const (
+	// defaultTenantMaxMessageBytes is the message size limit of Exchange
+	// Online mailboxes unless an admin changed it, and of a tenant without
+	// max_message_bytes
+	defaultTenantMaxMessageBytes = 35 << 20
+	// maxMIMERequestBytes is the largest sendMail request Graph takes, in
+	// which a MIME message travels base64 encoded
+	maxMIMERequestBytes = 4 << 20
+)
+
+// base64Size is the length of n bytes in base64
+func base64Size(n int) int {
+	return (n + 2) / 3 * 4
+}
+
+// graphPayloadBytes projects the size of the message Graph builds from
+// the body and the attachments, which it stores base64 encoded
+func graphPayloadBytes(body string, attachments []mimeAttachment) int {
+	size := len(body)
+	for _, a := range attachments {
+		size += base64Size(len(a.data))
+	}
+	return size
+}
+
+// maxMessageBytes returns the tenant's message size limit
+func (t *graphTenant) maxMessageBytes() int {
+	if t.maxBytes > 0 {
+		return int(t.maxBytes)
+	}
+	return defaultTenantMaxMessageBytes
+}
+
+// checkGraphSize refuses a message Graph would refuse for its size, before
+// the client is told it was accepted. size is the projected payload, or
+// with mime the MIME message, which must also fit a single request.
+// Messages routed to direct MX don't go through Graph and aren't checked.
+func (s *Session) checkGraphSize(size int, mime bool) error {
+	if s.control.route == "direct_mx" {
+		return nil
+	}
+	limit := s.backend.tenant(s.from).maxMessageBytes()
+	if mime && base64Size(size) > maxMIMERequestBytes {
+		limit = min(limit, maxMIMERequestBytes/4*3)
+	}
+	if size <= limit {
+		return nil
+	}
+	s.log().Warn("message exceeds the Graph size limit", "client", s.clientIP, "from", s.from, "status", "too_large", "size", size, "limit", limit)
+	return s.backend.replies.error(552, smtp.EnhancedCode{5, 3, 4}, "graph_size_exceeded", "size", strconv.Itoa(size), "limit", strconv.Itoa(limit))
+}
@@ -0,0 +1,79 @@
+// smarthost.go
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// defaultSmarthostTimeout bounds the delivery to the smarthost
+const defaultSmarthostTimeout = 2 * time.Minute
+
+// useSmarthost reports whether a message Graph failed to send goes to the
+// smarthost: when one is configured and Graph refused the message for good
+// or the circuit breaker is open
+func (c Config) useSmarthost(err error) bool {
+	var open breakerOpenError
+	return c.Smarthost.Address != "" && (permanentError(err) || errors.As(err, &open))
+}
+
+// sendSmarthost delivers the message by SMTP through the smarthost, as
+// received without its Bcc header. TLS is required unless smarthost.tls
+// is none, and the client authenticates when a username is set.
+func (bkd *Backend) sendSmarthost(from string, rcpts []string, data []byte) error {
+	sh := bkd.policy().config.Smarthost
+	timeout := sh.Timeout
+	if timeout <= 0 {
+		timeout = defaultSmarthostTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	host, _, err := net.SplitHostPort(sh.Address)
+	if err != nil {
+		return fmt.Errorf("invalid smarthost.address: %v", err)
+	}
+	tlsConfig := &tls.Config{ServerName: host}
+	var conn net.Conn
+	if sh.TLS == "implicit" {
+		conn, err = (&tls.Dialer{Config: tlsConfig}).DialContext(ctx, "tcp", sh.Address)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", sh.Address)
+	}
+	if err != nil {
+		return fmt.Errorf("smarthost: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("smarthost: %v", err)
+	}
+	defer c.Close()
+
+	if err := c.Hello(bkd.policy().config.hostname()); err != nil {
+		return fmt.Errorf("smarthost: %v", err)
+	}
+	if sh.TLS == "" || sh.TLS == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("smarthost %s does not offer STARTTLS", host)
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("smarthost STARTTLS: %v", err)
+		}
+	}
+	if sh.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", sh.Username, sh.Password, host)); err != nil {
+			return fmt.Errorf("smarthost AUTH: %v", err)
+		}
+	}
+	if err := smtpTransaction(c, host, from, rcpts, withoutBcc(data)); err != nil {
+		return fmt.Errorf("smarthost: %v", err)
+	}
+	return nil
+}
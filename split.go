@@ -0,0 +1,82 @@
+// split.go
+package main
+
+import (
+	"net/mail"
+	"strings"
+
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+)
+
+// rejectedRecipients returns the recipients a Graph error names, e.g. the
+// unresolved ones of ErrorInvalidRecipients
+func rejectedRecipients(err error, rcpts []string) []string {
+	text := strings.ToLower(err.Error())
+	var rejected []string
+	for _, rcpt := range rcpts {
+		if strings.Contains(text, strings.ToLower(rcpt)) || strings.Contains(text, strings.ToLower(graphAddress(rcpt))) {
+			rejected = append(rejected, rcpt)
+		}
+	}
+	return rejected
+}
+
+// onlyRecipients returns the addresses that are in rcpts
+func onlyRecipients(addrs, rcpts []string) []string {
+	var kept []string
+	for _, addr := range addrs {
+		for _, rcpt := range rcpts {
+			if sameAddress(addr, rcpt) {
+				kept = append(kept, addr)
+				break
+			}
+		}
+	}
+	return kept
+}
+
+// setBatchRecipients limits the recipients of a Graph message to a batch.
+// to, cc and bcc are the message's recipients without splitting.
+func setBatchRecipients(msg models.Messageable, to, cc, bcc, batch []string, names map[string]string) {
+	msg.SetToRecipients(graphRecipients(onlyRecipients(to, batch), names))
+	msg.SetCcRecipients(graphRecipients(onlyRecipients(cc, batch), names))
+	msg.SetBccRecipients(graphRecipients(onlyRecipients(bcc, batch), names))
+}
+
+// batchMessage returns a raw MIME message for a send to a batch of its
+// recipients. Graph delivers MIME messages to every address in their
+// headers, so To and Cc only keep the batch's own addresses and the rest
+// of the batch goes into Bcc. A nil batch returns the message as it is.
+func batchMessage(data []byte, headers map[string]string, batch []string) []byte {
+	if batch == nil {
+		return data
+	}
+	data = withoutHeaders(data, func(name string) bool {
+		return strings.EqualFold(name, "To") || strings.EqualFold(name, "Cc") || strings.EqualFold(name, "Bcc")
+	})
+
+	var lines strings.Builder
+	var named []string
+	for _, field := range []string{"To", "Cc"} {
+		var kept []string
+		for _, addr := range parseAddressList(headerValue(headers, field)) {
+			if len(onlyRecipients([]string{addr.Address}, batch)) > 0 {
+				kept = append(kept, (&mail.Address{Name: addr.Name, Address: addr.Address}).String())
+				named = append(named, addr.Address)
+			}
+		}
+		if len(kept) > 0 {
+			lines.WriteString(field + ": " + strings.Join(kept, ", ") + "\r\n")
+		}
+	}
+	var rest []string
+	for _, rcpt := range batch {
+		if len(onlyRecipients([]string{rcpt}, named)) == 0 {
+			rest = append(rest, rcpt)
+		}
+	}
+	if len(rest) > 0 {
+		lines.WriteString("Bcc: " + strings.Join(rest, ", ") + "\r\n")
+	}
+	return append([]byte(lines.String()), data...)
+}
@@ -0,0 +1,286 @@
+// spool.go
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+)
+
+// spoolEntry describes a message held back from sending, e.g. in the
+// quarantine; the message itself is stored next to it, as received or, in
+// the retry spool, as it was sent
+type spoolEntry struct {
+	ID        string      `json:"id"`
+	Received  time.Time   `json:"received"`
+	Client    string      `json:"client"`
+	From      string      `json:"from"`
+	To        []string    `json:"to"`
+	Subject   string      `json:"subject"`
+	Reason    string      `json:"reason,omitempty"`
+	NotBefore time.Time   `json:"not_before"`         // deferred until
+	Attempts  int         `json:"attempts,omitempty"` // failed sends so far
+	Callback  string      `json:"callback,omitempty"` // X-GoGraph-Callback-URL
+	DSN       *dsnRequest `json:"dsn,omitempty"`      // NOTIFY, ENVID and RET of the client
+	// Partial is set when To holds only some of the message's recipients,
+	// those of batches that failed while others were sent, or recipients
+	// its headers don't name, the members of an alias
+	Partial bool `json:"partial,omitempty"`
+	// GaveUp is when the retries of a message that failed for good ended
+	// and it went to the quarantine, Reason holding the last error
+	GaveUp time.Time `json:"gave_up,omitempty"`
+	// Requeued is when the message was moved back from the quarantine to
+	// the retry spool; spool.expiry counts from then
+	Requeued time.Time `json:"requeued,omitempty"`
+}
+
+// spoolStore keeps held messages in a directory as <id>.eml with the
+// entry in <id>.json
+type spoolStore struct {
+	dir string
+}
+
+func newSpoolStore(dir string) (*spoolStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory %s: %v", dir, err)
+	}
+	return &spoolStore{dir: dir}, nil
+}
+
+// put stores the message and returns its entry with time and, unless
+// the entry has one, ID set
+func (sp *spoolStore) put(entry spoolEntry, data []byte) (spoolEntry, error) {
+	if entry.ID == "" {
+		id, err := newQueueID()
+		if err != nil {
+			return entry, err
+		}
+		entry.ID = id
+	}
+	entry.Received = time.Now().UTC()
+
+	meta, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return entry, err
+	}
+	// The message goes first so every entry that is listed has one. Both
+	// are on disk before the client is told the message was taken.
+	if err := sp.writeFile(sp.path(entry.ID, ".eml"), data); err != nil {
+		return entry, err
+	}
+	if err := sp.writeFile(sp.path(entry.ID, ".json"), meta); err != nil {
+		os.Remove(sp.path(entry.ID, ".eml"))
+		return entry, err
+	}
+	return entry, syncDir(sp.dir)
+}
+
+// update rewrites the entry of a held message
+func (sp *spoolStore) update(entry spoolEntry) error {
+	if _, err := sp.entry(entry.ID); err != nil {
+		return err
+	}
+	meta, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := sp.writeFile(sp.path(entry.ID, ".json"), meta); err != nil {
+		return err
+	}
+	return syncDir(sp.dir)
+}
+
+// writeFile replaces name with data through a synced temporary file, so
+// a crash leaves either the old file or the whole new one
+func (sp *spoolStore) writeFile(name string, data []byte) error {
+	tmp, err := os.CreateTemp(sp.dir, "."+filepath.Base(name)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// list returns all held messages, oldest first
+func (sp *spoolStore) list() ([]spoolEntry, error) {
+	files, err := filepath.Glob(filepath.Join(sp.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	entries := []spoolEntry{}
+	for _, file := range files {
+		entry, err := sp.entry(strings.TrimSuffix(filepath.Base(file), ".json"))
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Received.Before(entries[j].Received)
+	})
+	return entries, nil
+}
+
+// get returns the entry and the message for id
+func (sp *spoolStore) get(id string) (spoolEntry, []byte, error) {
+	entry, err := sp.entry(id)
+	if err != nil {
+		return entry, nil, err
+	}
+	data, err := os.ReadFile(sp.path(id, ".eml"))
+	return entry, data, err
+}
+
+func (sp *spoolStore) entry(id string) (spoolEntry, error) {
+	var entry spoolEntry
+	if !validSpoolID(id) {
+		return entry, fmt.Errorf("no message %q", id)
+	}
+	meta, err := os.ReadFile(sp.path(id, ".json"))
+	if os.IsNotExist(err) {
+		return entry, fmt.Errorf("no message %q", id)
+	}
+	if err != nil {
+		return entry, err
+	}
+	if err := json.Unmarshal(meta, &entry); err != nil {
+		return entry, fmt.Errorf("invalid spool entry %s: %v", id, err)
+	}
+	return entry, nil
+}
+
+// remove deletes a held message
+func (sp *spoolStore) remove(id string) error {
+	if _, err := sp.entry(id); err != nil {
+		return err
+	}
+	if err := os.Remove(sp.path(id, ".json")); err != nil {
+		return err
+	}
+	return os.Remove(sp.path(id, ".eml"))
+}
+
+func (sp *spoolStore) path(id, ext string) string {
+	return filepath.Join(sp.dir, id+ext)
+}
+
+// validSpoolID keeps IDs from the API and CLI inside the directory
+func validSpoolID(id string) bool {
+	if id == "" {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// sendSpooled sends a held message as it was stored, as MIME to its
+// envelope recipients. A message too large for a MIME request is sent as a
+// Graph message through a draft instead.
+func (bkd *Backend) sendSpooled(ctx context.Context, entry spoolEntry, data []byte) error {
+	header, _, _ := strings.Cut(string(data), "\r\n\r\n")
+	headers := parseHeaders(header)
+	raw := withEnvelopeRecipients(data, headers, entry.To)
+	if entry.Partial {
+		raw = batchMessage(data, headers, entry.To)
+	}
+	start := time.Now()
+	var err error
+	transport, host := "graph", bkd.tenant(entry.From).cloud.host()
+	// Messages queued per route go their route again
+	if routes := bkd.policy().config.recipientBatches(entry.To); len(routes) == 1 && routes[0].transport == "smarthost" {
+		transport, host = "smarthost", bkd.policy().config.Smarthost.Address
+		err = bkd.sendSmarthost(entry.From, entry.To, data)
+	} else if base64Size(len(raw)) > maxMIMERequestBytes {
+		err = bkd.sendSpooledDraft(withQueueID(ctx, entry.ID), entry, headers, data)
+	} else {
+		err = bkd.sendMIME(withQueueID(ctx, entry.ID), entry.From, raw)
+	}
+	if err != nil && transport == "graph" && bkd.policy().config.useSmarthost(err) {
+		bkd.logger.Warn("Graph failed, sending through the smarthost", "spool", entry.ID, "from", entry.From, "host", host, "errormsg", err, "status", "smarthost_fallback")
+		bkd.history.add(entry.ID, deliveryEvent(transport, err))
+		err = bkd.sendSmarthost(entry.From, entry.To, data)
+		transport, host = "smarthost", bkd.policy().config.Smarthost.Address
+	}
+	if err != nil && bkd.policy().config.domain(entry.From).DirectMX {
+		msg := "Graph failed, falling back to direct MX"
+		if transport == "smarthost" {
+			msg = "smarthost failed, falling back to direct MX"
+		}
+		bkd.logger.Warn(msg, "spool", entry.ID, "from", entry.From, "host", host, "errormsg", err, "status", "direct_mx_fallback")
+		bkd.history.add(entry.ID, deliveryEvent(transport, err))
+		err = bkd.sendDirect(entry.From, entry.To, data)
+		transport, host = "direct_mx", "direct_mx"
+	}
+	bkd.history.add(entry.ID, deliveryEvent(transport, err))
+	bkd.recordDelivery(entry.From, start, err)
+	if err != nil {
+		bkd.notifyCallback(entry.Callback, entry.ID, "failed", err.Error())
+		// Wrapped, the retry spool tells permanent Graph errors apart
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	bkd.notifyCallback(entry.Callback, entry.ID, "sent", "")
+	bkd.archive(entry, data, "", host)
+	if bkd.policy().config.journalSeparate() {
+		env := journalEnvelope{client: entry.Client, from: entry.From, recipients: entry.To, subject: entry.Subject}
+		if err := bkd.sendJournal(ctx, env, data); err != nil {
+			bkd.logger.Error("journaling failed", "spool", entry.ID, "from", entry.From, "errormsg", err)
+		}
+	}
+	return nil
+}
+
+// sendSpooledDraft sends a held message as a Graph message to the entry's
+// recipients, its attachments uploaded to a draft
+func (bkd *Backend) sendSpooledDraft(ctx context.Context, entry spoolEntry, headers map[string]string, data []byte) error {
+	parsed, err := parseMIME(data, mimeOptions{})
+	if err != nil {
+		return fmt.Errorf("reading held message: %v", err)
+	}
+	content, isHTML := parsed.body()
+	contentType := models.TEXT_BODYTYPE
+	if isHTML {
+		contentType = models.HTML_BODYTYPE
+	}
+	body := models.NewItemBody()
+	body.SetContent(&content)
+	body.SetContentType(&contentType)
+
+	subject := decodeWords(headerValue(headers, "Subject"))
+	msg := models.NewMessage()
+	msg.SetSubject(&subject)
+	msg.SetBody(body)
+	names := displayNames(headers)
+	to, cc, bcc := splitRecipients(headers, entry.To)
+	if len(to) > 0 {
+		msg.SetToRecipients(graphRecipients(to, names))
+	}
+	if len(cc) > 0 {
+		msg.SetCcRecipients(graphRecipients(cc, names))
+	}
+	if len(bcc) > 0 {
+		msg.SetBccRecipients(graphRecipients(bcc, names))
+	}
+	if id := strings.TrimSpace(headerValue(headers, "Message-ID")); strings.HasPrefix(id, "<") && strings.HasSuffix(id, ">") {
+		msg.SetInternetMessageId(&id)
+	}
+	return bkd.sendDraft(ctx, entry.From, msg, parsed.attachments)
+}
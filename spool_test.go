@@ -0,0 +1,246 @@
+// spool_test.go
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/microsoft/kiota-abstractions-go/authentication"
+	msgraphsdk "github.com/microsoftgraph/msgraph-sdk-go"
+)
+
+// fakeGraph answers Graph requests with status, recording them
+type fakeGraph struct {
+	mu       sync.Mutex
+	status   int
+	requests []fakeRequest
+}
+
+type fakeRequest struct {
+	path string
+	body []byte
+}
+
+func (f *fakeGraph) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		body, _ = io.ReadAll(req.Body)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, fakeRequest{path: req.URL.Path, body: body})
+	return &http.Response{
+		StatusCode: f.status,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader("{}")),
+		Request:    req,
+	}, nil
+}
+
+func (f *fakeGraph) setStatus(status int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status = status
+}
+
+func (f *fakeGraph) last() fakeRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[len(f.requests)-1]
+}
+
+// newFakeTenant returns a tenant whose Graph requests go to f
+func newFakeTenant(t *testing.T, f *fakeGraph) *graphTenant {
+	t.Helper()
+	adapter, err := msgraphsdk.NewGraphRequestAdapterWithParseNodeFactoryAndSerializationWriterFactoryAndHttpClient(
+		&authentication.AnonymousAuthenticationProvider{}, nil, nil, &http.Client{Transport: f})
+	if err != nil {
+		t.Fatalf("creating adapter: %v", err)
+	}
+	cloud := graphClouds["global"]
+	adapter.SetBaseUrl(cloud.baseURL())
+	// The gates register metrics per tenant, so each test has its own
+	name := t.Name()
+	logger := newTestBackend(t, Config{}).logger
+	return &graphTenant{
+		name:     name,
+		client:   msgraphsdk.NewGraphServiceClient(adapter),
+		cloud:    cloud,
+		throttle: newThrottleGate(name, cloud.host(), logger),
+		breaker:  newCircuitBreaker(name, cloud.host(), Config{}, logger),
+	}
+}
+
+// relayMessage submits message to bkd through an SMTP listener on the
+// loopback interface and returns the error of the submission
+func relayMessage(t *testing.T, bkd *Backend, listener ListenerConfig, from string, to []string, message string) error {
+	t.Helper()
+	server := smtp.NewServer(bkd)
+	server.Domain = "relay.test"
+	server.AllowInsecureAuth = true
+	bkd.listeners = map[*smtp.Server]ListenerConfig{server: listener}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go server.Serve(l)
+	defer server.Close()
+
+	c, err := smtp.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	return c.SendMail(from, to, strings.NewReader(message))
+}
+
+// alertTemplates writes the alert template the tests select with
+// X-GoGraph-Template and returns its directory
+func alertTemplates(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"alert.html":    "<p>{{.host}} is down<script>alert(1)</script></p>",
+		"alert.subject": "Alert: {{.host}}",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// alertMessage selects the alert template
+const alertMessage = "From: app@example.com\r\n" +
+	"To: ops@example.com\r\n" +
+	"Subject: ignored\r\n" +
+	"X-GoGraph-Template: alert\r\n" +
+	"Content-Type: application/json\r\n" +
+	"\r\n" +
+	`{"host": "db1"}` + "\r\n"
+
+// checkRendered fails unless raw is the alert message as rendered and
+// sanitized, with the footer
+func checkRendered(t *testing.T, raw []byte) {
+	t.Helper()
+	c, err := parseMIME(raw, mimeOptions{})
+	if err != nil {
+		t.Fatalf("parseMIME: %v", err)
+	}
+	message := string(raw)
+	for _, unwanted := range []string{"X-GoGraph-Template", `"host"`, "<script>", "application/json"} {
+		if strings.Contains(message, unwanted) {
+			t.Errorf("message contains %q:\n%s", unwanted, message)
+		}
+	}
+	if !strings.Contains(message, "Subject: Alert: db1") {
+		t.Errorf("message lacks the template's subject:\n%s", message)
+	}
+	if !strings.Contains(c.html, "db1 is down") || !strings.Contains(c.html, "Sent by the monitoring relay") {
+		t.Errorf("body = %q, want the rendered template with the footer", c.html)
+	}
+}
+
+// sentMIME returns the message of the last sendMail request to graph
+func sentMIME(t *testing.T, graph *fakeGraph) []byte {
+	t.Helper()
+	sent := graph.last()
+	if !strings.HasSuffix(sent.path, "/sendMail") {
+		t.Fatalf("posted to %s, want sendMail", sent.path)
+	}
+	raw, err := base64.StdEncoding.DecodeString(string(sent.body))
+	if err != nil {
+		t.Fatalf("didn't post MIME: %v", err)
+	}
+	return raw
+}
+
+func TestRetrySendsRenderedMessage(t *testing.T) {
+	var config Config
+	config.Templates.Directory = alertTemplates(t)
+	config.Content.SanitizeHTML = true
+
+	bkd := newTestBackend(t, config)
+	graph := &fakeGraph{status: http.StatusServiceUnavailable}
+	bkd.tenants = []*graphTenant{newFakeTenant(t, graph)}
+	bkd.history = newDeliveryHistory(config)
+	bkd.labels = newMetricLabels(config)
+	retry, err := newSpoolStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newSpoolStore: %v", err)
+	}
+	bkd.retry = retry
+
+	var listener ListenerConfig
+	listener.MaxMessageBytes = 1 << 20
+	listener.Footer.Text = "Sent by the monitoring relay"
+	if err := relayMessage(t, bkd, listener, "app@example.com", []string{"ops@example.com"}, alertMessage); err != nil {
+		t.Fatalf("submission: %v, want the message queued", err)
+	}
+	entries, err := retry.list()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("retry spool holds %d messages (%v), want 1", len(entries), err)
+	}
+
+	graph.setStatus(http.StatusAccepted)
+	if err := bkd.sendRetry(entries[0]); err != nil {
+		t.Fatalf("sendRetry: %v", err)
+	}
+	checkRendered(t, sentMIME(t, graph))
+}
+
+func TestCanQueue(t *testing.T) {
+	bkd := newTestBackend(t, Config{})
+	retry, err := newSpoolStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newSpoolStore: %v", err)
+	}
+	bkd.retry = retry
+	if s := (&Session{backend: bkd}); !s.canQueue() {
+		t.Error("canQueue = false, want the message queued")
+	}
+	// Retries would go out with the app's credential
+	if s := (&Session{backend: bkd, userToken: &userToken{user: "user@example.com"}}); s.canQueue() {
+		t.Error("canQueue = true for an XOAUTH2 session, want the error passed to the client")
+	}
+}
+
+func TestSpoolPutWritesThroughTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	sp, err := newSpoolStore(dir)
+	if err != nil {
+		t.Fatalf("newSpoolStore: %v", err)
+	}
+	entry, err := sp.put(spoolEntry{From: "app@example.com"}, []byte("Subject: hi\r\n\r\nhello\r\n"))
+	if err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	entry.Attempts = 1
+	if err := sp.update(entry); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	if want := []string{entry.ID + ".eml", entry.ID + ".json"}; strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Errorf("spool holds %v, want %v", names, want)
+	}
+	got, data, err := sp.get(entry.ID)
+	if err != nil || got.Attempts != 1 || string(data) != "Subject: hi\r\n\r\nhello\r\n" {
+		t.Errorf("get = %+v, %q, %v; want the updated entry and the message", got, data, err)
+	}
+}
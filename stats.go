@@ -0,0 +1,96 @@
+// stats.go
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// logStats writes a snapshot of the relay to the log, for a quick look on
+// hosts without a metrics scraper: sessions, queues and the Graph results
+// and message outcomes since the start
+func (bkd *Backend) logStats() {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	attrs := []any{"sessions", len(bkd.sessions.list()), "listeners", fmt.Sprintf("%d/%d", bkd.listening.Load(), len(bkd.listeners))}
+	for _, q := range []struct {
+		name  string
+		store *spoolStore
+	}{{"retry", bkd.retry}, {"deferred", bkd.deferred}, {"quarantine", bkd.quarantine}} {
+		if q.store == nil {
+			continue
+		}
+		entries, err := q.store.list()
+		if err != nil {
+			attrs = append(attrs, "queue_"+q.name, "error")
+			continue
+		}
+		attrs = append(attrs, "queue_"+q.name, len(entries))
+	}
+	if bkd.workers != nil {
+		attrs = append(attrs, "queue_workers", len(bkd.workers.ready))
+	}
+	if bkd.memory != nil {
+		attrs = append(attrs, "memory_budget_mb", bkd.memory.inUse()>>20)
+	}
+	attrs = append(attrs,
+		"graph_requests", counterTotals("gographsmtp_graph_sendmail_requests_total", "status"),
+		"messages", counterTotals("gographsmtp_messages_total", "result"),
+		"goroutines", runtime.NumGoroutine(),
+		"heap_mb", mem.HeapAlloc>>20)
+	bkd.logger.Info("runtime stats", attrs...)
+}
+
+// counterTotals sums a counter of the default registry by one label, as
+// "value=count" pairs, e.g. "202=120 429=3"
+func counterTotals(name, label string) string {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return "error"
+	}
+	totals := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == label {
+					totals[l.GetValue()] += m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	pairs := make([]string, 0, len(totals))
+	for value, n := range totals {
+		pairs = append(pairs, fmt.Sprintf("%s=%.0f", value, n))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// histogramTotals returns the sum and count of a histogram of the default
+// registry over all its labels
+func histogramTotals(name string) (float64, uint64) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return 0, 0
+	}
+	var sum float64
+	var count uint64
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			sum += m.GetHistogram().GetSampleSum()
+			count += m.GetHistogram().GetSampleCount()
+		}
+	}
+	return sum, count
+}
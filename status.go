@@ -0,0 +1,77 @@
+// status.go
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/textproto"
+
+	"github.com/emersion/go-smtp"
+	abstractions "github.com/microsoft/kiota-abstractions-go"
+)
+
+// statusError turns a failure into a reply with an enhanced status code
+// (RFC 3463) that tells the client whether to retry. Replies pass through;
+// go-smtp would answer anything else with a permanent 554 5.0.0.
+func (bkd *Backend) statusError(err error) error {
+	if err == nil {
+		return nil
+	}
+	// go-smtp's own size error has its text, not the catalog's
+	if errors.Is(err, smtp.ErrDataTooLarge) {
+		limit := bkd.policy().config.SMTP.MaxMessageBytes
+		if limit <= 0 {
+			limit = defaultMaxMessageBytes
+		}
+		var tooLarge messageTooLarge
+		if errors.As(err, &tooLarge) {
+			limit = tooLarge.limit
+		}
+		return bkd.errMessageTooLarge(limit)
+	}
+	var reply *smtp.SMTPError
+	if errors.As(err, &reply) {
+		return reply
+	}
+	var open breakerOpenError
+	var netErr net.Error
+	switch {
+	case throttled(err):
+		return bkd.replies.error(451, smtp.EnhancedCode{4, 4, 5}, "graph_throttled")
+	case errors.As(err, &open):
+		return bkd.replies.error(451, smtp.EnhancedCode{4, 4, 1}, "graph_unavailable")
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return bkd.replies.error(451, smtp.EnhancedCode{4, 4, 2}, "graph_timeout")
+	}
+
+	var apiErr abstractions.ApiErrorable
+	if errors.As(err, &apiErr) {
+		switch code := apiErr.GetStatusCode(); {
+		case code == 401 || code == 403:
+			return bkd.replies.error(550, smtp.EnhancedCode{5, 7, 1}, "graph_denied")
+		case code == 404:
+			return bkd.replies.error(550, smtp.EnhancedCode{5, 1, 8}, "graph_mailbox_unknown")
+		case code == 413:
+			return bkd.replies.error(552, smtp.EnhancedCode{5, 2, 3}, "graph_too_large")
+		case code == 408:
+			return bkd.replies.error(451, smtp.EnhancedCode{4, 4, 2}, "graph_timeout")
+		case code >= 400 && code < 500:
+			return bkd.replies.error(554, smtp.EnhancedCode{5, 6, 0}, "graph_rejected")
+		}
+		return bkd.replies.error(451, smtp.EnhancedCode{4, 4, 0}, "delivery_deferred")
+	}
+
+	// Smarthost and direct MX replies keep their class
+	var remote *textproto.Error
+	if errors.As(err, &remote) {
+		if remote.Code >= 500 {
+			return bkd.replies.error(554, smtp.EnhancedCode{5, 0, 0}, "delivery_rejected")
+		}
+		return bkd.replies.error(451, smtp.EnhancedCode{4, 4, 0}, "delivery_deferred")
+	}
+	if errors.As(err, &netErr) {
+		return bkd.replies.error(451, smtp.EnhancedCode{4, 4, 1}, "graph_unavailable")
+	}
+	return bkd.replies.error(451, smtp.EnhancedCode{4, 3, 0}, "local_error")
+}
@@ -0,0 +1,50 @@
+// status_test.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestStatusErrorTooLarge(t *testing.T) {
+	var config Config
+	config.SMTP.MaxMessageBytes = 2048
+	bkd := newTestBackend(t, config)
+
+	tests := []struct {
+		name  string
+		err   error
+		limit string
+	}{
+		{"declared SIZE in MAIL FROM", messageTooLarge{1024}, "1024"},
+		{"DATA overflow", fmt.Errorf("receiving: %w", messageTooLarge{4096}), "4096"},
+		{"go-smtp size error", smtp.ErrDataTooLarge, "2048"},
+	}
+	for _, tt := range tests {
+		var reply *smtp.SMTPError
+		if !errors.As(bkd.statusError(tt.err), &reply) {
+			t.Fatalf("%s: statusError returned no reply", tt.name)
+		}
+		if reply.Code != 552 || reply.EnhancedCode != (smtp.EnhancedCode{5, 3, 4}) {
+			t.Errorf("%s: reply %d %v, want 552 5.3.4", tt.name, reply.Code, reply.EnhancedCode)
+		}
+		if !strings.Contains(reply.Message, tt.limit) {
+			t.Errorf("%s: reply %q doesn't name the limit %s", tt.name, reply.Message, tt.limit)
+		}
+	}
+}
+
+func TestReceiveTooLarge(t *testing.T) {
+	bkd := newTestBackend(t, Config{})
+	s := &Session{backend: bkd, from: "app@example.com", maxMessageBytes: 16}
+	err := s.receive(strings.NewReader("Subject: too large\r\n\r\nmore than sixteen bytes\r\n"))
+
+	var reply *smtp.SMTPError
+	if !errors.As(bkd.statusError(err), &reply) || reply.Code != 552 || reply.EnhancedCode != (smtp.EnhancedCode{5, 3, 4}) {
+		t.Errorf("receive: %v, want 552 5.3.4", err)
+	}
+}
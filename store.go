@@ -0,0 +1,200 @@
+// store.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// SharedStore holds the state that rate limits and dedup windows are
+// enforced against. The in-memory store is per process; the Redis store
+// is shared by every relay replica pointing at the same Redis.
+type SharedStore interface {
+	// Incr increments the counter at key and returns the new value. The
+	// counter expires window after it was created.
+	Incr(ctx context.Context, key string, window time.Duration) (int64, error)
+	// SetNX sets key if it does not exist yet and reports whether it did
+	SetNX(ctx context.Context, key string, ttl time.Duration) (bool, error)
+	// Get returns the counter at key, 0 when it is not set or expired
+	Get(ctx context.Context, key string) (int64, error)
+	// Exists reports whether key is set and not expired
+	Exists(ctx context.Context, key string) (bool, error)
+	// Del removes key
+	Del(ctx context.Context, key string) error
+	Close() error
+}
+
+// newSharedStore returns a Redis store when one is configured, otherwise
+// an in-memory store
+func newSharedStore(config Config) (SharedStore, error) {
+	if config.Redis.Address == "" {
+		return newMemoryStore(), nil
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     config.Redis.Address,
+		Username: config.Redis.Username,
+		Password: config.Redis.Password,
+		DB:       config.Redis.DB,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to redis at %s: %v", config.Redis.Address, err)
+	}
+
+	prefix := config.Redis.KeyPrefix
+	if prefix == "" {
+		prefix = "gographsmtp:"
+	}
+	return &redisStore{client: client, prefix: prefix}, nil
+}
+
+// redisStore implements SharedStore on top of Redis
+type redisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// incrScript sets the expiry atomically with the first increment so a
+// crashed replica can never leave a counter without a TTL
+var incrScript = redis.NewScript(`
+local v = redis.call("INCR", KEYS[1])
+if v == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return v`)
+
+func (r *redisStore) Incr(ctx context.Context, key string, window time.Duration) (int64, error) {
+	return incrScript.Run(ctx, r.client, []string{r.prefix + key}, window.Milliseconds()).Int64()
+}
+
+func (r *redisStore) SetNX(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	return r.client.SetNX(ctx, r.prefix+key, 1, ttl).Result()
+}
+
+func (r *redisStore) Get(ctx context.Context, key string) (int64, error) {
+	v, err := r.client.Get(ctx, r.prefix+key).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return v, err
+}
+
+func (r *redisStore) Exists(ctx context.Context, key string) (bool, error) {
+	n, err := r.client.Exists(ctx, r.prefix+key).Result()
+	return n > 0, err
+}
+
+func (r *redisStore) Del(ctx context.Context, key string) error {
+	return r.client.Del(ctx, r.prefix+key).Err()
+}
+
+func (r *redisStore) Close() error {
+	return r.client.Close()
+}
+
+// memoryStore implements SharedStore for a single relay instance
+type memoryStore struct {
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+	done    chan struct{}
+}
+
+type memoryEntry struct {
+	value   int64
+	expires time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	m := &memoryStore{
+		entries: make(map[string]*memoryEntry),
+		done:    make(chan struct{}),
+	}
+	go m.sweep()
+	return m
+}
+
+func (m *memoryStore) Incr(_ context.Context, key string, window time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	e, ok := m.entries[key]
+	if !ok || now.After(e.expires) {
+		e = &memoryEntry{expires: now.Add(window)}
+		m.entries[key] = e
+	}
+	e.value++
+	return e.value, nil
+}
+
+func (m *memoryStore) SetNX(_ context.Context, key string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if e, ok := m.entries[key]; ok && now.Before(e.expires) {
+		return false, nil
+	}
+	m.entries[key] = &memoryEntry{value: 1, expires: now.Add(ttl)}
+	return true, nil
+}
+
+func (m *memoryStore) Get(_ context.Context, key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e, ok := m.entries[key]; ok && time.Now().Before(e.expires) {
+		return e.value, nil
+	}
+	return 0, nil
+}
+
+func (m *memoryStore) Exists(_ context.Context, key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entries[key]
+	return ok && time.Now().Before(e.expires), nil
+}
+
+func (m *memoryStore) Del(_ context.Context, key string) error {
+	m.mu.Lock()
+	delete(m.entries, key)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memoryStore) Close() error {
+	close(m.done)
+	return nil
+}
+
+// sweep periodically drops expired entries so the map doesn't grow forever
+func (m *memoryStore) sweep() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case now := <-ticker.C:
+			m.mu.Lock()
+			for key, e := range m.entries {
+				if now.After(e.expires) {
+					delete(m.entries, key)
+				}
+			}
+			m.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+
+// syncdir_other.go
+package main
+
+import "os"
+
+// syncDir makes the files created in or renamed into dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,8 @@
+//go:build windows
+
+// syncdir_windows.go
+package main
+
+// syncDir does nothing on Windows, where directories can't be synced and
+// NTFS journals renames itself
+func syncDir(dir string) error { return nil }
@@ -0,0 +1,163 @@
+// systemd.go
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenFDsStart is the first file descriptor systemd passes sockets in
+const listenFDsStart = 3
+
+// systemdSockets are the listening sockets systemd passed on socket
+// activation, by the FileDescriptorName of their socket unit
+type systemdSockets struct {
+	names     []string
+	listeners []net.Listener
+}
+
+// inheritedSockets returns the sockets of LISTEN_FDS when they are meant
+// for this process, and unsets the variables so they don't reach child
+// processes
+func inheritedSockets() (*systemdSockets, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	sockets := &systemdSockets{}
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return sockets, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return sockets, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < n; i++ {
+		fd := listenFDsStart + i
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		// FileListener dups the descriptor
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %d from systemd isn't a listening socket: %v", fd, err)
+		}
+		sockets.names = append(sockets.names, name)
+		sockets.listeners = append(sockets.listeners, l)
+	}
+	return sockets, nil
+}
+
+// take returns the socket for the listener: the one named like it, or
+// else the one bound to its address
+func (s *systemdSockets) take(lc ListenerConfig) (net.Listener, bool) {
+	for i, l := range s.listeners {
+		if l != nil && s.names[i] == lc.Name {
+			s.listeners[i] = nil
+			return l, true
+		}
+	}
+	for i, l := range s.listeners {
+		if l != nil && sameListenAddress(lc.Address, l.Addr()) {
+			s.listeners[i] = nil
+			return l, true
+		}
+	}
+	return nil, false
+}
+
+// unused closes the sockets no listener took and returns their addresses
+func (s *systemdSockets) unused() []string {
+	var addrs []string
+	for i, l := range s.listeners {
+		if l != nil {
+			addrs = append(addrs, l.Addr().String())
+			l.Close()
+			s.listeners[i] = nil
+		}
+	}
+	return addrs
+}
+
+// sameListenAddress reports whether a socket bound to addr serves the
+// listener address, host:port or unix:/path
+func sameListenAddress(address string, addr net.Addr) bool {
+	if path, ok := strings.CutPrefix(address, unixPrefix); ok {
+		return addr.Network() == "unix" && addr.String() == path
+	}
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || port != strconv.Itoa(tcp.Port) {
+		return false
+	}
+	if host == "" {
+		return tcp.IP.IsUnspecified()
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.Equal(tcp.IP)
+}
+
+// sdNotify sends a state such as READY=1 to systemd, when it started the
+// relay as a Type=notify service
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// Abstract sockets start with @
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to notify systemd: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("failed to notify systemd: %v", err)
+	}
+	return nil
+}
+
+// watchdogInterval returns how often systemd expects WATCHDOG=1, half its
+// WatchdogSec, or 0 when the service has no watchdog
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// notifyWatchdog keeps the systemd watchdog from restarting the relay
+// while every listener is bound. Graph being unreachable doesn't stop it,
+// as a restart wouldn't help.
+func (bkd *Backend) notifyWatchdog(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if int(bkd.listening.Load()) < len(bkd.listeners) {
+			bkd.logger.Warn("skipping watchdog notification, listeners not bound")
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			bkd.logger.Warn("watchdog notification failed", "errormsg", err)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// templates.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/emersion/go-smtp"
+)
+
+// templateVarPrefix marks headers that carry template variables, e.g.
+// "X-GoGraph-Var-OrderID: 42" sets {{.OrderID}}
+const templateVarPrefix = "x-gograph-var-"
+
+// messageTemplate is a named template loaded from the templates directory.
+// The body is <name>.html (html/template) or <name>.txt (text/template),
+// the optional subject is <name>.subject (text/template).
+type messageTemplate struct {
+	html    *htmltemplate.Template
+	text    *texttemplate.Template
+	subject *texttemplate.Template
+}
+
+// loadTemplates parses every template in dir. Errors are reported at
+// startup rather than when the first message selects a broken template.
+func loadTemplates(dir string) (map[string]*messageTemplate, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read templates directory: %v", err)
+	}
+
+	templates := make(map[string]*messageTemplate)
+	get := func(name string) *messageTemplate {
+		if templates[name] == nil {
+			templates[name] = &messageTemplate{}
+		}
+		return templates[name]
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		ext := filepath.Ext(entry.Name())
+		name := strings.TrimSuffix(entry.Name(), ext)
+		path := filepath.Join(dir, entry.Name())
+
+		switch ext {
+		case ".html":
+			t, err := htmltemplate.New(name).Option("missingkey=error").ParseFiles(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse template %s: %v", entry.Name(), err)
+			}
+			get(name).html = t.Lookup(entry.Name())
+		case ".txt", ".subject":
+			t, err := texttemplate.New(name).Option("missingkey=error").ParseFiles(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse template %s: %v", entry.Name(), err)
+			}
+			if ext == ".txt" {
+				get(name).text = t.Lookup(entry.Name())
+			} else {
+				get(name).subject = t.Lookup(entry.Name())
+			}
+		}
+	}
+
+	for name, t := range templates {
+		if t.html == nil && t.text == nil {
+			return nil, fmt.Errorf("template %s has no .html or .txt body", name)
+		}
+	}
+	return templates, nil
+}
+
+// templateVars collects the variables for a template from a JSON body and
+// the X-GoGraph-Var-* headers. Headers win over JSON keys of the same name.
+func templateVars(headers map[string]string, body string) (map[string]any, error) {
+	vars := make(map[string]any)
+
+	ct := strings.ToLower(headerValue(headers, "Content-Type"))
+	if strings.HasPrefix(ct, "application/json") && strings.TrimSpace(body) != "" {
+		if err := json.Unmarshal([]byte(body), &vars); err != nil {
+			return nil, fmt.Errorf("invalid JSON variables: %v", err)
+		}
+	}
+
+	for key, value := range headers {
+		if len(key) > len(templateVarPrefix) && strings.HasPrefix(strings.ToLower(key), templateVarPrefix) {
+			// Header values can only carry non-ASCII text as encoded
+			// words (RFC 2047)
+			vars[key[len(templateVarPrefix):]] = decodeWords(value)
+		}
+	}
+	return vars, nil
+}
+
+// render executes the template and returns the subject, the body and
+// whether the body is HTML. An empty subject means the template has none.
+func (t *messageTemplate) render(vars map[string]any) (string, string, bool, error) {
+	var subject, body bytes.Buffer
+	if t.subject != nil {
+		if err := t.subject.Execute(&subject, vars); err != nil {
+			return "", "", false, err
+		}
+	}
+
+	if t.html != nil {
+		if err := t.html.Execute(&body, vars); err != nil {
+			return "", "", false, err
+		}
+		return strings.TrimSpace(subject.String()), body.String(), true, nil
+	}
+	if err := t.text.Execute(&body, vars); err != nil {
+		return "", "", false, err
+	}
+	return strings.TrimSpace(subject.String()), body.String(), false, nil
+}
+
+// renderTemplate renders the template selected by the client
+func (bkd *Backend) renderTemplate(name string, headers map[string]string, body string) (string, string, bool, error) {
+	t, ok := bkd.policy().templates[name]
+	if !ok {
+		return "", "", false, bkd.replies.error(554, smtp.EnhancedCode{5, 6, 0}, "unknown_template", "template", name)
+	}
+
+	failed := func(err error) error {
+		bkd.logger.Warn("template failed", "template", name, "errormsg", err)
+		return bkd.replies.error(554, smtp.EnhancedCode{5, 6, 0}, "template_failed", "template", name)
+	}
+
+	vars, err := templateVars(headers, body)
+	if err != nil {
+		return "", "", false, failed(err)
+	}
+	subject, rendered, html, err := t.render(vars)
+	if err != nil {
+		return "", "", false, failed(err)
+	}
+	return subject, rendered, html, nil
+}
+
+// headerValue looks up a header by name, ignoring case
+func headerValue(headers map[string]string, name string) string {
+	if v, ok := headers[name]; ok {
+		return v
+	}
+	for key, v := range headers {
+		if strings.EqualFold(key, name) {
+			return v
+		}
+	}
+	return ""
+}
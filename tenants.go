@@ -0,0 +1,187 @@
+// tenants.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	azauth "github.com/microsoft/kiota-authentication-azure-go"
+	khttp "github.com/microsoft/kiota-http-go"
+	msgraphsdk "github.com/microsoftgraph/msgraph-sdk-go"
+	msgraphcore "github.com/microsoftgraph/msgraph-sdk-go-core"
+	"github.com/microsoftgraph/msgraph-sdk-go/users"
+)
+
+// graphTenant is a Microsoft 365 tenant the relay sends through, with its
+// own app registration, Graph client and throttling pause
+type graphTenant struct {
+	name       string
+	domains    []string
+	senders    []string
+	client     *msgraphsdk.GraphServiceClient
+	credential *cachedCredential
+	// cloud holds the Graph endpoint and token scope of the tenant
+	cloud    graphCloud
+	throttle *throttleGate
+	breaker  *circuitBreaker
+	// maxBytes is the tenant's message size limit, max_message_bytes
+	maxBytes int64
+	// me is the signed-in user of auth_method: delegated, who sends all
+	// of the tenant's mail through /me
+	me string
+	// onBehalfOf returns a credential for the user who presented the
+	// token, for AUTH XOAUTH2, cached while the token is valid
+	onBehalfOf func(assertion string) (azcore.TokenCredential, error)
+}
+
+// graphDeps are the parts shared by the Graph clients of all tenants
+type graphDeps struct {
+	config    Config
+	transport *http.Transport
+	logger    *slog.Logger
+	labels    *metricLabels
+	history   *deliveryHistory
+	chaos     bool
+}
+
+func newGraphTenant(azure AzureConfig, deps graphDeps) (*graphTenant, error) {
+	name := azure.tenantName()
+	cred, err := newCredential(azure, deps.transport)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create credential for tenant %s: %v", name, err)
+	}
+
+	var me string
+	if dc, ok := cred.(*delegatedCredential); ok {
+		me = dc.username()
+	}
+
+	// Tokens are cached per tenant and renewed ahead of their expiry
+	cached := newCachedCredential(name, cred, deps.logger)
+	cloud := azure.cloud()
+	auth, err := azauth.NewAzureIdentityAuthenticationProviderWithScopes(cached, []string{cloud.scope()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create graph client for tenant %s: %v", name, err)
+	}
+	// The pacing observer goes last so it sees every retry; the throttle
+	// gate before it holds back retries and new requests alike, and the
+	// circuit breaker first fails them at once during an outage
+	gate := newThrottleGate(name, cloud.host(), deps.logger)
+	breaker := newCircuitBreaker(name, cloud.host(), deps.config, deps.logger)
+	options := msgraphsdk.GetDefaultClientOptions()
+	middlewares := append(msgraphcore.GetDefaultMiddlewaresWithOptions(&options), requestCorrelator{}, userAuthorizer{}, breaker, gate,
+		pacingObserver{tenant: name, me: me, labels: deps.labels, history: deps.history, logger: deps.logger})
+	if deps.chaos {
+		middlewares = append(middlewares, chaosInjector{config: deps.config.Chaos})
+	}
+	if deps.config.Graph.Debug {
+		middlewares = append(middlewares, graphWireLogger{tenant: name, logger: deps.logger})
+	}
+	httpClient := msgraphcore.GetDefaultClient(&options, middlewares...)
+	httpClient.Transport = khttp.NewCustomTransportWithParentTransport(deps.transport, middlewares...)
+	adapter, err := msgraphsdk.NewGraphRequestAdapterWithParseNodeFactoryAndSerializationWriterFactoryAndHttpClient(auth, nil, nil, httpClient)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create graph client for tenant %s: %v", name, err)
+	}
+	adapter.SetBaseUrl(cloud.baseURL())
+	users := &userCredentials{}
+	return &graphTenant{
+		name:       name,
+		client:     msgraphsdk.NewGraphServiceClient(adapter),
+		credential: cached,
+		cloud:      cloud,
+		throttle:   gate,
+		breaker:    breaker,
+		maxBytes:   azure.MaxMessageBytes,
+		me:         me,
+		onBehalfOf: func(assertion string) (azcore.TokenCredential, error) {
+			return users.get(assertion, func() (*cachedCredential, error) {
+				obo, err := newOnBehalfOfCredential(azure, deps.transport, assertion)
+				if err != nil {
+					return nil, err
+				}
+				return newCachedCredential(name, obo, deps.logger), nil
+			})
+		},
+	}, nil
+}
+
+// userID returns the Graph user ID that sends for the address, the
+// signed-in user with delegated auth
+func (t *graphTenant) userID(addr string) string {
+	if t.me != "" {
+		return meUserID
+	}
+	return graphAddress(addr)
+}
+
+// user returns the Graph user that sends for the address
+func (t *graphTenant) user(addr string) *users.UserItemRequestBuilder {
+	if t.me != "" {
+		return t.client.Me()
+	}
+	return t.client.Users().ByUserId(graphAddress(addr))
+}
+
+// newGraphTenants builds the default tenant of the azure section, first,
+// and the tenants section
+func newGraphTenants(deps graphDeps) ([]*graphTenant, error) {
+	def, err := newGraphTenant(deps.config.Azure, deps)
+	if err != nil {
+		return nil, err
+	}
+	tenants := []*graphTenant{def}
+	for _, tc := range deps.config.Tenants {
+		t, err := newGraphTenant(tc.AzureConfig, deps)
+		if err != nil {
+			return nil, err
+		}
+		t.domains, t.senders = tc.Domains, tc.Senders
+		tenants = append(tenants, t)
+	}
+	return tenants, nil
+}
+
+// tenant returns the tenant that sends for the address: the one listing
+// it in senders, else the one listing its domain, else the default
+func (bkd *Backend) tenant(sender string) *graphTenant {
+	if len(bkd.tenants) == 1 {
+		return bkd.tenants[0]
+	}
+	for _, t := range bkd.tenants[1:] {
+		for _, addr := range t.senders {
+			if strings.EqualFold(addr, sender) {
+				return t
+			}
+		}
+	}
+	if at := strings.LastIndex(sender, "@"); at >= 0 {
+		for _, t := range bkd.tenants[1:] {
+			if matchDomains(t.domains, sender[at+1:]) {
+				return t
+			}
+		}
+	}
+	return bkd.tenants[0]
+}
+
+// refreshToken gets a Graph token for every tenant ahead of the next
+// message, so an expired client secret shows up in the log and the task
+// metrics before mail is refused. The credential only contacts Azure AD
+// when its own cached token is about to expire; messages use the relay's
+// cache, which is renewed in the background as well.
+func (bkd *Backend) refreshToken(ctx context.Context) error {
+	var errs []error
+	for _, t := range bkd.tenants {
+		if err := t.credential.renew(ctx, policy.TokenRequestOptions{Scopes: []string{t.cloud.scope()}}); err != nil {
+			errs = append(errs, fmt.Errorf("token refresh for tenant %s: %v", t.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,106 @@
+// threads.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+	"github.com/microsoftgraph/msgraph-sdk-go/users"
+)
+
+// maxThreadReferences is how many of the message IDs a reply refers to
+// are looked up in the sender's mailbox: In-Reply-To and the last ones of
+// References, the closest to it
+const maxThreadReferences = 3
+
+// threadReferences returns the message IDs of In-Reply-To and References,
+// closest first and without duplicates
+func threadReferences(headers map[string]string) []string {
+	var ids []string
+	add := func(id string) {
+		if strings.HasPrefix(id, "<") && strings.HasSuffix(id, ">") && !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	for _, id := range strings.Fields(headerValue(headers, "In-Reply-To")) {
+		add(id)
+	}
+	refs := strings.Fields(headerValue(headers, "References"))
+	for i := len(refs) - 1; i >= 0; i-- {
+		add(refs[i])
+	}
+	if len(ids) > maxThreadReferences {
+		ids = ids[:maxThreadReferences]
+	}
+	return ids
+}
+
+// threadParent returns the Graph ID of the message in the sender's mailbox
+// the message replies to, with graph.thread_replies set. A failed lookup is
+// logged and the message sent as a new one.
+func (s *Session) threadParent(ctx context.Context, headers map[string]string) string {
+	if !s.backend.policy().config.Graph.ThreadReplies {
+		return ""
+	}
+	for _, ref := range threadReferences(headers) {
+		id, err := s.backend.findMessage(ctx, s.from, ref)
+		if err != nil {
+			s.log().Warn("looking up replied message failed", "client", s.clientIP, "from", s.from, "ref", ref, "errormsg", err)
+			return ""
+		}
+		if id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// findMessage returns the Graph ID of the message with an Internet
+// message ID in the mailbox, or "" if there is none
+func (bkd *Backend) findMessage(ctx context.Context, mailbox, internetMessageID string) (string, error) {
+	filter := fmt.Sprintf("internetMessageId eq '%s'", strings.ReplaceAll(internetMessageID, "'", "''"))
+	top := int32(1)
+	config := &users.ItemMessagesRequestBuilderGetRequestConfiguration{
+		QueryParameters: &users.ItemMessagesRequestBuilderGetQueryParameters{
+			Filter: &filter,
+			Select: []string{"id"},
+			Top:    &top,
+		},
+	}
+	resp, err := bkd.tenant(mailbox).user(mailbox).Messages().Get(ctx, config)
+	if err != nil {
+		return "", err
+	}
+	for _, m := range resp.GetValue() {
+		if m.GetId() != nil {
+			return *m.GetId(), nil
+		}
+	}
+	return "", nil
+}
+
+// sendReply sends msg as a reply to the message parent of the sender's
+// mailbox, through a draft made with createReply, so it joins parent's
+// conversation in Outlook. Subject, body and recipients are the message's
+// own, not those Graph suggests.
+func (bkd *Backend) sendReply(ctx context.Context, from, parent string, msg models.Messageable, attachments []mimeAttachment) error {
+	// Attachments are added to the draft; msg keeps its own for sending
+	// it otherwise on a later attempt
+	inline := msg.GetAttachments()
+	msg.SetAttachments(nil)
+	defer msg.SetAttachments(inline)
+
+	body := users.NewItemMessagesItemCreateReplyPostRequestBody()
+	body.SetMessage(msg)
+	draft, err := bkd.tenant(from).user(from).Messages().ByMessageId(parent).CreateReply().Post(ctx, body, nil)
+	if err != nil {
+		return fmt.Errorf("creating reply: %v", err)
+	}
+	if draft.GetId() == nil {
+		return fmt.Errorf("creating reply: no message ID returned")
+	}
+	return bkd.sendCreatedDraft(ctx, from, draft, attachments)
+}
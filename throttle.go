@@ -0,0 +1,142 @@
+// throttle.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	abstractions "github.com/microsoft/kiota-abstractions-go"
+	khttp "github.com/microsoft/kiota-http-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// defaultThrottlePause is the pause after a 429 or 503 without
+	// Retry-After
+	defaultThrottlePause = 10 * time.Second
+	// maxThrottlePause caps the pause a single answer can impose
+	maxThrottlePause = 5 * time.Minute
+)
+
+var graphPauses = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "gographsmtp_graph_throttle_pauses_total",
+	Help: "Times Graph requests were paused after a 429 or 503 answer, per tenant.",
+}, []string{"tenant"})
+
+// throttleGate pauses all Graph requests of a tenant while Graph is
+// throttling the relay. The retry handler only delays the request that was throttled;
+// without the gate every other message would run into the same 429 and
+// use up its retries.
+type throttleGate struct {
+	tenant string
+	host   string
+	logger *slog.Logger
+
+	mu    sync.Mutex
+	until time.Time
+}
+
+// throttledError is returned for requests that can't wait for the end of
+// the pause before their deadline
+type throttledError struct {
+	until time.Time
+}
+
+func (e throttledError) Error() string {
+	return fmt.Sprintf("Graph is throttling, requests are paused until %s", e.until.Format(time.RFC3339))
+}
+
+func newThrottleGate(tenant, host string, logger *slog.Logger) *throttleGate {
+	g := &throttleGate{tenant: tenant, host: host, logger: logger}
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "gographsmtp_graph_throttle_pause_seconds",
+		Help:        "Time left until Graph requests of the tenant resume after throttling, 0 when not paused.",
+		ConstLabels: prometheus.Labels{"tenant": tenant},
+	}, func() float64 { return g.remaining().Seconds() })
+	return g
+}
+
+func (g *throttleGate) Intercept(pipeline khttp.Pipeline, middlewareIndex int, req *http.Request) (*http.Response, error) {
+	if wait := g.remaining(); wait > 0 {
+		if deadline, ok := req.Context().Deadline(); ok && time.Until(deadline) < wait {
+			return nil, throttledError{until: time.Now().Add(wait)}
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			t.Stop()
+			return nil, req.Context().Err()
+		case <-t.C:
+		}
+	}
+
+	resp, err := pipeline.Next(req, middlewareIndex)
+	if err == nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		g.pause(resp.StatusCode, parseRetryAfter(resp.Header.Get("Retry-After")))
+	}
+	return resp, err
+}
+
+// remaining returns how long requests are still paused
+func (g *throttleGate) remaining() time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return max(time.Until(g.until), 0)
+}
+
+// pause holds back requests for d, unless they are already held longer.
+// Only the start of a pause is logged and counted.
+func (g *throttleGate) pause(status int, d time.Duration) {
+	if d <= 0 {
+		d = defaultThrottlePause
+	}
+	d = min(d, maxThrottlePause)
+
+	g.mu.Lock()
+	now := time.Now()
+	started := !now.Before(g.until)
+	if until := now.Add(d); until.After(g.until) {
+		g.until = until
+	}
+	g.mu.Unlock()
+	if started {
+		graphPauses.WithLabelValues(g.tenant).Inc()
+		g.logger.Warn("Graph is throttling", "host", g.host, "tenant", g.tenant, "status", "throttled", "code", status, "pause", d)
+	}
+}
+
+// parseRetryAfter reads a Retry-After header, in seconds or as an HTTP
+// date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// throttled reports whether a send failed because Graph is throttling or
+// briefly unavailable
+func throttled(err error) bool {
+	var te throttledError
+	if errors.As(err, &te) {
+		return true
+	}
+	var apiErr abstractions.ApiErrorable
+	if errors.As(err, &apiErr) {
+		code := apiErr.GetStatusCode()
+		return code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable
+	}
+	return false
+}
@@ -0,0 +1,202 @@
+// tls.go
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tlsHandshakeTimeout bounds the TLS handshake after STARTTLS
+const tlsHandshakeTimeout = 30 * time.Second
+
+// certCheckInterval is how often the certificate files are checked for a
+// renewed certificate
+const certCheckInterval = time.Minute
+
+// newTLSConfig returns the TLS settings of the listeners, or nil when no
+// certificate is configured. Clients asking for a domain with a
+// certificate of its own by SNI get that one, others the one of smtp.tls.
+func newTLSConfig(config Config, logger *slog.Logger) (*tls.Config, error) {
+	tc, err := defaultTLSConfig(config, logger)
+	if err != nil {
+		return nil, err
+	}
+	domains := map[string]*certReloader{}
+	for name, dc := range config.Domains {
+		if dc.TLS.CertFile == "" && dc.TLS.KeyFile == "" {
+			continue
+		}
+		r := &certReloader{certFile: dc.TLS.CertFile, keyFile: dc.TLS.KeyFile}
+		if err := r.load(); err != nil {
+			return nil, fmt.Errorf("domain %s: %v", name, err)
+		}
+		domains[strings.ToLower(name)] = r
+	}
+	if len(domains) == 0 {
+		return tc, nil
+	}
+	// Clients without SNI need a certificate too
+	if tc == nil {
+		return nil, fmt.Errorf("domains with a tls certificate need a default certificate in smtp.tls")
+	}
+	fallback := tc.GetCertificate
+	tc.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if r := domainCertificate(domains, hello.ServerName); r != nil {
+			return r.getCertificate(hello)
+		}
+		return fallback(hello)
+	}
+	return tc, nil
+}
+
+// domainCertificate returns the certificate of the domain serverName is
+// in, the longest matching domain winning, or nil
+func domainCertificate(domains map[string]*certReloader, serverName string) *certReloader {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	for name != "" {
+		if r, ok := domains[name]; ok {
+			return r
+		}
+		_, name, _ = strings.Cut(name, ".")
+	}
+	return nil
+}
+
+// defaultTLSConfig returns the TLS settings for the certificate of
+// smtp.tls, or nil when there is none. With ACME the certificate is
+// obtained from Let's Encrypt, answering the HTTP-01 challenge on
+// acme.http_address.
+func defaultTLSConfig(config Config, logger *slog.Logger) (*tls.Config, error) {
+	tc := config.SMTP.TLS
+	switch {
+	case len(tc.ACME.Domains) > 0:
+		if tc.ACME.HTTPAddress == "" {
+			return nil, fmt.Errorf("smtp.tls.acme needs an http_address for the HTTP-01 challenge")
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(tc.ACME.Domains...),
+			Cache:      autocert.DirCache(tc.ACME.CacheDir),
+			Email:      tc.ACME.Email,
+		}
+		if tc.ACME.CacheDir == "" {
+			m.Cache = nil
+		}
+		go func() {
+			err := newHTTPServer(tc.ACME.HTTPAddress, m.HTTPHandler(nil)).ListenAndServe()
+			logger.Error("ACME challenge server failed", "errormsg", err)
+		}()
+		// Clients don't always send SNI; the first domain is the default
+		domain := tc.ACME.Domains[0]
+		return &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				if hello.ServerName == "" {
+					hello.ServerName = domain
+				}
+				return m.GetCertificate(hello)
+			},
+		}, nil
+	case tc.CertFile != "" || tc.KeyFile != "":
+		r := &certReloader{certFile: tc.CertFile, keyFile: tc.KeyFile}
+		if err := r.load(); err != nil {
+			return nil, err
+		}
+		return &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: r.getCertificate}, nil
+	}
+	return nil, nil
+}
+
+// listenerTLSConfig returns the TLS settings of a listener: those of the
+// smtp section, plus client certificates verified against the listener's
+// client_ca_file when client_certs is set
+func listenerTLSConfig(base *tls.Config, lc ListenerConfig) (*tls.Config, error) {
+	if lc.ClientCerts == "" || lc.ClientCerts == "off" {
+		return base, nil
+	}
+	pem, err := os.ReadFile(lc.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client_ca_file of listener %s: %v", lc.Name, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("client_ca_file of listener %s holds no PEM certificate", lc.Name)
+	}
+	tc := base.Clone()
+	tc.ClientCAs = pool
+	tc.ClientAuth = tls.VerifyClientCertIfGiven
+	if lc.ClientCerts == "require" {
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tc, nil
+}
+
+// certificateIdentity is the user a client certificate authenticates: its
+// first email address, else its first DNS name, else its common name
+func certificateIdentity(cert *x509.Certificate) string {
+	switch {
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	}
+	return cert.Subject.CommonName
+}
+
+// certReloader serves a certificate from files and picks up renewed ones,
+// e.g. from certbot, without a restart
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func (r *certReloader) load() error {
+	info, err := os.Stat(r.certFile)
+	if err != nil {
+		return fmt.Errorf("failed to read certificate: %v", err)
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %v", err)
+	}
+	r.cert, r.modTime = &cert, info.ModTime()
+	return nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checked) > certCheckInterval {
+		r.checked = time.Now()
+		// A half-written renewal keeps the current certificate in use
+		if info, err := os.Stat(r.certFile); err == nil && info.ModTime().After(r.modTime) {
+			r.load()
+		}
+	}
+	return r.cert, nil
+}
+
+// tlsMode returns how the listener uses TLS: "implicit", "starttls" or
+// "none". STARTTLS is offered by default once a certificate is configured.
+func (lc ListenerConfig) tlsMode(haveCert bool) string {
+	if lc.TLS == "" {
+		if haveCert {
+			return "starttls"
+		}
+		return "none"
+	}
+	return lc.TLS
+}
@@ -0,0 +1,87 @@
+// tls_test.go
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate for name to dir and
+// returns its certificate and key files
+func writeCertificate(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestDomainCertificateBySNI(t *testing.T) {
+	dir := t.TempDir()
+	var config Config
+	config.SMTP.TLS.CertFile, config.SMTP.TLS.KeyFile = writeCertificate(t, dir, "relay.example.com")
+	var sales DomainConfig
+	sales.TLS.CertFile, sales.TLS.KeyFile = writeCertificate(t, dir, "sales.example.com")
+	config.Domains = map[string]DomainConfig{"Sales.example.com": sales}
+
+	tc, err := newTLSConfig(config, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("newTLSConfig: %v", err)
+	}
+	for serverName, want := range map[string]string{
+		"sales.example.com":      "sales.example.com",
+		"mail.sales.example.com": "sales.example.com",
+		"relay.example.com":      "relay.example.com",
+		"":                       "relay.example.com",
+	} {
+		cert, err := tc.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		if err != nil {
+			t.Fatalf("%q: %v", serverName, err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leaf.DNSNames[0] != want {
+			t.Errorf("SNI %q got the certificate of %s, want %s", serverName, leaf.DNSNames[0], want)
+		}
+	}
+
+	config.SMTP.TLS.CertFile, config.SMTP.TLS.KeyFile = "", ""
+	if _, err := newTLSConfig(config, slog.New(slog.NewTextHandler(io.Discard, nil))); err == nil {
+		t.Error("newTLSConfig accepted domain certificates without a default one")
+	}
+}
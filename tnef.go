@@ -0,0 +1,259 @@
+// tnef.go
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// tnefSignature starts every TNEF stream (winmail.dat)
+const tnefSignature = 0x223e9f78
+
+// TNEF attribute IDs, without the type in the upper word
+const (
+	tnefAttBody           = 0x800c
+	tnefAttAttachData     = 0x800f
+	tnefAttAttachTitle    = 0x8010
+	tnefAttAttachRendData = 0x9002
+	tnefAttMsgProps       = 0x9003
+	tnefAttAttachment     = 0x9005
+)
+
+// MAPI property IDs read from the message and attachment property blocks
+const (
+	mapiBodyHTML         = 0x1013
+	mapiAttachLongName   = 0x3707
+	mapiAttachMimeTag    = 0x370e
+	mapiAttachDataObject = 0x3701
+)
+
+// tnefContent is what is recovered from a TNEF stream
+type tnefContent struct {
+	text        string
+	html        string
+	attachments []mimeAttachment
+}
+
+// decodeTNEF unpacks the body and the attachments Outlook wrapped in an
+// application/ms-tnef part. Compressed RTF bodies are not converted; the
+// plain text body is used for those.
+func decodeTNEF(data []byte) (*tnefContent, error) {
+	if len(data) < 6 || binary.LittleEndian.Uint32(data) != tnefSignature {
+		return nil, fmt.Errorf("not a TNEF stream")
+	}
+
+	c := &tnefContent{}
+	var current *mimeAttachment
+	finish := func() {
+		if current != nil && current.data != nil {
+			if current.name == "" {
+				current.name = "attachment"
+			}
+			if current.contentType == "" {
+				current.contentType = "application/octet-stream"
+			}
+			c.attachments = append(c.attachments, *current)
+		}
+		current = nil
+	}
+
+	pos := 6 // signature and legacy key
+	for pos < len(data) {
+		// level (1), attribute (4), length (4), data, checksum (2)
+		if pos+9 > len(data) {
+			return nil, fmt.Errorf("truncated TNEF attribute at offset %d", pos)
+		}
+		id := binary.LittleEndian.Uint32(data[pos+1:]) & 0xffff
+		length := int(binary.LittleEndian.Uint32(data[pos+5:]))
+		start := pos + 9
+		if length < 0 || start+length+2 > len(data) {
+			return nil, fmt.Errorf("truncated TNEF attribute at offset %d", pos)
+		}
+		value := data[start : start+length]
+		pos = start + length + 2
+
+		switch id {
+		case tnefAttBody:
+			c.text = tnefString(value)
+		case tnefAttMsgProps:
+			props, err := readMAPIProps(value)
+			if err != nil {
+				return nil, err
+			}
+			if html, ok := props[mapiBodyHTML]; ok {
+				c.html = textContent(string(bytes.TrimRight(html, "\x00")))
+			}
+		case tnefAttAttachRendData:
+			// Every attachment starts with its rendering information
+			finish()
+			current = &mimeAttachment{}
+		case tnefAttAttachTitle:
+			if current != nil {
+				current.name = tnefString(value)
+			}
+		case tnefAttAttachData:
+			if current != nil {
+				current.data = value
+			}
+		case tnefAttAttachment:
+			if current == nil {
+				continue
+			}
+			props, err := readMAPIProps(value)
+			if err != nil {
+				return nil, err
+			}
+			if name, ok := props[mapiAttachLongName]; ok && len(name) > 0 {
+				current.name = string(name)
+			}
+			if tag, ok := props[mapiAttachMimeTag]; ok && len(tag) > 0 {
+				current.contentType = string(tag)
+			}
+			if current.data == nil {
+				current.data = props[mapiAttachDataObject]
+			}
+		}
+	}
+	finish()
+	return c, nil
+}
+
+// tnefString reads a NUL-terminated 8-bit TNEF string
+func tnefString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return textContent(string(b))
+}
+
+// readMAPIProps reads a MAPI property block and returns the first value of
+// every string and binary property. Strings are returned as UTF-8.
+func readMAPIProps(b []byte) (map[uint16][]byte, error) {
+	r := &tnefReader{b: b}
+	count := r.uint32()
+	props := make(map[uint16][]byte)
+
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		typ := r.uint16()
+		id := r.uint16()
+
+		// Named properties carry a GUID and an ID or name
+		if id >= 0x8000 {
+			r.skip(16)
+			if r.uint32() == 0 {
+				r.skip(4)
+			} else {
+				r.skip(pad4(int(r.uint32())))
+			}
+		}
+
+		multi := typ&0x1000 != 0
+		typ &^= 0x1000
+
+		values := uint32(1)
+		switch {
+		case multi:
+			values = r.uint32()
+		case typ == 0x1e || typ == 0x1f || typ == 0x102 || typ == 0x0d:
+			values = r.uint32()
+		}
+
+		for v := uint32(0); v < values && r.err == nil; v++ {
+			switch typ {
+			case 0x02, 0x03, 0x04, 0x0a, 0x0b: // int16, int32, float, error, bool
+				r.skip(4)
+			case 0x05, 0x06, 0x07, 0x14, 0x40: // double, currency, apptime, int64, systime
+				r.skip(8)
+			case 0x48: // CLSID
+				r.skip(16)
+			case 0x1e, 0x1f, 0x102, 0x0d: // string8, unicode, binary, object
+				n := int(r.uint32())
+				value := r.bytes(n)
+				r.skip(pad4(n) - n)
+				if _, seen := props[id]; seen || v > 0 {
+					continue
+				}
+				switch typ {
+				case 0x1e:
+					props[id] = []byte(tnefString(value))
+				case 0x1f:
+					props[id] = []byte(utf16String(value))
+				case 0x0d:
+					// Embedded objects start with the IID of the interface
+					if len(value) >= 16 {
+						value = value[16:]
+					}
+					props[id] = value
+				default:
+					props[id] = value
+				}
+			default:
+				return nil, fmt.Errorf("unsupported MAPI property type 0x%04x", typ)
+			}
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return props, nil
+}
+
+// utf16String decodes a NUL-terminated UTF-16LE string
+func utf16String(b []byte) string {
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		ch := binary.LittleEndian.Uint16(b[i:])
+		if ch == 0 {
+			break
+		}
+		u = append(u, ch)
+	}
+	return strings.ToValidUTF8(string(utf16.Decode(u)), "")
+}
+
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// tnefReader reads little-endian values and remembers the first overrun
+type tnefReader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (r *tnefReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.pos+n > len(r.b) {
+		r.err = fmt.Errorf("truncated MAPI property block")
+		return nil
+	}
+	b := r.b[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *tnefReader) skip(n int) {
+	r.bytes(n)
+}
+
+func (r *tnefReader) uint16() uint16 {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(b)
+}
+
+func (r *tnefReader) uint32() uint32 {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
@@ -0,0 +1,174 @@
+// tokencache.go
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+const (
+	// tokenRefreshMargin is how long before a cached token expires it's
+	// renewed in the background; messages keep using it meanwhile
+	tokenRefreshMargin = 10 * time.Minute
+	// tokenExpiryMargin is how long before it expires a token is no
+	// longer handed out, so it doesn't run out during a request
+	tokenExpiryMargin = 30 * time.Second
+	// tokenRefreshTimeout bounds a background renewal
+	tokenRefreshTimeout = 30 * time.Second
+)
+
+// cachedCredential keeps the Graph tokens of a credential and renews them
+// before they expire. Concurrent messages needing a new token wait for a
+// single request to Azure AD rather than each making one.
+type cachedCredential struct {
+	name       string // of the tenant or user, for the log
+	credential azcore.TokenCredential
+	logger     *slog.Logger
+
+	mu     sync.Mutex
+	tokens map[string]*cachedToken // by scopes
+}
+
+// cachedToken is a token of one set of scopes; mu is held while it's
+// requested
+type cachedToken struct {
+	mu         sync.Mutex
+	token      azcore.AccessToken
+	refreshing bool
+}
+
+func newCachedCredential(name string, credential azcore.TokenCredential, logger *slog.Logger) *cachedCredential {
+	return &cachedCredential{name: name, credential: credential, logger: logger, tokens: make(map[string]*cachedToken)}
+}
+
+// GetToken returns the cached token while it's valid, starting its renewal
+// once it nears expiry. Requests with claims, a Conditional Access
+// challenge, always go to the credential.
+func (c *cachedCredential) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	if opts.Claims != "" {
+		return c.credential.GetToken(ctx, opts)
+	}
+	t := c.token(opts)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(t.token.ExpiresOn.Add(-tokenExpiryMargin)) {
+		if now.After(t.token.ExpiresOn.Add(-tokenRefreshMargin)) && !t.refreshing {
+			t.refreshing = true
+			go c.refresh(t, opts)
+		}
+		return t.token, nil
+	}
+	at, err := c.credential.GetToken(ctx, opts)
+	if err != nil {
+		return at, err
+	}
+	t.token = at
+	return at, nil
+}
+
+// renew gets a token from the credential and caches it, for the
+// token_refresh task, which reports failures
+func (c *cachedCredential) renew(ctx context.Context, opts policy.TokenRequestOptions) error {
+	at, err := c.credential.GetToken(ctx, opts)
+	if err != nil {
+		return err
+	}
+	t := c.token(opts)
+	t.mu.Lock()
+	if at.ExpiresOn.After(t.token.ExpiresOn) {
+		t.token = at
+	}
+	t.mu.Unlock()
+	return nil
+}
+
+func (c *cachedCredential) token(opts policy.TokenRequestOptions) *cachedToken {
+	key := strings.Join(opts.Scopes, " ")
+	if opts.TenantID != "" {
+		key += "@" + opts.TenantID
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := c.tokens[key]
+	if t == nil {
+		t = &cachedToken{}
+		c.tokens[key] = t
+	}
+	return t
+}
+
+// refresh renews a token in the background. On failure the cached token
+// is used until it expires, and the next message tries again.
+func (c *cachedCredential) refresh(t *cachedToken, opts policy.TokenRequestOptions) {
+	ctx, cancel := context.WithTimeout(context.Background(), tokenRefreshTimeout)
+	defer cancel()
+	at, err := c.credential.GetToken(ctx, opts)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.refreshing = false
+	if err != nil {
+		c.logger.Warn("token refresh failed", "tenant", c.name, "status", "token_refresh_failed", "errormsg", err)
+		return
+	}
+	if at.ExpiresOn.After(t.token.ExpiresOn) {
+		t.token = at
+	}
+}
+
+// userCredentials caches the on-behalf-of credentials of AUTH XOAUTH2
+// users by the token they presented. Clients reuse a token until it
+// expires, so their sessions share one exchange with Azure AD.
+type userCredentials struct {
+	mu          sync.Mutex
+	credentials map[[sha256.Size]byte]userCredential
+}
+
+type userCredential struct {
+	credential *cachedCredential
+	expires    time.Time // of the client's token
+}
+
+// get returns the cached credential of the assertion, or one made by
+// create. Credentials of expired assertions are dropped on the way.
+func (u *userCredentials) get(assertion string, create func() (*cachedCredential, error)) (azcore.TokenCredential, error) {
+	key := sha256.Sum256([]byte(assertion))
+	now := time.Now()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if uc, ok := u.credentials[key]; ok && now.Before(uc.expires) {
+		return uc.credential, nil
+	}
+	for k, uc := range u.credentials {
+		if !now.Before(uc.expires) {
+			delete(u.credentials, k)
+		}
+	}
+
+	credential, err := create()
+	if err != nil {
+		return nil, err
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	tokenClaims(assertion, &claims)
+	if claims.Exp == 0 {
+		// Opaque tokens aren't cached
+		return credential, nil
+	}
+	if u.credentials == nil {
+		u.credentials = make(map[[sha256.Size]byte]userCredential)
+	}
+	u.credentials[key] = userCredential{credential: credential, expires: time.Unix(claims.Exp, 0)}
+	return credential, nil
+}
@@ -0,0 +1,70 @@
+// tracing.go
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// defaultTracingService is the service.name of the spans unless
+// tracing.service_name is set
+const defaultTracingService = "gographsmtp"
+
+// tracer makes the relay's spans. It uses the provider set up by
+// startTracing, and does nothing without one.
+var tracer = otel.Tracer("github.com/yourusername/GoGraphSmtp")
+
+// startTracing exports spans to tracing.endpoint with OTLP over HTTP. The
+// Graph SDK traces its requests with the same provider. The returned
+// function flushes the spans at shutdown.
+func startTracing(config Config) (func(context.Context) error, error) {
+	tc := config.Tracing
+	if tc.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(tc.Endpoint), otlptracehttp.WithHeaders(tc.Headers))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %v", err)
+	}
+	name := tc.ServiceName
+	if name == "" {
+		name = defaultTracingService
+	}
+	ratio := tc.SampleRatio
+	if ratio == 0 {
+		ratio = 1
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(name))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// startSpan starts a span of the session, for an SMTP command
+func (s *Session) startSpan(name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(s.traceCtx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends a span, marking it failed with err
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,80 @@
+// unixsocket.go
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// unixPrefix marks a listener address that is a Unix socket path
+const unixPrefix = "unix:"
+
+// defaultSocketMode lets the socket's owner and group connect
+const defaultSocketMode = 0660
+
+// socketMode returns the permissions of the listener's Unix socket
+func (lc ListenerConfig) socketMode() (os.FileMode, error) {
+	if lc.SocketMode == "" {
+		return defaultSocketMode, nil
+	}
+	mode, err := strconv.ParseUint(lc.SocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid socket_mode %q on listener %s", lc.SocketMode, lc.Name)
+	}
+	return os.FileMode(mode), nil
+}
+
+// listen opens the listener's address: host:port, or unix:/path for a
+// Unix socket, which local daemons can submit to without network access.
+// A stale socket file from an earlier run is replaced.
+func listen(lc ListenerConfig) (net.Listener, error) {
+	path, ok := strings.CutPrefix(lc.Address, unixPrefix)
+	if !ok {
+		return net.Listen("tcp", lc.Address)
+	}
+	mode, err := lc.socketMode()
+	if err != nil {
+		return nil, err
+	}
+	gid := -1
+	if lc.SocketGroup != "" {
+		if gid, err = lookupGroup(lc.SocketGroup); err != nil {
+			return nil, err
+		}
+	}
+
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if gid >= 0 {
+		if err := os.Chown(path, -1, gid); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to set group of %s: %v", path, err)
+		}
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to set permissions of %s: %v", path, err)
+	}
+	return l, nil
+}
+
+// lookupGroup returns the ID of a group given by name or number
+func lookupGroup(name string) (int, error) {
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, fmt.Errorf("unknown socket_group %s: %v", name, err)
+	}
+	return strconv.Atoi(g.Gid)
+}
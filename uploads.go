@@ -0,0 +1,198 @@
+// uploads.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+	"github.com/microsoftgraph/msgraph-sdk-go/users"
+)
+
+const (
+	// maxInlineAttachmentBytes is the most attachment data sent within a
+	// sendMail request, which Graph limits to 4 MB after base64 encoding
+	maxInlineAttachmentBytes = 3 << 20
+	// uploadChunkBytes is the size of an upload session chunk; Graph wants
+	// multiples of 320 KiB and at most 4 MiB
+	uploadChunkBytes = 10 * 320 << 10
+	// defaultGraphTimeout bounds the delivery of a message unless
+	// graph.timeout is set
+	defaultGraphTimeout = 30 * time.Second
+	// largeMessageTimeout bounds the delivery of a message with uploads
+	// unless graph.upload_timeout is set
+	largeMessageTimeout = 5 * time.Minute
+)
+
+// graphTimeout returns how long the delivery of a message of size bytes
+// may take: those too large for a single request upload attachments
+func (c Config) graphTimeout(size int) time.Duration {
+	if size > maxInlineAttachmentBytes {
+		return c.uploadTimeout()
+	}
+	if c.Graph.Timeout > 0 {
+		return c.Graph.Timeout
+	}
+	return defaultGraphTimeout
+}
+
+// uploadTimeout returns how long the delivery of a message with uploads
+// may take
+func (c Config) uploadTimeout() time.Duration {
+	if c.Graph.UploadTimeout > 0 {
+		return c.Graph.UploadTimeout
+	}
+	return largeMessageTimeout
+}
+
+// attachmentBytes returns the size of the attachments' content
+func attachmentBytes(attachments []mimeAttachment) int {
+	n := 0
+	for _, a := range attachments {
+		n += len(a.data)
+	}
+	return n
+}
+
+// sendDraft sends a message through a draft in the sender's mailbox:
+// attachments of 3 MB and more, which don't fit into a sendMail request,
+// are uploaded in chunks through upload sessions, smaller ones are added
+// directly. Graph moves the sent draft to Sent Items. A draft that
+// couldn't be sent is deleted. The draft's IDs go to the sentMessage of
+// ctx.
+func (bkd *Backend) sendDraft(ctx context.Context, from string, msg models.Messageable, attachments []mimeAttachment) error {
+	mailbox := bkd.tenant(from).user(from)
+	draft, err := mailbox.Messages().Post(ctx, msg, nil)
+	if err != nil {
+		return fmt.Errorf("creating draft: %v", err)
+	}
+	if draft.GetId() == nil {
+		return fmt.Errorf("creating draft: no message ID returned")
+	}
+	return bkd.sendCreatedDraft(ctx, from, draft, attachments)
+}
+
+// sendCreatedDraft adds the attachments to a draft in the mailbox of from
+// and sends it, or deletes it when that fails
+func (bkd *Backend) sendCreatedDraft(ctx context.Context, from string, draft models.Messageable, attachments []mimeAttachment) error {
+	mailbox := bkd.tenant(from).user(from)
+	id := *draft.GetId()
+	if sm := sentMessageFrom(ctx); sm != nil {
+		sm.id = id
+		if draft.GetInternetMessageId() != nil {
+			sm.internetMessageID = *draft.GetInternetMessageId()
+		}
+	}
+	sent := false
+	defer func() {
+		if sent {
+			return
+		}
+		// The caller's context may be what failed
+		cleanup, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := mailbox.Messages().ByMessageId(id).Delete(cleanup, nil); err != nil {
+			bkd.logger.Warn("deleting unsent draft failed", "from", from, "errormsg", err)
+		}
+	}()
+
+	for _, a := range attachments {
+		if len(a.data) < maxInlineAttachmentBytes {
+			attachment := graphAttachments([]mimeAttachment{a})[0]
+			if _, err := mailbox.Messages().ByMessageId(id).Attachments().Post(ctx, attachment, nil); err != nil {
+				return fmt.Errorf("adding attachment %s: %v", a.name, err)
+			}
+			continue
+		}
+		if err := bkd.uploadAttachment(ctx, mailbox, id, a); err != nil {
+			return fmt.Errorf("uploading attachment %s: %v", a.name, err)
+		}
+	}
+
+	if err := mailbox.Messages().ByMessageId(id).Send().Post(ctx, nil); err != nil {
+		return err
+	}
+	sent = true
+	return nil
+}
+
+// sentMessage receives the IDs of a message sent through a draft
+type sentMessage struct {
+	id                string
+	internetMessageID string
+}
+
+type sentMessageKey struct{}
+
+func withSentMessage(ctx context.Context, sm *sentMessage) context.Context {
+	return context.WithValue(ctx, sentMessageKey{}, sm)
+}
+
+func sentMessageFrom(ctx context.Context) *sentMessage {
+	sm, _ := ctx.Value(sentMessageKey{}).(*sentMessage)
+	return sm
+}
+
+// uploadAttachment attaches a large file to a draft through an upload
+// session
+func (bkd *Backend) uploadAttachment(ctx context.Context, mailbox *users.UserItemRequestBuilder, id string, a mimeAttachment) error {
+	item := models.NewAttachmentItem()
+	attachmentType := models.FILE_ATTACHMENTTYPE
+	item.SetAttachmentType(&attachmentType)
+	name := a.name
+	item.SetName(&name)
+	size := int64(len(a.data))
+	item.SetSize(&size)
+	if a.contentType != "" {
+		contentType := a.contentType
+		item.SetContentType(&contentType)
+	}
+	if a.contentID != "" {
+		contentID := a.contentID
+		item.SetContentId(&contentID)
+	}
+	if a.inline {
+		inline := true
+		item.SetIsInline(&inline)
+	}
+
+	body := users.NewItemMessagesItemAttachmentsCreateUploadSessionPostRequestBody()
+	body.SetAttachmentItem(item)
+	session, err := mailbox.Messages().ByMessageId(id).Attachments().CreateUploadSession().Post(ctx, body, nil)
+	if err != nil {
+		return err
+	}
+	if session.GetUploadUrl() == nil {
+		return fmt.Errorf("no upload URL returned")
+	}
+	return bkd.uploadChunks(ctx, *session.GetUploadUrl(), a.data)
+}
+
+// uploadChunks puts data to an upload session in chunks. The upload URL
+// carries its own authorization; a bearer token must not be sent along.
+func (bkd *Backend) uploadChunks(ctx context.Context, uploadURL string, data []byte) error {
+	for start := 0; start < len(data); start += uploadChunkBytes {
+		end := min(start+uploadChunkBytes, len(data))
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, uploadURL, bytes.NewReader(data[start:end]))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, len(data)))
+
+		resp, err := bkd.uploadClient.Do(req)
+		if err != nil {
+			return err
+		}
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("chunk at byte %d answered %s: %s", start, resp.Status, bytes.TrimSpace(detail))
+		}
+	}
+	return nil
+}
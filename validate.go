@@ -0,0 +1,387 @@
+// validate.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"gopkg.in/yaml.v3"
+)
+
+// validateTokenTimeout bounds the token request of validate -graph
+const validateTokenTimeout = 30 * time.Second
+
+// configProblem is an error in the config file, at the line of the setting
+// when it is known
+type configProblem struct {
+	line int
+	path string
+	msg  string
+}
+
+// configNode is a node of the config tree and its path, e.g.
+// smtp.listeners[0].networks[1]
+type configNode struct {
+	path string
+	node *yaml.Node
+}
+
+// configNodes returns the nodes at path; "*" stands for every item of a
+// list or every entry of a map
+func configNodes(root *yaml.Node, path string) []configNode {
+	nodes := []configNode{{node: root}}
+	if root.Kind == yaml.DocumentNode && len(root.Content) > 0 {
+		nodes[0].node = root.Content[0]
+	}
+	for _, seg := range strings.Split(path, ".") {
+		var next []configNode
+		for _, cn := range nodes {
+			switch cn.node.Kind {
+			case yaml.MappingNode:
+				for i := 0; i+1 < len(cn.node.Content); i += 2 {
+					key := cn.node.Content[i].Value
+					if seg == "*" || key == seg {
+						next = append(next, configNode{path: joinPath(cn.path, key), node: cn.node.Content[i+1]})
+					}
+				}
+			case yaml.SequenceNode:
+				if seg != "*" {
+					continue
+				}
+				for i, item := range cn.node.Content {
+					next = append(next, configNode{path: fmt.Sprintf("%s[%d]", cn.path, i), node: item})
+				}
+			}
+		}
+		nodes = next
+	}
+	return nodes
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// configValidator collects the problems of a config tree
+type configValidator struct {
+	root     *yaml.Node
+	problems []configProblem
+}
+
+func (v *configValidator) add(cn configNode, format string, args ...any) {
+	v.problems = append(v.problems, configProblem{line: cn.node.Line, path: cn.path, msg: fmt.Sprintf(format, args...)})
+}
+
+// scalars returns the non-empty values at path
+func (v *configValidator) scalars(path string) []configNode {
+	var result []configNode
+	for _, cn := range configNodes(v.root, path) {
+		if cn.node.Kind == yaml.ScalarNode && cn.node.Value != "" {
+			result = append(result, cn)
+		}
+	}
+	return result
+}
+
+// child returns the setting key of the map at cn
+func child(cn configNode, key string) (configNode, bool) {
+	for _, c := range configNodes(cn.node, key) {
+		return configNode{path: joinPath(cn.path, c.path), node: c.node}, true
+	}
+	return configNode{}, false
+}
+
+// checkRequired checks the app registration settings each auth method
+// needs, for azure and every tenant
+func (v *configValidator) checkRequired() {
+	registrations := configNodes(v.root, "azure")
+	registrations = append(registrations, configNodes(v.root, "tenants.*")...)
+	if len(registrations) == 0 {
+		v.problems = append(v.problems, configProblem{path: "azure", msg: "missing, the app registration to send with"})
+	}
+	for _, cn := range registrations {
+		method, ok := child(cn, "auth_method")
+		if !ok {
+			method.node = &yaml.Node{}
+		}
+		var need []string
+		switch method.node.Value {
+		case "", "secret":
+			need = []string{"tenant_id", "client_id", "client_secret"}
+		case "certificate":
+			need = []string{"tenant_id", "client_id", "certificate_file"}
+		case "delegated":
+			need = []string{"tenant_id", "client_id", "token_cache"}
+		case "managed_identity", "workload_identity", "default":
+		default:
+			v.add(method, "invalid auth_method %q", method.node.Value)
+		}
+		for _, key := range need {
+			if c, ok := child(cn, key); !ok || c.node.Value == "" {
+				v.add(cn, "%s is required", key)
+			}
+		}
+	}
+}
+
+// checkCIDRs checks the client networks, IP addresses or CIDRs
+func (v *configValidator) checkCIDRs() {
+	for _, path := range []string{"networks.*", "smtp.trusted_proxies.*", "smtp.listeners.*.networks.*"} {
+		for _, cn := range v.scalars(path) {
+			if _, err := parseCIDRs([]string{cn.node.Value}); err != nil {
+				v.add(cn, "%v", err)
+			}
+		}
+	}
+}
+
+// checkAddresses checks mailboxes, sender patterns and host:port addresses
+func (v *configValidator) checkAddresses() {
+	mailboxes := []string{"archive_bcc", "journal.address", "journal.sender", "clients.*.sender", "tenants.*.senders.*",
+		"domains.*.fallback_sender", "domains.*.archive", "recipients.aliases.*.*"}
+	for _, path := range mailboxes {
+		for _, cn := range v.scalars(path) {
+			if err := checkMailbox(cn.node.Value); err != nil {
+				v.add(cn, "%v", err)
+			}
+		}
+	}
+	patterns := []string{"senders.allowed.*", "senders.denied.*", "domains.*.allowed_senders.*",
+		"quarantine.rules.*.senders.*", "send_windows.windows.*.senders.*"}
+	for _, path := range patterns {
+		for _, cn := range v.scalars(path) {
+			addr := cn.node.Value
+			if domain, ok := strings.CutPrefix(addr, "*@"); ok {
+				addr = "postmaster@" + domain
+			}
+			if err := checkMailbox(addr); err != nil {
+				v.add(cn, "%v", err)
+			}
+		}
+	}
+	hostPorts := []string{"smtp.address", "smtp.listeners.*.address", "smtp.tls.acme.http_address",
+		"http.address", "redis.address", "smarthost.address"}
+	for _, path := range hostPorts {
+		for _, cn := range v.scalars(path) {
+			if strings.HasPrefix(cn.node.Value, "unix:") {
+				continue
+			}
+			if _, port, err := net.SplitHostPort(cn.node.Value); err != nil {
+				v.add(cn, "invalid address %q, must be host:port", cn.node.Value)
+			} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+				v.add(cn, "invalid port in %q", cn.node.Value)
+			}
+		}
+	}
+}
+
+// checkMailbox accepts a bare address such as user@example.com
+func checkMailbox(addr string) error {
+	parsed, err := mail.ParseAddress(addr)
+	if err != nil || parsed.Address != addr || parsed.Name != "" {
+		return fmt.Errorf("invalid address %q", addr)
+	}
+	return nil
+}
+
+// checkFiles checks that the files read at startup exist, and the
+// directories of the files written
+func (v *configValidator) checkFiles() {
+	inputs := []string{"secrets.age_key_file", "auth.htpasswd_file", "auth.ldap.ca_file",
+		"smtp.tls.cert_file", "smtp.tls.key_file", "smtp.listeners.*.client_ca_file",
+		"azure.certificate_file", "azure.token_file", "tenants.*.certificate_file", "tenants.*.token_file"}
+	for _, path := range inputs {
+		for _, cn := range v.scalars(path) {
+			info, err := os.Stat(cn.node.Value)
+			if err != nil {
+				v.add(cn, "%v", err)
+			} else if info.IsDir() {
+				v.add(cn, "%s is a directory", cn.node.Value)
+			}
+		}
+	}
+	for _, path := range []string{"log_file", "audit.file", "azure.token_cache", "tenants.*.token_cache"} {
+		for _, cn := range v.scalars(path) {
+			dir := filepath.Dir(cn.node.Value)
+			if info, err := os.Stat(dir); err != nil {
+				v.add(cn, "%v", err)
+			} else if !info.IsDir() {
+				v.add(cn, "%s is not a directory", dir)
+			}
+		}
+	}
+}
+
+// checkCertificate checks that smtp.tls holds a certificate and the key
+// that belongs to it, valid now
+func (v *configValidator) checkCertificate() {
+	certs := v.scalars("smtp.tls.cert_file")
+	keys := v.scalars("smtp.tls.key_file")
+	switch {
+	case len(certs) == 0 && len(keys) == 0:
+		return
+	case len(keys) == 0:
+		v.add(certs[0], "cert_file needs a key_file")
+		return
+	case len(certs) == 0:
+		v.add(keys[0], "key_file needs a cert_file")
+		return
+	}
+	pair, err := tls.LoadX509KeyPair(certs[0].node.Value, keys[0].node.Value)
+	if err != nil {
+		// Files that don't exist were reported already
+		if !errors.Is(err, os.ErrNotExist) {
+			v.add(certs[0], "invalid certificate or key: %v", err)
+		}
+		return
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		v.add(certs[0], "invalid certificate: %v", err)
+		return
+	}
+	if now := time.Now(); now.After(leaf.NotAfter) {
+		v.add(certs[0], "certificate expired on %s", leaf.NotAfter.Format(time.DateOnly))
+	} else if now.Before(leaf.NotBefore) {
+		v.add(certs[0], "certificate isn't valid before %s", leaf.NotBefore.Format(time.DateOnly))
+	}
+}
+
+// checkTokens gets a Graph token for azure and every tenant, to check the
+// app registrations against Azure AD
+func (v *configValidator) checkTokens(config Config) {
+	transport, err := graphTransport(config)
+	if err != nil {
+		v.problems = append(v.problems, configProblem{path: "graph", msg: err.Error()})
+		return
+	}
+	registrations := []AzureConfig{config.Azure}
+	nodes := configNodes(v.root, "azure")
+	if len(nodes) == 0 {
+		nodes = []configNode{{path: "azure", node: &yaml.Node{}}}
+	}
+	for _, t := range config.Tenants {
+		registrations = append(registrations, t.AzureConfig)
+	}
+	nodes = append(nodes, configNodes(v.root, "tenants.*")...)
+	for i, azure := range registrations {
+		cred, err := newCredential(azure, transport)
+		if err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), validateTokenTimeout)
+			var at azcore.AccessToken
+			if at, err = cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{azure.cloud().scope()}}); err == nil {
+				err = checkMailSend(at.Token)
+			}
+			cancel()
+		}
+		if err != nil {
+			v.add(nodes[i], "Graph token: %v", err)
+			continue
+		}
+		fmt.Printf("Graph token for %s: OK\n", nodes[i].path)
+	}
+}
+
+// strictDecode reports settings the config types don't have and values of
+// the wrong type, which loading the config ignores or fails on at once
+func (v *configValidator) strictDecode(data []byte) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var config Config
+	err := dec.Decode(&config)
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		return
+	}
+	for _, msg := range typeErr.Errors {
+		var line int
+		if rest, ok := strings.CutPrefix(msg, "line "); ok {
+			if n, text, ok := strings.Cut(rest, ": "); ok {
+				if l, err := strconv.Atoi(n); err == nil {
+					line, msg = l, text
+				}
+			}
+		}
+		v.problems = append(v.problems, configProblem{line: line, msg: msg})
+	}
+}
+
+// runValidateCommand checks the config file and prints every problem with
+// the line it is on; -graph also gets a token for each app registration
+func runValidateCommand(opts cliOptions, args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	graph := fs.Bool("graph", false, "also get a Graph token for each app registration")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("usage: validate [-graph]")
+	}
+
+	root, data, err := readConfigTree(opts.config)
+	if err != nil {
+		return err
+	}
+	v := &configValidator{root: &root}
+	v.strictDecode(data)
+	v.checkRequired()
+	v.checkCIDRs()
+	v.checkAddresses()
+	v.checkFiles()
+	v.checkCertificate()
+
+	// The remaining checks of loading the config have no line, they are
+	// reported once the others are fixed
+	config, err := opts.loadConfig()
+	if err == nil {
+		_, err = newPolicySet(config)
+	}
+	if err != nil && len(v.problems) == 0 {
+		v.problems = append(v.problems, configProblem{msg: err.Error()})
+	}
+	if len(v.problems) == 0 && *graph {
+		v.checkTokens(config)
+	}
+
+	sort.SliceStable(v.problems, func(i, j int) bool { return v.problems[i].line < v.problems[j].line })
+	for _, p := range v.problems {
+		location := opts.config
+		if p.line > 0 {
+			location += ":" + strconv.Itoa(p.line)
+		}
+		if p.path != "" {
+			fmt.Fprintf(os.Stderr, "%s: %s: %s\n", location, p.path, p.msg)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", location, p.msg)
+		}
+	}
+	if len(v.problems) > 0 {
+		if len(v.problems) == 1 {
+			return fmt.Errorf("%s has 1 problem", opts.config)
+		}
+		return fmt.Errorf("%s has %d problems", opts.config, len(v.problems))
+	}
+	for _, lc := range config.listeners() {
+		fmt.Printf("Listener %s at %s\n", lc.Name, lc.Address)
+	}
+	fmt.Println("Configuration OK")
+	return nil
+}
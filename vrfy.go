@@ -0,0 +1,84 @@
+// vrfy.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultVRFYRate is how many addresses a client may verify per minute
+// unless vrfy.rate is set
+const defaultVRFYRate = 10
+
+// vrfyAllowed reports whether VRFY is answered from the directory for the
+// client. Other clients get go-smtp's 252 without a lookup.
+func (bkd *Backend) vrfyAllowed(ip net.IP) bool {
+	p := bkd.policy()
+	return p.vrfy != nil && ip != nil && containsIP(p.vrfyClients, ip)
+}
+
+// newVRFYDirectory returns the directory VRFY looks addresses of
+// vrfy.domains up in, nil when VRFY isn't enabled
+func newVRFYDirectory(config Config) *recipientDirectory {
+	if len(config.VRFY.Clients) == 0 || len(config.VRFY.Domains) == 0 {
+		return nil
+	}
+	ttl := config.Recipients.VerifyCacheTTL
+	if ttl <= 0 {
+		ttl = defaultDirectoryCacheTTL
+	}
+	return &recipientDirectory{domains: config.VRFY.Domains, ttl: ttl, cache: make(map[string]directoryResult)}
+}
+
+// vrfy answers VRFY <address> (RFC 5321) for upstream MTAs making
+// recipient verification callouts: 252 when a user or group of the
+// tenant has the address, 550 when none has. Addresses outside
+// vrfy.domains, lookups that fail and local parts without a domain get
+// the usual 252 that promises nothing.
+func (bkd *Backend) vrfy(client, arg string) string {
+	addr := strings.TrimSpace(arg)
+	if i := strings.LastIndexByte(addr, '<'); i >= 0 {
+		addr = strings.TrimSuffix(addr[i+1:], ">")
+	}
+	unverified := "252 2.5.0 " + bkd.replies.text("vrfy_unverified", "address", addr)
+	_, domain, ok := strings.Cut(addr, "@")
+	d := bkd.policy().vrfy
+	if !ok || d == nil || !d.covers(domain) {
+		return unverified
+	}
+
+	if limit := bkd.vrfyRate(); limit > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		key := fmt.Sprintf("vrfy:%s:%d", client, time.Now().Unix()/60)
+		// Like the other rate limits, store errors fail open
+		if count, err := bkd.store.Incr(ctx, key, time.Minute); err == nil && count > int64(limit) {
+			bkd.logger.Warn("VRFY limited", "client", client, "vrfy", addr, "status", "vrfy_limited")
+			return "450 4.7.1 " + bkd.replies.text("vrfy_limited", "limit", strconv.Itoa(limit))
+		}
+	}
+
+	exists, err := d.exists(bkd.tenant(addr), addr)
+	switch {
+	case err != nil:
+		bkd.logger.Warn("VRFY lookup failed", "client", client, "vrfy", addr, "status", "directory_error", "errormsg", err)
+		return unverified
+	case !exists:
+		bkd.logger.Info("address verified", "client", client, "vrfy", addr, "status", "vrfy_unknown")
+		return "550 5.1.1 " + bkd.replies.text("vrfy_unknown", "address", addr)
+	}
+	bkd.logger.Info("address verified", "client", client, "vrfy", addr, "status", "vrfy_found")
+	return "252 2.1.5 " + bkd.replies.text("vrfy_found", "address", addr)
+}
+
+// vrfyRate returns the lookups per minute a client may make
+func (bkd *Backend) vrfyRate() int {
+	if rate := bkd.policy().config.VRFY.Rate; rate != 0 {
+		return rate
+	}
+	return defaultVRFYRate
+}
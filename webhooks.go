@@ -0,0 +1,82 @@
+// webhooks.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// webhookEvents are the delivery events webhooks can subscribe to: the
+// outcomes posted to per-message callbacks, plus accepted and retried
+var webhookEvents = []string{
+	"accepted", "sent", "failed", "retried", "queued", "bounced",
+	"quarantined", "deferred", "duplicate", "dry_run", "captured",
+}
+
+var webhookPosts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "gographsmtp_webhook_posts_total",
+	Help: "Delivery events posted to the configured webhooks, per event and result (ok, failed).",
+}, []string{"event", "result"})
+
+// WebhookConfig is an endpoint that gets delivery events pushed
+type WebhookConfig struct {
+	URL string `yaml:"url"`
+	// Events are the events posted, all unless set
+	Events []string `yaml:"events"`
+	// Headers are added to every request, e.g. Authorization
+	Headers map[string]string `yaml:"headers"`
+}
+
+// validate checks the webhook's URL and events
+func (w WebhookConfig) validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("invalid webhooks url %q, must be an http(s) URL", w.URL)
+	}
+	for _, event := range w.Events {
+		if !slices.Contains(webhookEvents, event) {
+			return fmt.Errorf("unknown webhooks event %q", event)
+		}
+	}
+	return nil
+}
+
+// wants reports whether the webhook subscribed to the event
+func (w WebhookConfig) wants(event string) bool {
+	return len(w.Events) == 0 || slices.Contains(w.Events, event)
+}
+
+// notifyWebhooks posts a delivery event to the webhooks that subscribed
+// to it, in the background. Like callbacks, failed posts are logged, not
+// retried.
+func (bkd *Backend) notifyWebhooks(queueID, event, detail string) {
+	var hooks []WebhookConfig
+	for _, w := range bkd.policy().config.Webhooks {
+		if w.wants(event) {
+			hooks = append(hooks, w)
+		}
+	}
+	if len(hooks) == 0 {
+		return
+	}
+	body, err := json.Marshal(bkd.deliveryNotice(queueID, event, detail))
+	if err != nil {
+		return
+	}
+
+	go func() {
+		for _, w := range hooks {
+			if err := postCallback(w.URL, w.Headers, body); err != nil {
+				webhookPosts.WithLabelValues(event, "failed").Inc()
+				bkd.logger.Warn("webhook failed", "queueid", queueID, "event", event, "callback", w.URL, "errormsg", err)
+				continue
+			}
+			webhookPosts.WithLabelValues(event, "ok").Inc()
+		}
+	}()
+}
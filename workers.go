@@ -0,0 +1,198 @@
+// workers.go
+package main
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// defaultWorkerQueue is the number of messages waiting for a worker
+// unless workers.queue_size is set
+const defaultWorkerQueue = 100
+
+var (
+	workerJobs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gographsmtp_worker_jobs_total",
+		Help: "Messages delivered by each delivery worker, per result (sent, queued, failed).",
+	}, []string{"worker", "result"})
+	workerBusy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gographsmtp_worker_busy",
+		Help: "1 while the delivery worker is sending a message.",
+	}, []string{"worker"})
+	workerQueueFull = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gographsmtp_worker_queue_full_total",
+		Help: "Messages refused with 451 because the delivery queue was full.",
+	})
+)
+
+// priorities are the classes of the delivery queue, highest first
+var priorities = []string{"high", "normal", "low"}
+
+// defaultWeights shares the workers among the priorities unless
+// workers.weights is set
+var defaultWeights = map[string]int{"high": 4, "normal": 2, "low": 1}
+
+// deliveryJob delivers one accepted message
+type deliveryJob struct {
+	// priority is high, normal or low, from the message's importance
+	priority string
+	// run sends the message and returns its result for the worker metrics
+	run func() string
+	// spool puts the message into the retry spool instead, when the relay
+	// shuts down before a worker gets to it
+	spool func() error
+}
+
+// workerPool delivers accepted messages in the background, so the SMTP
+// session doesn't wait for Graph. Waiting messages are queued by priority
+// and taken in weighted turns, so urgent mail overtakes a backlog of bulk
+// mail without starving it.
+type workerPool struct {
+	// ready holds a token for every queued job
+	ready   chan struct{}
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	queues  [][]deliveryJob // by index in priorities
+	weights []int
+	turns   []int // jobs each priority may still take in this round
+	size    int
+	queued  int
+	stopped bool
+	expired atomic.Bool // the shutdown timeout passed, waiting jobs are spooled
+}
+
+// newWorkerPool starts the workers; it returns nil without workers.count
+func newWorkerPool(config Config) *workerPool {
+	if config.Workers.Count <= 0 {
+		return nil
+	}
+	size := config.Workers.QueueSize
+	if size <= 0 {
+		size = defaultWorkerQueue
+	}
+	p := &workerPool{
+		ready:  make(chan struct{}, size),
+		queues: make([][]deliveryJob, len(priorities)),
+		turns:  make([]int, len(priorities)),
+		size:   size,
+	}
+	for _, priority := range priorities {
+		w, ok := config.Workers.Weights[priority]
+		if !ok {
+			w = defaultWeights[priority]
+		}
+		p.weights = append(p.weights, w)
+	}
+	for i := 1; i <= config.Workers.Count; i++ {
+		p.wg.Add(1)
+		go p.work(strconv.Itoa(i))
+	}
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "gographsmtp_worker_queue_messages",
+		Help: "Accepted messages waiting for a delivery worker.",
+	}, func() float64 { return float64(len(p.ready)) }))
+	for i, priority := range priorities {
+		prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "gographsmtp_worker_queue_priority_messages",
+			Help:        "Accepted messages waiting for a delivery worker, per priority.",
+			ConstLabels: prometheus.Labels{"priority": priority},
+		}, func() float64 {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			return float64(len(p.queues[i]))
+		}))
+	}
+	return p
+}
+
+func (p *workerPool) work(worker string) {
+	defer p.wg.Done()
+	busy := workerBusy.WithLabelValues(worker)
+	for range p.ready {
+		job := p.next()
+		if p.expired.Load() {
+			result := "queued"
+			if job.spool() != nil {
+				result = "failed"
+			}
+			workerJobs.WithLabelValues(worker, result).Inc()
+			continue
+		}
+		busy.Set(1)
+		workerJobs.WithLabelValues(worker, job.run()).Inc()
+		busy.Set(0)
+	}
+}
+
+// next takes the job whose turn it is: the highest priority with turns
+// left in this round and a job waiting. When none is left a new round
+// starts, with as many turns as the weights give. The caller holds a
+// token from ready, so a job is waiting.
+func (p *workerPool) next() deliveryJob {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		for i, queue := range p.queues {
+			if len(queue) == 0 || p.turns[i] == 0 {
+				continue
+			}
+			job := queue[0]
+			p.queues[i] = queue[1:]
+			p.turns[i]--
+			p.queued--
+			return job
+		}
+		copy(p.turns, p.weights)
+	}
+}
+
+// submit queues a job and reports false when the queue is full or the
+// pool was stopped
+func (p *workerPool) submit(job deliveryJob) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return false
+	}
+	if p.queued >= p.size {
+		workerQueueFull.Inc()
+		return false
+	}
+	i := slices.Index(priorities, job.priority)
+	if i < 0 {
+		i = slices.Index(priorities, "normal")
+	}
+	p.queues[i] = append(p.queues[i], job)
+	p.queued++
+	p.ready <- struct{}{}
+	return true
+}
+
+// stop refuses new jobs and waits for the queued ones to be delivered.
+// Jobs still waiting when ctx ends go to the retry spool; deliveries in
+// progress finish within their own timeout.
+func (p *workerPool) stop(ctx context.Context) {
+	p.mu.Lock()
+	p.stopped = true
+	close(p.ready)
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+	p.expired.Store(true)
+	<-done
+}